@@ -0,0 +1,192 @@
+// Package account describes how to reach an Azure storage account:
+// where its blob service lives and which credentials to use.
+package account
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/ppanyukov/azure-sdk-for-go/storage"
+)
+
+// Well-known account of the Azurite emulator and the legacy Azure Storage
+// Emulator. The key is public and documented by Microsoft.
+const (
+	EmulatorAccountName  = "devstoreaccount1"
+	EmulatorAccountKey   = "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw=="
+	EmulatorBlobEndpoint = "http://127.0.0.1:10000/" + EmulatorAccountName
+)
+
+// Config holds everything needed to create a storage client.
+// Name and one of Key, SAS or Anonymous are required, the rest defaults
+// to the public Azure cloud.
+type Config struct {
+	Name string
+	Key  string
+
+	// SAS is a shared access signature token used instead of Key. It can
+	// be an account SAS or a service SAS scoped to a single container.
+	SAS string
+
+	// Anonymous sends requests without any credentials. Only works with
+	// containers which have public access and is always read-only.
+	Anonymous bool
+
+	// BlobEndpoint is the full URL of the blob service, for example
+	// http://127.0.0.1:10000/devstoreaccount1 for Azurite. When set, it
+	// takes precedence over BaseURL, UseHTTPS and PathStyle.
+	BlobEndpoint string
+
+	// BaseURL is the DNS suffix of the storage service, for example
+	// core.chinacloudapi.cn for Azure China. Defaults to storage.DefaultBaseURL.
+	BaseURL string
+
+	// APIVersion defaults to storage.DefaultAPIVersion.
+	APIVersion string
+
+	UseHTTPS bool
+
+	// PathStyle addresses the account as <BaseURL>/<Name> instead of
+	// <Name>.blob.<BaseURL>, which is what emulators and some local
+	// stand-ins expect.
+	PathStyle bool
+}
+
+// NewClient creates a storage client for the account described by c.
+func (c Config) NewClient() (storage.Client, error) {
+	if c.Name == "" {
+		return storage.Client{}, errors.New("account name is required")
+	}
+
+	baseURL := c.BaseURL
+	if baseURL == "" {
+		baseURL = storage.DefaultBaseURL
+	}
+
+	apiVersion := c.APIVersion
+	if apiVersion == "" {
+		apiVersion = storage.DefaultAPIVersion
+	}
+
+	key := c.Key
+	var sas url.Values
+	if c.Anonymous {
+		if c.Key != "" || c.SAS != "" {
+			return storage.Client{}, errors.New("anonymous access cannot be combined with account key or SAS")
+		}
+		key = placeholderKey
+	} else if c.SAS != "" {
+		var err error
+		if sas, err = parseSAS(c.SAS); err != nil {
+			return storage.Client{}, err
+		}
+		key = placeholderKey
+	} else if key == "" {
+		return storage.Client{}, errors.New("account key or SAS is required")
+	}
+
+	client, err := storage.NewClient(c.Name, key, baseURL, apiVersion, c.UseHTTPS)
+	if err != nil {
+		return storage.Client{}, err
+	}
+
+	endpoint, err := c.blobEndpoint(baseURL)
+	if err != nil {
+		return storage.Client{}, err
+	}
+
+	var transport http.RoundTripper = http.DefaultTransport
+	if endpoint != nil {
+		transport = &endpointTransport{endpoint: endpoint, next: transport}
+	}
+	if sas != nil || c.Anonymous {
+		transport = &sasTransport{sas: sas, next: transport}
+	}
+
+	if transport != http.DefaultTransport {
+		client.HTTPClient = &http.Client{Transport: transport}
+	}
+
+	return client, nil
+}
+
+// BlobService returns the URL of the blob service as the client created by
+// NewClient addresses it and the key it signs requests with, "" with a SAS
+// or anonymous access, for requests the client can't make itself. Those
+// are to be sent with the client's HTTPClient, which takes care of
+// BlobEndpoint, SAS and anonymous access the same as for the client's own
+// requests.
+func (c Config) BlobService() (serviceURL string, key string) {
+	baseURL := c.BaseURL
+	if baseURL == "" {
+		baseURL = storage.DefaultBaseURL
+	}
+
+	scheme := "http"
+	if c.UseHTTPS {
+		scheme = "https"
+	}
+
+	key = c.Key
+	if c.Anonymous || c.SAS != "" {
+		key = ""
+	}
+
+	return scheme + "://" + c.Name + ".blob." + baseURL, key
+}
+
+// blobEndpoint returns the URL all blob requests should be sent to, or nil
+// if the default <account>.blob.<baseURL> addressing is to be used.
+func (c Config) blobEndpoint(baseURL string) (*url.URL, error) {
+	if c.BlobEndpoint != "" {
+		endpoint, err := url.Parse(c.BlobEndpoint)
+		if err != nil {
+			return nil, fmt.Errorf("invalid blob endpoint '%s': %s", c.BlobEndpoint, err)
+		}
+
+		if (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+			return nil, fmt.Errorf("invalid blob endpoint '%s': must be an absolute http or https URL", c.BlobEndpoint)
+		}
+
+		return endpoint, nil
+	}
+
+	if c.PathStyle {
+		scheme := "http"
+		if c.UseHTTPS {
+			scheme = "https"
+		}
+
+		return &url.URL{Scheme: scheme, Host: baseURL, Path: "/" + c.Name}, nil
+	}
+
+	return nil, nil
+}
+
+// endpointTransport redirects requests built by the storage client for
+// <account>.blob.<baseURL> to a custom endpoint. The request signature
+// stays valid because the canonicalized resource it is computed from
+// (/<account>/<container>/<blob>) does not depend on the host.
+type endpointTransport struct {
+	endpoint *url.URL
+	next     http.RoundTripper
+}
+
+func (t *endpointTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// RoundTrip must not modify the request, so work on copies.
+	u := *req.URL
+	u.Scheme = t.endpoint.Scheme
+	u.Host = t.endpoint.Host
+	u.Path = strings.TrimSuffix(t.endpoint.Path, "/") + req.URL.Path
+	u.RawPath = ""
+
+	r := new(http.Request)
+	*r = *req
+	r.URL = &u
+	r.Host = ""
+
+	return t.next.RoundTrip(r)
+}
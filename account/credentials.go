@@ -0,0 +1,256 @@
+package account
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// maxSecretSize caps how much we are prepared to read from a credentials
+// file or descriptor. Anything bigger is not credentials.
+const maxSecretSize = 64 * 1024
+
+// LoadCredentialsFile reads account settings from the file at path and
+// applies them on top of base. Settings present in the file win.
+//
+// The file must be a regular file owned by the current user and not
+// accessible by group or others. It can be in one of these formats:
+//
+//   - a connection string as shown in the portal:
+//
+//     DefaultEndpointsProtocol=https;AccountName=foo;AccountKey=...
+//
+//   - INI-style, one connection string setting per line:
+//
+//     [account]
+//     AccountName = foo
+//     AccountKey = ...
+//
+//   - JSON object with connection string settings as keys:
+//
+//     {"AccountName": "foo", "AccountKey": "..."}
+//
+// Setting names are case-insensitive. Both INI and JSON can also have
+// a ConnectionString setting which is parsed as above.
+func LoadCredentialsFile(path string, base Config) (Config, error) {
+	// Not blocking on a FIFO until checkCredentialsFile turns it away,
+	// regular files don't care.
+	f, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return base, err
+	}
+	defer f.Close()
+
+	if err := checkCredentialsFile(f, path); err != nil {
+		return base, err
+	}
+
+	data, err := readSecret(f)
+	if err != nil {
+		return base, fmt.Errorf("cannot read credentials file '%s': %s", path, err)
+	}
+
+	settings, err := parseCredentials(data)
+	if err != nil {
+		return base, fmt.Errorf("invalid credentials file '%s': %s", path, err)
+	}
+
+	return applySettings(base, settings)
+}
+
+// ReadSecretFromFd reads a secret such as the account key from an already
+// open file descriptor, e.g. 0 for stdin, and closes it. Surrounding
+// whitespace is trimmed.
+func ReadSecretFromFd(fd int) (string, error) {
+	f := os.NewFile(uintptr(fd), fmt.Sprintf("fd %d", fd))
+	if f == nil {
+		return "", fmt.Errorf("invalid file descriptor %d", fd)
+	}
+	defer f.Close()
+
+	data, err := readSecret(f)
+	if err != nil {
+		return "", fmt.Errorf("cannot read secret from fd %d: %s", fd, err)
+	}
+
+	secret := strings.TrimSpace(data)
+	if secret == "" {
+		return "", fmt.Errorf("no secret found on fd %d", fd)
+	}
+
+	return secret, nil
+}
+
+// checkCredentialsFile makes sure nobody but us can read or
+// replace the credentials, same as ssh does for private keys. It checks
+// the file already open so that it can't be swapped in between.
+func checkCredentialsFile(f *os.File, path string) error {
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("credentials file '%s' is not a regular file", path)
+	}
+
+	if perm := info.Mode().Perm(); perm&0077 != 0 {
+		return fmt.Errorf("credentials file '%s' is accessible by group or others (mode %04o), it must be 0600 or stricter", path, perm)
+	}
+
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok && int(stat.Uid) != os.Getuid() {
+		return fmt.Errorf("credentials file '%s' is owned by uid %d, expected %d", path, stat.Uid, os.Getuid())
+	}
+
+	return nil
+}
+
+func readSecret(r io.Reader) (string, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, maxSecretSize+1))
+	if err != nil {
+		return "", err
+	}
+
+	if len(data) > maxSecretSize {
+		return "", fmt.Errorf("more than %d bytes", maxSecretSize)
+	}
+
+	return string(data), nil
+}
+
+// parseCredentials detects the format of data and returns its
+// settings keyed by lower-cased setting name.
+func parseCredentials(data string) (map[string]string, error) {
+	data = strings.TrimSpace(data)
+
+	var (
+		settings map[string]string
+		err      error
+	)
+
+	switch {
+	case strings.HasPrefix(data, "{"):
+		settings, err = parseJSONCredentials(data)
+	case strings.ContainsAny(data, "\n"):
+		settings, err = parseINICredentials(data)
+	default:
+		settings, err = parseConnectionString(data)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if connectionString, ok := settings["connectionstring"]; ok {
+		delete(settings, "connectionstring")
+		fromConnectionString, err := parseConnectionString(connectionString)
+		if err != nil {
+			return nil, err
+		}
+		for name, value := range fromConnectionString {
+			settings[name] = value
+		}
+	}
+
+	return settings, nil
+}
+
+// parseConnectionString splits a storage connection string into settings
+// keyed by lower-cased setting name.
+func parseConnectionString(connectionString string) (map[string]string, error) {
+	settings := make(map[string]string)
+	for i, part := range strings.Split(connectionString, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		// Values such as keys and SAS contain '=' so only split on the first one.
+		// Don't echo a malformed setting back, it may well be a secret.
+		eq := strings.Index(part, "=")
+		if eq <= 0 {
+			return nil, fmt.Errorf("malformed connection string setting #%d", i+1)
+		}
+
+		settings[strings.ToLower(strings.TrimSpace(part[:eq]))] = strings.TrimSpace(part[eq+1:])
+	}
+
+	return settings, nil
+}
+
+func parseINICredentials(data string) (map[string]string, error) {
+	settings := make(map[string]string)
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+
+		// Sections carry no meaning for us, there is just one account per file.
+		if line == "" || line[0] == '#' || line[0] == ';' || line[0] == '[' {
+			continue
+		}
+
+		i := strings.Index(line, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("line %d: expected 'Name = Value'", lineNo)
+		}
+
+		settings[strings.ToLower(strings.TrimSpace(line[:i]))] = strings.TrimSpace(line[i+1:])
+	}
+
+	return settings, scanner.Err()
+}
+
+func parseJSONCredentials(data string) (map[string]string, error) {
+	var raw map[string]string
+	if err := json.Unmarshal([]byte(data), &raw); err != nil {
+		return nil, err
+	}
+
+	settings := make(map[string]string, len(raw))
+	for name, value := range raw {
+		settings[strings.ToLower(name)] = value
+	}
+
+	return settings, nil
+}
+
+// applySettings copies the settings onto c. Unknown settings are an
+// error so that typos don't silently result in the wrong account.
+func applySettings(c Config, settings map[string]string) (Config, error) {
+	if settings["usedevelopmentstorage"] == "true" {
+		c.Name = EmulatorAccountName
+		c.Key = EmulatorAccountKey
+		c.BlobEndpoint = EmulatorBlobEndpoint
+	}
+
+	for name, value := range settings {
+		switch name {
+		case "accountname":
+			c.Name = value
+		case "accountkey":
+			c.Key = value
+		case "sharedaccesssignature":
+			c.SAS = value
+		case "blobendpoint":
+			c.BlobEndpoint = value
+		case "endpointsuffix":
+			c.BaseURL = value
+		case "defaultendpointsprotocol":
+			if value != "http" && value != "https" {
+				return c, fmt.Errorf("DefaultEndpointsProtocol must be http or https, got '%s'", value)
+			}
+			c.UseHTTPS = value == "https"
+		case "usedevelopmentstorage", "queueendpoint", "tableendpoint", "fileendpoint":
+			// Handled above or not relevant for blobs.
+		default:
+			return c, fmt.Errorf("unknown setting '%s'", name)
+		}
+	}
+
+	return c, nil
+}
@@ -0,0 +1,116 @@
+package account
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseCredentials(t *testing.T) {
+	for _, c := range []struct {
+		format string
+		data   string
+	}{
+		{"connection string", "DefaultEndpointsProtocol=https;AccountName=foo;AccountKey=a2V5==;EndpointSuffix=core.chinacloudapi.cn;"},
+		{"INI", `
+# Azure China
+[account]
+DefaultEndpointsProtocol = https
+accountname = foo
+AccountKey = a2V5==
+; suffix
+EndpointSuffix=core.chinacloudapi.cn
+`},
+		{"JSON", `{"AccountName": "foo", "ACCOUNTKEY": "a2V5==", "DefaultEndpointsProtocol": "https", "EndpointSuffix": "core.chinacloudapi.cn"}`},
+		{"INI connection string", "[account]\nConnectionString = DefaultEndpointsProtocol=https;AccountName=foo;AccountKey=a2V5==;EndpointSuffix=core.chinacloudapi.cn\n"},
+		{"JSON connection string", `{"ConnectionString": "DefaultEndpointsProtocol=https;AccountName=foo;AccountKey=a2V5==;EndpointSuffix=core.chinacloudapi.cn"}`},
+	} {
+		settings, err := parseCredentials(c.data)
+		if err != nil {
+			t.Errorf("%s: %s", c.format, err)
+			continue
+		}
+
+		config, err := applySettings(Config{Name: "base"}, settings)
+		if err != nil {
+			t.Errorf("%s: %s", c.format, err)
+			continue
+		}
+
+		expected := Config{Name: "foo", Key: "a2V5==", BaseURL: "core.chinacloudapi.cn", UseHTTPS: true}
+		if config != expected {
+			t.Errorf("%s: expected %+v got %+v", c.format, expected, config)
+		}
+	}
+}
+
+func TestParseCredentialsDevelopmentStorage(t *testing.T) {
+	settings, err := parseCredentials("UseDevelopmentStorage=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := applySettings(Config{}, settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Name != EmulatorAccountName || config.Key != EmulatorAccountKey || config.BlobEndpoint != EmulatorBlobEndpoint {
+		t.Errorf("expected the emulator account got %+v", config)
+	}
+}
+
+func TestParseCredentialsErrors(t *testing.T) {
+	for _, c := range []struct{ data, err string }{
+		{"AccountName=foo;secret", "malformed connection string setting #2"},
+		{"[account]\nAccountName = foo\nsecret", "line 3: expected 'Name = Value'"},
+		{`{"AccountName": 1}`, "cannot unmarshal"},
+		{`{"ConnectionString": "AccountName=foo;secret"}`, "malformed connection string setting #2"},
+		{"AccountName=foo;AcountKey=a2V5==", "unknown setting 'acountkey'"},
+		{"AccountName=foo;DefaultEndpointsProtocol=ftp", "DefaultEndpointsProtocol must be http or https"},
+	} {
+		settings, err := parseCredentials(c.data)
+		if err == nil {
+			_, err = applySettings(Config{}, settings)
+		}
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%q: expected '%s' got %v", c.data, c.err, err)
+		}
+		if err != nil && strings.Contains(err.Error(), "secret") {
+			t.Errorf("%q: error shows the malformed setting: %s", c.data, err)
+		}
+	}
+}
+
+func TestLoadCredentialsFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "credentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "foo.key")
+	if err := ioutil.WriteFile(path, []byte("AccountName=foo;AccountKey=a2V5==\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := LoadCredentialsFile(path, Config{Name: "base", UseHTTPS: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := (Config{Name: "foo", Key: "a2V5==", UseHTTPS: true}); config != expected {
+		t.Errorf("expected %+v got %+v", expected, config)
+	}
+
+	if err := os.Chmod(path, 0640); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadCredentialsFile(path, Config{}); err == nil || !strings.Contains(err.Error(), "accessible by group or others") {
+		t.Errorf("group readable: expected an error got %v", err)
+	}
+
+	if _, err := LoadCredentialsFile(dir, Config{}); err == nil || !strings.Contains(err.Error(), "not a regular file") {
+		t.Errorf("directory: expected an error got %v", err)
+	}
+}
@@ -0,0 +1,98 @@
+package account
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// placeholderKey is given to the storage client when authenticating with
+// a SAS or anonymously. The client insists on having a key to sign requests
+// with; the resulting signature is thrown away by sasTransport.
+var placeholderKey = base64.StdEncoding.EncodeToString([]byte("placeholder"))
+
+// writePermissions are the SAS permissions which allow changing anything.
+// A SAS with none of these can only be used for a read-only mount.
+const writePermissions = "acdw"
+
+// parseSAS parses a SAS token as given by the portal or the CLI,
+// with or without the leading '?'.
+func parseSAS(sas string) (url.Values, error) {
+	values, err := url.ParseQuery(strings.TrimPrefix(sas, "?"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid SAS: %s", err)
+	}
+
+	if values.Get("sig") == "" {
+		return nil, fmt.Errorf("invalid SAS: no signature (sig) found")
+	}
+
+	return values, nil
+}
+
+// IsContainerSAS tells if the configured SAS is a service SAS scoped to
+// a single container. Such SAS cannot be used to list containers.
+func (c Config) IsContainerSAS() bool {
+	if c.SAS == "" {
+		return false
+	}
+
+	values, err := parseSAS(c.SAS)
+	if err != nil {
+		return false
+	}
+
+	return values.Get("sr") == "c"
+}
+
+// IsReadOnly tells if the credentials in c only allow reading, in which
+// case the file systems should be mounted read-only.
+func (c Config) IsReadOnly() bool {
+	if c.Anonymous {
+		return true
+	}
+
+	if c.SAS == "" {
+		return false
+	}
+
+	values, err := parseSAS(c.SAS)
+	if err != nil {
+		return false
+	}
+
+	return !strings.ContainsAny(values.Get("sp"), writePermissions)
+}
+
+// sasTransport authorizes requests with a SAS token instead of the
+// shared key signature added by the storage client. With no SAS the
+// requests are sent anonymously.
+type sasTransport struct {
+	sas  url.Values
+	next http.RoundTripper
+}
+
+func (t *sasTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// RoundTrip must not modify the request, so work on copies.
+	u := *req.URL
+	query := u.Query()
+	for name, values := range t.sas {
+		query[name] = values
+	}
+	u.RawQuery = query.Encode()
+
+	header := make(http.Header, len(req.Header))
+	for name, values := range req.Header {
+		header[name] = values
+	}
+	header.Del("Authorization")
+
+	r := new(http.Request)
+	*r = *req
+	r.URL = &u
+	r.Header = header
+
+	return t.next.RoundTrip(r)
+}
@@ -0,0 +1,153 @@
+package blobfs
+
+// With Options.AsOf, flatblobFs shows blobs as they were at that time, e.g.
+// for audits. Each blob is whichever of these is the latest not newer than
+// that time: the blob itself, the blob deleted since, a version or a
+// snapshot. Blobs created later or deleted before are hidden.
+//
+// With blob versioning on, the versions tell exactly what each blob was
+// like. Without it there is no telling what a blob changed since was like,
+// so the view is only as good as the snapshots taken, see snapshots.go.
+
+import (
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func (fs *flatblobFs) asOfGetAttr(name string, blobName string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
+	props, status := fs.blobAsOf("GetAttr", name, blobName, context)
+	if status != fuse.OK {
+		return nil, status
+	}
+
+	attr := fs.defaultFileFuseAttr
+	attr.Size = uint64(props.ContentLength)
+	attr.SetTimes(nil, &props.LastModified, &props.LastModified)
+	return &attr, fuse.OK
+}
+
+// blobAsOf returns what the blob was at fs.options.AsOf, op and name are
+// for logging.
+func (fs *flatblobFs) blobAsOf(op string, name string, blobName string, context *fuse.Context) (BlobProperties, fuse.Status) {
+	blobs, status := fs.listAsOf(op, name, blobName, context)
+	if status != fuse.OK {
+		return BlobProperties{}, status
+	}
+
+	for _, props := range blobs {
+		if props.Name == blobName {
+			return props, fuse.OK
+		}
+	}
+	return BlobProperties{}, fuse.ENOENT
+}
+
+// listAsOf lists what the blobs starting with prefix were at
+// fs.options.AsOf, op and name are for logging.
+func (fs *flatblobFs) listAsOf(op string, name string, prefix string, context *fuse.Context) ([]BlobProperties, fuse.Status) {
+	blobs, err := fs.storage(context).ListBlobs(fs.accountContainer, asOfListParameters(prefix, 0))
+	if err != nil {
+		fs.log.Printf("[ERROR] %s '%s': %s\n", op, name, err)
+		return nil, statusFromError(err)
+	}
+
+	return resolveAsOf(blobs, fs.options.AsOf), fuse.OK
+}
+
+// asOfListParameters lists everything resolveAsOf needs.
+func asOfListParameters(prefix string, maxResults uint) ListBlobsParameters {
+	return ListBlobsParameters{Prefix: prefix, MaxResults: maxResults, Snapshots: true, Deleted: true, Versions: true}
+}
+
+// CheckAsOf makes sure that the snapshots, deleted blobs and versions
+// Options.AsOf needs can be listed in the container, so that the mount
+// fails rather than show blobs as they are now.
+func CheckAsOf(backend Backend, container string) error {
+	_, err := backend.ListBlobs(container, asOfListParameters("", 1))
+	return err
+}
+
+// resolveAsOf returns what each blob was at t, from blobs as listed by
+// ListBlobs with snapshots, deleted blobs and versions.
+func resolveAsOf(blobs []BlobProperties, t time.Time) []BlobProperties {
+	var result []BlobProperties
+	for start := 0; start < len(blobs); {
+		end := start
+		for end < len(blobs) && blobs[end].Name == blobs[start].Name {
+			end++
+		}
+
+		if props, ok := resolveBlobAsOf(blobs[start:end], t); ok {
+			result = append(result, props)
+		}
+		start = end
+	}
+	return result
+}
+
+// resolveBlobAsOf picks what a blob was at t from its snapshots, versions,
+// deleted blob and the blob itself, false if it didn't exist then.
+func resolveBlobAsOf(entries []BlobProperties, t time.Time) (BlobProperties, bool) {
+	// The blob itself, or as it was when deleted, is exact if it was last
+	// changed before t.
+	var lastDeleted time.Time
+	for _, props := range entries {
+		switch {
+		case props.Snapshot != "" || isPreviousVersion(props):
+		case props.Deleted && !props.LastModified.After(t) && props.DeletedTime.After(t):
+			return props, true
+		case !props.Deleted && !props.LastModified.After(t):
+			return props, true
+		case props.Deleted && !props.DeletedTime.After(t) && props.DeletedTime.After(lastDeleted):
+			lastDeleted = props.DeletedTime
+		}
+	}
+
+	// Otherwise the latest version made before t, which is exact too
+	// unless the blob was deleted after it.
+	if props, ok := latestAsOf(entries, t, func(props BlobProperties) string {
+		if isPreviousVersion(props) {
+			return props.VersionID
+		}
+		return ""
+	}); ok {
+		made, _ := time.Parse(snapshotTimeFormat, props.VersionID)
+		if made.Before(lastDeleted) {
+			return BlobProperties{}, false
+		}
+		return props, true
+	}
+
+	// Otherwise the latest snapshot taken before t, unless the blob was
+	// deleted after it, e.g. together with its snapshots.
+	props, ok := latestAsOf(entries, t, func(props BlobProperties) string { return props.Snapshot })
+	if !ok {
+		return BlobProperties{}, false
+	}
+	taken, _ := time.Parse(snapshotTimeFormat, props.Snapshot)
+	if taken.Before(lastDeleted) {
+		return BlobProperties{}, false
+	}
+	return props, true
+}
+
+// latestAsOf returns the entry with the latest timestamp not after t, false
+// if there is none. timestamp returns it in snapshotTimeFormat, or "" for
+// entries which don't count.
+func latestAsOf(entries []BlobProperties, t time.Time, timestamp func(BlobProperties) string) (BlobProperties, bool) {
+	var found BlobProperties
+	var foundTime time.Time
+	ok := false
+	for _, props := range entries {
+		s := timestamp(props)
+		if s == "" {
+			continue
+		}
+		taken, err := time.Parse(snapshotTimeFormat, s)
+		if err == nil && !taken.After(t) && (!ok || taken.After(foundTime)) {
+			found, foundTime, ok = props, taken, true
+		}
+	}
+	return found, ok
+}
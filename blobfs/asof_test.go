@@ -0,0 +1,190 @@
+package blobfs
+
+import (
+	"io/ioutil"
+	"log"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func TestFlatBlobFsAsOf(t *testing.T) {
+	backend := newTestBackend(t)
+	memory := backend.backend.(*memoryBackend)
+	now := time.Date(2016, 4, 1, 9, 0, 0, 0, time.UTC)
+	memory.now = func() time.Time { return now }
+
+	// 9:00 changed is written and snapshotted, gone is written.
+	putBlob(t, memory, conformanceContainer, "changed", "at nine")
+	putBlob(t, memory, conformanceContainer, "gone", "deleted later")
+	if _, err := memory.SnapshotBlob(conformanceContainer, "changed"); err != nil {
+		t.Fatal(err)
+	}
+
+	// 11:00 changed is changed, gone is deleted and new is written.
+	now = now.Add(2 * time.Hour)
+	putBlob(t, memory, conformanceContainer, "changed", "at eleven")
+	putBlob(t, memory, conformanceContainer, "new", "created later")
+	if err := memory.DeleteBlob(conformanceContainer, "gone", "", "", false); err != nil {
+		t.Fatal(err)
+	}
+
+	asOf, err := ParseAsOf("2016-04-01T10:00:00Z")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := NewFlatBlobFs(conformanceContainer, backend, Options{AsOf: asOf}).(*flatblobFs)
+	fs.log = log.New(ioutil.Discard, "", 0)
+
+	if names := listNames(t, fs, ""); strings.Join(names, ",") != "changed,gone" {
+		t.Errorf("OpenDir: expected [changed gone] got %q", names)
+	}
+	if got := readFile(t, fs, "changed"); got != "at nine" {
+		t.Errorf("Read changed: expected 'at nine' got '%s'", got)
+	}
+	if got := readFile(t, fs, "gone"); got != "deleted later" {
+		t.Errorf("Read gone: expected 'deleted later' got '%s'", got)
+	}
+	expectStatus(t, "GetAttr new", statusOf(fs.GetAttr("new", nil)), fuse.ENOENT)
+
+	attr, status := fs.GetAttr("changed", nil)
+	expectStatus(t, "GetAttr changed", status, fuse.OK)
+	if attr != nil && attr.Size != 7 {
+		t.Errorf("GetAttr changed: expected size 7 got %d", attr.Size)
+	}
+
+	// Strictly read-only, even with -o rw.
+	options := Options{AsOf: asOf}
+	options.ParseMountOptions("rw")
+	if kernel := options.KernelMountOptions(); len(kernel) != 1 || kernel[0] != "ro" {
+		t.Errorf("KernelMountOptions: expected [ro] got %q", kernel)
+	}
+	expectStatus(t, "Open for writing", statusOf(fs.Open("changed", uint32(syscall.O_WRONLY), nil)), fuse.EROFS)
+	expectStatus(t, "Unlink", fs.Unlink("changed", nil), fuse.EROFS)
+	expectStatus(t, "Mkdir snapshot", fs.Mkdir(".snapshots/now", 0755, nil), fuse.EROFS)
+}
+
+func TestFlatBlobFsAsOfVersions(t *testing.T) {
+	backend := newTestBackend(t)
+	memory := backend.backend.(*memoryBackend)
+	memory.versioning = true
+	now := time.Date(2016, 4, 1, 9, 0, 0, 0, time.UTC)
+	memory.now = func() time.Time { return now }
+
+	// 9:00 changed and gone are written, without snapshots.
+	putBlob(t, memory, conformanceContainer, "changed", "at nine")
+	putBlob(t, memory, conformanceContainer, "gone", "deleted later")
+
+	// 11:00 changed is changed, gone is deleted and new is written.
+	now = now.Add(2 * time.Hour)
+	putBlob(t, memory, conformanceContainer, "changed", "at eleven")
+	putBlob(t, memory, conformanceContainer, "new", "created later")
+	if err := memory.DeleteBlob(conformanceContainer, "gone", "", "", false); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		asOf    string
+		names   string
+		changed string
+	}{
+		{"2016-04-01T10:00:00Z", "changed,gone", "at nine"},
+		{"2016-04-01T12:00:00Z", "changed,new", "at eleven"},
+	} {
+		asOf, err := ParseAsOf(c.asOf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fs := NewFlatBlobFs(conformanceContainer, backend, Options{AsOf: asOf}).(*flatblobFs)
+		fs.log = log.New(ioutil.Discard, "", 0)
+
+		if names := listNames(t, fs, ""); strings.Join(names, ",") != c.names {
+			t.Errorf("OpenDir as of %s: expected %s got %q", c.asOf, c.names, names)
+		}
+		if got := readFile(t, fs, "changed"); got != c.changed {
+			t.Errorf("Read changed as of %s: expected '%s' got '%s'", c.asOf, c.changed, got)
+		}
+	}
+
+	// Versions are read as such, the blob itself has changed since.
+	if countCalls(backend, "GetBlobVersionRange") == 0 {
+		t.Errorf("expected reads of versions")
+	}
+}
+
+func TestFlatBlobFsAsOfDeletedSnapshots(t *testing.T) {
+	backend := newTestBackend(t)
+	memory := backend.backend.(*memoryBackend)
+	now := time.Date(2016, 4, 1, 9, 0, 0, 0, time.UTC)
+	memory.now = func() time.Time { return now }
+
+	// 9:00 gone is written and snapshotted, 10:00 it's deleted with its
+	// snapshots, which are still listed as soft-deleted.
+	putBlob(t, memory, conformanceContainer, "gone", "at nine")
+	if _, err := memory.SnapshotBlob(conformanceContainer, "gone"); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(time.Hour)
+	if err := memory.DeleteBlob(conformanceContainer, "gone", "", "", true); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(2 * time.Hour)
+
+	for _, c := range []struct {
+		asOf  string
+		names string
+	}{
+		{"2016-04-01T09:30:00Z", "gone"},
+		{"2016-04-01T11:00:00Z", ""},
+	} {
+		asOf, err := ParseAsOf(c.asOf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fs := NewFlatBlobFs(conformanceContainer, backend, Options{AsOf: asOf}).(*flatblobFs)
+		fs.log = log.New(ioutil.Discard, "", 0)
+		if names := listNames(t, fs, ""); strings.Join(names, ",") != c.names {
+			t.Errorf("OpenDir as of %s: expected [%s] got %q", c.asOf, c.names, names)
+		}
+	}
+}
+
+func TestFlatBlobFsAsOfListFails(t *testing.T) {
+	backend := newTestBackend(t)
+	putBlob(t, backend.backend, conformanceContainer, "foo", "foo")
+	asOf, err := ParseAsOf("2016-04-01")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing is shown as it is now when the past can't be listed.
+	backend.errOp = "ListBlobs"
+	backend.failWith(errNotImplemented("List Blobs with versions"))
+	if err := CheckAsOf(backend, conformanceContainer); err == nil {
+		t.Errorf("CheckAsOf: expected an error")
+	}
+	fs := NewFlatBlobFs(conformanceContainer, backend, Options{AsOf: asOf}).(*flatblobFs)
+	fs.log = log.New(ioutil.Discard, "", 0)
+	expectStatus(t, "GetAttr", statusOf(fs.GetAttr("foo", nil)), fuse.ENOSYS)
+
+	backend.failWith(nil)
+	if err := CheckAsOf(backend, conformanceContainer); err != nil {
+		t.Errorf("CheckAsOf: %v", err)
+	}
+}
+
+func TestParseAsOf(t *testing.T) {
+	for _, s := range []string{"2016-04-01T00:00:00Z", "2016-04-01T02:00:00.0000000+02:00", "2016-04-01"} {
+		got, err := ParseAsOf(s)
+		if err != nil || !got.Equal(time.Date(2016, 4, 1, 0, 0, 0, 0, time.UTC)) {
+			t.Errorf("ParseAsOf '%s': got %v %v", s, got, err)
+		}
+	}
+
+	if _, err := ParseAsOf("yesterday"); err == nil {
+		t.Errorf("ParseAsOf 'yesterday': expected an error")
+	}
+}
@@ -0,0 +1,265 @@
+package blobfs
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Backend is the subset of blob storage operations the file systems
+// in this package need. NewStorageBackend implements it on top of the
+// Azure SDK, NewMemoryBackend keeps everything in memory for tests.
+//
+// Errors reported by the storage service are returned as *StorageError
+// so that they can be mapped to the right errno.
+type Backend interface {
+	ListContainers(prefix string) ([]ContainerProperties, error)
+	ContainerExists(container string) (bool, error)
+	CreateContainer(container string) error
+
+	// DeleteContainer needs leaseID if the container has an active lease.
+	DeleteContainer(container string, leaseID string) error
+
+	// Container leases only keep others from deleting or leasing the
+	// container, blobs in it can still be written. Durations are the same
+	// as for blob leases. Backends which don't support them return
+	// NotImplemented.
+	AcquireContainerLease(container string, duration int, proposedLeaseID string) (leaseID string, err error)
+	ReleaseContainerLease(container, leaseID string) error
+	BreakContainerLease(container string) error
+
+	// ListBlobs returns all blobs matching params, following continuation
+	// markers as needed unless params.MaxResults is set.
+	ListBlobs(container string, params ListBlobsParameters) ([]BlobProperties, error)
+	GetBlobProperties(container, blob string) (BlobProperties, error)
+
+	// GetBlobRange reads the blob as of the snapshot, or the blob itself
+	// if snapshot is empty.
+	GetBlobRange(container, blob, snapshot string, offset, count int64) (io.ReadCloser, error)
+
+	// GetBlobVersionRange reads a version of the blob as listed with
+	// ListBlobsParameters.Versions. Backends without blob versioning have
+	// no versions to read and return NotImplemented.
+	GetBlobVersionRange(container, blob, versionID string, offset, count int64) (io.ReadCloser, error)
+
+	// SnapshotBlob takes a read-only snapshot of the blob as it is now and
+	// returns its timestamp. Backends which don't support snapshots return
+	// NotImplemented.
+	SnapshotBlob(container, blob string) (snapshot string, err error)
+
+	// When ifMatch is given, CreateBlockBlob, DeleteBlob and PutBlockList
+	// only change the blob if its ETag is still ifMatch and fail with
+	// ConditionNotMet otherwise, so that changes made by others in the
+	// meantime are not lost.
+	//
+	// Blobs with an active lease can only be written with its leaseID,
+	// otherwise writes fail with LeaseIdMissing.
+	//
+	// CreateBlockBlob, CopyBlob and PutBlockList return the properties of
+	// the blob as written, so that the next write can expect its ETag.
+	//
+	// DeleteBlob fails with SnapshotsPresent if the blob has snapshots,
+	// unless deleteSnapshots is set to delete them along with it.
+	CreateBlockBlob(container, blob string, ifMatch, leaseID string) (BlobProperties, error)
+	DeleteBlob(container, blob string, ifMatch, leaseID string, deleteSnapshots bool) error
+
+	// CopyBlob replaces blob with a copy of sourceBlob, which may be in
+	// another container of the account, without the data going through
+	// us. The storage service may copy asynchronously, then the copy is
+	// still pending when CopyBlob returns and BlobProperties.CopyStatus
+	// tells how far it got. ifMatch is the same as for CreateBlockBlob,
+	// blobs with an active lease can't be copied over.
+	CopyBlob(container, blob, sourceContainer, sourceBlob string, ifMatch string) (BlobProperties, error)
+
+	// With soft delete, deleted blobs are kept for a while and listed with
+	// ListBlobsParameters.Deleted. UndeleteBlob restores one with its
+	// snapshots. If there is a blob by that name again, only the snapshots
+	// come back, as snapshots of that blob. Backends which don't support
+	// soft delete return NotImplemented, as does GetDeletedBlobRange where
+	// deleted blobs can't be read.
+	UndeleteBlob(container, blob string) error
+	GetDeletedBlobRange(container, blob string, offset, count int64) (io.ReadCloser, error)
+
+	// Block blobs are written by uploading blocks and then committing
+	// them. Block IDs are base64 strings of the same length within a blob.
+	PutBlock(container, blob, blockID string, data []byte, leaseID string) error
+
+	// PutBlockFromURL stages a block of count bytes at offset of
+	// sourceBlob, which may be in another container of the account,
+	// without the data going through us. Blocks can be up to
+	// copyBlockSize.
+	PutBlockFromURL(container, blob, blockID, sourceContainer, sourceBlob string, offset, count int64, leaseID string) error
+	PutBlockList(container, blob string, blockIDs []string, ifMatch, leaseID string) (BlobProperties, error)
+	GetBlockList(container, blob string) ([]BlockProperties, error)
+
+	// Lease duration is in seconds, from 15 to 60, or -1 for infinite.
+	AcquireLease(container, blob string, duration int, proposedLeaseID string) (leaseID string, err error)
+	RenewLease(container, blob, leaseID string) error
+	ReleaseLease(container, blob, leaseID string) error
+	BreakLease(container, blob string) error
+}
+
+// operationBackend is implemented by backends which tell apart the
+// operations calls are made for, see Tracer.Backend.
+type operationBackend interface {
+	forOperation(key interface{}) Backend
+}
+
+// backendFor returns backend for the calls made for key: the *fuse.Context
+// of a file system operation, or the open nodefs.File for operations on it.
+func backendFor(backend Backend, key interface{}) Backend {
+	if b, ok := backend.(operationBackend); ok {
+		return b.forOperation(key)
+	}
+	return backend
+}
+
+// ContainerProperties describes a container as returned by ListContainers.
+type ContainerProperties struct {
+	Name         string
+	LastModified time.Time
+	ETag         string
+
+	// LeaseState is "available", "leased", "expired", "breaking" or
+	// "broken", same as the storage service reports.
+	LeaseState string
+}
+
+// Lease states as reported by the storage service.
+const (
+	leaseStateAvailable = "available"
+	leaseStateLeased    = "leased"
+	leaseStateExpired   = "expired"
+	leaseStateBreaking  = "breaking"
+)
+
+// ListBlobsParameters narrows down the blobs returned by ListBlobs.
+type ListBlobsParameters struct {
+	Prefix     string
+	MaxResults uint
+
+	// Snapshots includes snapshots of the blobs, each right before the
+	// blob itself and oldest first.
+	Snapshots bool
+
+	// Deleted includes soft-deleted blobs, each right before a blob of
+	// the same name if there is one.
+	Deleted bool
+
+	// Versions includes the previous versions of the blobs, oldest first
+	// after the snapshots, with blob versioning on. Without it there are
+	// none.
+	Versions bool
+}
+
+// BlobProperties describes a blob as returned by ListBlobs and GetBlobProperties.
+type BlobProperties struct {
+	Name          string
+	ContentLength int64
+	LastModified  time.Time
+	ETag          string
+
+	// Snapshot is the timestamp of the snapshot, such as
+	// "2016-04-01T09:50:39.1234567Z", or empty for the blob itself.
+	Snapshot string
+
+	// Deleted is set for soft-deleted blobs, deleted at DeletedTime.
+	Deleted     bool
+	DeletedTime time.Time
+
+	// VersionID is the timestamp of the version, in snapshotTimeFormat,
+	// when listed with ListBlobsParameters.Versions. IsCurrentVersion is
+	// set for the blob itself, previous versions don't have it.
+	VersionID        string
+	IsCurrentVersion bool
+
+	// CopyStatus is "pending", "success", "aborted" or "failed" if the
+	// blob was last written by CopyBlob, with CopyProgress as
+	// "<bytes copied>/<total bytes>". Both are empty otherwise.
+	CopyStatus   string
+	CopyProgress string
+
+	// LeaseState is the same as for ContainerProperties. Only
+	// GetBlobProperties is sure to set it.
+	LeaseState string
+}
+
+// isPreviousVersion tells if props is a previous version of a blob rather
+// than the blob itself.
+func isPreviousVersion(props BlobProperties) bool {
+	return props.VersionID != "" && !props.IsCurrentVersion
+}
+
+// copyStatusSuccess is the CopyStatus of a finished copy.
+const copyStatusSuccess = "success"
+
+// softDeleteRetention is how long the in-memory and local backends keep
+// deleted blobs, the same as the default of Azure.
+const softDeleteRetention = 7 * 24 * time.Hour
+
+// snapshotTimeFormat is the format of snapshot timestamps and version IDs.
+const snapshotTimeFormat = "2006-01-02T15:04:05.0000000Z"
+
+// BlockProperties describes a committed block of a block blob.
+type BlockProperties struct {
+	ID   string
+	Size int64
+}
+
+// Error codes returned by the storage service which we care about. See
+// https://msdn.microsoft.com/en-us/library/azure/dd179439.aspx
+const (
+	errorCodeContainerNotFound      = "ContainerNotFound"
+	errorCodeContainerAlreadyExists = "ContainerAlreadyExists"
+	errorCodeContainerBeingDeleted  = "ContainerBeingDeleted"
+	errorCodeBlobNotFound           = "BlobNotFound"
+	errorCodeBlobAlreadyExists      = "BlobAlreadyExists"
+	errorCodeInvalidBlockList       = "InvalidBlockList"
+	errorCodeInvalidBlockID         = "InvalidBlockId"
+	errorCodeInvalidRange           = "InvalidRange"
+	errorCodeInvalidHeaderValue     = "InvalidHeaderValue"
+	errorCodeInvalidResourceName    = "InvalidResourceName"
+	errorCodeConditionNotMet        = "ConditionNotMet"
+	errorCodeLeaseIDMissing         = "LeaseIdMissing"
+	errorCodeLeaseAlreadyPresent    = "LeaseAlreadyPresent"
+	errorCodeLeaseNotPresent        = "LeaseNotPresentWithLeaseOperation"
+	errorCodeLeaseIDMismatch        = "LeaseIdMismatchWithLeaseOperation"
+	errorCodeLeaseIDMismatchWrite   = "LeaseIdMismatchWithBlobOperation"
+	errorCodeLeaseNotPresentWrite   = "LeaseNotPresentWithBlobOperation"
+	errorCodeSnapshotsPresent       = "SnapshotsPresent"
+	errorCodeNotImplemented         = "NotImplemented"
+)
+
+// StorageError is an error reported by the storage service.
+type StorageError struct {
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+func (e *StorageError) Error() string {
+	return fmt.Sprintf("storage: %d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+func errInvalidRange() error {
+	return &StorageError{http.StatusRequestedRangeNotSatisfiable, errorCodeInvalidRange, "The range specified is invalid for the current size of the resource."}
+}
+
+func errConditionNotMet() error {
+	return &StorageError{http.StatusPreconditionFailed, errorCodeConditionNotMet, "The condition specified using HTTP conditional header(s) is not met."}
+}
+
+func errSnapshotsPresent() error {
+	return &StorageError{http.StatusConflict, errorCodeSnapshotsPresent, "This operation is not permitted because the blob has snapshots."}
+}
+
+func errNotImplemented(op string) error {
+	return &StorageError{http.StatusNotImplemented, errorCodeNotImplemented, op + " is not supported."}
+}
+
+// isNotFound tells if err means that the container or blob does not exist.
+func isNotFound(err error) bool {
+	e, ok := err.(*StorageError)
+	return ok && e.StatusCode == http.StatusNotFound
+}
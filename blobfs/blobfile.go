@@ -1,20 +1,113 @@
 package blobfs
 
 import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/hanwen/go-fuse/fuse"
 	"github.com/hanwen/go-fuse/fuse/nodefs"
 )
 
+// blockSize is the size of blocks we upload blobs in.
+const blockSize = 4 * 1024 * 1024
+
+// copyBlockSize is the size of blocks copied with PutBlockFromURL, the
+// most Azure takes at a time.
+const copyBlockSize = 100 * 1024 * 1024
+
 // blobFile implements fuse/nodefs/File interface to
 // read/write data from/to blobs.
-type blobFile struct{}
+//
+// Files opened for reading read straight from storage, or from a snapshot
+// of the blob or the deleted blob if props.Snapshot or props.Deleted is
+// set. Files opened for writing keep the whole content in memory and
+// upload it as a list of blocks on Flush.
+// TODO(ppanyukov): don't hold the whole blob in memory for writes.
+type blobFile struct {
+	backend   Backend
+	container string
+	blobName  string
+	writable  bool
+	log       *log.Logger
+
+	// Unless lastWriterWins, changes are only committed if the blob is
+	// still the one seen at open, otherwise Flush fails with ESTALE.
+	lastWriterWins bool
+
+	// committed, if set, is told about the blob after each commit.
+	committed func(props BlobProperties)
+
+	mu    sync.Mutex
+	props BlobProperties
+
+	// lock is held through this file with flock or fcntl, see bloblock.go.
+	lock *blobLock
+
+	// data is the content of the blob, only used when writable.
+	data  []byte
+	dirty bool
+
+	// copied is set after CopyFrom had the blob copied server-side. data
+	// is only loaded when needed then, see loadData.
+	copied bool
+
+	// rangedCopy is the copy CopyFrom is making server-side a range at a
+	// time, see copyRange.
+	rangedCopy *rangedCopy
+
+	// copyProgress, if set, is told how far a ranged copy got, and ""
+	// once the file is released.
+	copyProgress func(progress string)
+}
+
+// rangedCopy is a server-side copy of a blob too big for one
+// copy_file_range. Its blocks are staged as cp goes through the source,
+// and committed once it got to the end or anything else is done with the
+// file.
+type rangedCopy struct {
+	srcContainer string
+	src          BlobProperties
+	blockIDs     []string
+	copied       int64
+}
+
+// newBlobFile opens the blob described by props for the operation with
+// context. When opened for writing, the content is loaded unless truncate
+// is given.
+func newBlobFile(backend Backend, container string, props BlobProperties, writable bool, truncate bool, lastWriterWins bool, log *log.Logger, context *fuse.Context) (*blobFile, fuse.Status) {
+	f := &blobFile{
+		backend:        backend,
+		container:      container,
+		blobName:       props.Name,
+		writable:       writable,
+		log:            log,
+		lastWriterWins: lastWriterWins,
+		props:          props,
+	}
+
+	if !writable {
+		return f, fuse.OK
+	}
+
+	if truncate {
+		f.dirty = props.ContentLength != 0
+		return f, fuse.OK
+	}
+
+	data, err := f.readRange(backendFor(backend, context), 0, props.ContentLength)
+	if err != nil {
+		f.log.Printf("[ERROR] Open '%s': Could not read blob. %s\n", f.blobName, err)
+		return nil, statusFromError(err)
+	}
+	f.data = data
 
-// NewBlobFile returns a File instance that returns ENOSYS for
-// every operation.
-func NewBlobFile() nodefs.File {
-	return (*blobFile)(nil)
+	return f, fuse.OK
 }
 
 // SetInode Called upon registering the filehandle in the inode.
@@ -29,22 +122,347 @@ func (f *blobFile) InnerFile() nodefs.File {
 
 // The String method is for debug printing.
 func (f *blobFile) String() string {
-	return "blobFile"
+	return fmt.Sprintf("blobFile(%s/%s)", f.container, f.blobName)
 }
 
 func (f *blobFile) Read(buf []byte, off int64) (fuse.ReadResult, fuse.Status) {
-	return nil, fuse.ENOSYS
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if status := f.commitRangedCopy(); status != fuse.OK {
+		return nil, status
+	}
+
+	if f.writable && !f.copied {
+		if off >= int64(len(f.data)) {
+			return fuse.ReadResultData(nil), fuse.OK
+		}
+		n := copy(buf, f.data[off:])
+		return fuse.ReadResultData(buf[:n]), fuse.OK
+	}
+
+	count := int64(len(buf))
+	if off+count > f.props.ContentLength {
+		count = f.props.ContentLength - off
+	}
+
+	data, err := f.readRange(f.storage(), off, count)
+	if err != nil {
+		f.log.Printf("[ERROR] Read '%s' at %d: %s\n", f.blobName, off, err)
+		return nil, statusFromError(err)
+	}
+
+	return fuse.ReadResultData(data), fuse.OK
 }
 
 func (f *blobFile) Write(data []byte, off int64) (uint32, fuse.Status) {
-	return 0, fuse.ENOSYS
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.writable {
+		return 0, fuse.EBADF
+	}
+
+	if status := f.loadData(); status != fuse.OK {
+		return 0, status
+	}
+	f.writeAt(data, off)
+
+	return uint32(len(data)), fuse.OK
+}
+
+// CopyFrom copies count bytes at offIn of src to offOut of this file for
+// copy_file_range and returns how many it copied, fewer at the end of src.
+// Copying all of src into an empty file is left to the storage service
+// with CopyBlob. The kernel asks for at most 4GB at a time, so bigger
+// blobs are copied with PutBlockFromURL a range at a time as cp goes
+// through them. Other copies and those the storage service can't do go
+// through here a block at a time.
+func (f *blobFile) CopyFrom(src *blobFile, offIn, offOut, count int64) (int64, fuse.Status) {
+	if !f.writable {
+		return 0, fuse.EBADF
+	}
+
+	// Never hold both locks, the same two files may be copied the other
+	// way round at the same time.
+	src.mu.Lock()
+	srcProps, srcSize, srcDirty := src.props, src.size(), src.dirty
+	src.mu.Unlock()
+
+	if offIn >= srcSize || count <= 0 {
+		return 0, fuse.OK
+	}
+	if offIn+count > srcSize {
+		count = srcSize - offIn
+	}
+
+	if offIn == offOut && src != f && !srcDirty && srcProps.Snapshot == "" && !srcProps.Deleted {
+		var copied bool
+		var status fuse.Status
+		if offIn == 0 && count == srcSize {
+			copied, status = f.copyBlob(src.container, srcProps)
+		} else {
+			copied, status = f.copyRange(src.container, srcProps, offIn, count)
+		}
+		if status != fuse.OK {
+			return 0, status
+		}
+		if copied {
+			return count, fuse.OK
+		}
+	}
+
+	// Not all at once, that could be 4GB.
+	var written int64
+	for written < count {
+		n := count - written
+		if n > blockSize {
+			n = blockSize
+		}
+		data, status := src.readAt(offIn+written, n)
+		if status == fuse.OK {
+			status = f.writeCopied(data, offOut+written)
+		}
+		if status != fuse.OK {
+			if written > 0 {
+				break
+			}
+			return 0, status
+		}
+		written += int64(len(data))
+		if int64(len(data)) < n {
+			break
+		}
+	}
+	return written, fuse.OK
+}
+
+// writeCopied writes data read by CopyFrom at off.
+func (f *blobFile) writeCopied(data []byte, off int64) fuse.Status {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if status := f.loadData(); status != fuse.OK {
+		return status
+	}
+	f.writeAt(data, off)
+	return fuse.OK
+}
+
+// copyBlob has the storage service replace the blob with a copy of the
+// source blob if this file is still empty, false if it didn't.
+func (f *blobFile) copyBlob(srcContainer string, srcProps BlobProperties) (bool, fuse.Status) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// Leased blobs can't be copied over, see Backend.CopyBlob.
+	if len(f.data) != 0 || f.copied || f.rangedCopy != nil || f.lock != nil {
+		return false, fuse.OK
+	}
+
+	ifMatch := f.props.ETag
+	if f.lastWriterWins {
+		ifMatch = ""
+	}
+
+	props, err := f.storage().CopyBlob(f.container, f.blobName, srcContainer, srcProps.Name, ifMatch)
+	status := statusFromError(err)
+	if status == fuse.Status(syscall.ESTALE) {
+		f.log.Printf("[ERROR] CopyFileRange '%s': Blob was changed by someone else since it was opened, not overwriting it. %s\n", f.blobName, err)
+		return false, status
+	}
+	if err != nil {
+		f.log.Printf("[ERROR] CopyFileRange '%s': Could not copy blob '%s' server-side, copying it through here. %s\n", f.blobName, srcProps.Name, err)
+		return false, fuse.OK
+	}
+
+	f.data = nil
+	f.dirty = false
+	f.copied = true
+	props.ContentLength = srcProps.ContentLength
+	f.setCommitted(props)
+	return true, fuse.OK
+}
+
+// copyRange stages the count bytes at off of the source blob as blocks
+// copied server-side, if this file was empty and that's where the copy
+// left off, false if it didn't. The copy is committed once it gets to the
+// end of the source.
+func (f *blobFile) copyRange(srcContainer string, srcProps BlobProperties, off, count int64) (bool, fuse.Status) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	rc := f.rangedCopy
+	if rc == nil {
+		if off != 0 || len(f.data) != 0 || f.copied {
+			return false, fuse.OK
+		}
+		rc = &rangedCopy{srcContainer: srcContainer, src: srcProps}
+	} else if rc.srcContainer != srcContainer || rc.src.Name != srcProps.Name || rc.src.ETag != srcProps.ETag || rc.copied != off {
+		// Anything but going on with the copy starts from what was
+		// copied so far.
+		return false, f.commitRangedCopy()
+	}
+
+	leaseID := ""
+	if f.lock != nil {
+		leaseID = f.lock.leaseID
+	}
+
+	staged := len(rc.blockIDs)
+	for pos := off; pos < off+count; pos += copyBlockSize {
+		n := off + count - pos
+		if n > copyBlockSize {
+			n = copyBlockSize
+		}
+		blockID := blockIDFor(len(rc.blockIDs))
+		err := f.storage().PutBlockFromURL(f.container, f.blobName, blockID, srcContainer, srcProps.Name, pos, n, leaseID)
+		if err != nil {
+			f.log.Printf("[ERROR] CopyFileRange '%s': Could not copy blob '%s' server-side, copying it through here. %s\n", f.blobName, srcProps.Name, err)
+			rc.blockIDs = rc.blockIDs[:staged]
+			if f.rangedCopy == nil {
+				return false, fuse.OK
+			}
+			return false, f.commitRangedCopy()
+		}
+		rc.blockIDs = append(rc.blockIDs, blockID)
+	}
+	rc.copied = off + count
+	f.rangedCopy = rc
+	f.dirty = false
+
+	if rc.copied < srcProps.ContentLength {
+		f.reportCopy("pending", rc.copied, srcProps.ContentLength)
+		return true, fuse.OK
+	}
+	if status := f.commitRangedCopy(); status != fuse.OK {
+		return false, status
+	}
+	f.reportCopy(copyStatusSuccess, rc.copied, srcProps.ContentLength)
+	return true, fuse.OK
+}
+
+// commitRangedCopy commits the blocks of the ranged copy, if any, so that
+// the blob has what was copied so far. Must be called with mu held.
+func (f *blobFile) commitRangedCopy() fuse.Status {
+	rc := f.rangedCopy
+	if rc == nil {
+		return fuse.OK
+	}
+
+	ifMatch := f.props.ETag
+	if f.lastWriterWins {
+		ifMatch = ""
+	}
+	leaseID := ""
+	if f.lock != nil {
+		leaseID = f.lock.leaseID
+	}
+
+	props, err := f.storage().PutBlockList(f.container, f.blobName, rc.blockIDs, ifMatch, leaseID)
+	status := statusFromError(err)
+	if status == fuse.Status(syscall.ESTALE) {
+		f.log.Printf("[ERROR] CopyFileRange '%s': Blob was changed by someone else since it was opened, not overwriting it. %s\n", f.blobName, err)
+		return status
+	}
+	if err != nil {
+		f.log.Printf("[ERROR] CopyFileRange '%s': Could not commit blob copied from '%s'. %s\n", f.blobName, rc.src.Name, err)
+		return status
+	}
+
+	f.rangedCopy = nil
+	f.data = nil
+	f.dirty = false
+	f.copied = true
+	props.ContentLength = rc.copied
+	f.setCommitted(props)
+	return fuse.OK
+}
+
+// reportCopy tells copyProgress how far a copy got, in the format of
+// BlobProperties.CopyStatus and CopyProgress.
+func (f *blobFile) reportCopy(status string, copied, total int64) {
+	if f.copyProgress != nil {
+		f.copyProgress(fmt.Sprintf("%s %d/%d", status, copied, total))
+	}
+}
+
+// readAt reads count bytes at off, from memory if opened for writing.
+func (f *blobFile) readAt(off int64, count int64) ([]byte, fuse.Status) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if status := f.commitRangedCopy(); status != fuse.OK {
+		return nil, status
+	}
+
+	if f.writable && !f.copied {
+		end := off + count
+		if end > int64(len(f.data)) {
+			end = int64(len(f.data))
+		}
+		return append([]byte(nil), f.data[off:end]...), fuse.OK
+	}
+
+	data, err := f.readRange(f.storage(), off, count)
+	if err != nil {
+		f.log.Printf("[ERROR] CopyFileRange '%s' at %d: %s\n", f.blobName, off, err)
+		return nil, statusFromError(err)
+	}
+	return data, fuse.OK
+}
+
+// writeAt writes data at off, growing the content as needed. Must be
+// called with mu held.
+func (f *blobFile) writeAt(data []byte, off int64) {
+	end := off + int64(len(data))
+	if end > int64(len(f.data)) {
+		f.resize(end)
+	}
+	copy(f.data[off:], data)
+	f.dirty = true
+}
+
+// loadData loads the content after a server-side copy, before it's
+// changed. Must be called with mu held.
+func (f *blobFile) loadData() fuse.Status {
+	if status := f.commitRangedCopy(); status != fuse.OK {
+		return status
+	}
+	if !f.copied {
+		return fuse.OK
+	}
+
+	data, err := f.readRange(f.storage(), 0, f.props.ContentLength)
+	if err != nil {
+		f.log.Printf("[ERROR] Write '%s': Could not read copied blob. %s\n", f.blobName, err)
+		return statusFromError(err)
+	}
+	f.data = data
+	f.copied = false
+	return fuse.OK
+}
+
+// size is the size of the content as seen through this file. Must be
+// called with mu held.
+func (f *blobFile) size() int64 {
+	if f.rangedCopy != nil {
+		return f.rangedCopy.copied
+	}
+	if f.writable && !f.copied {
+		return int64(len(f.data))
+	}
+	return f.props.ContentLength
 }
 
 // Flush is called for close() call on a file descriptor. In
 // case of duplicated descriptor, it may be called more than
 // once for a file.
 func (f *blobFile) Flush() fuse.Status {
-	return fuse.OK
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.upload()
 }
 
 // This is called to before the file handle is forgotten. This
@@ -52,25 +470,155 @@ func (f *blobFile) Flush() fuse.Status {
 // the call. Any cleanup that requires specific synchronization or
 // could fail with I/O errors should happen in Flush instead.
 func (f *blobFile) Release() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
 
+	if f.dirty || f.rangedCopy != nil {
+		f.log.Printf("[ERROR] Release '%s': Changes were not saved.\n", f.blobName)
+	}
+	f.data = nil
+	f.copied = false
+	f.rangedCopy = nil
+	if f.copyProgress != nil {
+		f.copyProgress("")
+	}
+	f.unlock()
 }
 
-func (f *blobFile) GetAttr(*fuse.Attr) fuse.Status {
-	return fuse.ENOSYS
+func (f *blobFile) GetAttr(out *fuse.Attr) fuse.Status {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	out.Mode = fuse.S_IFREG | 0644
+	out.Size = uint64(f.size())
+	out.SetTimes(nil, &f.props.LastModified, &f.props.LastModified)
+
+	return fuse.OK
+}
+
+// GetLk reports a lock held through another file, here or on another
+// machine, as a write lock on the whole file. There is no way to tell
+// who holds it, so Pid is 0.
+func (f *blobFile) GetLk(owner uint64, lk *fuse.FileLock, flags uint32, out *fuse.FileLock) (code fuse.Status) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	*out = *lk
+	out.Typ = syscall.F_UNLCK
+	if f.lock != nil || f.props.Snapshot != "" || f.props.Deleted {
+		return fuse.OK
+	}
+
+	props, err := f.storage().GetBlobProperties(f.container, f.blobName)
+	if err != nil {
+		f.log.Printf("[ERROR] GetLk '%s': Could not get lease state. %s\n", f.blobName, err)
+		return statusFromError(err)
+	}
+
+	// A lease being broken still keeps others from writing.
+	if props.LeaseState == leaseStateLeased || props.LeaseState == leaseStateBreaking {
+		out.Typ = syscall.F_WRLCK
+		out.Start = 0
+		out.End = math.MaxInt64
+		out.Pid = 0
+	}
+	return fuse.OK
+}
+
+// SetLk locks or unlocks the file. Leases are exclusive, so read locks are
+// write locks too, and any lock is on the whole file. Locks belong to this
+// open file rather than to owner.
+// TODO(ppanyukov): shared read locks and byte ranges.
+func (f *blobFile) SetLk(owner uint64, lk *fuse.FileLock, flags uint32) (code fuse.Status) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if lk.Typ == syscall.F_UNLCK {
+		return f.unlock()
+	}
+
+	// Snapshots and deleted blobs can't be leased.
+	if f.props.Snapshot != "" || f.props.Deleted {
+		return fuse.Status(syscall.ENOLCK)
+	}
+
+	if f.lock != nil {
+		return fuse.OK
+	}
+
+	lock, err := acquireBlobLock(f.storage(), f.container, f.blobName, f.log)
+	if statusFromError(err) == fuse.EBUSY {
+		return fuse.EAGAIN
+	}
+	if err != nil {
+		f.log.Printf("[ERROR] SetLk '%s': Could not acquire lease. %s\n", f.blobName, err)
+		return statusFromError(err)
+	}
+
+	f.lock = lock
+	return fuse.OK
+}
+
+// SetLkw is SetLk which waits for the lock to become available.
+// TODO(ppanyukov): keeps waiting even if the caller gives up, e.g. on Ctrl+C.
+func (f *blobFile) SetLkw(owner uint64, lk *fuse.FileLock, flags uint32) (code fuse.Status) {
+	for {
+		status := f.SetLk(owner, lk, flags)
+		if status != fuse.EAGAIN {
+			return status
+		}
+		time.Sleep(lockRetryInterval)
+	}
+}
+
+// unlock releases the lock if held. Must be called with mu held.
+func (f *blobFile) unlock() fuse.Status {
+	if f.lock == nil {
+		return fuse.OK
+	}
+
+	err := f.lock.release()
+	f.lock = nil
+	if err != nil {
+		f.log.Printf("[ERROR] Unlock '%s': Could not release lease. %s\n", f.blobName, err)
+		return statusFromError(err)
+	}
+	return fuse.OK
 }
 
 func (f *blobFile) Fsync(flags int) (code fuse.Status) {
-	return fuse.ENOSYS
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.upload()
 }
 
 func (f *blobFile) Utimens(atime *time.Time, mtime *time.Time) fuse.Status {
-	return fuse.ENOSYS
+	// TODO(ppanyukov): implement setting times on blobs. Ignored for now
+	// same as in flatblobFs.Utimens.
+	return fuse.OK
 }
 
 // The methods below may be called on closed files, due to
 // concurrency.  In that case, you should return EBADF.
 func (f *blobFile) Truncate(size uint64) fuse.Status {
-	return fuse.ENOSYS
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.writable {
+		return fuse.EBADF
+	}
+
+	if status := f.loadData(); status != fuse.OK {
+		return status
+	}
+
+	if int64(size) != int64(len(f.data)) {
+		f.resize(int64(size))
+		f.dirty = true
+	}
+
+	return fuse.OK
 }
 
 func (f *blobFile) Chown(uid uint32, gid uint32) fuse.Status {
@@ -84,3 +632,137 @@ func (f *blobFile) Chmod(perms uint32) fuse.Status {
 func (f *blobFile) Allocate(off uint64, size uint64, mode uint32) (code fuse.Status) {
 	return fuse.ENOSYS
 }
+
+// resize grows or shrinks data to size, zero-filling when growing.
+// Must be called with mu held.
+func (f *blobFile) resize(size int64) {
+	if size <= int64(cap(f.data)) {
+		old := int64(len(f.data))
+		f.data = f.data[:size]
+		for i := old; i < size; i++ {
+			f.data[i] = 0
+		}
+		return
+	}
+
+	data := make([]byte, size, size+size/4)
+	copy(data, f.data)
+	f.data = data
+}
+
+// storage returns the backend for the calls made by operations on f, see
+// backendFor.
+func (f *blobFile) storage() Backend {
+	return backendFor(f.backend, f)
+}
+
+// readRange reads count bytes at off from the blob through backend.
+func (f *blobFile) readRange(backend Backend, off int64, count int64) ([]byte, error) {
+	if count <= 0 {
+		return nil, nil
+	}
+
+	var body io.ReadCloser
+	var err error
+	if f.props.Deleted {
+		body, err = backend.GetDeletedBlobRange(f.container, f.blobName, off, count)
+	} else if f.props.VersionID != "" {
+		body, err = backend.GetBlobVersionRange(f.container, f.blobName, f.props.VersionID, off, count)
+	} else {
+		body, err = backend.GetBlobRange(f.container, f.blobName, f.props.Snapshot, off, count)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	data := make([]byte, count)
+	n, err := io.ReadFull(body, data)
+	if err == io.ErrUnexpectedEOF {
+		// The blob got shorter since we looked at it.
+		err = nil
+	}
+	return data[:n], err
+}
+
+// upload commits the content to storage if there are any changes.
+// Must be called with mu held.
+func (f *blobFile) upload() fuse.Status {
+	if f.rangedCopy != nil {
+		return f.commitRangedCopy()
+	}
+	if !f.dirty {
+		return fuse.OK
+	}
+
+	ifMatch := f.props.ETag
+	if f.lastWriterWins {
+		ifMatch = ""
+	}
+
+	// Writes to a locked blob need the lease of the lock.
+	leaseID := ""
+	if f.lock != nil {
+		leaseID = f.lock.leaseID
+	}
+
+	var props BlobProperties
+	var err error
+	if len(f.data) == 0 {
+		props, err = f.storage().CreateBlockBlob(f.container, f.blobName, ifMatch, leaseID)
+	} else {
+		props, err = f.putBlocks(ifMatch, leaseID)
+	}
+
+	status := statusFromError(err)
+	if status == fuse.Status(syscall.ESTALE) {
+		f.log.Printf("[ERROR] Flush '%s': Blob was changed by someone else since it was opened, not overwriting it. %s\n", f.blobName, err)
+		return status
+	}
+	if err != nil {
+		f.log.Printf("[ERROR] Flush '%s': Could not upload blob. %s\n", f.blobName, err)
+		return status
+	}
+
+	f.dirty = false
+	props.ContentLength = int64(len(f.data))
+	f.setCommitted(props)
+	return fuse.OK
+}
+
+// setCommitted takes the properties returned by a commit, so that the next
+// commit expects the new ETag. They come from the response to the commit
+// itself: asking for them afterwards could get the ETag of a change made
+// by someone else in between. Must be called with mu held.
+func (f *blobFile) setCommitted(props BlobProperties) {
+	props.Name = f.blobName
+	f.props = props
+
+	if f.committed != nil {
+		f.committed(props)
+	}
+}
+
+func (f *blobFile) putBlocks(ifMatch, leaseID string) (BlobProperties, error) {
+	var blockIDs []string
+	for off := 0; off < len(f.data); off += blockSize {
+		end := off + blockSize
+		if end > len(f.data) {
+			end = len(f.data)
+		}
+
+		blockID := blockIDFor(len(blockIDs))
+		if err := f.storage().PutBlock(f.container, f.blobName, blockID, f.data[off:end], leaseID); err != nil {
+			return BlobProperties{}, err
+		}
+		blockIDs = append(blockIDs, blockID)
+	}
+
+	return f.storage().PutBlockList(f.container, f.blobName, blockIDs, ifMatch, leaseID)
+}
+
+// blockIDFor returns the ID of the n-th block. Azure wants all IDs within
+// a blob to be base64 of the same length.
+func blockIDFor(n int) string {
+	return base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("block-%010d", n)))
+}
@@ -0,0 +1,85 @@
+package blobfs
+
+// flock(2) and fcntl(2) locks on files are leases on their blobs, so that
+// they exclude lock holders on other machines too. While the lease is
+// held, writes by anyone but the holder fail with EBUSY.
+
+import (
+	"log"
+	"time"
+)
+
+const (
+	// lockLeaseDuration is how long in seconds the lease of a lock is
+	// acquired for. It's renewed in the background while the lock is held,
+	// so a crashed holder doesn't keep the lock for longer than that.
+	lockLeaseDuration = 60
+
+	// lockRenewInterval is how often the lease of a lock is renewed.
+	lockRenewInterval = 20 * time.Second
+
+	// lockRetryInterval is how often blocking lock requests try again.
+	lockRetryInterval = time.Second
+)
+
+// blobLock is a lock on a blob held as a lease.
+type blobLock struct {
+	backend   Backend
+	container string
+	blobName  string
+	leaseID   string
+	log       *log.Logger
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// acquireBlobLock acquires the lease for a lock on the blob and starts
+// renewing it. Fails with LeaseAlreadyPresent if someone else holds it.
+func acquireBlobLock(backend Backend, container string, blobName string, log *log.Logger) (*blobLock, error) {
+	leaseID, err := backend.AcquireLease(container, blobName, lockLeaseDuration, "")
+	if err != nil {
+		return nil, err
+	}
+
+	l := &blobLock{
+		backend:   backend,
+		container: container,
+		blobName:  blobName,
+		leaseID:   leaseID,
+		log:       log,
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	go l.renew(lockRenewInterval)
+	return l, nil
+}
+
+// renew renews the lease every interval until released.
+func (l *blobLock) renew(interval time.Duration) {
+	defer close(l.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			if err := l.backend.RenewLease(l.container, l.blobName, l.leaseID); err != nil {
+				// Keep trying, the lease is only lost once someone else
+				// acquires it.
+				l.log.Printf("[ERROR] Lock '%s': Could not renew lease. %s\n", l.blobName, err)
+			}
+		}
+	}
+}
+
+// release stops renewing the lease and releases it.
+func (l *blobLock) release() error {
+	close(l.stop)
+	<-l.done
+
+	return l.backend.ReleaseLease(l.container, l.blobName, l.leaseID)
+}
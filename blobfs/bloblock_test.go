@@ -0,0 +1,88 @@
+package blobfs
+
+import (
+	"io/ioutil"
+	"log"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+func TestBlobFileLocks(t *testing.T) {
+	backend := newTestBackend(t)
+	putBlob(t, backend.backend, conformanceContainer, "lock", "")
+
+	fs := NewFlatBlobFs(conformanceContainer, backend, Options{}).(*flatblobFs)
+	fs.log = log.New(ioutil.Discard, "", 0)
+
+	open := func() nodefs.File {
+		f, status := fs.Open("lock", uint32(syscall.O_RDWR), nil)
+		expectStatus(t, "Open", status, fuse.OK)
+		return f
+	}
+	lock := &fuse.FileLock{Typ: syscall.F_WRLCK}
+	unlock := &fuse.FileLock{Typ: syscall.F_UNLCK}
+
+	// Two files as if on two machines, only one gets the lock.
+	holder := open()
+	other := open()
+	expectStatus(t, "SetLk holder", holder.SetLk(1, lock, fuse.FUSE_LK_FLOCK), fuse.OK)
+	expectStatus(t, "SetLk again", holder.SetLk(1, lock, fuse.FUSE_LK_FLOCK), fuse.OK)
+	expectStatus(t, "SetLk other", other.SetLk(2, lock, fuse.FUSE_LK_FLOCK), fuse.EAGAIN)
+
+	var out fuse.FileLock
+	acquired := countCalls(backend, "AcquireLease")
+	expectStatus(t, "GetLk other", other.GetLk(2, lock, 0, &out), fuse.OK)
+	if out.Typ != syscall.F_WRLCK {
+		t.Errorf("GetLk other: expected F_WRLCK got %d", out.Typ)
+	}
+	if countCalls(backend, "AcquireLease") != acquired {
+		t.Errorf("GetLk other: expected no lease to be taken, got %q", backend.calls)
+	}
+	expectStatus(t, "GetLk holder", holder.GetLk(1, lock, 0, &out), fuse.OK)
+	if out.Typ != syscall.F_UNLCK {
+		t.Errorf("GetLk holder: expected F_UNLCK got %d", out.Typ)
+	}
+
+	// Only the holder can change the file.
+	other.Write([]byte("other"), 0)
+	expectStatus(t, "Flush other", other.Flush(), fuse.EBUSY)
+	other.Release()
+	holder.Write([]byte("holder"), 0)
+	expectStatus(t, "Flush holder", holder.Flush(), fuse.OK)
+	expectStatus(t, "Unlink", fs.Unlink("lock", nil), fuse.EBUSY)
+
+	// A waiting lock request gets the lock once it's unlocked.
+	waiter := open()
+	locked := make(chan fuse.Status)
+	go func() {
+		locked <- waiter.SetLkw(3, lock, 0)
+	}()
+
+	select {
+	case status := <-locked:
+		t.Fatalf("SetLkw returned %v while locked", status)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	expectStatus(t, "Unlock holder", holder.SetLk(1, unlock, fuse.FUSE_LK_FLOCK), fuse.OK)
+	holder.Release()
+
+	select {
+	case status := <-locked:
+		expectStatus(t, "SetLkw", status, fuse.OK)
+	case <-time.After(5 * lockRetryInterval):
+		t.Fatalf("SetLkw did not get the lock after unlock")
+	}
+
+	// Closing the file releases the lock.
+	waiter.Release()
+	leaseID, err := backend.backend.AcquireLease(conformanceContainer, "lock", lockLeaseDuration, "")
+	if err != nil {
+		t.Fatalf("Lease still held after Release: %s", err)
+	}
+	backend.backend.ReleaseLease(conformanceContainer, "lock", leaseID)
+}
@@ -0,0 +1,660 @@
+package blobfs
+
+// Conformance suite which drives the file systems in this package through
+// the pathfs.FileSystem interface the same way the kernel would, against
+// an in-memory backend. New views only need an entry in conformanceFs.
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+)
+
+// conformanceContainer is the container every backend in the suite has.
+const conformanceContainer = "data"
+
+// fsConformance describes a file system under test.
+type fsConformance struct {
+	name  string
+	newFs func(backend Backend, options Options) pathfs.FileSystem
+
+	// containers tells the root lists containers as directories.
+	containers bool
+
+	// files tells the root lists the blobs of conformanceContainer as files.
+	files bool
+
+	// fileName returns the file name of a blob, the blob name if not given.
+	fileName func(blobName string) string
+}
+
+func (c fsConformance) file(blobName string) string {
+	if c.fileName == nil {
+		return blobName
+	}
+	return c.fileName(blobName)
+}
+
+var conformanceFs = []fsConformance{
+	{
+		name:       "containerfs",
+		newFs:      NewContainerFs,
+		containers: true,
+	},
+	{
+		name: "flatblobfs",
+		newFs: func(backend Backend, options Options) pathfs.FileSystem {
+			return NewFlatBlobFs(conformanceContainer, backend, options)
+		},
+		files: true,
+	},
+}
+
+func init() {
+	for _, escaping := range PathEscapings {
+		options := Options{PathEscaping: escaping}
+		conformanceFs = append(conformanceFs, fsConformance{
+			name: "flatblobfs/" + string(escaping),
+			newFs: func(backend Backend, o Options) pathfs.FileSystem {
+				o.PathEscaping = options.PathEscaping
+				return NewFlatBlobFs(conformanceContainer, backend, o)
+			},
+			files: true,
+			fileName: func(blobName string) string {
+				fileName, _ := newPathEscaper(options.PathEscaping).BlobNameToFileName(blobName)
+				return fileName
+			},
+		})
+	}
+}
+
+func TestConformance(t *testing.T) {
+	for _, c := range conformanceFs {
+		t.Run(c.name, func(t *testing.T) {
+			t.Run("Root", func(t *testing.T) { testConformanceRoot(t, c) })
+			t.Run("ReadOnly", func(t *testing.T) { testConformanceReadOnly(t, c) })
+			t.Run("ErrorMapping", func(t *testing.T) { testConformanceErrorMapping(t, c) })
+			if c.containers {
+				t.Run("Containers", func(t *testing.T) { testConformanceContainers(t, c) })
+			}
+			if c.files {
+				t.Run("Files", func(t *testing.T) { testConformanceFiles(t, c) })
+				t.Run("ReadWrite", func(t *testing.T) { testConformanceReadWrite(t, c) })
+				t.Run("Escaping", func(t *testing.T) { testConformanceEscaping(t, c) })
+			}
+		})
+	}
+}
+
+// testBackend wraps a backend to record the calls made to it and to make
+// them fail with err when set, only those to errOp if that is set too.
+type testBackend struct {
+	backend Backend
+
+	mu    sync.Mutex
+	err   error
+	errOp string
+	calls []string
+}
+
+func newTestBackend(t *testing.T) *testBackend {
+	backend := NewMemoryBackend()
+	if err := backend.CreateContainer(conformanceContainer); err != nil {
+		t.Fatal(err)
+	}
+	return &testBackend{backend: backend}
+}
+
+func (b *testBackend) call(op string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.calls = append(b.calls, op)
+	if b.errOp != "" && b.errOp != op {
+		return nil
+	}
+	return b.err
+}
+
+func (b *testBackend) failWith(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.err = err
+	b.calls = nil
+}
+
+func (b *testBackend) callCount() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return len(b.calls)
+}
+
+func (b *testBackend) ListContainers(prefix string) ([]ContainerProperties, error) {
+	if err := b.call("ListContainers"); err != nil {
+		return nil, err
+	}
+	return b.backend.ListContainers(prefix)
+}
+
+func (b *testBackend) ContainerExists(container string) (bool, error) {
+	if err := b.call("ContainerExists"); err != nil {
+		return false, err
+	}
+	return b.backend.ContainerExists(container)
+}
+
+func (b *testBackend) CreateContainer(container string) error {
+	if err := b.call("CreateContainer"); err != nil {
+		return err
+	}
+	return b.backend.CreateContainer(container)
+}
+
+func (b *testBackend) DeleteContainer(container string, leaseID string) error {
+	if err := b.call("DeleteContainer"); err != nil {
+		return err
+	}
+	return b.backend.DeleteContainer(container, leaseID)
+}
+
+func (b *testBackend) AcquireContainerLease(container string, duration int, proposedLeaseID string) (string, error) {
+	if err := b.call("AcquireContainerLease"); err != nil {
+		return "", err
+	}
+	return b.backend.AcquireContainerLease(container, duration, proposedLeaseID)
+}
+
+func (b *testBackend) ReleaseContainerLease(container, leaseID string) error {
+	if err := b.call("ReleaseContainerLease"); err != nil {
+		return err
+	}
+	return b.backend.ReleaseContainerLease(container, leaseID)
+}
+
+func (b *testBackend) BreakContainerLease(container string) error {
+	if err := b.call("BreakContainerLease"); err != nil {
+		return err
+	}
+	return b.backend.BreakContainerLease(container)
+}
+
+func (b *testBackend) ListBlobs(container string, params ListBlobsParameters) ([]BlobProperties, error) {
+	if err := b.call("ListBlobs"); err != nil {
+		return nil, err
+	}
+	return b.backend.ListBlobs(container, params)
+}
+
+func (b *testBackend) GetBlobProperties(container, blob string) (BlobProperties, error) {
+	if err := b.call("GetBlobProperties"); err != nil {
+		return BlobProperties{}, err
+	}
+	return b.backend.GetBlobProperties(container, blob)
+}
+
+func (b *testBackend) GetBlobRange(container, blob, snapshot string, offset, count int64) (io.ReadCloser, error) {
+	if err := b.call("GetBlobRange"); err != nil {
+		return nil, err
+	}
+	return b.backend.GetBlobRange(container, blob, snapshot, offset, count)
+}
+
+func (b *testBackend) GetBlobVersionRange(container, blob, versionID string, offset, count int64) (io.ReadCloser, error) {
+	if err := b.call("GetBlobVersionRange"); err != nil {
+		return nil, err
+	}
+	return b.backend.GetBlobVersionRange(container, blob, versionID, offset, count)
+}
+
+func (b *testBackend) SnapshotBlob(container, blob string) (string, error) {
+	if err := b.call("SnapshotBlob"); err != nil {
+		return "", err
+	}
+	return b.backend.SnapshotBlob(container, blob)
+}
+
+func (b *testBackend) GetDeletedBlobRange(container, blob string, offset, count int64) (io.ReadCloser, error) {
+	if err := b.call("GetDeletedBlobRange"); err != nil {
+		return nil, err
+	}
+	return b.backend.GetDeletedBlobRange(container, blob, offset, count)
+}
+
+func (b *testBackend) UndeleteBlob(container, blob string) error {
+	if err := b.call("UndeleteBlob"); err != nil {
+		return err
+	}
+	return b.backend.UndeleteBlob(container, blob)
+}
+
+func (b *testBackend) CreateBlockBlob(container, blob string, ifMatch, leaseID string) (BlobProperties, error) {
+	if err := b.call("CreateBlockBlob"); err != nil {
+		return BlobProperties{}, err
+	}
+	return b.backend.CreateBlockBlob(container, blob, ifMatch, leaseID)
+}
+
+func (b *testBackend) DeleteBlob(container, blob string, ifMatch, leaseID string, deleteSnapshots bool) error {
+	if err := b.call("DeleteBlob"); err != nil {
+		return err
+	}
+	return b.backend.DeleteBlob(container, blob, ifMatch, leaseID, deleteSnapshots)
+}
+
+func (b *testBackend) CopyBlob(container, blob, sourceContainer, sourceBlob string, ifMatch string) (BlobProperties, error) {
+	if err := b.call("CopyBlob"); err != nil {
+		return BlobProperties{}, err
+	}
+	return b.backend.CopyBlob(container, blob, sourceContainer, sourceBlob, ifMatch)
+}
+
+func (b *testBackend) PutBlock(container, blob, blockID string, data []byte, leaseID string) error {
+	if err := b.call("PutBlock"); err != nil {
+		return err
+	}
+	return b.backend.PutBlock(container, blob, blockID, data, leaseID)
+}
+
+func (b *testBackend) PutBlockFromURL(container, blob, blockID, sourceContainer, sourceBlob string, offset, count int64, leaseID string) error {
+	if err := b.call("PutBlockFromURL"); err != nil {
+		return err
+	}
+	return b.backend.PutBlockFromURL(container, blob, blockID, sourceContainer, sourceBlob, offset, count, leaseID)
+}
+
+func (b *testBackend) PutBlockList(container, blob string, blockIDs []string, ifMatch, leaseID string) (BlobProperties, error) {
+	if err := b.call("PutBlockList"); err != nil {
+		return BlobProperties{}, err
+	}
+	return b.backend.PutBlockList(container, blob, blockIDs, ifMatch, leaseID)
+}
+
+func (b *testBackend) GetBlockList(container, blob string) ([]BlockProperties, error) {
+	if err := b.call("GetBlockList"); err != nil {
+		return nil, err
+	}
+	return b.backend.GetBlockList(container, blob)
+}
+
+func (b *testBackend) AcquireLease(container, blob string, duration int, proposedLeaseID string) (string, error) {
+	if err := b.call("AcquireLease"); err != nil {
+		return "", err
+	}
+	return b.backend.AcquireLease(container, blob, duration, proposedLeaseID)
+}
+
+func (b *testBackend) RenewLease(container, blob, leaseID string) error {
+	if err := b.call("RenewLease"); err != nil {
+		return err
+	}
+	return b.backend.RenewLease(container, blob, leaseID)
+}
+
+func (b *testBackend) ReleaseLease(container, blob, leaseID string) error {
+	if err := b.call("ReleaseLease"); err != nil {
+		return err
+	}
+	return b.backend.ReleaseLease(container, blob, leaseID)
+}
+
+func (b *testBackend) BreakLease(container, blob string) error {
+	if err := b.call("BreakLease"); err != nil {
+		return err
+	}
+	return b.backend.BreakLease(container, blob)
+}
+
+// statusOf drops the result of a call which returns a status too.
+func statusOf(_ interface{}, status fuse.Status) fuse.Status {
+	return status
+}
+
+func expectStatus(t *testing.T, what string, got fuse.Status, expected fuse.Status) {
+	if got != expected {
+		t.Errorf("%s: expected %v got %v", what, expected, got)
+	}
+}
+
+func listNames(t *testing.T, fs pathfs.FileSystem, name string) []string {
+	entries, status := fs.OpenDir(name, nil)
+	if status != fuse.OK {
+		t.Fatalf("OpenDir '%s': %v", name, status)
+	}
+
+	names := make([]string, len(entries))
+	for i, entry := range entries {
+		names[i] = entry.Name
+	}
+	sort.Strings(names)
+	return names
+}
+
+// writeFile writes content to name the way `echo content > name` does.
+func writeFile(t *testing.T, fs pathfs.FileSystem, name string, content string) {
+	f, status := fs.Open(name, uint32(syscall.O_WRONLY|syscall.O_TRUNC), nil)
+	if status != fuse.OK {
+		t.Fatalf("Open '%s' for writing: %v", name, status)
+	}
+	defer f.Release()
+
+	if n, status := f.Write([]byte(content), 0); status != fuse.OK || int(n) != len(content) {
+		t.Fatalf("Write '%s': wrote %d %v", name, n, status)
+	}
+	if status := f.Flush(); status != fuse.OK {
+		t.Fatalf("Flush '%s': %v", name, status)
+	}
+}
+
+// readFile reads the content of name the way `cat name` does.
+func readFile(t *testing.T, fs pathfs.FileSystem, name string) string {
+	f, status := fs.Open(name, uint32(syscall.O_RDONLY), nil)
+	if status != fuse.OK {
+		t.Fatalf("Open '%s' for reading: %v", name, status)
+	}
+	defer f.Release()
+
+	var content []byte
+	buf := make([]byte, 3)
+	for {
+		res, status := f.Read(buf, int64(len(content)))
+		if status != fuse.OK {
+			t.Fatalf("Read '%s': %v", name, status)
+		}
+		data, status := res.Bytes(buf)
+		if status != fuse.OK {
+			t.Fatalf("Read '%s': %v", name, status)
+		}
+		if len(data) == 0 {
+			return string(content)
+		}
+		content = append(content, data...)
+	}
+}
+
+func testConformanceRoot(t *testing.T, c fsConformance) {
+	fs := c.newFs(newTestBackend(t), Options{})
+
+	attr, status := fs.GetAttr("", nil)
+	if status != fuse.OK || attr.Mode&fuse.S_IFDIR == 0 {
+		t.Errorf("GetAttr root: expected directory got %v %v", attr, status)
+	}
+
+	expectStatus(t, "GetAttr missing", statusOf(fs.GetAttr(c.file("nosuchthing"), nil)), fuse.ENOENT)
+	expectStatus(t, "Access root", fs.Access("", accessWrite, nil), fuse.OK)
+
+	if statfs := fs.StatFs(""); statfs == nil || statfs.NameLen != maxNameLen {
+		t.Errorf("StatFs: unexpected %v", statfs)
+	}
+}
+
+func testConformanceReadOnly(t *testing.T, c fsConformance) {
+	backend := newTestBackend(t)
+	putBlob(t, backend.backend, conformanceContainer, "foo", "content")
+	fs := c.newFs(backend, Options{ReadOnly: true})
+
+	backend.failWith(nil)
+	expectStatus(t, "Mknod", fs.Mknod(c.file("bar"), fuse.S_IFREG|0644, 0, nil), fuse.EROFS)
+	expectStatus(t, "Mkdir", fs.Mkdir("newcontainer", 0755, nil), fuse.EROFS)
+	expectStatus(t, "Unlink", fs.Unlink(c.file("foo"), nil), fuse.EROFS)
+	expectStatus(t, "Rmdir", fs.Rmdir(conformanceContainer, nil), fuse.EROFS)
+	expectStatus(t, "Truncate", fs.Truncate(c.file("foo"), 0, nil), fuse.EROFS)
+	expectStatus(t, "Rename", fs.Rename(c.file("foo"), "bar", nil), fuse.EROFS)
+	expectStatus(t, "Utimens", fs.Utimens(c.file("foo"), nil, nil, nil), fuse.EROFS)
+	expectStatus(t, "Access write", fs.Access(c.file("foo"), accessWrite, nil), fuse.EROFS)
+	expectStatus(t, "Open for writing", statusOf(fs.Open(c.file("foo"), uint32(syscall.O_WRONLY), nil)), fuse.EROFS)
+	expectStatus(t, "Create", statusOf(fs.Create(c.file("bar"), uint32(syscall.O_WRONLY|syscall.O_CREAT), 0644, nil)), fuse.EROFS)
+
+	if n := backend.callCount(); n != 0 {
+		t.Errorf("Read-only operations called storage: %v", backend.calls)
+	}
+}
+
+func testConformanceErrorMapping(t *testing.T, c fsConformance) {
+	cases := []struct {
+		err      error
+		expected fuse.Status
+	}{
+		{&StorageError{http.StatusForbidden, "AuthorizationPermissionMismatch", "This request is not authorized to perform this operation using this permission."}, fuse.EACCES},
+		{&StorageError{http.StatusConflict, errorCodeContainerBeingDeleted, "The specified container is being deleted."}, fuse.EBUSY},
+		{&StorageError{http.StatusPreconditionFailed, errorCodeLeaseIDMissing, "There is currently a lease on the blob and no lease ID was specified in the request."}, fuse.EBUSY},
+		{&StorageError{http.StatusInternalServerError, "InternalError", "The server encountered an internal error."}, fuse.EIO},
+		{errors.New("dial tcp: i/o timeout"), fuse.EIO},
+	}
+
+	backend := newTestBackend(t)
+	fs := c.newFs(backend, Options{})
+
+	for _, tc := range cases {
+		backend.failWith(tc.err)
+
+		expectStatus(t, tc.err.Error()+": OpenDir", statusOf(fs.OpenDir("", nil)), tc.expected)
+
+		if c.containers {
+			expectStatus(t, tc.err.Error()+": GetAttr", statusOf(fs.GetAttr(conformanceContainer, nil)), tc.expected)
+			expectStatus(t, tc.err.Error()+": Mkdir", fs.Mkdir("newcontainer", 0755, nil), tc.expected)
+			expectStatus(t, tc.err.Error()+": Rmdir", fs.Rmdir(conformanceContainer, nil), tc.expected)
+		}
+
+		if c.files {
+			expectStatus(t, tc.err.Error()+": GetAttr", statusOf(fs.GetAttr(c.file("foo"), nil)), tc.expected)
+			expectStatus(t, tc.err.Error()+": Mknod", fs.Mknod(c.file("foo"), fuse.S_IFREG|0644, 0, nil), tc.expected)
+			expectStatus(t, tc.err.Error()+": Unlink", fs.Unlink(c.file("foo"), nil), tc.expected)
+			expectStatus(t, tc.err.Error()+": Open", statusOf(fs.Open(c.file("foo"), uint32(syscall.O_RDONLY), nil)), tc.expected)
+		}
+	}
+}
+
+func testConformanceContainers(t *testing.T, c fsConformance) {
+	backend := newTestBackend(t)
+	fs := c.newFs(backend, Options{})
+
+	expectStatus(t, "Mkdir", fs.Mkdir("newcontainer", 0755, nil), fuse.OK)
+	expectStatus(t, "Mkdir existing", fs.Mkdir("newcontainer", 0755, nil), fuse.Status(syscall.EEXIST))
+	expectStatus(t, "Mkdir invalid name", fs.Mkdir("no_underscores", 0755, nil), fuse.EPERM)
+
+	if names := listNames(t, fs, ""); strings.Join(names, ",") != "data,newcontainer" {
+		t.Errorf("OpenDir: expected [data newcontainer] got %v", names)
+	}
+
+	attr, status := fs.GetAttr("newcontainer", nil)
+	if status != fuse.OK || attr.Mode&fuse.S_IFDIR == 0 {
+		t.Errorf("GetAttr: expected directory got %v %v", attr, status)
+	}
+
+	// Invalid names are not looked up in storage.
+	backend.failWith(nil)
+	expectStatus(t, "GetAttr invalid name", statusOf(fs.GetAttr("a/b", nil)), fuse.ENOENT)
+	expectStatus(t, "Rmdir invalid name", fs.Rmdir("ab", nil), fuse.ENOENT)
+	if n := backend.callCount(); n != 0 {
+		t.Errorf("Invalid names were looked up: %v", backend.calls)
+	}
+
+	putBlob(t, backend.backend, "newcontainer", "foo", "content")
+	expectStatus(t, "Rmdir not empty", fs.Rmdir("newcontainer", nil), fuse.Status(syscall.ENOTEMPTY))
+
+	if err := backend.backend.DeleteBlob("newcontainer", "foo", "", "", false); err != nil {
+		t.Fatal(err)
+	}
+	expectStatus(t, "Rmdir", fs.Rmdir("newcontainer", nil), fuse.OK)
+	expectStatus(t, "GetAttr removed", statusOf(fs.GetAttr("newcontainer", nil)), fuse.ENOENT)
+	expectStatus(t, "Rmdir removed", fs.Rmdir("newcontainer", nil), fuse.ENOENT)
+}
+
+func testConformanceFiles(t *testing.T, c fsConformance) {
+	backend := newTestBackend(t)
+	fs := c.newFs(backend, Options{})
+
+	// touch foo
+	expectStatus(t, "Mknod", fs.Mknod(c.file("foo"), fuse.S_IFREG|0644, 0, nil), fuse.OK)
+	expectStatus(t, "Utimens", fs.Utimens(c.file("foo"), nil, nil, nil), fuse.OK)
+
+	attr, status := fs.GetAttr(c.file("foo"), nil)
+	if status != fuse.OK || attr.Mode&fuse.S_IFREG == 0 || attr.Size != 0 {
+		t.Errorf("GetAttr: expected empty file got %v %v", attr, status)
+	}
+
+	if names := listNames(t, fs, ""); strings.Join(names, ",") != c.file("foo") {
+		t.Errorf("OpenDir: expected [foo] got %v", names)
+	}
+
+	expectStatus(t, "Mkdir", fs.Mkdir("dir", 0755, nil), fuse.ENOSYS)
+	expectStatus(t, "Rmdir", fs.Rmdir(c.file("foo"), nil), fuse.ENOSYS)
+
+	// rm foo
+	expectStatus(t, "Unlink", fs.Unlink(c.file("foo"), nil), fuse.OK)
+	expectStatus(t, "GetAttr removed", statusOf(fs.GetAttr(c.file("foo"), nil)), fuse.ENOENT)
+	expectStatus(t, "Unlink removed", fs.Unlink(c.file("foo"), nil), fuse.OK)
+	expectStatus(t, "Open removed", statusOf(fs.Open(c.file("foo"), uint32(syscall.O_RDONLY), nil)), fuse.ENOENT)
+
+	if names := listNames(t, fs, ""); len(names) != 0 {
+		t.Errorf("OpenDir: expected nothing got %v", names)
+	}
+
+	// Blobs with a lease can't be removed.
+	putBlob(t, backend.backend, conformanceContainer, "leased", "content")
+	if _, err := backend.backend.AcquireLease(conformanceContainer, "leased", -1, ""); err != nil {
+		t.Fatal(err)
+	}
+	expectStatus(t, "Unlink leased", fs.Unlink(c.file("leased"), nil), fuse.EBUSY)
+}
+
+func testConformanceReadWrite(t *testing.T, c fsConformance) {
+	backend := newTestBackend(t)
+	fs := c.newFs(backend, Options{})
+
+	expectStatus(t, "Mknod", fs.Mknod(c.file("foo"), fuse.S_IFREG|0644, 0, nil), fuse.OK)
+
+	writeFile(t, fs, c.file("foo"), "hello world\n")
+	if got := readFile(t, fs, c.file("foo")); got != "hello world\n" {
+		t.Errorf("Read: expected 'hello world' got '%s'", got)
+	}
+
+	attr, status := fs.GetAttr(c.file("foo"), nil)
+	if status != fuse.OK || attr.Size != 12 {
+		t.Errorf("GetAttr: expected size 12 got %v %v", attr, status)
+	}
+
+	// echo more >> foo
+	f, status := fs.Open(c.file("foo"), uint32(syscall.O_WRONLY|syscall.O_APPEND), nil)
+	if status != fuse.OK {
+		t.Fatalf("Open for appending: %v", status)
+	}
+	f.Write([]byte("more\n"), 12)
+	expectStatus(t, "Flush", f.Flush(), fuse.OK)
+	f.Release()
+
+	if got := readFile(t, fs, c.file("foo")); got != "hello world\nmore\n" {
+		t.Errorf("Read: expected appended content got '%s'", got)
+	}
+
+	// truncate -s 5 foo
+	expectStatus(t, "Truncate", fs.Truncate(c.file("foo"), 5, nil), fuse.OK)
+	if got := readFile(t, fs, c.file("foo")); got != "hello" {
+		t.Errorf("Read: expected 'hello' got '%s'", got)
+	}
+
+	writeFile(t, fs, c.file("foo"), "")
+	if got := readFile(t, fs, c.file("foo")); got != "" {
+		t.Errorf("Read: expected nothing got '%s'", got)
+	}
+
+	// Writes to files opened for reading fail.
+	f, status = fs.Open(c.file("foo"), uint32(syscall.O_RDONLY), nil)
+	if status != fuse.OK {
+		t.Fatalf("Open for reading: %v", status)
+	}
+	_, status = f.Write([]byte("nope"), 0)
+	expectStatus(t, "Write to read-only handle", status, fuse.EBADF)
+	f.Release()
+}
+
+// conformanceBlobNames are blob names which need care to be shown as files.
+var conformanceBlobNames = []string{
+	"plain",
+	"with space",
+	"/usr/bin/ls",
+	"dir/",
+	"trailing.",
+	"100%",
+	"a+b",
+	"q?x=1&y=2",
+	"#hash",
+	"~tilde",
+	"back\\slash",
+	"quote'\"",
+	"tab\tnewline\n",
+	"日本語のファイル",
+	"emoji 🙂",
+	"...",
+	".",
+	"..",
+	".snapshots",
+	".trash",
+	strings.Repeat("long/name ", maxBlobNameLen/10),
+	strings.Repeat("x", maxBlobNameLen),
+}
+
+func testConformanceEscaping(t *testing.T, c fsConformance) {
+	backend := newTestBackend(t)
+	fs := c.newFs(backend, Options{})
+
+	// Use the length of the content to tell which blob a file is.
+	for i, blobName := range conformanceBlobNames {
+		putBlob(t, backend.backend, conformanceContainer, blobName, strings.Repeat("x", i+1))
+	}
+
+	names := listNames(t, fs, "")
+	if len(names) != len(conformanceBlobNames) {
+		t.Errorf("OpenDir: expected %d files got %d: %q", len(conformanceBlobNames), len(names), names)
+	}
+
+	seen := make(map[int]string)
+	for _, name := range names {
+		if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\x00") || len(name) > maxNameLen {
+			t.Errorf("OpenDir: invalid file name %q", name)
+			continue
+		}
+
+		attr, status := fs.GetAttr(name, nil)
+		if status != fuse.OK {
+			t.Errorf("GetAttr %q: %v", name, status)
+			continue
+		}
+
+		i := int(attr.Size) - 1
+		if other, ok := seen[i]; ok {
+			t.Errorf("Files %q and %q are the same blob", other, name)
+		}
+		seen[i] = name
+	}
+
+	// Files created through the file system round trip to the same blob names.
+	for i, blobName := range conformanceBlobNames {
+		name, ok := seen[i]
+		if !ok {
+			t.Errorf("Blob %q is not listed", blobName)
+			continue
+		}
+
+		if xattr, status := fs.GetXAttr(name, xattrBlobName, nil); status != fuse.OK || string(xattr) != blobName {
+			t.Errorf("GetXAttr %q: expected %q got %q %v", name, blobName, xattr, status)
+		}
+
+		expectStatus(t, "Unlink "+name, fs.Unlink(name, nil), fuse.OK)
+		expectStatus(t, "Mknod "+name, fs.Mknod(name, fuse.S_IFREG|0644, 0, nil), fuse.OK)
+
+		if _, err := backend.backend.GetBlobProperties(conformanceContainer, blobName); err != nil {
+			t.Errorf("File %q did not map back to blob %q: %s", name, blobName, err)
+		}
+	}
+}
@@ -5,13 +5,13 @@ import (
 	"log"
 	"os"
 	"regexp"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/hanwen/go-fuse/fuse"
 	"github.com/hanwen/go-fuse/fuse/nodefs"
 	"github.com/hanwen/go-fuse/fuse/pathfs"
-	"github.com/ppanyukov/azure-sdk-for-go/storage"
 )
 
 // TODO(ppanyukov): performance, caching etc, once we have stuff working :)
@@ -30,17 +30,24 @@ func isInvalidContainerName(name string) bool {
 	return !validContainerRegex.MatchString(name)
 }
 
+// rmdirLeaseDuration is how long in seconds Rmdir leases a container for.
+// Short, so that the container is not stuck if we die in between.
+const rmdirLeaseDuration = 15
+
 // NewContainerFs creates a filesystem that lists containers as directories.
-func NewContainerFs(storageClient storage.Client) pathfs.FileSystem {
+func NewContainerFs(backend Backend, options Options) pathfs.FileSystem {
 	logPrefix := fmt.Sprintf("[containerfs]: ")
 
 	result := containerFs{
-		client: storageClient.GetBlobService(),
-		log:    log.New(os.Stderr, logPrefix, log.LstdFlags),
-		defaultListContainersParameters: storage.ListContainersParameters{},
+		backend: backend,
+		options: options,
+		log:     log.New(os.Stderr, logPrefix, log.LstdFlags),
 		defaultFuseAttr: fuse.Attr{
 			Mode: fuse.S_IFDIR | 0755,
 		},
+		defaultStatfsOut: fuse.StatfsOut{
+			NameLen: maxNameLen,
+		},
 	}
 
 	return &result
@@ -48,10 +55,11 @@ func NewContainerFs(storageClient storage.Client) pathfs.FileSystem {
 
 // containerFs implements a FileSystem that returns blob container names as directories.
 type containerFs struct {
-	client                          storage.BlobStorageClient
-	defaultListContainersParameters storage.ListContainersParameters
-	defaultFuseAttr                 fuse.Attr
-	log                             *log.Logger
+	backend          Backend
+	options          Options
+	defaultFuseAttr  fuse.Attr
+	defaultStatfsOut fuse.StatfsOut
+	log              *log.Logger
 }
 
 func (fs *containerFs) SetDebug(debug bool) {}
@@ -72,11 +80,11 @@ func (fs *containerFs) GetAttr(name string, context *fuse.Context) (*fuse.Attr,
 		return nil, fuse.ENOENT
 	}
 
-	exists, err := fs.client.ContainerExists(name)
+	exists, err := fs.storage(context).ContainerExists(name)
 
 	if err != nil {
 		fs.log.Printf("[ERROR] GetAttr '%s': %s\n", name, err)
-		return nil, fuse.EIO
+		return nil, statusFromError(err)
 	}
 
 	if exists {
@@ -87,18 +95,70 @@ func (fs *containerFs) GetAttr(name string, context *fuse.Context) (*fuse.Attr,
 }
 
 func (fs *containerFs) GetXAttr(name string, attr string, context *fuse.Context) ([]byte, fuse.Status) {
-	return nil, fuse.ENOSYS
+	// The lease state of the container, e.g. to see why rmdir is busy:
+	// `getfattr -n user.azurefs.lease mycontainer`
+	if name == "" || attr != xattrLease {
+		return nil, fuse.Status(syscall.ENODATA)
+	}
+
+	if isInvalidContainerName(name) {
+		return nil, fuse.ENOENT
+	}
+
+	containers, err := fs.storage(context).ListContainers(name)
+	if err != nil {
+		fs.log.Printf("[ERROR] GetXAttr '%s': %s\n", name, err)
+		return nil, statusFromError(err)
+	}
+
+	for _, container := range containers {
+		if container.Name == name {
+			return []byte(container.LeaseState), fuse.OK
+		}
+	}
+	return nil, fuse.ENOENT
 }
 
 func (fs *containerFs) SetXAttr(name string, attr string, data []byte, flags int, context *fuse.Context) fuse.Status {
-	return fuse.ENOSYS
+	if fs.options.ReadOnly {
+		return fuse.EROFS
+	}
+
+	if name == "" || attr != xattrLease {
+		return fuse.ENOSYS
+	}
+
+	// Breaking is all that can be done, e.g. when whoever holds the
+	// lease is gone: `setfattr -n user.azurefs.lease -v break mycontainer`
+	if strings.TrimSpace(string(data)) != "break" {
+		return fuse.EINVAL
+	}
+
+	if isInvalidContainerName(name) {
+		return fuse.ENOENT
+	}
+
+	err := fs.storage(context).BreakContainerLease(name)
+	if err != nil {
+		fs.log.Printf("[ERROR] SetXAttr '%s': Could not break lease. %s\n", name, err)
+		return statusFromError(err)
+	}
+	return fuse.OK
 }
 
 func (fs *containerFs) ListXAttr(name string, context *fuse.Context) ([]string, fuse.Status) {
-	return nil, fuse.ENOSYS
+	if name == "" {
+		return nil, fuse.OK
+	}
+
+	return []string{xattrLease}, fuse.OK
 }
 
 func (fs *containerFs) RemoveXAttr(name string, attr string, context *fuse.Context) fuse.Status {
+	if fs.options.ReadOnly {
+		return fuse.EROFS
+	}
+
 	return fuse.ENOSYS
 }
 
@@ -107,79 +167,155 @@ func (fs *containerFs) Readlink(name string, context *fuse.Context) (string, fus
 }
 
 func (fs *containerFs) Mknod(name string, mode uint32, dev uint32, context *fuse.Context) fuse.Status {
+	if fs.options.ReadOnly {
+		return fuse.EROFS
+	}
+
 	return fuse.ENOSYS
 }
 
 func (fs *containerFs) Mkdir(name string, mode uint32, context *fuse.Context) fuse.Status {
+	if fs.options.ReadOnly {
+		return fuse.EROFS
+	}
+
 	// Can create containers at the root level
 	if isInvalidContainerName(name) {
 		fs.log.Printf("[ERROR] Mkdir '%s': This container name is not valid.\n", name)
 		return fuse.EPERM
 	}
 
-	err := fs.client.CreateContainer(name, storage.ContainerAccessTypePrivate)
+	err := fs.storage(context).CreateContainer(name)
 	if err != nil {
 		fs.log.Printf("[ERROR] Mkdir '%s': %s\n", name, err)
-		return fuse.EIO
+		return statusFromError(err)
 	}
 	return fuse.OK
 }
 
 func (fs *containerFs) Unlink(name string, context *fuse.Context) (code fuse.Status) {
+	if fs.options.ReadOnly {
+		return fuse.EROFS
+	}
+
 	return fuse.ENOSYS
 }
 
 func (fs *containerFs) Rmdir(name string, context *fuse.Context) (code fuse.Status) {
+	if fs.options.ReadOnly {
+		return fuse.EROFS
+	}
+
 	if isInvalidContainerName(name) {
 		return fuse.ENOENT
 	}
 
-	// Check if empty container
-	blobListResponse, err := fs.client.ListBlobs(name, storage.ListBlobsParameters{MaxResults: 1})
+	if status := fs.checkEmpty(name, context); status != fuse.OK {
+		return status
+	}
+
+	// Lease the container so that nobody else can delete or lease it and
+	// check again, blobs may have been written since. Leases don't stop
+	// blobs being written, but that leaves only the time to the delete.
+	// Backends without container leases only get the first check.
+	leaseID, err := fs.storage(context).AcquireContainerLease(name, rmdirLeaseDuration, "")
+	if statusFromError(err) == fuse.ENOSYS {
+		leaseID = ""
+	} else if err != nil {
+		fs.log.Printf("[ERROR] Rmdir '%s': Could not lease container. %s\n", name, err)
+		return statusFromError(err)
+	} else if status := fs.checkEmpty(name, context); status != fuse.OK {
+		fs.releaseLease(name, leaseID, context)
+		return status
+	}
+
+	err = fs.storage(context).DeleteContainer(name, leaseID)
+	if err != nil {
+		fs.log.Printf("[ERROR] Rmdir '%s': %s'\n", name, err)
+		if leaseID != "" {
+			fs.releaseLease(name, leaseID, context)
+		}
+		return statusFromError(err)
+	}
+	return fuse.OK
+}
+
+// checkEmpty returns ENOTEMPTY unless the container has no blobs.
+func (fs *containerFs) checkEmpty(name string, context *fuse.Context) fuse.Status {
+	blobs, err := fs.storage(context).ListBlobs(name, ListBlobsParameters{MaxResults: 1})
 	if err != nil {
 		fs.log.Printf("[ERROR] Rmdir '%s': %s'\n", name, err)
-		return fuse.EIO
+		return statusFromError(err)
 	}
 
-	if len(blobListResponse.Blobs) > 0 {
+	if len(blobs) > 0 {
 		// TODO(ppanyukov): why fuse lib doesn't have ENOTEMPTY?
 		return fuse.Status(syscall.ENOTEMPTY)
 	}
+	return fuse.OK
+}
 
-	err = fs.client.DeleteContainer(name)
-	if err != nil {
-		fs.log.Printf("[ERROR] Rmdir '%s': %s'\n", name, err)
-		return fuse.EIO
+// releaseLease releases the lease taken by Rmdir when not deleting after all.
+func (fs *containerFs) releaseLease(name string, leaseID string, context *fuse.Context) {
+	if err := fs.storage(context).ReleaseContainerLease(name, leaseID); err != nil {
+		fs.log.Printf("[ERROR] Rmdir '%s': Could not release lease. %s\n", name, err)
 	}
-	return fuse.OK
 }
 
 func (fs *containerFs) Symlink(value string, linkName string, context *fuse.Context) (code fuse.Status) {
+	if fs.options.ReadOnly {
+		return fuse.EROFS
+	}
+
 	return fuse.ENOSYS
 }
 
 func (fs *containerFs) Rename(oldName string, newName string, context *fuse.Context) (code fuse.Status) {
 	// renaming containers is not directly supported
+	if fs.options.ReadOnly {
+		return fuse.EROFS
+	}
+
 	return fuse.ENOSYS
 }
 
 func (fs *containerFs) Link(oldName string, newName string, context *fuse.Context) (code fuse.Status) {
+	if fs.options.ReadOnly {
+		return fuse.EROFS
+	}
+
 	return fuse.ENOSYS
 }
 
 func (fs *containerFs) Chmod(name string, mode uint32, context *fuse.Context) (code fuse.Status) {
+	if fs.options.ReadOnly {
+		return fuse.EROFS
+	}
+
 	return fuse.ENOSYS
 }
 
 func (fs *containerFs) Chown(name string, uid uint32, gid uint32, context *fuse.Context) (code fuse.Status) {
+	if fs.options.ReadOnly {
+		return fuse.EROFS
+	}
+
 	return fuse.ENOSYS
 }
 
 func (fs *containerFs) Truncate(name string, offset uint64, context *fuse.Context) (code fuse.Status) {
+	if fs.options.ReadOnly {
+		return fuse.EROFS
+	}
+
 	return fuse.ENOSYS
 }
 
 func (fs *containerFs) Open(name string, flags uint32, context *fuse.Context) (file nodefs.File, code fuse.Status) {
+	if fs.options.ReadOnly && isWriteOpen(flags) {
+		return nil, fuse.EROFS
+	}
+
 	return nil, fuse.ENOSYS
 }
 
@@ -188,14 +324,13 @@ func (fs *containerFs) OpenDir(name string, context *fuse.Context) (stream []fus
 		return []fuse.DirEntry(nil), fuse.OK
 	}
 
-	res, err := fs.client.ListContainers(fs.defaultListContainersParameters)
+	containers, err := fs.storage(context).ListContainers("")
 	if err != nil {
 		fs.log.Printf("[ERROR] OpenDir '%s': %s'\n", name, err)
-		return nil, fuse.EIO
+		return nil, statusFromError(err)
 	}
 
-	containers := res.Containers
-	stream = make([]fuse.DirEntry, len(res.Containers))
+	stream = make([]fuse.DirEntry, len(containers))
 	for i, container := range containers {
 		stream[i] = fuse.DirEntry{
 			Mode: fuse.S_IFDIR | 0755,
@@ -206,6 +341,12 @@ func (fs *containerFs) OpenDir(name string, context *fuse.Context) (stream []fus
 	return stream, fuse.OK
 }
 
+// storage returns the backend for the calls made by the operation with
+// context, see backendFor.
+func (fs *containerFs) storage(context *fuse.Context) Backend {
+	return backendFor(fs.backend, context)
+}
+
 func (fs *containerFs) OnMount(nodeFs *pathfs.PathNodeFs) {
 }
 
@@ -214,14 +355,26 @@ func (fs *containerFs) OnUnmount() {
 
 func (fs *containerFs) Access(name string, mode uint32, context *fuse.Context) (code fuse.Status) {
 	// TODO(ppanyukov): what is the meaningful implementation for this?
+	if fs.options.ReadOnly && mode&accessWrite != 0 {
+		return fuse.EROFS
+	}
+
 	return fuse.OK
 }
 
 func (fs *containerFs) Create(name string, flags uint32, mode uint32, context *fuse.Context) (file nodefs.File, code fuse.Status) {
+	if fs.options.ReadOnly {
+		return nil, fuse.EROFS
+	}
+
 	return nil, fuse.ENOSYS
 }
 
 func (fs *containerFs) Utimens(name string, Atime *time.Time, Mtime *time.Time, context *fuse.Context) (code fuse.Status) {
+	if fs.options.ReadOnly {
+		return fuse.EROFS
+	}
+
 	return fuse.ENOSYS
 }
 
@@ -229,6 +382,9 @@ func (fs *containerFs) String() string {
 	return "containerFs"
 }
 
+// StatFs reports no capacity as there is no such thing in blob storage.
+// Note that statfs gets ST_RDONLY from the mount flags rather than from
+// here, which is why read-only mounts pass "ro" to the kernel too.
 func (fs *containerFs) StatFs(name string) *fuse.StatfsOut {
-	return nil
+	return &fs.defaultStatfsOut
 }
@@ -0,0 +1,76 @@
+package blobfs
+
+import (
+	"io/ioutil"
+	"log"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// racingBackend writes a blob into containers as soon as they are leased,
+// as if someone did between the first emptiness check of Rmdir and the lease.
+type racingBackend struct {
+	*testBackend
+}
+
+func (b racingBackend) AcquireContainerLease(container string, duration int, proposedLeaseID string) (string, error) {
+	leaseID, err := b.testBackend.AcquireContainerLease(container, duration, proposedLeaseID)
+	if err == nil {
+		_, err = b.backend.CreateBlockBlob(container, "late", "", "")
+	}
+	return leaseID, err
+}
+
+// noContainerLeasesBackend is like the SDK backend which can't lease containers.
+type noContainerLeasesBackend struct {
+	*testBackend
+}
+
+func (b noContainerLeasesBackend) AcquireContainerLease(container string, duration int, proposedLeaseID string) (string, error) {
+	return "", errNotImplemented("Lease Container")
+}
+
+func TestContainerFsRmdirLease(t *testing.T) {
+	backend := newTestBackend(t)
+	fs := NewContainerFs(backend, Options{}).(*containerFs)
+	fs.log = log.New(ioutil.Discard, "", 0)
+
+	lease := func(name string) string {
+		state, status := fs.GetXAttr(name, xattrLease, nil)
+		expectStatus(t, "GetXAttr "+name, status, fuse.OK)
+		return string(state)
+	}
+
+	// Someone else leased it, e.g. another rmdir in progress.
+	expectStatus(t, "Mkdir", fs.Mkdir("leased", 0755, nil), fuse.OK)
+	if _, err := backend.backend.AcquireContainerLease("leased", -1, ""); err != nil {
+		t.Fatal(err)
+	}
+	expectStatus(t, "Rmdir leased", fs.Rmdir("leased", nil), fuse.EBUSY)
+	if state := lease("leased"); state != leaseStateLeased {
+		t.Errorf("Expected %q got %q", leaseStateLeased, state)
+	}
+
+	expectStatus(t, "SetXAttr nonsense", fs.SetXAttr("leased", xattrLease, []byte("steal"), 0, nil), fuse.EINVAL)
+	expectStatus(t, "SetXAttr break", fs.SetXAttr("leased", xattrLease, []byte("break"), 0, nil), fuse.OK)
+	if state := lease("leased"); state != leaseStateAvailable {
+		t.Errorf("Expected %q got %q", leaseStateAvailable, state)
+	}
+	expectStatus(t, "Rmdir after break", fs.Rmdir("leased", nil), fuse.OK)
+
+	// A blob written after the first check is caught by the second one.
+	racing := NewContainerFs(racingBackend{backend}, Options{}).(*containerFs)
+	racing.log = fs.log
+	expectStatus(t, "Mkdir", fs.Mkdir("racing", 0755, nil), fuse.OK)
+	expectStatus(t, "Rmdir racing", racing.Rmdir("racing", nil), fuse.Status(syscall.ENOTEMPTY))
+	if state := lease("racing"); state != leaseStateAvailable {
+		t.Errorf("Lease not released after ENOTEMPTY: %q", state)
+	}
+
+	// Without container leases rmdir still works.
+	noLeases := NewContainerFs(noContainerLeasesBackend{backend}, Options{})
+	expectStatus(t, "Mkdir", fs.Mkdir("noleases", 0755, nil), fuse.OK)
+	expectStatus(t, "Rmdir no leases", noLeases.Rmdir("noleases", nil), fuse.OK)
+}
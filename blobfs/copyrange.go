@@ -0,0 +1,194 @@
+package blobfs
+
+// copy_file_range(2) between two files of the mount, which is what cp uses
+// where it can, goes to blobFile.CopyFrom so that blobs are copied by the
+// storage service. Files it can't find, such as those of other file
+// systems, make it fail with EXDEV and cp falls back to reading and
+// writing. ENOSYS would keep the kernel from ever asking again.
+//
+// FUSE only gives the file handles, and nodefs has no way to get from
+// those to files. So the files are taken as the path file system opens
+// them, and given their handle when the open replies with it. The two are
+// told apart from other opens by the cancel channel of the request, which
+// is its own for each.
+
+import (
+	"sync"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+)
+
+// CopyFileRange hands copy_file_range between files opened through
+// FileSystem to the file copied to, see RawFileSystem.
+type CopyFileRange struct {
+	mu sync.Mutex
+
+	// opening has the files opened by requests still waiting for their
+	// handle, by the cancel channel of the request.
+	opening map[<-chan struct{}]nodefs.File
+
+	// files has the open files by handle, until released.
+	files map[uint64]nodefs.File
+}
+
+// NewCopyFileRange returns a CopyFileRange with no files open yet.
+func NewCopyFileRange() *CopyFileRange {
+	return &CopyFileRange{
+		opening: make(map[<-chan struct{}]nodefs.File),
+		files:   make(map[uint64]nodefs.File),
+	}
+}
+
+// FileSystem wraps fs to take the files as they are opened.
+func (c *CopyFileRange) FileSystem(fs pathfs.FileSystem) pathfs.FileSystem {
+	return &copyFileRangeFs{
+		FileSystem: fs,
+		copies:     c,
+	}
+}
+
+// RawFileSystem wraps the raw file system of the mount, made from
+// FileSystem, to handle CopyFileRange.
+func (c *CopyFileRange) RawFileSystem(raw fuse.RawFileSystem) fuse.RawFileSystem {
+	return &copyFileRangeRawFs{
+		RawFileSystem: raw,
+		copies:        c,
+	}
+}
+
+// opened takes file as opened by the request with context, if it's a blob.
+func (c *CopyFileRange) opened(file nodefs.File, context *fuse.Context) {
+	if innerBlobFile(file) == nil || context == nil || context.Cancel == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.opening[context.Cancel] = file
+}
+
+// handled gives the file opened by the request with cancel its handle, or
+// forgets it if the open failed.
+func (c *CopyFileRange) handled(cancel <-chan struct{}, fh uint64, status fuse.Status) {
+	if cancel == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	f, ok := c.opening[cancel]
+	delete(c.opening, cancel)
+	if ok && status == fuse.OK {
+		c.files[fh] = f
+	}
+}
+
+func (c *CopyFileRange) file(fh uint64) nodefs.File {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.files[fh]
+}
+
+func (c *CopyFileRange) released(fh uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.files, fh)
+}
+
+// writeGuard is implemented by wrappers of files which can turn away
+// writes, such as those of Shutdown.
+type writeGuard interface {
+	startWrite() (done func(), status fuse.Status)
+}
+
+// startWrite asks the wrappers of file to let a write to it through.
+func startWrite(file nodefs.File) (done func(), status fuse.Status) {
+	for ; file != nil; file = file.InnerFile() {
+		if g, ok := file.(writeGuard); ok {
+			return g.startWrite()
+		}
+	}
+	return func() {}, fuse.OK
+}
+
+// innerBlobFile finds the blobFile in file wrapped by tracing and metrics.
+func innerBlobFile(file nodefs.File) *blobFile {
+	for file != nil {
+		if f, ok := file.(*blobFile); ok {
+			return f
+		}
+		file = file.InnerFile()
+	}
+	return nil
+}
+
+// copyFileRangeFs takes the files opened. Everything else goes straight to
+// the embedded file system.
+type copyFileRangeFs struct {
+	pathfs.FileSystem
+	copies *CopyFileRange
+}
+
+func (fs *copyFileRangeFs) Open(name string, flags uint32, context *fuse.Context) (file nodefs.File, code fuse.Status) {
+	file, status := fs.FileSystem.Open(name, flags, context)
+	if status == fuse.OK {
+		fs.copies.opened(file, context)
+	}
+	return file, status
+}
+
+func (fs *copyFileRangeFs) Create(name string, flags uint32, mode uint32, context *fuse.Context) (file nodefs.File, code fuse.Status) {
+	file, status := fs.FileSystem.Create(name, flags, mode, context)
+	if status == fuse.OK {
+		fs.copies.opened(file, context)
+	}
+	return file, status
+}
+
+// copyFileRangeRawFs gives the files their handles and handles
+// CopyFileRange. Everything else goes straight to the embedded file system.
+type copyFileRangeRawFs struct {
+	fuse.RawFileSystem
+	copies *CopyFileRange
+}
+
+func (fs *copyFileRangeRawFs) Open(cancel <-chan struct{}, input *fuse.OpenIn, out *fuse.OpenOut) fuse.Status {
+	status := fs.RawFileSystem.Open(cancel, input, out)
+	fs.copies.handled(cancel, out.Fh, status)
+	return status
+}
+
+func (fs *copyFileRangeRawFs) Create(cancel <-chan struct{}, input *fuse.CreateIn, name string, out *fuse.CreateOut) fuse.Status {
+	status := fs.RawFileSystem.Create(cancel, input, name, out)
+	fs.copies.handled(cancel, out.Fh, status)
+	return status
+}
+
+func (fs *copyFileRangeRawFs) Release(cancel <-chan struct{}, input *fuse.ReleaseIn) {
+	// Before the handle can be given to another file.
+	fs.copies.released(input.Fh)
+	fs.RawFileSystem.Release(cancel, input)
+}
+
+func (fs *copyFileRangeRawFs) CopyFileRange(cancel <-chan struct{}, input *fuse.CopyFileRangeIn) (uint32, fuse.Status) {
+	out := fs.copies.file(input.FhOut)
+	src, dst := innerBlobFile(fs.copies.file(input.FhIn)), innerBlobFile(out)
+	if src == nil || dst == nil {
+		return 0, fuse.Status(syscall.EXDEV)
+	}
+
+	done, status := startWrite(out)
+	if status != fuse.OK {
+		return 0, status
+	}
+	defer done()
+	written, status := dst.CopyFrom(src, int64(input.OffIn), int64(input.OffOut), int64(input.Len))
+	return uint32(written), status
+}
@@ -0,0 +1,282 @@
+package blobfs
+
+import (
+	"io/ioutil"
+	"log"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+)
+
+// openBlobFile opens name in fs and returns the blobFile behind it.
+func openBlobFile(t *testing.T, fs pathfs.FileSystem, name string, flags int) *blobFile {
+	f, status := fs.Open(name, uint32(flags), nil)
+	if status != fuse.OK {
+		t.Fatalf("Open '%s': %v", name, status)
+	}
+	return f.(*blobFile)
+}
+
+func countCalls(backend *testBackend, op string) int {
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+
+	n := 0
+	for _, call := range backend.calls {
+		if call == op {
+			n++
+		}
+	}
+	return n
+}
+
+func TestBlobFileCopyFrom(t *testing.T) {
+	backend := newTestBackend(t)
+	putBlob(t, backend.backend, conformanceContainer, "foo", "original")
+	putBlob(t, backend.backend, conformanceContainer, "digits", "0123456789")
+
+	fs := NewFlatBlobFs(conformanceContainer, backend, Options{}).(*flatblobFs)
+	fs.log = log.New(ioutil.Discard, "", 0)
+
+	src := openBlobFile(t, fs, "foo", syscall.O_RDONLY)
+	defer src.Release()
+
+	// cp into a new file copies the whole blob server-side, then finds
+	// there is nothing left.
+	expectStatus(t, "Mknod", fs.Mknod("copy", fuse.S_IFREG|0644, 0, nil), fuse.OK)
+	dst := openBlobFile(t, fs, "copy", syscall.O_WRONLY|syscall.O_TRUNC)
+	if n, status := dst.CopyFrom(src, 0, 0, 1<<30); n != 8 || status != fuse.OK {
+		t.Errorf("CopyFrom: expected 8 got %d %v", n, status)
+	}
+	if n, status := dst.CopyFrom(src, 8, 8, 1<<30); n != 0 || status != fuse.OK {
+		t.Errorf("CopyFrom at the end: expected 0 got %d %v", n, status)
+	}
+	if countCalls(backend, "CopyBlob") != 1 {
+		t.Errorf("CopyFrom: expected a CopyBlob call, got %q", backend.calls)
+	}
+	var attr fuse.Attr
+	if dst.GetAttr(&attr); attr.Size != 8 {
+		t.Errorf("GetAttr after CopyFrom: expected size 8 got %d", attr.Size)
+	}
+	expectStatus(t, "Flush", dst.Flush(), fuse.OK)
+	dst.Release()
+
+	if countCalls(backend, "PutBlock") != 0 {
+		t.Errorf("Flush after CopyFrom: expected no upload, got %q", backend.calls)
+	}
+	if got := readFile(t, fs, "copy"); got != "original" {
+		t.Errorf("Read copy: expected 'original' got '%s'", got)
+	}
+	value, _ := fs.GetXAttr("copy", xattrCopy, nil)
+	if string(value) != "success 8/8" {
+		t.Errorf("GetXAttr copy: expected 'success 8/8' got '%s'", value)
+	}
+	expectStatus(t, "GetXAttr copy of a written blob", statusOf(fs.GetXAttr("foo", xattrCopy, nil)), fuse.Status(syscall.ENODATA))
+
+	// Writing after a server-side copy changes the copy.
+	dst = openBlobFile(t, fs, "copy", syscall.O_WRONLY|syscall.O_TRUNC)
+	dst.CopyFrom(src, 0, 0, 8)
+	if n, status := dst.Write([]byte("!"), 8); n != 1 || status != fuse.OK {
+		t.Errorf("Write after CopyFrom: wrote %d %v", n, status)
+	}
+	expectStatus(t, "Flush after Write", dst.Flush(), fuse.OK)
+	dst.Release()
+	if got := readFile(t, fs, "copy"); got != "original!" {
+		t.Errorf("Read copy after Write: expected 'original!' got '%s'", got)
+	}
+
+	// Parts of blobs are copied through here.
+	copies := countCalls(backend, "CopyBlob")
+	dst = openBlobFile(t, fs, "digits", syscall.O_WRONLY)
+	if n, status := dst.CopyFrom(src, 2, 4, 3); n != 3 || status != fuse.OK {
+		t.Errorf("CopyFrom part: expected 3 got %d %v", n, status)
+	}
+	expectStatus(t, "Flush part", dst.Flush(), fuse.OK)
+	dst.Release()
+	if got := readFile(t, fs, "digits"); got != "0123igi789" {
+		t.Errorf("Read after CopyFrom part: expected '0123igi789' got '%s'", got)
+	}
+	if countCalls(backend, "CopyBlob") != copies {
+		t.Errorf("CopyFrom part: expected no CopyBlob call, got %q", backend.calls)
+	}
+
+	// So is everything the storage service can't copy.
+	backend.err, backend.errOp = errNotImplemented("Copy Blob"), "CopyBlob"
+	dst = openBlobFile(t, fs, "copy", syscall.O_WRONLY|syscall.O_TRUNC)
+	n, status := dst.CopyFrom(src, 0, 0, 8)
+	backend.err, backend.errOp = nil, ""
+	if n != 8 || status != fuse.OK {
+		t.Errorf("CopyFrom without CopyBlob: expected 8 got %d %v", n, status)
+	}
+	expectStatus(t, "Flush without CopyBlob", dst.Flush(), fuse.OK)
+	dst.Release()
+	if got := readFile(t, fs, "copy"); got != "original" {
+		t.Errorf("Read copy without CopyBlob: expected 'original' got '%s'", got)
+	}
+}
+
+func TestBlobFileCopyFromRanges(t *testing.T) {
+	backend := newTestBackend(t)
+	putBlob(t, backend.backend, conformanceContainer, "foo", "original")
+
+	fs := NewFlatBlobFs(conformanceContainer, backend, Options{}).(*flatblobFs)
+	fs.log = log.New(ioutil.Discard, "", 0)
+
+	src := openBlobFile(t, fs, "foo", syscall.O_RDONLY)
+	defer src.Release()
+
+	// Blobs the kernel asks to copy a range at a time, such as those over
+	// 4GB, are copied block by block and committed at the end.
+	expectStatus(t, "Mknod", fs.Mknod("copy", fuse.S_IFREG|0644, 0, nil), fuse.OK)
+	dst := openBlobFile(t, fs, "copy", syscall.O_WRONLY|syscall.O_TRUNC)
+	if n, status := dst.CopyFrom(src, 0, 0, 5); n != 5 || status != fuse.OK {
+		t.Errorf("CopyFrom first range: expected 5 got %d %v", n, status)
+	}
+	var attr fuse.Attr
+	if dst.GetAttr(&attr); attr.Size != 5 {
+		t.Errorf("GetAttr after first range: expected size 5 got %d", attr.Size)
+	}
+	value, _ := fs.GetXAttr("copy", xattrCopy, nil)
+	if string(value) != "pending 5/8" {
+		t.Errorf("GetXAttr copy after first range: expected 'pending 5/8' got '%s'", value)
+	}
+	if n, status := dst.CopyFrom(src, 5, 5, 1<<30); n != 3 || status != fuse.OK {
+		t.Errorf("CopyFrom second range: expected 3 got %d %v", n, status)
+	}
+	value, _ = fs.GetXAttr("copy", xattrCopy, nil)
+	if string(value) != "success 8/8" {
+		t.Errorf("GetXAttr copy: expected 'success 8/8' got '%s'", value)
+	}
+	expectStatus(t, "Flush", dst.Flush(), fuse.OK)
+	dst.Release()
+
+	if countCalls(backend, "PutBlockFromURL") != 2 || countCalls(backend, "PutBlockList") != 1 {
+		t.Errorf("CopyFrom ranges: expected 2 PutBlockFromURL and 1 PutBlockList calls, got %q", backend.calls)
+	}
+	if countCalls(backend, "CopyBlob") != 0 || countCalls(backend, "PutBlock") != 0 {
+		t.Errorf("CopyFrom ranges: expected nothing copied through here, got %q", backend.calls)
+	}
+	if got := readFile(t, fs, "copy"); got != "original" {
+		t.Errorf("Read copy: expected 'original' got '%s'", got)
+	}
+	// The blob itself doesn't know it was copied.
+	expectStatus(t, "GetXAttr copy after Release", statusOf(fs.GetXAttr("copy", xattrCopy, nil)), fuse.Status(syscall.ENODATA))
+
+	// A copy which doesn't go on where it left off keeps what was copied
+	// and copies the rest through here.
+	dst = openBlobFile(t, fs, "copy", syscall.O_RDWR|syscall.O_TRUNC)
+	dst.CopyFrom(src, 0, 0, 3)
+	if n, status := dst.CopyFrom(src, 4, 4, 4); n != 4 || status != fuse.OK {
+		t.Errorf("CopyFrom elsewhere: expected 4 got %d %v", n, status)
+	}
+	if n, status := dst.CopyFrom(src, 3, 3, 1); n != 1 || status != fuse.OK {
+		t.Errorf("CopyFrom the gap: expected 1 got %d %v", n, status)
+	}
+	expectStatus(t, "Flush elsewhere", dst.Flush(), fuse.OK)
+	dst.Release()
+	if got := readFile(t, fs, "copy"); got != "original" {
+		t.Errorf("Read copy elsewhere: expected 'original' got '%s'", got)
+	}
+
+	// So is everything the storage service can't copy.
+	backend.err, backend.errOp = errNotImplemented("Put Block From URL"), "PutBlockFromURL"
+	dst = openBlobFile(t, fs, "copy", syscall.O_WRONLY|syscall.O_TRUNC)
+	n, status := dst.CopyFrom(src, 0, 0, 5)
+	backend.err, backend.errOp = nil, ""
+	if n != 5 || status != fuse.OK {
+		t.Errorf("CopyFrom without PutBlockFromURL: expected 5 got %d %v", n, status)
+	}
+	dst.CopyFrom(src, 5, 5, 3)
+	expectStatus(t, "Flush without PutBlockFromURL", dst.Flush(), fuse.OK)
+	dst.Release()
+	if got := readFile(t, fs, "copy"); got != "original" {
+		t.Errorf("Read copy without PutBlockFromURL: expected 'original' got '%s'", got)
+	}
+}
+
+func TestCopyFileRangeFs(t *testing.T) {
+	backend := newTestBackend(t)
+	putBlob(t, backend.backend, conformanceContainer, "foo", "original")
+
+	fs := NewFlatBlobFs(conformanceContainer, backend, Options{}).(*flatblobFs)
+	fs.log = log.New(ioutil.Discard, "", 0)
+	shutdown := NewShutdown()
+	copies := NewCopyFileRange()
+	conn := nodefs.NewFileSystemConnector(pathfs.NewPathNodeFs(copies.FileSystem(shutdown.FileSystem(fs)), nil).Root(), nil)
+	raw := copies.RawFileSystem(conn.RawFS())
+
+	// Every request has a cancel channel of its own.
+	open := func(name string, nodeID uint64, flags uint32) uint64 {
+		var out fuse.OpenOut
+		expectStatus(t, "Open "+name, raw.Open(make(chan struct{}), &fuse.OpenIn{InHeader: fuse.InHeader{NodeId: nodeID}, Flags: flags}, &out), fuse.OK)
+		return out.Fh
+	}
+
+	var src, dst fuse.EntryOut
+	expectStatus(t, "Lookup", raw.Lookup(nil, &fuse.InHeader{NodeId: fuse.FUSE_ROOT_ID}, "foo", &src), fuse.OK)
+	expectStatus(t, "Mknod", raw.Mknod(nil, &fuse.MknodIn{InHeader: fuse.InHeader{NodeId: fuse.FUSE_ROOT_ID}, Mode: fuse.S_IFREG | 0644}, "copy", &dst), fuse.OK)
+	srcFh := open("foo", src.NodeId, syscall.O_RDONLY)
+	dstFh := open("copy", dst.NodeId, syscall.O_WRONLY|syscall.O_TRUNC)
+
+	in := &fuse.CopyFileRangeIn{
+		InHeader:  fuse.InHeader{NodeId: src.NodeId},
+		FhIn:      srcFh,
+		NodeIdOut: dst.NodeId,
+		FhOut:     dstFh,
+		Len:       1 << 30,
+	}
+	if n, status := raw.CopyFileRange(nil, in); n != 8 || status != fuse.OK {
+		t.Errorf("CopyFileRange: expected 8 got %d %v", n, status)
+	}
+	expectStatus(t, "Flush", raw.Flush(nil, &fuse.FlushIn{InHeader: fuse.InHeader{NodeId: dst.NodeId}, Fh: dstFh}), fuse.OK)
+	if got := readFile(t, fs, "copy"); got != "original" {
+		t.Errorf("Read copy: expected 'original' got '%s'", got)
+	}
+	if countCalls(backend, "CopyBlob") != 1 {
+		t.Errorf("CopyFileRange: expected a CopyBlob call, got %q", backend.calls)
+	}
+
+	// Each handle of a file is its own.
+	secondFh := open("copy", dst.NodeId, syscall.O_WRONLY|syscall.O_TRUNC)
+	second := *in
+	second.FhOut = secondFh
+	if n, status := raw.CopyFileRange(nil, &second); n != 8 || status != fuse.OK {
+		t.Errorf("CopyFileRange second handle: expected 8 got %d %v", n, status)
+	}
+	if countCalls(backend, "CopyBlob") != 2 {
+		t.Errorf("CopyFileRange second handle: expected another CopyBlob call, got %q", backend.calls)
+	}
+
+	// Handles which aren't open here, such as those of other file systems,
+	// are left to the caller to copy.
+	unknown := *in
+	unknown.FhOut = 12345
+	_, status := raw.CopyFileRange(nil, &unknown)
+	expectStatus(t, "CopyFileRange unknown handle", status, fuse.Status(syscall.EXDEV))
+
+	raw.Release(nil, &fuse.ReleaseIn{InHeader: fuse.InHeader{NodeId: dst.NodeId}, Fh: secondFh})
+	_, status = raw.CopyFileRange(nil, &second)
+	expectStatus(t, "CopyFileRange released", status, fuse.Status(syscall.EXDEV))
+
+	// Opens which fail leave nothing behind.
+	if err := backend.backend.DeleteBlob(conformanceContainer, "foo", "", "", false); err != nil {
+		t.Fatalf("DeleteBlob: %s", err)
+	}
+	var out fuse.OpenOut
+	expectStatus(t, "Open deleted", raw.Open(make(chan struct{}), &fuse.OpenIn{InHeader: fuse.InHeader{NodeId: src.NodeId}}, &out), fuse.ENOENT)
+	if len(copies.opening) != 0 {
+		t.Errorf("Open deleted: expected no files waiting for a handle, got %d", len(copies.opening))
+	}
+
+	// Nothing is written once the mount is going away.
+	shutdown.Flush(time.Minute)
+	_, status = raw.CopyFileRange(nil, in)
+	expectStatus(t, "CopyFileRange after Shutdown.Flush", status, fuse.Status(syscall.ESHUTDOWN))
+	if countCalls(backend, "CopyBlob") != 2 {
+		t.Errorf("CopyFileRange after Shutdown.Flush: expected no CopyBlob call, got %q", backend.calls)
+	}
+}
@@ -0,0 +1,54 @@
+package blobfs
+
+import (
+	"net/http"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// statusFromError maps errors returned by the backend to the closest
+// errno, so that e.g. a SAS lacking a permission shows up as
+// "Permission denied" rather than a generic I/O error.
+func statusFromError(err error) fuse.Status {
+	if err == nil {
+		return fuse.OK
+	}
+
+	e, ok := err.(*StorageError)
+	if !ok {
+		return fuse.EIO
+	}
+
+	switch e.Code {
+	case errorCodeContainerAlreadyExists, errorCodeBlobAlreadyExists:
+		return fuse.Status(syscall.EEXIST)
+	case errorCodeContainerBeingDeleted, errorCodeLeaseIDMissing, errorCodeLeaseAlreadyPresent, errorCodeLeaseIDMismatchWrite:
+		// Someone else holds a lease, e.g. for a lock.
+		return fuse.EBUSY
+	case errorCodeLeaseNotPresentWrite:
+		// Our lease is gone, so is the lock it was for.
+		return fuse.Status(syscall.ENOLCK)
+	case errorCodeInvalidResourceName:
+		return fuse.EINVAL
+	case errorCodeConditionNotMet:
+		// Someone else changed the blob since we looked at it.
+		return fuse.Status(syscall.ESTALE)
+	}
+
+	switch e.StatusCode {
+	case http.StatusForbidden:
+		// AuthorizationPermissionMismatch, AuthorizationResourceTypeMismatch
+		// etc. This is what we get when a SAS does not grant the permission
+		// or does not cover the resource for the attempted operation.
+		return fuse.EACCES
+	case http.StatusNotFound:
+		return fuse.ENOENT
+	case http.StatusConflict:
+		return fuse.EBUSY
+	case http.StatusNotImplemented:
+		return fuse.ENOSYS
+	}
+
+	return fuse.EIO
+}
@@ -8,29 +8,40 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/hanwen/go-fuse/fuse"
 	"github.com/hanwen/go-fuse/fuse/nodefs"
 	"github.com/hanwen/go-fuse/fuse/pathfs"
-	"github.com/ppanyukov/azure-sdk-for-go/storage"
 )
 
 // NewFlatBlobFs creates a filesystem that lists containers as directories.
-func NewFlatBlobFs(accountContainer string, storageClient storage.Client) pathfs.FileSystem {
+func NewFlatBlobFs(accountContainer string, backend Backend, options Options) pathfs.FileSystem {
+	if !options.AsOf.IsZero() {
+		options.ReadOnly = true
+	}
+
 	logPrefix := fmt.Sprintf("[flatblobFs]: ")
+	logger := log.New(os.Stderr, logPrefix, log.LstdFlags)
 
 	result := flatblobFs{
-		client:           storageClient.GetBlobService(),
+		backend:          backend,
 		accountContainer: accountContainer,
-		log:              log.New(os.Stderr, logPrefix, log.LstdFlags),
+		options:          options,
+		log:              logger,
 		defaultDirFuseAttr: fuse.Attr{
 			Mode: fuse.S_IFDIR | 0755,
 		},
 		defaultFileFuseAttr: fuse.Attr{
 			Mode: fuse.S_IFREG | 0644,
 		},
-		pathEscaper: pathEscaperURLQuery{},
+		defaultStatfsOut: fuse.StatfsOut{
+			NameLen: maxNameLen,
+		},
+		pathEscaper: newPathEscaperShortening(newPathEscaper(options.PathEscaping), options.NameMapFile, logger),
+		etags:       make(map[string]seenETag),
 	}
 
 	return &result
@@ -38,13 +49,32 @@ func NewFlatBlobFs(accountContainer string, storageClient storage.Client) pathfs
 
 // flatblobFs implements a FileSystem that returns blobs as one big flat list.
 type flatblobFs struct {
-	client                storage.BlobStorageClient
+	backend               Backend
 	log                   *log.Logger
 	defaultDirFuseAttr    fuse.Attr
 	defaultFileFuseAttr   fuse.Attr
-	defaultListBlobParams storage.ListBlobsParameters
+	defaultStatfsOut      fuse.StatfsOut
+	defaultListBlobParams ListBlobsParameters
 	accountContainer      string
-	pathEscaper
+	options               Options
+	pathEscaper           *pathEscaperShortening
+
+	// etags are the ETags of blobs as last seen by GetAttr or written
+	// through this mount, by blob name. Unlink only deletes that version.
+	// They are kept for seenETagTTL and for no more than maxSeenETags
+	// blobs, so that walking a big container doesn't keep them all.
+	etagsMu sync.Mutex
+	etags   map[string]seenETag
+
+	// snapshotsNowMade is set by `mkdir .snapshots/now` until the kernel
+	// looks at what it made, see snapshots.go.
+	snapshotsMu      sync.Mutex
+	snapshotsNowMade bool
+
+	// copies has how far the ranged copies into open files got, by blob
+	// name, see blobFile.copyRange.
+	copiesMu sync.Mutex
+	copies   map[string]string
 }
 
 func (fs *flatblobFs) SetDebug(debug bool) {}
@@ -55,41 +85,152 @@ func (fs *flatblobFs) GetAttr(name string, context *fuse.Context) (*fuse.Attr, f
 		return &fs.defaultDirFuseAttr, fuse.OK
 	}
 
+	if isSnapshotPath(name) {
+		return fs.snapshotGetAttr(name, context)
+	}
+
+	if isTrashPath(name) {
+		return fs.trashGetAttr(name, context)
+	}
+
+	// Names the escaper could never produce can't be blobs. With escapers
+	// like base32 most names people type in are such, so no error here.
 	blobName, err := fs.pathEscaper.FileNameToBlobName(name)
 	if err != nil {
-		fs.log.Printf("[ERROR] GetAttr '%s': Could not convert file name to blob name. %s\n", name, err)
-		// TODO(ppanyukov): is this correct status to return?
-		return nil, fuse.EINVAL
+		return nil, fuse.ENOENT
 	}
 
-	exists, err := fs.client.BlobExists(fs.accountContainer, blobName)
+	if !fs.options.AsOf.IsZero() {
+		return fs.asOfGetAttr(name, blobName, context)
+	}
+
+	props, err := fs.storage(context).GetBlobProperties(fs.accountContainer, blobName)
+	if isNotFound(err) {
+		return nil, fuse.ENOENT
+	}
 
 	if err != nil {
 		fs.log.Printf("[ERROR] GetAttr '%s': %s\n", name, err)
-		return nil, fuse.EIO
+		return nil, statusFromError(err)
 	}
+	fs.sawBlob(props)
 
-	if exists {
-		// NOTE: all entries are files in this flat view.
-		return &fs.defaultFileFuseAttr, fuse.OK
+	// NOTE: all entries are files in this flat view.
+	attr := fs.defaultFileFuseAttr
+	attr.Size = uint64(props.ContentLength)
+	attr.SetTimes(nil, &props.LastModified, &props.LastModified)
+	return &attr, fuse.OK
+}
+
+func (fs *flatblobFs) GetXAttr(name string, attr string, context *fuse.Context) ([]byte, fuse.Status) {
+	// The blob name behind the file is there for when it's not obvious,
+	// e.g. with shortened names: `getfattr -n user.azurefs.blobname foo`
+	if isSnapshotPath(name) {
+		return fs.snapshotGetXAttr(name, attr, context)
+	}
+
+	if isTrashPath(name) {
+		return fs.trashGetXAttr(name, attr, context)
+	}
+
+	if name == "" || (attr != xattrBlobName && attr != xattrCopy) {
+		return nil, fuse.Status(syscall.ENODATA)
+	}
+
+	blobName, err := fs.pathEscaper.FileNameToBlobName(name)
+	if err != nil {
+		return nil, fuse.ENOENT
 	}
 
-	return nil, fuse.ENOENT
+	if attr == xattrCopy {
+		return fs.copyStatus(name, blobName, context)
+	}
+	return []byte(blobName), fuse.OK
 }
 
-func (fs *flatblobFs) GetXAttr(name string, attr string, context *fuse.Context) ([]byte, fuse.Status) {
-	return nil, fuse.ENOSYS
+// copyStatus tells how far the server-side copy to the blob got, which
+// is worth watching from elsewhere while cp waits for a big one:
+// `getfattr -n user.azurefs.copy foo`. Ranged copies are only known to
+// the file they are made through, until it's released.
+func (fs *flatblobFs) copyStatus(name string, blobName string, context *fuse.Context) ([]byte, fuse.Status) {
+	fs.copiesMu.Lock()
+	progress, ok := fs.copies[blobName]
+	fs.copiesMu.Unlock()
+	if ok {
+		return []byte(progress), fuse.OK
+	}
+
+	props, err := fs.storage(context).GetBlobProperties(fs.accountContainer, blobName)
+	if err != nil {
+		if !isNotFound(err) {
+			fs.log.Printf("[ERROR] GetXAttr '%s': %s\n", name, err)
+		}
+		return nil, statusFromError(err)
+	}
+
+	if props.CopyStatus == "" {
+		return nil, fuse.Status(syscall.ENODATA)
+	}
+	return []byte(props.CopyStatus + " " + props.CopyProgress), fuse.OK
+}
+
+// setCopyProgress records how far the ranged copy to the blob got, or that
+// it's no longer open if progress is "".
+func (fs *flatblobFs) setCopyProgress(blobName string, progress string) {
+	fs.copiesMu.Lock()
+	defer fs.copiesMu.Unlock()
+
+	if progress == "" {
+		delete(fs.copies, blobName)
+		return
+	}
+	if fs.copies == nil {
+		fs.copies = make(map[string]string)
+	}
+	fs.copies[blobName] = progress
 }
 
 func (fs *flatblobFs) SetXAttr(name string, attr string, data []byte, flags int, context *fuse.Context) fuse.Status {
+	if fs.options.ReadOnly || isVirtualPath(name) {
+		return fuse.EROFS
+	}
+
+	// Any value takes a snapshot of the blob, see snapshots.go:
+	// `setfattr -n user.azurefs.snapshot -v 1 foo`
+	if name != "" && attr == xattrSnapshot {
+		return fs.snapshotBlob(name, context)
+	}
+
 	return fuse.ENOSYS
 }
 
 func (fs *flatblobFs) ListXAttr(name string, context *fuse.Context) ([]string, fuse.Status) {
-	return nil, fuse.ENOSYS
+	if name == "" {
+		return nil, fuse.OK
+	}
+
+	if isSnapshotPath(name) {
+		if _, fileName := splitSnapshotPath(name); fileName == "" {
+			return nil, fuse.OK
+		}
+		return []string{xattrBlobName, xattrSnapshot}, fuse.OK
+	}
+
+	if isTrashPath(name) {
+		if name == trashDir {
+			return nil, fuse.OK
+		}
+		return []string{xattrBlobName, xattrDeletedTime}, fuse.OK
+	}
+
+	return []string{xattrBlobName}, fuse.OK
 }
 
 func (fs *flatblobFs) RemoveXAttr(name string, attr string, context *fuse.Context) fuse.Status {
+	if fs.options.ReadOnly || isVirtualPath(name) {
+		return fuse.EROFS
+	}
+
 	return fuse.ENOSYS
 }
 
@@ -109,27 +250,43 @@ func (fs *flatblobFs) Mknod(name string, mode uint32, dev uint32, context *fuse.
 	//      [flatblobFs]: 2016/04/01 09:50:40 [TRACE] Open: name: zzz flags: 34817
 	//      [flatblobFs]: 2016/04/01 09:50:40 [TRACE] Utimens: name: zzz Atime: 2016-04-01 09:50:40.066466083 +0000 UTC Mtime: 2016-04-01 09:50:40.066466083 +0000 UTC
 	//      [flatblobFs]: 2016/04/01 09:50:40 [TRACE] GetAttr: name: zzz
+	if fs.options.ReadOnly || isVirtualPath(name) {
+		return fuse.EROFS
+	}
+
 	blobName, err := fs.pathEscaper.FileNameToBlobName(name)
 	if err != nil {
 		fs.log.Printf("[ERROR] Mknod '%s': Could not convert file name to blob name. %s\n", name, err)
-		// TODO(ppanyukov): is this correct status to return?
-		return fuse.EINVAL
+		return fileNameStatus(err)
 	}
 
 	// Assume that if we get to here the OS has already checked that
 	// this file does not exist. However because it's a remote multi-user
 	// system, there is always a chance it appeared in the meantime.
 	// TODO(ppanyukov): how does azure handle create blob request if blob exists?
-	err = fs.client.CreateBlockBlob(fs.accountContainer, blobName)
+	_, err = fs.storage(context).CreateBlockBlob(fs.accountContainer, blobName, "", "")
 	if err != nil {
 		fs.log.Printf("[ERROR] Mknod '%s': Could not create blob. %s\n", name, err)
-		return fuse.EIO
+		return statusFromError(err)
 	}
+	fs.forgetBlob(blobName)
 
 	return fuse.OK
 }
 
 func (fs *flatblobFs) Mkdir(name string, mode uint32, context *fuse.Context) fuse.Status {
+	if fs.options.ReadOnly {
+		return fuse.EROFS
+	}
+
+	if isSnapshotPath(name) {
+		return fs.snapshotMkdir(name, context)
+	}
+
+	if isTrashPath(name) {
+		return fuse.EROFS
+	}
+
 	return fuse.ENOSYS
 }
 
@@ -139,48 +296,116 @@ func (fs *flatblobFs) Unlink(name string, context *fuse.Context) (code fuse.Stat
 	//      [flatblobFs]: 2016/04/01 09:53:02 [TRACE] GetAttr: name: foo
 	//      [flatblobFs]: 2016/04/01 09:53:02 [TRACE] Access: name: foo mode: 2
 	//      [flatblobFs]: 2016/04/01 09:53:02 [TRACE] Unlink: name: foo
+	if fs.options.ReadOnly || isVirtualPath(name) {
+		return fuse.EROFS
+	}
+
 	blobName, err := fs.pathEscaper.FileNameToBlobName(name)
 	if err != nil {
 		fs.log.Printf("[ERROR] Unlink '%s': Could not convert file name to blob name. %s\n", name, err)
-		// TODO(ppanyukov): is this correct status to return?
-		return fuse.EINVAL
+		return fileNameStatus(err)
 	}
 
-	_, err = fs.client.DeleteBlobIfExists(fs.accountContainer, blobName, nil)
-	if err != nil {
+	// Only delete what was seen, not what someone else wrote since.
+	ifMatch := ""
+	if !fs.options.LastWriterWins {
+		ifMatch = fs.seenETag(blobName)
+	}
+
+	// Same as rm on a regular file system, the blob may have gone already.
+	err = fs.storage(context).DeleteBlob(fs.accountContainer, blobName, ifMatch, "", fs.options.DeleteSnapshots)
+	if status := statusFromError(err); status == fuse.Status(syscall.ESTALE) {
+		fs.log.Printf("[ERROR] Unlink '%s': Blob was changed by someone else since it was looked at, not deleting it. %s\n", name, err)
+		fs.forgetBlob(blobName)
+		return status
+	}
+	if e, ok := err.(*StorageError); ok && e.Code == errorCodeSnapshotsPresent {
+		fs.log.Printf("[ERROR] Unlink '%s': Blob has snapshots, not deleting it. Mount with -o deletesnapshots to delete them along with it.\n", name)
+		return statusFromError(err)
+	}
+	if err != nil && !isNotFound(err) {
 		fs.log.Printf("[ERROR] Unlink '%s': Could not delete blob. %s\n", name, err)
-		return fuse.EIO
+		return statusFromError(err)
 	}
+	fs.forgetBlob(blobName)
 
 	return fuse.OK
 }
 
 func (fs *flatblobFs) Rmdir(name string, context *fuse.Context) (code fuse.Status) {
+	if fs.options.ReadOnly || isVirtualPath(name) {
+		return fuse.EROFS
+	}
+
 	return fuse.ENOSYS
 }
 
 func (fs *flatblobFs) Symlink(value string, linkName string, context *fuse.Context) (code fuse.Status) {
+	if fs.options.ReadOnly || isVirtualPath(linkName) {
+		return fuse.EROFS
+	}
+
 	return fuse.ENOSYS
 }
 
 func (fs *flatblobFs) Rename(oldName string, newName string, context *fuse.Context) (code fuse.Status) {
+	if fs.options.ReadOnly {
+		return fuse.EROFS
+	}
+
+	// Moving a file out of the trash restores it, see trash.go.
+	if isTrashPath(oldName) && !isVirtualPath(newName) {
+		return fs.trashRestore(oldName, newName, context)
+	}
+
+	if isVirtualPath(oldName) || isVirtualPath(newName) {
+		return fuse.EROFS
+	}
+
 	return fuse.ENOSYS
 }
 
 func (fs *flatblobFs) Link(oldName string, newName string, context *fuse.Context) (code fuse.Status) {
+	if fs.options.ReadOnly || isVirtualPath(newName) {
+		return fuse.EROFS
+	}
+
 	return fuse.ENOSYS
 }
 
 func (fs *flatblobFs) Chmod(name string, mode uint32, context *fuse.Context) (code fuse.Status) {
+	if fs.options.ReadOnly || isVirtualPath(name) {
+		return fuse.EROFS
+	}
+
 	return fuse.ENOSYS
 }
 
 func (fs *flatblobFs) Chown(name string, uid uint32, gid uint32, context *fuse.Context) (code fuse.Status) {
+	if fs.options.ReadOnly || isVirtualPath(name) {
+		return fuse.EROFS
+	}
+
 	return fuse.ENOSYS
 }
 
 func (fs *flatblobFs) Truncate(name string, offset uint64, context *fuse.Context) (code fuse.Status) {
-	return fuse.ENOSYS
+	if fs.options.ReadOnly || isVirtualPath(name) {
+		return fuse.EROFS
+	}
+
+	// Truncate without an open file handle, e.g. `truncate -s 0 foo`.
+	f, status := fs.openBlob("Truncate", name, true, offset == 0, context)
+	if status != fuse.OK {
+		return status
+	}
+	defer f.Release()
+
+	if status := f.Truncate(offset); status != fuse.OK {
+		return status
+	}
+
+	return f.Flush()
 }
 
 func (fs *flatblobFs) Open(name string, flags uint32, context *fuse.Context) (file nodefs.File, code fuse.Status) {
@@ -201,28 +426,165 @@ func (fs *flatblobFs) Open(name string, flags uint32, context *fuse.Context) (fi
 	//      [flatblobFs]: 2016/04/01 11:29:44 [TRACE] GetAttr: name: foo
 	//      [flatblobFs]: 2016/04/01 11:29:45 [TRACE] Open: name: foo flags: 33793 (O_WRONLY|O_APPEND|O_ACCMODE|O_LARGEFILE)
 
-	return nil, fuse.ENOSYS
+	writable := isWriteOpen(flags)
+	if fs.options.ReadOnly && writable {
+		return nil, fuse.EROFS
+	}
+
+	if isSnapshotPath(name) {
+		return fs.snapshotOpen(name, flags, context)
+	}
+
+	if isTrashPath(name) {
+		return fs.trashOpen(name, flags, context)
+	}
+
+	f, status := fs.openBlob("Open", name, writable, flags&syscall.O_TRUNC != 0, context)
+	if status != fuse.OK {
+		return nil, status
+	}
+
+	return f, fuse.OK
+}
+
+// openBlob opens the blob behind the file name, op is for logging.
+func (fs *flatblobFs) openBlob(op string, name string, writable bool, truncate bool, context *fuse.Context) (*blobFile, fuse.Status) {
+	blobName, err := fs.pathEscaper.FileNameToBlobName(name)
+	if err != nil {
+		fs.log.Printf("[ERROR] %s '%s': Could not convert file name to blob name. %s\n", op, name, err)
+		return nil, fileNameStatus(err)
+	}
+
+	if !fs.options.AsOf.IsZero() {
+		props, status := fs.blobAsOf(op, name, blobName, context)
+		if status != fuse.OK {
+			return nil, status
+		}
+		return newBlobFile(fs.backend, fs.accountContainer, props, false, false, true, fs.log, context)
+	}
+
+	props, err := fs.storage(context).GetBlobProperties(fs.accountContainer, blobName)
+	if err != nil {
+		if !isNotFound(err) {
+			fs.log.Printf("[ERROR] %s '%s': %s\n", op, name, err)
+		}
+		return nil, statusFromError(err)
+	}
+
+	fs.sawBlob(props)
+	f, status := newBlobFile(fs.backend, fs.accountContainer, props, writable, truncate, fs.options.LastWriterWins, fs.log, context)
+	if f != nil {
+		f.committed = fs.sawBlob
+		f.copyProgress = func(progress string) { fs.setCopyProgress(blobName, progress) }
+	}
+	return f, status
+}
+
+// storage returns the backend for the calls made by the operation with
+// context, see backendFor.
+func (fs *flatblobFs) storage(context *fuse.Context) Backend {
+	return backendFor(fs.backend, context)
+}
+
+// The kernel looks a file up right before removing it, so an ETag seen
+// longer ago than seenETagTTL is of no use to Unlink.
+const (
+	seenETagTTL  = time.Minute
+	maxSeenETags = 10000
+)
+
+type seenETag struct {
+	etag string
+	seen time.Time
+}
+
+// sawBlob remembers the ETag of the blob as seen through this mount.
+func (fs *flatblobFs) sawBlob(props BlobProperties) {
+	fs.etagsMu.Lock()
+	defer fs.etagsMu.Unlock()
+
+	now := time.Now()
+	if _, ok := fs.etags[props.Name]; !ok && len(fs.etags) >= maxSeenETags {
+		for name, seen := range fs.etags {
+			if now.Sub(seen.seen) > seenETagTTL {
+				delete(fs.etags, name)
+			}
+		}
+		// Still full of recent ones, forget any.
+		for name := range fs.etags {
+			if len(fs.etags) < maxSeenETags {
+				break
+			}
+			delete(fs.etags, name)
+		}
+	}
+	fs.etags[props.Name] = seenETag{props.ETag, now}
+}
+
+// seenETag returns the ETag of the blob as last seen, "" if never or too
+// long ago.
+func (fs *flatblobFs) seenETag(blobName string) string {
+	fs.etagsMu.Lock()
+	defer fs.etagsMu.Unlock()
+
+	seen, ok := fs.etags[blobName]
+	if !ok {
+		return ""
+	}
+	if time.Since(seen.seen) > seenETagTTL {
+		delete(fs.etags, blobName)
+		return ""
+	}
+	return seen.etag
+}
+
+// forgetBlob forgets the ETag of the blob, e.g. when it's gone.
+func (fs *flatblobFs) forgetBlob(blobName string) {
+	fs.etagsMu.Lock()
+	defer fs.etagsMu.Unlock()
+
+	delete(fs.etags, blobName)
 }
 
 func (fs *flatblobFs) OpenDir(name string, context *fuse.Context) (stream []fuse.DirEntry, status fuse.Status) {
+	if isSnapshotPath(name) {
+		return fs.snapshotOpenDir(name, context)
+	}
+
+	if isTrashPath(name) {
+		return fs.trashOpenDir(name, context)
+	}
+
 	if name != "" {
 		return []fuse.DirEntry(nil), fuse.OK
 	}
 
-	res, err := fs.client.ListBlobs(fs.accountContainer, fs.defaultListBlobParams)
+	if !fs.options.AsOf.IsZero() {
+		blobs, status := fs.listAsOf("OpenDir", name, "", context)
+		if status != fuse.OK {
+			return nil, status
+		}
+		return fs.dirEntries(blobs, fuse.S_IFREG|0644), fuse.OK
+	}
+
+	blobs, err := fs.storage(context).ListBlobs(fs.accountContainer, fs.defaultListBlobParams)
 	if err != nil {
 		fs.log.Printf("[ERROR] OpenDir '%s': %s'\n", name, err)
-		return nil, fuse.EIO
+		return nil, statusFromError(err)
 	}
 
-	blobs := res.Blobs
+	return fs.dirEntries(blobs, fuse.S_IFREG|0644), fuse.OK
+}
 
+// dirEntries returns the directory entries for blobs, with the mode given.
+func (fs *flatblobFs) dirEntries(blobs []BlobProperties, mode uint32) []fuse.DirEntry {
 	// Preallocate the array with capacity equal to the number of blobs
 	// but set initial len to 0 and grow as needed.
 	// Reason is there may be blobs which we can't translate to file names
 	// due to bugs or escaping issues and so may end up with fewer files than
 	// there are blobs.
-	stream = make([]fuse.DirEntry, 0, len(blobs))
+	fileNames := make([]string, 0, len(blobs))
+	blobNames := make(map[string][]string, len(blobs))
 	for _, blob := range blobs {
 		blobName := blob.Name
 		fileName, err := fs.pathEscaper.BlobNameToFileName(blobName)
@@ -231,22 +593,69 @@ func (fs *flatblobFs) OpenDir(name string, context *fuse.Context) (stream []fuse
 			continue
 		}
 
-		stream = append(stream, fuse.DirEntry{
-			Mode: fuse.S_IFREG | 0644,
-			Name: fileName,
-		})
+		if len(blobNames[fileName]) == 0 {
+			fileNames = append(fileNames, fileName)
+		}
+		blobNames[fileName] = append(blobNames[fileName], blobName)
 	}
 
-	return stream, fuse.OK
+	stream := make([]fuse.DirEntry, 0, len(blobs))
+	for _, fileName := range fileNames {
+		for _, name := range fs.disambiguate(fileName, blobNames[fileName]) {
+			stream = append(stream, fuse.DirEntry{
+				Mode: mode,
+				Name: name,
+			})
+		}
+	}
+
+	return stream
+}
+
+// isVirtualPath tells if the file name is in one of the read-only
+// directories which aren't blobs, see snapshots.go and trash.go.
+func isVirtualPath(name string) bool {
+	return isSnapshotPath(name) || isTrashPath(name)
+}
+
+// disambiguate returns file names for blobs which all have fileName.
+// Usually there is just one, otherwise the blob which fileName leads to
+// keeps it and the others get names of their own, so that e.g. `rm` never
+// removes the wrong blob.
+func (fs *flatblobFs) disambiguate(fileName string, blobNames []string) []string {
+	if len(blobNames) == 1 {
+		return []string{fileName}
+	}
+
+	fs.log.Printf("[ERROR] OpenDir blobs %q all have file name '%s'\n", blobNames, fileName)
+
+	owner, _ := fs.pathEscaper.FileNameToBlobName(fileName)
+	fileNames := make([]string, len(blobNames))
+	for i, blobName := range blobNames {
+		if blobName == owner {
+			fileNames[i] = fileName
+		} else {
+			fileNames[i] = fs.pathEscaper.Disambiguate(fileName, blobName)
+		}
+	}
+
+	return fileNames
 }
 
 func (fs *flatblobFs) OnMount(nodeFs *pathfs.PathNodeFs) {
 }
 
 func (fs *flatblobFs) OnUnmount() {
+	if err := fs.pathEscaper.Close(); err != nil {
+		fs.log.Printf("[ERROR] Could not close name map. %s\n", err)
+	}
 }
 
 func (fs *flatblobFs) Access(name string, mode uint32, context *fuse.Context) (code fuse.Status) {
+	if (fs.options.ReadOnly || isVirtualPath(name)) && mode&accessWrite != 0 {
+		return fuse.EROFS
+	}
+
 	return fuse.OK
 }
 
@@ -261,12 +670,20 @@ func (fs *flatblobFs) Create(name string, flags uint32, mode uint32, context *fu
 	// should be ready to read/write depending on flags. Which complicates things really.
 	//
 	// Perhaps it's OK to not support Create.
+	if fs.options.ReadOnly || isVirtualPath(name) {
+		return nil, fuse.EROFS
+	}
+
 	return nil, fuse.ENOSYS
 }
 
 func (fs *flatblobFs) Utimens(name string, Atime *time.Time, Mtime *time.Time, context *fuse.Context) (code fuse.Status) {
 	// TODO(ppanyukov): Meaningful implementatin of Utimens. For now just return OK.
 	// This is so other things like `touch foo` work without errors. See Mknod.
+	if fs.options.ReadOnly || isVirtualPath(name) {
+		return fuse.EROFS
+	}
+
 	return fuse.OK
 }
 
@@ -274,6 +691,9 @@ func (fs *flatblobFs) String() string {
 	return "flatblobFs"
 }
 
+// StatFs reports no capacity as there is no such thing in blob storage.
+// Note that statfs gets ST_RDONLY from the mount flags rather than from
+// here, which is why read-only mounts pass "ro" to the kernel too.
 func (fs *flatblobFs) StatFs(name string) *fuse.StatfsOut {
-	return nil
+	return &fs.defaultStatfsOut
 }
@@ -0,0 +1,193 @@
+package blobfs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// pathEscaperLowerCase is a lossy pathEscaper, as if blobs were on
+// a case-insensitive file system.
+type pathEscaperLowerCase struct {
+}
+
+func (x pathEscaperLowerCase) BlobNameToFileName(blobName string) (fileName string, err error) {
+	return strings.ToLower(blobName), nil
+}
+
+func (x pathEscaperLowerCase) FileNameToBlobName(fileName string) (blobName string, err error) {
+	return fileName, nil
+}
+
+func TestFlatBlobFsCollisions(t *testing.T) {
+	backend := newTestBackend(t)
+	for i, blobName := range []string{"Foo", "fOO", "foo", "bar"} {
+		putBlob(t, backend.backend, conformanceContainer, blobName, strings.Repeat("x", i+1))
+	}
+
+	fs := NewFlatBlobFs(conformanceContainer, backend, Options{}).(*flatblobFs)
+	fs.log = log.New(ioutil.Discard, "", 0)
+	fs.pathEscaper = newPathEscaperShortening(pathEscaperLowerCase{}, "", fs.log)
+
+	names := listNames(t, fs, "")
+	if len(names) != 4 {
+		t.Fatalf("OpenDir: expected 4 files got %q", names)
+	}
+
+	// The file name which leads to a blob is kept, the others get a suffix.
+	sizes := make(map[string]uint64)
+	for _, name := range names {
+		attr, status := fs.GetAttr(name, nil)
+		if status != fuse.OK {
+			t.Fatalf("GetAttr %q: %v", name, status)
+		}
+		sizes[name] = attr.Size
+	}
+	if sizes["foo"] != 3 || sizes["bar"] != 4 {
+		t.Errorf("GetAttr: unexpected sizes %v", sizes)
+	}
+
+	// Names are the same every time.
+	if again := listNames(t, fs, ""); strings.Join(again, ",") != strings.Join(names, ",") {
+		t.Errorf("OpenDir: names changed from %q to %q", names, again)
+	}
+
+	// rm removes the right blob.
+	for _, name := range names {
+		if sizes[name] == 1 {
+			expectStatus(t, "Unlink "+name, fs.Unlink(name, nil), fuse.OK)
+		}
+	}
+	if _, err := backend.backend.GetBlobProperties(conformanceContainer, "Foo"); !isNotFound(err) {
+		t.Errorf("Unlink did not remove 'Foo': %v", err)
+	}
+	for _, blobName := range []string{"fOO", "foo", "bar"} {
+		if _, err := backend.backend.GetBlobProperties(conformanceContainer, blobName); err != nil {
+			t.Errorf("Unlink removed '%s': %s", blobName, err)
+		}
+	}
+}
+
+func TestFlatBlobFsNonCanonicalNames(t *testing.T) {
+	backend := newTestBackend(t)
+	putBlob(t, backend.backend, conformanceContainer, "a b", "content")
+	fs := NewFlatBlobFs(conformanceContainer, backend, Options{})
+
+	expectStatus(t, "GetAttr canonical", statusOf(fs.GetAttr("a+b", nil)), fuse.OK)
+	expectStatus(t, "GetAttr non-canonical", statusOf(fs.GetAttr("a%20b", nil)), fuse.ENOENT)
+	expectStatus(t, "Unlink non-canonical", fs.Unlink("a%20b", nil), fuse.EINVAL)
+
+	if _, err := backend.backend.GetBlobProperties(conformanceContainer, "a b"); err != nil {
+		t.Errorf("Unlink of a non-canonical name removed the blob: %s", err)
+	}
+
+	// Names typed in as the blob name itself work too.
+	for _, name := range []string{"a b", "c d", "naïve"} {
+		if name != "a b" {
+			expectStatus(t, "Mknod "+name, fs.Mknod(name, fuse.S_IFREG|0644, 0, nil), fuse.OK)
+		}
+		expectStatus(t, "GetAttr "+name, statusOf(fs.GetAttr(name, nil)), fuse.OK)
+		expectStatus(t, "Unlink "+name, fs.Unlink(name, nil), fuse.OK)
+		if _, err := backend.backend.GetBlobProperties(conformanceContainer, name); !isNotFound(err) {
+			t.Errorf("Unlink '%s' did not remove the blob: %v", name, err)
+		}
+	}
+}
+
+func TestFlatBlobFsConflicts(t *testing.T) {
+	backend := newTestBackend(t)
+	putBlob(t, backend.backend, conformanceContainer, "foo", "original")
+
+	fs := NewFlatBlobFs(conformanceContainer, backend, Options{}).(*flatblobFs)
+	fs.log = log.New(ioutil.Discard, "", 0)
+
+	// Two writers open the same blob, the second one to commit loses.
+	first, status := fs.Open("foo", uint32(syscall.O_WRONLY|syscall.O_TRUNC), nil)
+	expectStatus(t, "Open first", status, fuse.OK)
+	defer first.Release()
+	second, status := fs.Open("foo", uint32(syscall.O_WRONLY|syscall.O_TRUNC), nil)
+	expectStatus(t, "Open second", status, fuse.OK)
+	defer second.Release()
+
+	first.Write([]byte("first"), 0)
+	second.Write([]byte("second"), 0)
+	lookups := countCalls(backend, "GetBlobProperties")
+	expectStatus(t, "Flush first", first.Flush(), fuse.OK)
+	if countCalls(backend, "GetBlobProperties") != lookups {
+		t.Errorf("Flush: expected the ETag from the commit, got %q", backend.calls)
+	}
+	expectStatus(t, "Flush second", second.Flush(), fuse.Status(syscall.ESTALE))
+	if content := readFile(t, fs, "foo"); content != "first" {
+		t.Errorf("Expected 'first' got %q", content)
+	}
+
+	// The winner can keep writing, it knows the blob is its own.
+	first.Write([]byte("FIRST"), 0)
+	expectStatus(t, "Flush first again", first.Flush(), fuse.OK)
+
+	// rm does not delete what someone else wrote since GetAttr.
+	expectStatus(t, "GetAttr", statusOf(fs.GetAttr("foo", nil)), fuse.OK)
+	putBlob(t, backend.backend, conformanceContainer, "foo", "someone else")
+	expectStatus(t, "Unlink changed", fs.Unlink("foo", nil), fuse.Status(syscall.ESTALE))
+	expectStatus(t, "GetAttr", statusOf(fs.GetAttr("foo", nil)), fuse.OK)
+	expectStatus(t, "Unlink", fs.Unlink("foo", nil), fuse.OK)
+}
+
+func TestFlatBlobFsSeenETags(t *testing.T) {
+	fs := NewFlatBlobFs(conformanceContainer, NewMemoryBackend(), Options{}).(*flatblobFs)
+
+	fs.sawBlob(BlobProperties{Name: "foo", ETag: "\"1\""})
+	if etag := fs.seenETag("foo"); etag != "\"1\"" {
+		t.Errorf("seenETag: expected the ETag got %q", etag)
+	}
+
+	// Too long ago to tell anything about the blob.
+	fs.etags["foo"] = seenETag{"\"1\"", time.Now().Add(-2 * seenETagTTL)}
+	if etag := fs.seenETag("foo"); etag != "" {
+		t.Errorf("seenETag expired: expected none got %q", etag)
+	}
+
+	for i := 0; i < maxSeenETags+10; i++ {
+		fs.sawBlob(BlobProperties{Name: fmt.Sprintf("blob%d", i), ETag: "\"1\""})
+	}
+	if len(fs.etags) > maxSeenETags {
+		t.Errorf("sawBlob: expected at most %d ETags got %d", maxSeenETags, len(fs.etags))
+	}
+	if etag := fs.seenETag(fmt.Sprintf("blob%d", maxSeenETags+9)); etag == "" {
+		t.Errorf("seenETag: expected the last ETag seen")
+	}
+}
+
+func TestFlatBlobFsLastWriterWins(t *testing.T) {
+	backend := newTestBackend(t)
+	putBlob(t, backend.backend, conformanceContainer, "foo", "original")
+
+	var options Options
+	if rest := options.ParseMountOptions("lastwriterwins,allow_other"); !options.LastWriterWins || len(rest) != 1 {
+		t.Fatalf("ParseMountOptions: %+v %q", options, rest)
+	}
+	fs := NewFlatBlobFs(conformanceContainer, backend, options)
+
+	first, _ := fs.Open("foo", uint32(syscall.O_WRONLY|syscall.O_TRUNC), nil)
+	defer first.Release()
+	second, _ := fs.Open("foo", uint32(syscall.O_WRONLY|syscall.O_TRUNC), nil)
+	defer second.Release()
+
+	first.Write([]byte("first"), 0)
+	second.Write([]byte("second"), 0)
+	expectStatus(t, "Flush first", first.Flush(), fuse.OK)
+	expectStatus(t, "Flush second", second.Flush(), fuse.OK)
+	if content := readFile(t, fs, "foo"); content != "second" {
+		t.Errorf("Expected 'second' got %q", content)
+	}
+
+	expectStatus(t, "GetAttr", statusOf(fs.GetAttr("foo", nil)), fuse.OK)
+	putBlob(t, backend.backend, conformanceContainer, "foo", "someone else")
+	expectStatus(t, "Unlink", fs.Unlink("foo", nil), fuse.OK)
+}
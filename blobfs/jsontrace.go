@@ -0,0 +1,749 @@
+package blobfs
+
+// Structured tracing: one JSON line per operation with its arguments,
+// status, how long it took and the storage calls it made, for analysing
+// slow or failing workloads offline.
+//
+// Storage calls are matched to the operation which made them by what the
+// file systems get their backend for, see backendFor: the *fuse.Context
+// of the operation, or the open file for operations on open files.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+)
+
+// traceQueueLen is how many records can wait to be written before
+// further ones are dropped, so that a slow reader of the trace doesn't
+// slow down the mount.
+const traceQueueLen = 4096
+
+// TraceRecord is a line in the JSON trace.
+type TraceRecord struct {
+	Time time.Time `json:"time"`
+	Op   string    `json:"op"`
+	Path string    `json:"path,omitempty"`
+
+	// FH identifies the open file for Open, Create and operations
+	// on open files such as Read and Write.
+	FH   uint64                 `json:"fh,omitempty"`
+	Args map[string]interface{} `json:"args,omitempty"`
+
+	// Status is the errno returned, 0 for OK.
+	Status   int32         `json:"status"`
+	Error    string        `json:"error,omitempty"`
+	Duration time.Duration `json:"durationNs"`
+
+	Calls []TraceCall `json:"calls,omitempty"`
+
+	// key is what the storage calls of the operation are made for.
+	key interface{}
+}
+
+// TraceCall is a storage call made by an operation.
+type TraceCall struct {
+	Op       string                 `json:"op"`
+	Args     map[string]interface{} `json:"args,omitempty"`
+	Error    string                 `json:"error,omitempty"`
+	Duration time.Duration          `json:"durationNs"`
+}
+
+// Tracer writes the JSON trace of the file system and backend it wraps.
+type Tracer struct {
+	log    *log.Logger
+	filter *TraceFilter
+
+	// queue holds the records until writeQueue gets to write them.
+	queue   chan traceItem
+	dropped uint64
+
+	mu sync.Mutex
+
+	// active are the operations in progress by what their storage
+	// calls are made for.
+	active map[interface{}]*TraceRecord
+	nextFH uint64
+
+	// files are the names of the open files by what their storage calls
+	// are made for, for the calls made outside of any operation.
+	files map[interface{}]string
+}
+
+// traceItem is a record to write, or a Flush waiting for those before it.
+type traceItem struct {
+	record  *TraceRecord
+	flushed chan struct{}
+}
+
+// NewTracer creates a Tracer which writes the operations filter lets
+// through to out, all of them if it's nil.
+func NewTracer(out io.Writer, filter *TraceFilter) *Tracer {
+	t := &Tracer{
+		log:    log.New(os.Stderr, "[tracer]: ", log.LstdFlags),
+		filter: filter,
+		queue:  make(chan traceItem, traceQueueLen),
+		active: make(map[interface{}]*TraceRecord),
+		files:  make(map[interface{}]string),
+	}
+	go t.writeQueue(json.NewEncoder(out))
+	return t
+}
+
+// OpenTraceOutput opens dest to write a trace to. It's a file name, or
+// unix:<path> or tcp:<host:port> to send the trace to a socket.
+func OpenTraceOutput(dest string) (io.WriteCloser, error) {
+	switch {
+	case strings.HasPrefix(dest, "unix:"):
+		return net.Dial("unix", strings.TrimPrefix(dest, "unix:"))
+	case strings.HasPrefix(dest, "tcp:"):
+		return net.Dial("tcp", strings.TrimPrefix(dest, "tcp:"))
+	}
+
+	return os.OpenFile(dest, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+}
+
+// Flush waits until the records traced so far are written.
+func (t *Tracer) Flush() {
+	flushed := make(chan struct{})
+	t.queue <- traceItem{flushed: flushed}
+	<-flushed
+}
+
+// begin starts tracing an operation whose storage calls are made for key,
+// see backendFor. Nil if there are none.
+func (t *Tracer) begin(op string, path string, args map[string]interface{}, key interface{}) *TraceRecord {
+	record := &TraceRecord{
+		Time: time.Now(),
+		Op:   op,
+		Path: path,
+		Args: args,
+		key:  key,
+	}
+
+	if key != nil {
+		t.mu.Lock()
+		t.active[key] = record
+		t.mu.Unlock()
+	}
+
+	return record
+}
+
+// end finishes tracing an operation and writes it out.
+func (t *Tracer) end(record *TraceRecord, status fuse.Status) {
+	record.Duration = time.Since(record.Time)
+	record.Status = int32(status)
+	if status != fuse.OK {
+		record.Error = status.String()
+	}
+
+	if record.key != nil {
+		t.mu.Lock()
+		if t.active[record.key] == record {
+			delete(t.active, record.key)
+		}
+		t.mu.Unlock()
+	}
+
+	if t.filter.match(record.Op, record.Path, status) {
+		t.write(record)
+	}
+}
+
+// newFH returns an ID for a newly opened file.
+func (t *Tracer) newFH() uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.nextFH++
+	return t.nextFH
+}
+
+// call records a storage call made for key by the operation in progress.
+// Calls made outside of any operation, e.g. renewing the lease of an open
+// file, are written out as records of their own with the name of the
+// file they are made for.
+func (t *Tracer) call(key interface{}, op string, args map[string]interface{}, start time.Time, err error) {
+	call := TraceCall{
+		Op:       op,
+		Args:     args,
+		Duration: time.Since(start),
+	}
+	if err != nil {
+		call.Error = err.Error()
+	}
+
+	t.mu.Lock()
+	record, ok := t.active[key]
+	if ok {
+		record.Calls = append(record.Calls, call)
+	}
+	name := t.files[key]
+	t.mu.Unlock()
+	if ok {
+		return
+	}
+
+	if !t.filter.match("storage."+op, name, statusFromError(err)) {
+		return
+	}
+
+	t.write(&TraceRecord{
+		Time:     start,
+		Op:       "storage." + op,
+		Path:     name,
+		Args:     args,
+		Error:    call.Error,
+		Duration: call.Duration,
+	})
+}
+
+// opened remembers the name of the file whose storage calls are made for
+// key, see call.
+func (t *Tracer) opened(key interface{}, name string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.files[key] = name
+}
+
+func (t *Tracer) released(key interface{}) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.files, key)
+}
+
+// write queues record to be written, or drops it if the queue is full.
+func (t *Tracer) write(record *TraceRecord) {
+	select {
+	case t.queue <- traceItem{record: record}:
+	default:
+		if atomic.AddUint64(&t.dropped, 1) == 1 {
+			t.log.Printf("[ERROR] Trace output can't keep up, dropping records, further drops are not reported.\n")
+		}
+	}
+}
+
+// writeQueue writes the queued records, for as long as the Tracer is used.
+func (t *Tracer) writeQueue(enc *json.Encoder) {
+	failed := false
+	for item := range t.queue {
+		if item.flushed != nil {
+			close(item.flushed)
+			continue
+		}
+
+		if err := enc.Encode(item.record); err != nil && !failed {
+			// Don't fail the operation because of tracing, but say it once.
+			t.log.Printf("[ERROR] Could not write trace, further errors are not reported. %s\n", err)
+			failed = true
+		}
+	}
+}
+
+// FileSystem creates a file system which traces calls and delegates to fs.
+func (t *Tracer) FileSystem(fs pathfs.FileSystem) pathfs.FileSystem {
+	return &jsonTraceFs{
+		fs:     fs,
+		tracer: t,
+	}
+}
+
+type jsonTraceFs struct {
+	fs     pathfs.FileSystem
+	tracer *Tracer
+}
+
+func (fs *jsonTraceFs) SetDebug(debug bool) {
+	fs.fs.SetDebug(debug)
+}
+
+func (fs *jsonTraceFs) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
+	record := fs.tracer.begin("GetAttr", name, nil, context)
+	attr, status := fs.fs.GetAttr(name, context)
+	fs.tracer.end(record, status)
+	return attr, status
+}
+
+func (fs *jsonTraceFs) GetXAttr(name string, attr string, context *fuse.Context) ([]byte, fuse.Status) {
+	record := fs.tracer.begin("GetXAttr", name, map[string]interface{}{"attr": attr}, context)
+	data, status := fs.fs.GetXAttr(name, attr, context)
+	fs.tracer.end(record, status)
+	return data, status
+}
+
+func (fs *jsonTraceFs) SetXAttr(name string, attr string, data []byte, flags int, context *fuse.Context) fuse.Status {
+	record := fs.tracer.begin("SetXAttr", name, map[string]interface{}{"attr": attr, "size": len(data), "flags": flags}, context)
+	status := fs.fs.SetXAttr(name, attr, data, flags, context)
+	fs.tracer.end(record, status)
+	return status
+}
+
+func (fs *jsonTraceFs) ListXAttr(name string, context *fuse.Context) ([]string, fuse.Status) {
+	record := fs.tracer.begin("ListXAttr", name, nil, context)
+	attrs, status := fs.fs.ListXAttr(name, context)
+	fs.tracer.end(record, status)
+	return attrs, status
+}
+
+func (fs *jsonTraceFs) RemoveXAttr(name string, attr string, context *fuse.Context) fuse.Status {
+	record := fs.tracer.begin("RemoveXAttr", name, map[string]interface{}{"attr": attr}, context)
+	status := fs.fs.RemoveXAttr(name, attr, context)
+	fs.tracer.end(record, status)
+	return status
+}
+
+func (fs *jsonTraceFs) Readlink(name string, context *fuse.Context) (string, fuse.Status) {
+	record := fs.tracer.begin("Readlink", name, nil, context)
+	value, status := fs.fs.Readlink(name, context)
+	fs.tracer.end(record, status)
+	return value, status
+}
+
+func (fs *jsonTraceFs) Mknod(name string, mode uint32, dev uint32, context *fuse.Context) fuse.Status {
+	record := fs.tracer.begin("Mknod", name, map[string]interface{}{"mode": mode, "dev": dev}, context)
+	status := fs.fs.Mknod(name, mode, dev, context)
+	fs.tracer.end(record, status)
+	return status
+}
+
+func (fs *jsonTraceFs) Mkdir(name string, mode uint32, context *fuse.Context) fuse.Status {
+	record := fs.tracer.begin("Mkdir", name, map[string]interface{}{"mode": mode}, context)
+	status := fs.fs.Mkdir(name, mode, context)
+	fs.tracer.end(record, status)
+	return status
+}
+
+func (fs *jsonTraceFs) Unlink(name string, context *fuse.Context) (code fuse.Status) {
+	record := fs.tracer.begin("Unlink", name, nil, context)
+	status := fs.fs.Unlink(name, context)
+	fs.tracer.end(record, status)
+	return status
+}
+
+func (fs *jsonTraceFs) Rmdir(name string, context *fuse.Context) (code fuse.Status) {
+	record := fs.tracer.begin("Rmdir", name, nil, context)
+	status := fs.fs.Rmdir(name, context)
+	fs.tracer.end(record, status)
+	return status
+}
+
+func (fs *jsonTraceFs) Symlink(value string, linkName string, context *fuse.Context) (code fuse.Status) {
+	record := fs.tracer.begin("Symlink", linkName, map[string]interface{}{"value": value}, context)
+	status := fs.fs.Symlink(value, linkName, context)
+	fs.tracer.end(record, status)
+	return status
+}
+
+func (fs *jsonTraceFs) Rename(oldName string, newName string, context *fuse.Context) (code fuse.Status) {
+	record := fs.tracer.begin("Rename", oldName, map[string]interface{}{"newName": newName}, context)
+	status := fs.fs.Rename(oldName, newName, context)
+	fs.tracer.end(record, status)
+	return status
+}
+
+func (fs *jsonTraceFs) Link(oldName string, newName string, context *fuse.Context) (code fuse.Status) {
+	record := fs.tracer.begin("Link", oldName, map[string]interface{}{"newName": newName}, context)
+	status := fs.fs.Link(oldName, newName, context)
+	fs.tracer.end(record, status)
+	return status
+}
+
+func (fs *jsonTraceFs) Chmod(name string, mode uint32, context *fuse.Context) (code fuse.Status) {
+	record := fs.tracer.begin("Chmod", name, map[string]interface{}{"mode": mode}, context)
+	status := fs.fs.Chmod(name, mode, context)
+	fs.tracer.end(record, status)
+	return status
+}
+
+func (fs *jsonTraceFs) Chown(name string, uid uint32, gid uint32, context *fuse.Context) (code fuse.Status) {
+	record := fs.tracer.begin("Chown", name, map[string]interface{}{"uid": uid, "gid": gid}, context)
+	status := fs.fs.Chown(name, uid, gid, context)
+	fs.tracer.end(record, status)
+	return status
+}
+
+func (fs *jsonTraceFs) Truncate(name string, offset uint64, context *fuse.Context) (code fuse.Status) {
+	record := fs.tracer.begin("Truncate", name, map[string]interface{}{"offset": offset}, context)
+	status := fs.fs.Truncate(name, offset, context)
+	fs.tracer.end(record, status)
+	return status
+}
+
+func (fs *jsonTraceFs) Open(name string, flags uint32, context *fuse.Context) (file nodefs.File, code fuse.Status) {
+	record := fs.tracer.begin("Open", name, map[string]interface{}{"flags": flags, "flagsText": flagsToText(flags)}, context)
+	file, status := fs.fs.Open(name, flags, context)
+	file = fs.traceFile(record, name, file)
+	fs.tracer.end(record, status)
+	return file, status
+}
+
+func (fs *jsonTraceFs) OpenDir(name string, context *fuse.Context) (stream []fuse.DirEntry, status fuse.Status) {
+	record := fs.tracer.begin("OpenDir", name, nil, context)
+	stream, status = fs.fs.OpenDir(name, context)
+	record.Args = map[string]interface{}{"entries": len(stream)}
+	fs.tracer.end(record, status)
+	return stream, status
+}
+
+func (fs *jsonTraceFs) OnMount(nodeFs *pathfs.PathNodeFs) {
+	fs.fs.OnMount(nodeFs)
+}
+
+func (fs *jsonTraceFs) OnUnmount() {
+	fs.fs.OnUnmount()
+}
+
+func (fs *jsonTraceFs) Access(name string, mode uint32, context *fuse.Context) (code fuse.Status) {
+	record := fs.tracer.begin("Access", name, map[string]interface{}{"mode": mode}, context)
+	status := fs.fs.Access(name, mode, context)
+	fs.tracer.end(record, status)
+	return status
+}
+
+func (fs *jsonTraceFs) Create(name string, flags uint32, mode uint32, context *fuse.Context) (file nodefs.File, code fuse.Status) {
+	record := fs.tracer.begin("Create", name, map[string]interface{}{"flags": flags, "flagsText": flagsToText(flags), "mode": mode}, context)
+	file, status := fs.fs.Create(name, flags, mode, context)
+	file = fs.traceFile(record, name, file)
+	fs.tracer.end(record, status)
+	return file, status
+}
+
+func (fs *jsonTraceFs) Utimens(name string, Atime *time.Time, Mtime *time.Time, context *fuse.Context) (code fuse.Status) {
+	record := fs.tracer.begin("Utimens", name, map[string]interface{}{"atime": Atime, "mtime": Mtime}, context)
+	status := fs.fs.Utimens(name, Atime, Mtime, context)
+	fs.tracer.end(record, status)
+	return status
+}
+
+func (fs *jsonTraceFs) String() string {
+	return fs.fs.String()
+}
+
+func (fs *jsonTraceFs) StatFs(name string) *fuse.StatfsOut {
+	record := fs.tracer.begin("StatFs", name, nil, nil)
+	out := fs.fs.StatFs(name)
+	status := fuse.OK
+	if out == nil {
+		status = fuse.ENOSYS
+	}
+	fs.tracer.end(record, status)
+	return out
+}
+
+// traceFile wraps file opened by the operation in record so that the
+// operations on it are traced too.
+func (fs *jsonTraceFs) traceFile(record *TraceRecord, name string, file nodefs.File) nodefs.File {
+	if file == nil {
+		return nil
+	}
+
+	record.FH = fs.tracer.newFH()
+	f := &jsonTraceFile{
+		File:   file,
+		tracer: fs.tracer,
+		name:   name,
+		fh:     record.FH,
+		key:    innermostFile(file),
+	}
+	fs.tracer.opened(f.key, name)
+	return f
+}
+
+// innermostFile returns the file wrapped by file and any other wrappers,
+// which is what the file systems get their backend for, see backendFor.
+func innermostFile(file nodefs.File) nodefs.File {
+	for {
+		inner := file.InnerFile()
+		if inner == nil {
+			return file
+		}
+		file = inner
+	}
+}
+
+// jsonTraceFile traces operations on an open file. Operations
+// which are not traced go straight to the embedded File.
+type jsonTraceFile struct {
+	nodefs.File
+	tracer *Tracer
+	name   string
+	fh     uint64
+	key    nodefs.File
+}
+
+func (f *jsonTraceFile) begin(op string, args map[string]interface{}) *TraceRecord {
+	record := f.tracer.begin(op, f.name, args, f.key)
+	record.FH = f.fh
+	return record
+}
+
+func (f *jsonTraceFile) InnerFile() nodefs.File {
+	return f.File
+}
+
+func (f *jsonTraceFile) String() string {
+	return fmt.Sprintf("jsonTraceFile(%s)", f.File)
+}
+
+func (f *jsonTraceFile) Read(buf []byte, off int64) (fuse.ReadResult, fuse.Status) {
+	record := f.begin("Read", map[string]interface{}{"offset": off, "size": len(buf)})
+	res, status := f.File.Read(buf, off)
+	if res != nil {
+		record.Args["read"] = res.Size()
+	}
+	f.tracer.end(record, status)
+	return res, status
+}
+
+func (f *jsonTraceFile) Write(data []byte, off int64) (uint32, fuse.Status) {
+	record := f.begin("Write", map[string]interface{}{"offset": off, "size": len(data)})
+	n, status := f.File.Write(data, off)
+	f.tracer.end(record, status)
+	return n, status
+}
+
+func (f *jsonTraceFile) Flush() fuse.Status {
+	record := f.begin("Flush", nil)
+	status := f.File.Flush()
+	f.tracer.end(record, status)
+	return status
+}
+
+func (f *jsonTraceFile) Release() {
+	record := f.begin("Release", nil)
+	f.File.Release()
+	f.tracer.end(record, fuse.OK)
+	f.tracer.released(f.key)
+}
+
+func (f *jsonTraceFile) Fsync(flags int) (code fuse.Status) {
+	record := f.begin("Fsync", map[string]interface{}{"flags": flags})
+	status := f.File.Fsync(flags)
+	f.tracer.end(record, status)
+	return status
+}
+
+func (f *jsonTraceFile) Truncate(size uint64) fuse.Status {
+	record := f.begin("FTruncate", map[string]interface{}{"size": size})
+	status := f.File.Truncate(size)
+	f.tracer.end(record, status)
+	return status
+}
+
+func (f *jsonTraceFile) GetAttr(out *fuse.Attr) fuse.Status {
+	record := f.begin("FGetAttr", nil)
+	status := f.File.GetAttr(out)
+	f.tracer.end(record, status)
+	return status
+}
+
+// Backend creates a Backend which records the calls made to backend.
+func (t *Tracer) Backend(backend Backend) Backend {
+	return &jsonTraceBackend{
+		backend: backend,
+		tracer:  t,
+	}
+}
+
+type jsonTraceBackend struct {
+	backend Backend
+	tracer  *Tracer
+	key     interface{}
+}
+
+func (b *jsonTraceBackend) forOperation(key interface{}) Backend {
+	return &jsonTraceBackend{
+		backend: b.backend,
+		tracer:  b.tracer,
+		key:     key,
+	}
+}
+
+func (b *jsonTraceBackend) ListContainers(prefix string) ([]ContainerProperties, error) {
+	start := time.Now()
+	containers, err := b.backend.ListContainers(prefix)
+	b.tracer.call(b.key, "ListContainers", map[string]interface{}{"prefix": prefix, "count": len(containers)}, start, err)
+	return containers, err
+}
+
+func (b *jsonTraceBackend) ContainerExists(container string) (bool, error) {
+	start := time.Now()
+	exists, err := b.backend.ContainerExists(container)
+	b.tracer.call(b.key, "ContainerExists", map[string]interface{}{"container": container, "exists": exists}, start, err)
+	return exists, err
+}
+
+func (b *jsonTraceBackend) CreateContainer(container string) error {
+	start := time.Now()
+	err := b.backend.CreateContainer(container)
+	b.tracer.call(b.key, "CreateContainer", map[string]interface{}{"container": container}, start, err)
+	return err
+}
+
+func (b *jsonTraceBackend) DeleteContainer(container string, leaseID string) error {
+	start := time.Now()
+	err := b.backend.DeleteContainer(container, leaseID)
+	b.tracer.call(b.key, "DeleteContainer", map[string]interface{}{"container": container, "leaseId": leaseID}, start, err)
+	return err
+}
+
+func (b *jsonTraceBackend) AcquireContainerLease(container string, duration int, proposedLeaseID string) (string, error) {
+	start := time.Now()
+	leaseID, err := b.backend.AcquireContainerLease(container, duration, proposedLeaseID)
+	b.tracer.call(b.key, "AcquireContainerLease", map[string]interface{}{"container": container, "duration": duration, "leaseId": leaseID}, start, err)
+	return leaseID, err
+}
+
+func (b *jsonTraceBackend) ReleaseContainerLease(container, leaseID string) error {
+	start := time.Now()
+	err := b.backend.ReleaseContainerLease(container, leaseID)
+	b.tracer.call(b.key, "ReleaseContainerLease", map[string]interface{}{"container": container, "leaseId": leaseID}, start, err)
+	return err
+}
+
+func (b *jsonTraceBackend) BreakContainerLease(container string) error {
+	start := time.Now()
+	err := b.backend.BreakContainerLease(container)
+	b.tracer.call(b.key, "BreakContainerLease", map[string]interface{}{"container": container}, start, err)
+	return err
+}
+
+func (b *jsonTraceBackend) ListBlobs(container string, params ListBlobsParameters) ([]BlobProperties, error) {
+	start := time.Now()
+	blobs, err := b.backend.ListBlobs(container, params)
+	b.tracer.call(b.key, "ListBlobs", map[string]interface{}{"container": container, "prefix": params.Prefix, "maxResults": params.MaxResults, "snapshots": params.Snapshots, "deleted": params.Deleted, "versions": params.Versions, "count": len(blobs)}, start, err)
+	return blobs, err
+}
+
+func (b *jsonTraceBackend) GetBlobProperties(container, blob string) (BlobProperties, error) {
+	start := time.Now()
+	props, err := b.backend.GetBlobProperties(container, blob)
+	b.tracer.call(b.key, "GetBlobProperties", map[string]interface{}{"container": container, "blob": blob}, start, err)
+	return props, err
+}
+
+func (b *jsonTraceBackend) GetBlobRange(container, blob, snapshot string, offset, count int64) (io.ReadCloser, error) {
+	start := time.Now()
+	body, err := b.backend.GetBlobRange(container, blob, snapshot, offset, count)
+	b.tracer.call(b.key, "GetBlobRange", map[string]interface{}{"container": container, "blob": blob, "snapshot": snapshot, "offset": offset, "count": count}, start, err)
+	return body, err
+}
+
+func (b *jsonTraceBackend) GetBlobVersionRange(container, blob, versionID string, offset, count int64) (io.ReadCloser, error) {
+	start := time.Now()
+	body, err := b.backend.GetBlobVersionRange(container, blob, versionID, offset, count)
+	b.tracer.call(b.key, "GetBlobVersionRange", map[string]interface{}{"container": container, "blob": blob, "versionID": versionID, "offset": offset, "count": count}, start, err)
+	return body, err
+}
+
+func (b *jsonTraceBackend) SnapshotBlob(container, blob string) (string, error) {
+	start := time.Now()
+	snapshot, err := b.backend.SnapshotBlob(container, blob)
+	b.tracer.call(b.key, "SnapshotBlob", map[string]interface{}{"container": container, "blob": blob, "snapshot": snapshot}, start, err)
+	return snapshot, err
+}
+
+func (b *jsonTraceBackend) GetDeletedBlobRange(container, blob string, offset, count int64) (io.ReadCloser, error) {
+	start := time.Now()
+	body, err := b.backend.GetDeletedBlobRange(container, blob, offset, count)
+	b.tracer.call(b.key, "GetDeletedBlobRange", map[string]interface{}{"container": container, "blob": blob, "offset": offset, "count": count}, start, err)
+	return body, err
+}
+
+func (b *jsonTraceBackend) UndeleteBlob(container, blob string) error {
+	start := time.Now()
+	err := b.backend.UndeleteBlob(container, blob)
+	b.tracer.call(b.key, "UndeleteBlob", map[string]interface{}{"container": container, "blob": blob}, start, err)
+	return err
+}
+
+func (b *jsonTraceBackend) CreateBlockBlob(container, blob string, ifMatch, leaseID string) (BlobProperties, error) {
+	start := time.Now()
+	props, err := b.backend.CreateBlockBlob(container, blob, ifMatch, leaseID)
+	b.tracer.call(b.key, "CreateBlockBlob", map[string]interface{}{"container": container, "blob": blob, "ifMatch": ifMatch, "leaseId": leaseID}, start, err)
+	return props, err
+}
+
+func (b *jsonTraceBackend) DeleteBlob(container, blob string, ifMatch, leaseID string, deleteSnapshots bool) error {
+	start := time.Now()
+	err := b.backend.DeleteBlob(container, blob, ifMatch, leaseID, deleteSnapshots)
+	b.tracer.call(b.key, "DeleteBlob", map[string]interface{}{"container": container, "blob": blob, "ifMatch": ifMatch, "leaseId": leaseID, "deleteSnapshots": deleteSnapshots}, start, err)
+	return err
+}
+
+func (b *jsonTraceBackend) CopyBlob(container, blob, sourceContainer, sourceBlob string, ifMatch string) (BlobProperties, error) {
+	start := time.Now()
+	props, err := b.backend.CopyBlob(container, blob, sourceContainer, sourceBlob, ifMatch)
+	b.tracer.call(b.key, "CopyBlob", map[string]interface{}{"container": container, "blob": blob, "sourceContainer": sourceContainer, "sourceBlob": sourceBlob, "ifMatch": ifMatch}, start, err)
+	return props, err
+}
+
+func (b *jsonTraceBackend) PutBlock(container, blob, blockID string, data []byte, leaseID string) error {
+	start := time.Now()
+	err := b.backend.PutBlock(container, blob, blockID, data, leaseID)
+	b.tracer.call(b.key, "PutBlock", map[string]interface{}{"container": container, "blob": blob, "blockId": blockID, "size": len(data), "leaseId": leaseID}, start, err)
+	return err
+}
+
+func (b *jsonTraceBackend) PutBlockFromURL(container, blob, blockID, sourceContainer, sourceBlob string, offset, count int64, leaseID string) error {
+	start := time.Now()
+	err := b.backend.PutBlockFromURL(container, blob, blockID, sourceContainer, sourceBlob, offset, count, leaseID)
+	b.tracer.call(b.key, "PutBlockFromURL", map[string]interface{}{"container": container, "blob": blob, "blockId": blockID, "sourceContainer": sourceContainer, "sourceBlob": sourceBlob, "offset": offset, "count": count, "leaseId": leaseID}, start, err)
+	return err
+}
+
+func (b *jsonTraceBackend) PutBlockList(container, blob string, blockIDs []string, ifMatch, leaseID string) (BlobProperties, error) {
+	start := time.Now()
+	props, err := b.backend.PutBlockList(container, blob, blockIDs, ifMatch, leaseID)
+	b.tracer.call(b.key, "PutBlockList", map[string]interface{}{"container": container, "blob": blob, "blocks": len(blockIDs), "ifMatch": ifMatch, "leaseId": leaseID}, start, err)
+	return props, err
+}
+
+func (b *jsonTraceBackend) GetBlockList(container, blob string) ([]BlockProperties, error) {
+	start := time.Now()
+	blocks, err := b.backend.GetBlockList(container, blob)
+	b.tracer.call(b.key, "GetBlockList", map[string]interface{}{"container": container, "blob": blob, "blocks": len(blocks)}, start, err)
+	return blocks, err
+}
+
+func (b *jsonTraceBackend) AcquireLease(container, blob string, duration int, proposedLeaseID string) (string, error) {
+	start := time.Now()
+	leaseID, err := b.backend.AcquireLease(container, blob, duration, proposedLeaseID)
+	b.tracer.call(b.key, "AcquireLease", map[string]interface{}{"container": container, "blob": blob, "duration": duration}, start, err)
+	return leaseID, err
+}
+
+func (b *jsonTraceBackend) RenewLease(container, blob, leaseID string) error {
+	start := time.Now()
+	err := b.backend.RenewLease(container, blob, leaseID)
+	b.tracer.call(b.key, "RenewLease", map[string]interface{}{"container": container, "blob": blob}, start, err)
+	return err
+}
+
+func (b *jsonTraceBackend) ReleaseLease(container, blob, leaseID string) error {
+	start := time.Now()
+	err := b.backend.ReleaseLease(container, blob, leaseID)
+	b.tracer.call(b.key, "ReleaseLease", map[string]interface{}{"container": container, "blob": blob}, start, err)
+	return err
+}
+
+func (b *jsonTraceBackend) BreakLease(container, blob string) error {
+	start := time.Now()
+	err := b.backend.BreakLease(container, blob)
+	b.tracer.call(b.key, "BreakLease", map[string]interface{}{"container": container, "blob": blob}, start, err)
+	return err
+}
@@ -0,0 +1,149 @@
+package blobfs
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"sync/atomic"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// readTrace parses the JSON trace lines in buf.
+func readTrace(t *testing.T, buf *bytes.Buffer) []TraceRecord {
+	var records []TraceRecord
+	scanner := bufio.NewScanner(buf)
+	for scanner.Scan() {
+		var record TraceRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("Invalid trace line %q: %s", scanner.Text(), err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestJSONTrace(t *testing.T) {
+	var buf bytes.Buffer
+	tracer := NewTracer(&buf, nil)
+	tracer.log = log.New(ioutil.Discard, "", 0)
+
+	backend := tracer.Backend(newTestBackend(t))
+	fs := tracer.FileSystem(NewFlatBlobFs(conformanceContainer, backend, Options{}))
+
+	expectStatus(t, "Mknod", fs.Mknod("foo", syscall.S_IFREG|0644, 0, nil), fuse.OK)
+	writeFile(t, fs, "foo", "hello")
+	expectStatus(t, "GetAttr", statusOf(fs.GetAttr("bar", nil)), fuse.ENOENT)
+	tracer.Flush()
+
+	var ops []string
+	byOp := make(map[string]TraceRecord)
+	for _, record := range readTrace(t, &buf) {
+		ops = append(ops, record.Op)
+		byOp[record.Op] = record
+		if record.Duration < 0 || record.Time.IsZero() {
+			t.Errorf("%s: unexpected time %v and duration %v", record.Op, record.Time, record.Duration)
+		}
+	}
+
+	expected := []string{"Mknod", "Open", "Write", "Flush", "Release", "GetAttr"}
+	if len(ops) != len(expected) {
+		t.Fatalf("Expected operations %q got %q", expected, ops)
+	}
+	for i := range expected {
+		if ops[i] != expected[i] {
+			t.Fatalf("Expected operations %q got %q", expected, ops)
+		}
+	}
+
+	if mknod := byOp["Mknod"]; mknod.Path != "foo" || mknod.Status != 0 || len(mknod.Calls) == 0 {
+		t.Errorf("Mknod: unexpected record %+v", mknod)
+	}
+
+	// Operations on the open file refer back to Open.
+	if fh := byOp["Open"].FH; fh == 0 || byOp["Write"].FH != fh || byOp["Release"].FH != fh {
+		t.Errorf("File handles don't match: %d %d %d", fh, byOp["Write"].FH, byOp["Release"].FH)
+	}
+	if size := byOp["Write"].Args["size"]; size != float64(5) {
+		t.Errorf("Write: expected size 5 got %v", size)
+	}
+
+	// Flush commits the blob, so storage calls show there.
+	committed := false
+	for _, call := range byOp["Flush"].Calls {
+		committed = committed || call.Op == "PutBlockList"
+	}
+	if !committed {
+		t.Errorf("Flush: expected PutBlockList call got %+v", byOp["Flush"].Calls)
+	}
+
+	if getAttr := byOp["GetAttr"]; getAttr.Status != int32(fuse.ENOENT) || getAttr.Error == "" ||
+		len(getAttr.Calls) == 0 || getAttr.Calls[0].Error == "" {
+		t.Errorf("GetAttr: unexpected record %+v", getAttr)
+	}
+
+	// Storage calls made outside of any operation get a line of their own.
+	backend.ContainerExists(conformanceContainer)
+	tracer.Flush()
+	if records := readTrace(t, &buf); len(records) != 1 || records[0].Op != "storage.ContainerExists" {
+		t.Errorf("Expected storage.ContainerExists record got %+v", records)
+	}
+}
+
+// blockedWriter doesn't return from Write until unblocked.
+type blockedWriter struct {
+	unblock chan struct{}
+}
+
+func (w *blockedWriter) Write(p []byte) (int, error) {
+	<-w.unblock
+	return len(p), nil
+}
+
+func TestJSONTraceDropsWhenBehind(t *testing.T) {
+	out := &blockedWriter{unblock: make(chan struct{})}
+	tracer := NewTracer(out, nil)
+	tracer.log = log.New(ioutil.Discard, "", 0)
+	fs := tracer.FileSystem(NewFlatBlobFs(conformanceContainer, newTestBackend(t), Options{}))
+
+	// Operations don't wait for a trace output which doesn't keep up.
+	for i := 0; i < traceQueueLen+10; i++ {
+		fs.GetAttr("foo", nil)
+	}
+	if dropped := atomic.LoadUint64(&tracer.dropped); dropped == 0 {
+		t.Errorf("Expected dropped records")
+	}
+
+	close(out.unblock)
+	tracer.Flush()
+}
+
+func TestJSONTraceOpenFileCalls(t *testing.T) {
+	var buf bytes.Buffer
+	filter, _ := NewTraceFilter("path=foo")
+	tracer := NewTracer(&buf, filter)
+	tracer.log = log.New(ioutil.Discard, "", 0)
+
+	backend := tracer.Backend(newTestBackend(t))
+	fs := tracer.FileSystem(NewFlatBlobFs(conformanceContainer, backend, Options{}))
+	expectStatus(t, "Mknod", fs.Mknod("foo", syscall.S_IFREG|0644, 0, nil), fuse.OK)
+	file, status := fs.Open("foo", uint32(syscall.O_RDONLY), nil)
+	expectStatus(t, "Open", status, fuse.OK)
+
+	// Calls made for the open file outside of any operation, such as
+	// renewing its lease, go by the name of the file.
+	tracer.Flush()
+	buf.Reset()
+	backendFor(backend, innermostFile(file)).GetBlobProperties(conformanceContainer, "foo")
+	file.Release()
+	tracer.Flush()
+
+	records := readTrace(t, &buf)
+	if len(records) != 2 || records[0].Op != "storage.GetBlobProperties" || records[0].Path != "foo" || records[1].Op != "Release" {
+		t.Errorf("Expected storage.GetBlobProperties on foo and Release got %+v", records)
+	}
+}
@@ -0,0 +1,1292 @@
+package blobfs
+
+// Backend which keeps containers and blobs in a local directory tree, for
+// working on laptops and air-gapped machines without a storage account.
+//
+// The layout is:
+//
+//     <root>/<container>/                      a container
+//     <root>/<container>/<blob name>           a blob, '/' in names make subdirectories
+//     <root>/<container>/.azurefs/<blob>.json  sidecar with the block list and lease
+//     <root>/<container>/.azurefs/<blob>.snapshots/<timestamp>
+//                                              a snapshot of the blob
+//     <root>/.azurefs/<container>.json         sidecar with the container lease
+//     <root>/.azurefs/deleted/<container>.json index of the deleted blobs
+//     <root>/.azurefs/deleted/<container>/<id> a deleted blob, see deletedPath
+//
+// Files can be dropped into the tree by other tools too, they show up as
+// blobs without a block list.
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// localMetaDir is the directory in each container with the sidecar files.
+// Blob names starting with it are rejected.
+const localMetaDir = ".azurefs"
+
+// maxBlobNameLen is the longest blob name Azure accepts.
+const maxBlobNameLen = 1024
+
+// validContainerName matches names Azure accepts for containers: 3 to 63
+// lowercase letters, digits and single dashes, not starting or ending
+// with a dash.
+var validContainerName = regexp.MustCompile(`^[a-z0-9]([a-z0-9]|-[a-z0-9])+$`)
+
+// NewLocalBackend creates a Backend which keeps everything under
+// the directory root. The directory must exist.
+func NewLocalBackend(root string) (Backend, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("'%s' is not a directory", root)
+	}
+
+	return &localBackend{
+		root:        root,
+		uncommitted: make(map[string]map[string][]byte),
+		now:         time.Now,
+	}, nil
+}
+
+type localBackend struct {
+	root string
+
+	mu sync.Mutex
+
+	// uncommitted blocks by container/blob. They are only kept in memory
+	// and lost on restart, same as Azure drops them after a week.
+	uncommitted map[string]map[string][]byte
+
+	// now is the clock used for lease expiry.
+	now func() time.Time
+}
+
+// localSidecar is what is kept in the sidecar JSON of a blob.
+type localSidecar struct {
+	// ETag of the file when Blocks were committed. The block list is
+	// stale if the file was changed by something else since.
+	ETag   string       `json:"etag,omitempty"`
+	Blocks []localBlock `json:"blocks,omitempty"`
+
+	LeaseID string `json:"leaseId,omitempty"`
+
+	// LeaseExpires is zero for infinite leases.
+	LeaseExpires time.Time `json:"leaseExpires,omitempty"`
+}
+
+type localBlock struct {
+	ID   string `json:"id"`
+	Size int64  `json:"size"`
+}
+
+func (s *localSidecar) lease() memoryLease {
+	return memoryLease{id: s.LeaseID, expires: s.LeaseExpires}
+}
+
+func (b *localBackend) ListContainers(prefix string) ([]ContainerProperties, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	infos, err := ioutil.ReadDir(b.root)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []ContainerProperties
+	for _, fi := range infos {
+		name := fi.Name()
+		if !fi.IsDir() || !isValidContainerName(name) || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		sidecar, err := b.readSidecarFile(b.containerSidecarPath(name))
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, ContainerProperties{
+			Name:         name,
+			LastModified: fi.ModTime().UTC(),
+			ETag:         localETag(fi),
+			LeaseState:   sidecar.lease().state(b.now()),
+		})
+	}
+
+	sort.Sort(containersByName(result))
+	return result, nil
+}
+
+func (b *localBackend) ContainerExists(container string) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	err := b.checkContainer(container)
+	if isNotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (b *localBackend) CreateContainer(container string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !isValidContainerName(container) {
+		return errInvalidResourceName()
+	}
+
+	err := os.Mkdir(filepath.Join(b.root, container), 0755)
+	if os.IsExist(err) {
+		return &StorageError{http.StatusConflict, errorCodeContainerAlreadyExists, "The specified container already exists."}
+	}
+	return err
+}
+
+func (b *localBackend) DeleteContainer(container string, leaseID string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err := b.checkContainer(container); err != nil {
+		return err
+	}
+
+	sidecar, err := b.readSidecarFile(b.containerSidecarPath(container))
+	if err != nil {
+		return err
+	}
+	if err := sidecar.lease().checkWrite(leaseID, b.now()); err != nil {
+		return err
+	}
+	if err := os.Remove(b.containerSidecarPath(container)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Remove(b.deletedIndexPath(container)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.RemoveAll(b.deletedPath(container, "")); err != nil {
+		return err
+	}
+
+	for key := range b.uncommitted {
+		if strings.HasPrefix(key, container+"/") {
+			delete(b.uncommitted, key)
+		}
+	}
+
+	return os.RemoveAll(filepath.Join(b.root, container))
+}
+
+func (b *localBackend) ListBlobs(container string, params ListBlobsParameters) ([]BlobProperties, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err := b.checkContainer(container); err != nil {
+		return nil, err
+	}
+
+	containerDir := filepath.Join(b.root, container)
+	var result []BlobProperties
+	err := filepath.Walk(containerDir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(containerDir, path)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+
+		if fi.IsDir() {
+			if name == localMetaDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if !fi.Mode().IsRegular() || !strings.HasPrefix(name, params.Prefix) {
+			return nil
+		}
+		if params.Snapshots {
+			snapshots, err := b.listSnapshots(container, name)
+			if err != nil {
+				return err
+			}
+			result = append(result, snapshots...)
+		}
+		result = append(result, localBlobProperties(name, fi))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if params.Deleted {
+		deleted, err := b.listDeleted(container, params.Prefix)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, deleted...)
+	}
+
+	sort.Sort(blobsByName(result))
+	if params.MaxResults > 0 && uint(len(result)) > params.MaxResults {
+		result = result[:params.MaxResults]
+	}
+	return result, nil
+}
+
+func (b *localBackend) GetBlobProperties(container, blob string) (BlobProperties, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	fi, err := b.statBlob(container, blob)
+	if err != nil {
+		return BlobProperties{}, err
+	}
+
+	sidecar, err := b.readSidecar(container, blob)
+	if err != nil {
+		return BlobProperties{}, err
+	}
+
+	props := localBlobProperties(blob, fi)
+	props.LeaseState = sidecar.lease().state(b.now())
+	return props, nil
+}
+
+func (b *localBackend) GetBlobRange(container, blob, snapshot string, offset, count int64) (io.ReadCloser, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	fi, err := b.statBlob(container, blob)
+	if err != nil {
+		return nil, err
+	}
+
+	path := b.blobPath(container, blob)
+	if snapshot != "" {
+		if _, err := time.Parse(snapshotTimeFormat, snapshot); err != nil {
+			return nil, errBlobNotFound()
+		}
+		path = filepath.Join(b.snapshotDir(container, blob), snapshot)
+		fi, err = os.Stat(path)
+		if os.IsNotExist(err) {
+			return nil, errBlobNotFound()
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return openLocalRange(path, fi, offset, count)
+}
+
+func (b *localBackend) GetDeletedBlobRange(container, blob string, offset, count int64) (io.ReadCloser, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err := b.checkContainer(container); err != nil {
+		return nil, err
+	}
+
+	index, err := b.deletedIndex(container)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := index[blob]; !ok {
+		return nil, errBlobNotFound()
+	}
+
+	path := b.deletedPath(container, blob)
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return openLocalRange(path, fi, offset, count)
+}
+
+func (b *localBackend) UndeleteBlob(container, blob string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err := b.checkContainer(container); err != nil {
+		return err
+	}
+
+	index, err := b.deletedIndex(container)
+	if err != nil {
+		return err
+	}
+	if _, ok := index[blob]; !ok {
+		return errBlobNotFound()
+	}
+
+	if _, err := b.statBlob(container, blob); err == nil {
+		// Like Azure, bring back only the snapshots, the blob stays deleted.
+		return b.mergeSnapshots(b.deletedPath(container, blob)+".snapshots", b.snapshotDir(container, blob))
+	} else if !isNotFound(err) {
+		return err
+	}
+
+	path := b.blobPath(container, blob)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return errLocalPathConflict(err)
+	}
+	if err := os.Rename(b.deletedPath(container, blob), path); err != nil {
+		return errLocalPathConflict(err)
+	}
+
+	// The snapshots come back too, the block list doesn't.
+	if err := b.moveSnapshots(b.deletedPath(container, blob)+".snapshots", b.snapshotDir(container, blob)); err != nil {
+		return err
+	}
+
+	delete(index, blob)
+	return b.writeDeletedIndex(container, index)
+}
+
+// GetBlobVersionRange fails, the local backend keeps no versions and lists
+// none, like an account without blob versioning.
+func (b *localBackend) GetBlobVersionRange(container, blob, versionID string, offset, count int64) (io.ReadCloser, error) {
+	return nil, errNotImplemented("Blob versioning")
+}
+
+func (b *localBackend) SnapshotBlob(container, blob string) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	fi, err := b.statBlob(container, blob)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := ioutil.ReadFile(b.blobPath(container, blob))
+	if err != nil {
+		return "", err
+	}
+
+	dir := b.snapshotDir(container, blob)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+
+	// Timestamps have a resolution of 100ns and must be unique per blob.
+	t := b.now().UTC()
+	snapshot := t.Format(snapshotTimeFormat)
+	for {
+		_, err := os.Stat(filepath.Join(dir, snapshot))
+		if os.IsNotExist(err) {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		t = t.Add(100 * time.Nanosecond)
+		snapshot = t.Format(snapshotTimeFormat)
+	}
+
+	// Same time as the blob, so that the snapshot has its ETag too.
+	path := filepath.Join(dir, snapshot)
+	if err := ioutil.WriteFile(path, data, 0444); err != nil {
+		return "", err
+	}
+	return snapshot, os.Chtimes(path, fi.ModTime(), fi.ModTime())
+}
+
+func (b *localBackend) CreateBlockBlob(container, blob string, ifMatch, leaseID string) (BlobProperties, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	sidecar, err := b.writableBlob(container, blob, leaseID)
+	if err != nil {
+		return BlobProperties{}, err
+	}
+
+	if err := b.checkIfMatch(container, blob, ifMatch); err != nil {
+		return BlobProperties{}, err
+	}
+
+	delete(b.uncommitted, container+"/"+blob)
+	return b.commit(container, blob, nil, nil, sidecar)
+}
+
+// CopyBlob copies right away and keeps no copy status, as there is nowhere
+// to keep it but the sidecar and GetBlobProperties doesn't read those.
+func (b *localBackend) CopyBlob(container, blob, sourceContainer, sourceBlob string, ifMatch string) (BlobProperties, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, err := b.statBlob(sourceContainer, sourceBlob); err != nil {
+		return BlobProperties{}, err
+	}
+
+	sidecar, err := b.writableBlob(container, blob, "")
+	if err != nil {
+		return BlobProperties{}, err
+	}
+
+	if err := b.checkIfMatch(container, blob, ifMatch); err != nil {
+		return BlobProperties{}, err
+	}
+
+	data, err := ioutil.ReadFile(b.blobPath(sourceContainer, sourceBlob))
+	if err != nil {
+		return BlobProperties{}, err
+	}
+
+	delete(b.uncommitted, container+"/"+blob)
+	return b.commit(container, blob, data, nil, sidecar)
+}
+
+func (b *localBackend) DeleteBlob(container, blob string, ifMatch, leaseID string, deleteSnapshots bool) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, err := b.statBlob(container, blob); err != nil {
+		return err
+	}
+
+	if err := b.checkIfMatch(container, blob, ifMatch); err != nil {
+		return err
+	}
+
+	sidecar, err := b.readSidecar(container, blob)
+	if err != nil {
+		return err
+	}
+	if err := sidecar.lease().checkWrite(leaseID, b.now()); err != nil {
+		return err
+	}
+
+	if !deleteSnapshots {
+		snapshots, err := b.listSnapshots(container, blob)
+		if err != nil {
+			return err
+		}
+		if len(snapshots) != 0 {
+			return errSnapshotsPresent()
+		}
+	}
+
+	// Soft delete, with the snapshots. A blob deleted earlier by the same
+	// name is gone for good.
+	index, err := b.deletedIndex(container)
+	if err != nil {
+		return err
+	}
+	deletedPath := b.deletedPath(container, blob)
+	if err := os.RemoveAll(deletedPath + ".snapshots"); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(deletedPath), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(b.blobPath(container, blob), deletedPath); err != nil {
+		return err
+	}
+	index[blob] = b.now().UTC()
+	if err := b.writeDeletedIndex(container, index); err != nil {
+		return err
+	}
+	if err := b.moveSnapshots(b.snapshotDir(container, blob), deletedPath+".snapshots"); err != nil {
+		return err
+	}
+
+	if err := os.Remove(b.sidecarPath(container, blob)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	delete(b.uncommitted, container+"/"+blob)
+
+	// Don't leave behind directories which only existed for this blob.
+	b.removeEmptyParents(filepath.Join(b.root, container), b.blobPath(container, blob))
+	b.removeEmptyParents(filepath.Join(b.root, container, localMetaDir), b.sidecarPath(container, blob))
+	return nil
+}
+
+// listDeleted returns the deleted blobs starting with prefix. Must be
+// called with mu held.
+func (b *localBackend) listDeleted(container, prefix string) ([]BlobProperties, error) {
+	index, err := b.deletedIndex(container)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []BlobProperties
+	for name, deletedTime := range index {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		fi, err := os.Stat(b.deletedPath(container, name))
+		if err != nil {
+			return nil, err
+		}
+		props := localBlobProperties(name, fi)
+		props.Deleted = true
+		props.DeletedTime = deletedTime
+		result = append(result, props)
+	}
+	return result, nil
+}
+
+// deletedIndex returns when the deleted blobs of the container were
+// deleted by name, after removing those deleted for longer than
+// softDeleteRetention. Must be called with mu held.
+func (b *localBackend) deletedIndex(container string) (map[string]time.Time, error) {
+	index := make(map[string]time.Time)
+
+	path := b.deletedIndexPath(container)
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return index, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, fmt.Errorf("invalid index '%s': %s", path, err)
+	}
+
+	expired := false
+	for name, deletedTime := range index {
+		if b.now().Sub(deletedTime) > softDeleteRetention {
+			os.Remove(b.deletedPath(container, name))
+			os.RemoveAll(b.deletedPath(container, name) + ".snapshots")
+			delete(index, name)
+			expired = true
+		}
+	}
+	if expired {
+		if err := b.writeDeletedIndex(container, index); err != nil {
+			return nil, err
+		}
+	}
+	return index, nil
+}
+
+// writeDeletedIndex must be called with mu held.
+func (b *localBackend) writeDeletedIndex(container string, index map[string]time.Time) error {
+	data, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+
+	path := b.deletedIndexPath(container)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// moveSnapshots moves the snapshot directory from to to, if there is one.
+func (b *localBackend) moveSnapshots(from, to string) error {
+	if _, err := os.Stat(from); os.IsNotExist(err) {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(to), 0755); err != nil {
+		return err
+	}
+	return os.Rename(from, to)
+}
+
+// mergeSnapshots moves the snapshots in the directory from into to, except
+// for those with a timestamp already taken there.
+func (b *localBackend) mergeSnapshots(from, to string) error {
+	infos, err := ioutil.ReadDir(from)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(to, 0755); err != nil {
+		return errLocalPathConflict(err)
+	}
+
+	for _, fi := range infos {
+		path := filepath.Join(to, fi.Name())
+		if _, err := os.Stat(path); err == nil {
+			continue
+		}
+		if err := os.Rename(filepath.Join(from, fi.Name()), path); err != nil {
+			return err
+		}
+	}
+	return os.RemoveAll(from)
+}
+
+// listSnapshots returns the snapshots of the blob, oldest first. Must be
+// called with mu held.
+func (b *localBackend) listSnapshots(container, blob string) ([]BlobProperties, error) {
+	infos, err := ioutil.ReadDir(b.snapshotDir(container, blob))
+	if os.IsNotExist(err) || isNotDir(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var result []BlobProperties
+	for _, fi := range infos {
+		if _, err := time.Parse(snapshotTimeFormat, fi.Name()); err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+		props := localBlobProperties(blob, fi)
+		props.Snapshot = fi.Name()
+		result = append(result, props)
+	}
+	return result, nil
+}
+
+func (b *localBackend) PutBlock(container, blob, blockID string, data []byte, leaseID string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.putBlock(container, blob, blockID, append([]byte(nil), data...), leaseID)
+}
+
+func (b *localBackend) PutBlockFromURL(container, blob, blockID, sourceContainer, sourceBlob string, offset, count int64, leaseID string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	fi, err := b.statBlob(sourceContainer, sourceBlob)
+	if err != nil {
+		return err
+	}
+	if count > copyBlockSize || offset+count > fi.Size() {
+		return errInvalidRange()
+	}
+
+	body, err := openLocalRange(b.blobPath(sourceContainer, sourceBlob), fi, offset, count)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return err
+	}
+
+	return b.putBlock(container, blob, blockID, data, leaseID)
+}
+
+// putBlock stages data, which it keeps, as the block. Must be called with
+// mu held.
+func (b *localBackend) putBlock(container, blob, blockID string, data []byte, leaseID string) error {
+	if _, err := b.writableBlob(container, blob, leaseID); err != nil {
+		return err
+	}
+
+	key := container + "/" + blob
+	uncommitted := b.uncommitted[key]
+	if err := checkBlockID(&memoryBlob{uncommitted: uncommitted}, blockID); err != nil {
+		return err
+	}
+
+	if uncommitted == nil {
+		uncommitted = make(map[string][]byte)
+		b.uncommitted[key] = uncommitted
+	}
+	uncommitted[blockID] = data
+	return nil
+}
+
+func (b *localBackend) PutBlockList(container, blob string, blockIDs []string, ifMatch, leaseID string) (BlobProperties, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	sidecar, err := b.writableBlob(container, blob, leaseID)
+	if err != nil {
+		return BlobProperties{}, err
+	}
+
+	if err := b.checkIfMatch(container, blob, ifMatch); err != nil {
+		return BlobProperties{}, err
+	}
+
+	committed, err := b.committedBlocks(container, blob, sidecar)
+	if err != nil {
+		return BlobProperties{}, err
+	}
+
+	// Same as BlockStatusLatest: prefer uncommitted blocks, then committed.
+	key := container + "/" + blob
+	blocks := make([]localBlock, 0, len(blockIDs))
+	var data []byte
+	for _, id := range blockIDs {
+		blockData, ok := b.uncommitted[key][id]
+		if !ok {
+			blockData, ok = committed[id]
+		}
+		if !ok {
+			return BlobProperties{}, &StorageError{http.StatusBadRequest, errorCodeInvalidBlockList, "The specified block list is invalid."}
+		}
+		blocks = append(blocks, localBlock{ID: id, Size: int64(len(blockData))})
+		data = append(data, blockData...)
+	}
+
+	props, err := b.commit(container, blob, data, blocks, sidecar)
+	if err != nil {
+		return BlobProperties{}, err
+	}
+
+	delete(b.uncommitted, key)
+	return props, nil
+}
+
+func (b *localBackend) GetBlockList(container, blob string) ([]BlockProperties, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	fi, err := b.statBlob(container, blob)
+	if err != nil {
+		return nil, err
+	}
+
+	sidecar, err := b.readSidecar(container, blob)
+	if err != nil {
+		return nil, err
+	}
+
+	if sidecar.ETag != localETag(fi) {
+		return nil, nil
+	}
+
+	blocks := make([]BlockProperties, len(sidecar.Blocks))
+	for i, block := range sidecar.Blocks {
+		blocks[i] = BlockProperties{ID: block.ID, Size: block.Size}
+	}
+	return blocks, nil
+}
+
+func (b *localBackend) AcquireLease(container, blob string, duration int, proposedLeaseID string) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, err := b.statBlob(container, blob); err != nil {
+		return "", err
+	}
+
+	sidecar, err := b.readSidecar(container, blob)
+	if err != nil {
+		return "", err
+	}
+
+	leaseID, err := b.acquireLease(sidecar, duration, proposedLeaseID)
+	if err != nil {
+		return "", err
+	}
+
+	return leaseID, b.writeSidecar(container, blob, sidecar)
+}
+
+func (b *localBackend) RenewLease(container, blob, leaseID string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	sidecar, err := b.leasedBlob(container, blob, leaseID)
+	if err != nil {
+		return err
+	}
+
+	if !sidecar.LeaseExpires.IsZero() {
+		duration := sidecar.LeaseExpires.Sub(b.now())
+		if duration < 15*time.Second {
+			duration = 15 * time.Second
+		}
+		sidecar.LeaseExpires = b.now().Add(duration)
+	}
+
+	return b.writeSidecar(container, blob, sidecar)
+}
+
+func (b *localBackend) ReleaseLease(container, blob, leaseID string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	sidecar, err := b.leasedBlob(container, blob, leaseID)
+	if err != nil {
+		return err
+	}
+
+	sidecar.LeaseID = ""
+	sidecar.LeaseExpires = time.Time{}
+	return b.writeSidecar(container, blob, sidecar)
+}
+
+func (b *localBackend) BreakLease(container, blob string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, err := b.statBlob(container, blob); err != nil {
+		return err
+	}
+
+	sidecar, err := b.readSidecar(container, blob)
+	if err != nil {
+		return err
+	}
+
+	if err := b.breakLease(sidecar); err != nil {
+		return err
+	}
+
+	return b.writeSidecar(container, blob, sidecar)
+}
+
+func (b *localBackend) AcquireContainerLease(container string, duration int, proposedLeaseID string) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err := b.checkContainer(container); err != nil {
+		return "", err
+	}
+
+	sidecar, err := b.readSidecarFile(b.containerSidecarPath(container))
+	if err != nil {
+		return "", err
+	}
+
+	leaseID, err := b.acquireLease(sidecar, duration, proposedLeaseID)
+	if err != nil {
+		return "", err
+	}
+
+	return leaseID, b.writeSidecarFile(b.containerSidecarPath(container), sidecar)
+}
+
+func (b *localBackend) ReleaseContainerLease(container, leaseID string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err := b.checkContainer(container); err != nil {
+		return err
+	}
+
+	sidecar, err := b.readSidecarFile(b.containerSidecarPath(container))
+	if err != nil {
+		return err
+	}
+
+	if err := checkLeaseID(sidecar.lease(), leaseID); err != nil {
+		return err
+	}
+
+	return os.Remove(b.containerSidecarPath(container))
+}
+
+func (b *localBackend) BreakContainerLease(container string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err := b.checkContainer(container); err != nil {
+		return err
+	}
+
+	sidecar, err := b.readSidecarFile(b.containerSidecarPath(container))
+	if err != nil {
+		return err
+	}
+
+	if err := b.breakLease(sidecar); err != nil {
+		return err
+	}
+
+	return os.Remove(b.containerSidecarPath(container))
+}
+
+// acquireLease acquires or changes the lease kept in sidecar, of a blob
+// or container. Must be called with mu held.
+func (b *localBackend) acquireLease(sidecar *localSidecar, duration int, proposedLeaseID string) (string, error) {
+	if duration != -1 && (duration < 15 || duration > 60) {
+		return "", &StorageError{http.StatusBadRequest, errorCodeInvalidHeaderValue, "The value for one of the HTTP headers is not in the correct format."}
+	}
+
+	now := b.now()
+	if sidecar.lease().isActive(now) && sidecar.LeaseID != proposedLeaseID {
+		return "", &StorageError{http.StatusConflict, errorCodeLeaseAlreadyPresent, "There is already a lease present."}
+	}
+
+	leaseID := proposedLeaseID
+	if leaseID == "" {
+		var err error
+		if leaseID, err = newLeaseID(); err != nil {
+			return "", err
+		}
+	}
+
+	sidecar.LeaseID = leaseID
+	sidecar.LeaseExpires = time.Time{}
+	if duration != -1 {
+		sidecar.LeaseExpires = now.Add(time.Duration(duration) * time.Second)
+	}
+	return leaseID, nil
+}
+
+// breakLease ends the lease kept in sidecar. Must be called with mu held.
+func (b *localBackend) breakLease(sidecar *localSidecar) error {
+	if !sidecar.lease().isActive(b.now()) {
+		return &StorageError{http.StatusConflict, errorCodeLeaseNotPresent, "There is currently no lease on the blob."}
+	}
+
+	// Break period of 0, the lease ends immediately.
+	sidecar.LeaseID = ""
+	sidecar.LeaseExpires = time.Time{}
+	return nil
+}
+
+// checkContainer returns ContainerNotFound unless the container exists.
+// Must be called with mu held.
+func (b *localBackend) checkContainer(container string) error {
+	if !isValidContainerName(container) {
+		return errContainerNotFound()
+	}
+
+	fi, err := os.Stat(filepath.Join(b.root, container))
+	if os.IsNotExist(err) || (err == nil && !fi.IsDir()) {
+		return errContainerNotFound()
+	}
+	return err
+}
+
+// statBlob returns the file of the blob if it exists. Must be called with mu held.
+func (b *localBackend) statBlob(container, blob string) (os.FileInfo, error) {
+	if err := b.checkContainer(container); err != nil {
+		return nil, err
+	}
+
+	if !isValidLocalBlobName(blob) {
+		return nil, errBlobNotFound()
+	}
+
+	fi, err := os.Stat(b.blobPath(container, blob))
+	if os.IsNotExist(err) || isNotDir(err) || (err == nil && !fi.Mode().IsRegular()) {
+		return nil, errBlobNotFound()
+	}
+	return fi, err
+}
+
+// checkIfMatch fails with ConditionNotMet unless ifMatch is not given or
+// is the ETag of the blob. Must be called with mu held.
+func (b *localBackend) checkIfMatch(container, blob string, ifMatch string) error {
+	if ifMatch == "" {
+		return nil
+	}
+
+	fi, err := b.statBlob(container, blob)
+	if isNotFound(err) || (err == nil && localETag(fi) != ifMatch) {
+		return errConditionNotMet()
+	}
+	return err
+}
+
+// writableBlob checks that the blob can be written to with leaseID and
+// returns its sidecar. Must be called with mu held.
+func (b *localBackend) writableBlob(container, blob, leaseID string) (*localSidecar, error) {
+	if err := b.checkContainer(container); err != nil {
+		return nil, err
+	}
+
+	if !isValidLocalBlobName(blob) {
+		return nil, errInvalidResourceName()
+	}
+
+	sidecar, err := b.readSidecar(container, blob)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := sidecar.lease().checkWrite(leaseID, b.now()); err != nil {
+		return nil, err
+	}
+
+	return sidecar, nil
+}
+
+// leasedBlob returns the sidecar of the blob if leaseID matches its lease,
+// whether the lease expired or not. Must be called with mu held.
+func (b *localBackend) leasedBlob(container, blob, leaseID string) (*localSidecar, error) {
+	if _, err := b.statBlob(container, blob); err != nil {
+		return nil, err
+	}
+
+	sidecar, err := b.readSidecar(container, blob)
+	if err != nil {
+		return nil, err
+	}
+
+	if sidecar.LeaseID == "" {
+		return nil, &StorageError{http.StatusConflict, errorCodeLeaseNotPresent, "There is currently no lease on the blob."}
+	}
+
+	if sidecar.LeaseID != leaseID {
+		return nil, &StorageError{http.StatusConflict, errorCodeLeaseIDMismatch, "The lease ID specified did not match the lease ID for the blob."}
+	}
+
+	return sidecar, nil
+}
+
+// committedBlocks returns the data of the committed blocks of the blob
+// by ID, nothing if the blob does not exist or the block list is stale.
+// Must be called with mu held.
+func (b *localBackend) committedBlocks(container, blob string, sidecar *localSidecar) (map[string][]byte, error) {
+	fi, err := os.Stat(b.blobPath(container, blob))
+	if err != nil || sidecar.ETag != localETag(fi) {
+		return nil, nil
+	}
+
+	data, err := ioutil.ReadFile(b.blobPath(container, blob))
+	if err != nil {
+		return nil, err
+	}
+
+	blocks := make(map[string][]byte, len(sidecar.Blocks))
+	var off int64
+	for _, block := range sidecar.Blocks {
+		if off+block.Size > int64(len(data)) {
+			return nil, nil
+		}
+		blocks[block.ID] = data[off : off+block.Size]
+		off += block.Size
+	}
+	return blocks, nil
+}
+
+// commit replaces the content of the blob with data atomically, records
+// the block list in the sidecar and returns the properties of the new
+// content. Must be called with mu held.
+func (b *localBackend) commit(container, blob string, data []byte, blocks []localBlock, sidecar *localSidecar) (BlobProperties, error) {
+	metaDir := filepath.Join(b.root, container, localMetaDir)
+	if err := os.MkdirAll(metaDir, 0755); err != nil {
+		return BlobProperties{}, err
+	}
+
+	tmp, err := ioutil.TempFile(metaDir, "upload-")
+	if err != nil {
+		return BlobProperties{}, err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return BlobProperties{}, err
+	}
+
+	path := b.blobPath(container, blob)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return BlobProperties{}, errLocalPathConflict(err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return BlobProperties{}, errLocalPathConflict(err)
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return BlobProperties{}, err
+	}
+
+	sidecar.ETag = localETag(fi)
+	sidecar.Blocks = blocks
+	return localBlobProperties(blob, fi), b.writeSidecar(container, blob, sidecar)
+}
+
+// readSidecar returns the sidecar of the blob, empty if there is none.
+// Must be called with mu held.
+func (b *localBackend) readSidecar(container, blob string) (*localSidecar, error) {
+	return b.readSidecarFile(b.sidecarPath(container, blob))
+}
+
+// writeSidecar must be called with mu held.
+func (b *localBackend) writeSidecar(container, blob string, sidecar *localSidecar) error {
+	return b.writeSidecarFile(b.sidecarPath(container, blob), sidecar)
+}
+
+// readSidecarFile returns the sidecar at path, empty if there is none.
+// Must be called with mu held.
+func (b *localBackend) readSidecarFile(path string) (*localSidecar, error) {
+	sidecar := &localSidecar{}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) || isNotDir(err) {
+		return sidecar, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, sidecar); err != nil {
+		return nil, fmt.Errorf("invalid sidecar '%s': %s", path, err)
+	}
+	return sidecar, nil
+}
+
+// writeSidecarFile must be called with mu held.
+func (b *localBackend) writeSidecarFile(path string, sidecar *localSidecar) error {
+	data, err := json.Marshal(sidecar)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// removeEmptyParents removes the directories of path up to but not
+// including top as long as they are empty.
+func (b *localBackend) removeEmptyParents(top, path string) {
+	for dir := filepath.Dir(path); dir != top && strings.HasPrefix(dir, top); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			return
+		}
+	}
+}
+
+func (b *localBackend) blobPath(container, blob string) string {
+	return filepath.Join(b.root, container, filepath.FromSlash(blob))
+}
+
+func (b *localBackend) sidecarPath(container, blob string) string {
+	return filepath.Join(b.root, container, localMetaDir, filepath.FromSlash(blob)+".json")
+}
+
+// snapshotDir is next to the sidecar of the blob. Timestamps don't end
+// in ".json", so snapshots can't be mistaken for sidecars of other blobs.
+func (b *localBackend) snapshotDir(container, blob string) string {
+	return filepath.Join(b.root, container, localMetaDir, filepath.FromSlash(blob)+".snapshots")
+}
+
+// deletedPath is where the deleted blob is kept, or the directory of all
+// deleted blobs of the container if blob is "". Deleted blobs are kept
+// under a hash of their name, so that they can't get in each other's way
+// like 'a' and 'a/b' would.
+func (b *localBackend) deletedPath(container, blob string) string {
+	dir := filepath.Join(b.root, localMetaDir, "deleted", container)
+	if blob == "" {
+		return dir
+	}
+	return filepath.Join(dir, fmt.Sprintf("%x", sha1.Sum([]byte(blob))))
+}
+
+func (b *localBackend) deletedIndexPath(container string) string {
+	return filepath.Join(b.root, localMetaDir, "deleted", container+".json")
+}
+
+// containerSidecarPath is outside of the container, where no blob sidecar
+// can be. Not a valid container name either, so ListContainers skips it.
+func (b *localBackend) containerSidecarPath(container string) string {
+	return filepath.Join(b.root, localMetaDir, container+".json")
+}
+
+type localRangeReader struct {
+	io.Reader
+	io.Closer
+}
+
+// openLocalRange returns count bytes at offset of the file at path.
+func openLocalRange(path string, fi os.FileInfo, offset, count int64) (io.ReadCloser, error) {
+	if offset < 0 || count <= 0 || offset >= fi.Size() {
+		return nil, errInvalidRange()
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &localRangeReader{io.NewSectionReader(f, offset, count), f}, nil
+}
+
+func localBlobProperties(name string, fi os.FileInfo) BlobProperties {
+	return BlobProperties{
+		Name:          name,
+		ContentLength: fi.Size(),
+		LastModified:  fi.ModTime().UTC(),
+		ETag:          localETag(fi),
+	}
+}
+
+// localETag derives an ETag from the modification time and size, so that
+// changes made to the files by other tools change it too.
+func localETag(fi os.FileInfo) string {
+	return fmt.Sprintf("\"0x8D%X%X\"", fi.ModTime().UnixNano(), fi.Size())
+}
+
+func isValidContainerName(name string) bool {
+	return len(name) >= 3 && len(name) <= 63 && validContainerName.MatchString(name)
+}
+
+// isValidLocalBlobName tells if the blob name can be mapped to a path in
+// the container. Names with empty, '.' or '..' segments can't.
+func isValidLocalBlobName(name string) bool {
+	if name == "" || len(name) > maxBlobNameLen || strings.ContainsRune(name, 0) {
+		return false
+	}
+
+	segments := strings.Split(name, "/")
+	if segments[0] == localMetaDir {
+		return false
+	}
+	for _, segment := range segments {
+		if segment == "" || segment == "." || segment == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// isNotDir tells if err is ENOTDIR, i.e. a blob is in the way of a path
+// with it as a directory.
+func isNotDir(err error) bool {
+	if e, ok := err.(*os.PathError); ok {
+		err = e.Err
+	}
+	return err == syscall.ENOTDIR
+}
+
+// newLeaseID returns a random ID in the GUID format Azure uses.
+func newLeaseID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+func errInvalidResourceName() error {
+	return &StorageError{http.StatusBadRequest, errorCodeInvalidResourceName, "The specified resource name contains invalid characters."}
+}
+
+// errLocalPathConflict is returned when a blob can't be written because
+// its name needs a file where there is a directory or the other way round,
+// e.g. 'a/b' when there is a blob 'a'.
+func errLocalPathConflict(err error) error {
+	return &StorageError{http.StatusConflict, errorCodeBlobAlreadyExists, err.Error()}
+}
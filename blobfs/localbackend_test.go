@@ -0,0 +1,196 @@
+package blobfs
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestLocalBackend(t *testing.T) (*localBackend, func()) {
+	root, err := ioutil.TempDir("", "localbackend")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := NewLocalBackend(root)
+	if err != nil {
+		os.RemoveAll(root)
+		t.Fatal(err)
+	}
+
+	if err := b.CreateContainer("data"); err != nil {
+		os.RemoveAll(root)
+		t.Fatal(err)
+	}
+
+	return b.(*localBackend), func() { os.RemoveAll(root) }
+}
+
+func TestLocalBackendLayout(t *testing.T) {
+	b, cleanup := newTestLocalBackend(t)
+	defer cleanup()
+
+	putBlob(t, b, "data", "dir/foo", "content")
+
+	data, err := ioutil.ReadFile(filepath.Join(b.root, "data", "dir", "foo"))
+	if err != nil || string(data) != "content" {
+		t.Errorf("blob file: expected 'content' got '%s' %v", data, err)
+	}
+
+	if _, err := os.Stat(filepath.Join(b.root, "data", localMetaDir, "dir", "foo.json")); err != nil {
+		t.Errorf("sidecar: %s", err)
+	}
+
+	// Files put there by other tools are blobs too.
+	if err := ioutil.WriteFile(filepath.Join(b.root, "data", "bar"), []byte("dropped"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	blobs, err := b.ListBlobs("data", ListBlobsParameters{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blobs) != 2 || blobs[0].Name != "bar" || blobs[1].Name != "dir/foo" {
+		t.Errorf("ListBlobs: expected [bar dir/foo] got %v", blobs)
+	}
+
+	if got := readBlob(t, b, "data", "bar", 1, 3); got != "rop" {
+		t.Errorf("GetBlobRange: expected 'rop' got '%s'", got)
+	}
+
+	if err := b.DeleteBlob("data", "dir/foo", "", "", false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(b.root, "data", "dir")); !os.IsNotExist(err) {
+		t.Errorf("DeleteBlob: directory left behind: %v", err)
+	}
+
+	containers, err := b.ListContainers("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(containers) != 1 || containers[0].Name != "data" {
+		t.Errorf("ListContainers: expected [data] got %v", containers)
+	}
+}
+
+func TestLocalBackendBlocks(t *testing.T) {
+	b, cleanup := newTestLocalBackend(t)
+	defer cleanup()
+
+	putBlob(t, b, "data", "foo", "hello ")
+	first, _ := b.GetBlobProperties("data", "foo")
+
+	// The committed block is reused from the file.
+	if err := b.PutBlock("data", "foo", blockIDFor(1), []byte("world"), ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.PutBlockList("data", "foo", []string{blockIDFor(0), blockIDFor(1)}, "", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := readBlob(t, b, "data", "foo", 0, 100); got != "hello world" {
+		t.Errorf("GetBlobRange: expected 'hello world' got '%s'", got)
+	}
+
+	second, _ := b.GetBlobProperties("data", "foo")
+	if second.ETag == first.ETag || second.ContentLength != 11 {
+		t.Errorf("GetBlobProperties: unexpected %+v after %+v", second, first)
+	}
+
+	blocks, err := b.GetBlockList("data", "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blocks) != 2 || blocks[1].Size != 5 {
+		t.Errorf("GetBlockList: unexpected %v", blocks)
+	}
+}
+
+func TestLocalBackendErrors(t *testing.T) {
+	b, cleanup := newTestLocalBackend(t)
+	defer cleanup()
+
+	err := b.CreateContainer("../escape")
+	expectStorageError(t, "CreateContainer invalid name", err, http.StatusBadRequest, errorCodeInvalidResourceName)
+
+	_, err = b.GetBlobProperties("data", "../data/foo")
+	expectStorageError(t, "GetBlobProperties invalid name", err, http.StatusNotFound, errorCodeBlobNotFound)
+
+	for _, name := range []string{"a//b", "a/../b", localMetaDir + "/foo", "/foo"} {
+		_, err = b.CreateBlockBlob("data", name, "", "")
+		expectStorageError(t, "CreateBlockBlob '"+name+"'", err, http.StatusBadRequest, errorCodeInvalidResourceName)
+	}
+
+	putBlob(t, b, "data", "a", "file")
+	_, err = b.CreateBlockBlob("data", "a/b", "", "")
+	expectStorageError(t, "CreateBlockBlob under a blob", err, http.StatusConflict, errorCodeBlobAlreadyExists)
+
+	leaseID, err := b.AcquireLease("data", "a", -1, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.DeleteBlob("data", "a", "", "", false)
+	expectStorageError(t, "DeleteBlob leased", err, http.StatusPreconditionFailed, errorCodeLeaseIDMissing)
+	if err := b.ReleaseLease("data", "a", leaseID); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.DeleteBlob("data", "a", "", "", false); err != nil {
+		t.Errorf("DeleteBlob after release: %s", err)
+	}
+
+	if err := b.DeleteContainer("data", ""); err != nil {
+		t.Fatal(err)
+	}
+	_, err = b.ListBlobs("data", ListBlobsParameters{})
+	expectStorageError(t, "ListBlobs deleted container", err, http.StatusNotFound, errorCodeContainerNotFound)
+}
+
+func TestLocalBackendContainerLeases(t *testing.T) {
+	b, cleanup := newTestLocalBackend(t)
+	defer cleanup()
+
+	testContainerLeases(t, b)
+}
+
+func TestLocalBackendSnapshots(t *testing.T) {
+	b, cleanup := newTestLocalBackend(t)
+	defer cleanup()
+
+	testSnapshots(t, b)
+}
+
+func TestLocalBackendCopyBlob(t *testing.T) {
+	b, cleanup := newTestLocalBackend(t)
+	defer cleanup()
+
+	testCopyBlob(t, b)
+}
+
+func TestLocalBackendSoftDelete(t *testing.T) {
+	b, cleanup := newTestLocalBackend(t)
+	defer cleanup()
+
+	testSoftDelete(t, b)
+
+	// Snapshots come back with their blob.
+	putBlob(t, b, "data", "dir/bar", "content")
+	if _, err := b.SnapshotBlob("data", "dir/bar"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.DeleteBlob("data", "dir/bar", "", "", true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(b.root, "data", "dir")); !os.IsNotExist(err) {
+		t.Errorf("DeleteBlob: directory left behind: %v", err)
+	}
+	if err := b.UndeleteBlob("data", "dir/bar"); err != nil {
+		t.Fatal(err)
+	}
+	blobs, err := b.ListBlobs("data", ListBlobsParameters{Prefix: "dir/", Snapshots: true})
+	if err != nil || len(blobs) != 2 || blobs[0].Snapshot == "" {
+		t.Errorf("ListBlobs after UndeleteBlob: expected snapshot and blob got %v %v", blobs, err)
+	}
+}
@@ -0,0 +1,234 @@
+package blobfs
+
+// Blob names can be up to 1024 characters and escaping makes them longer
+// still, but file names can't be longer than 255 bytes. Such names are
+// shortened to a prefix plus a hash of the blob name, and the mapping back
+// is remembered, optionally in a file so that it survives remounts.
+//
+// The same goes for blobs which end up with the same file name as another
+// blob, they get a hash of the blob name added to tell them apart.
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// shortNameHashLen is the number of hex digits of the hash in shortened names.
+const shortNameHashLen = 32
+
+// shortNameSeparator goes between the prefix and the hash in shortened names.
+const shortNameSeparator = "~"
+
+// collisionHashLen is the number of hex digits of the hash added to file
+// names which are the same for more than one blob.
+const collisionHashLen = 8
+
+// errShortNameNotMapped is returned for shortened file names which aren't
+// in the name map, e.g. after a remount without a name map file. The inner
+// escaper would turn them into a blob name made of the prefix and the hash,
+// which `touch` would then create.
+var errShortNameNotMapped = errors.New("shortened file name is not in the name map")
+
+// pathEscaperShortening is an implementation of pathEscaper which uses
+// another pathEscaper and shortens the file names which are too long.
+type pathEscaperShortening struct {
+	pathEscaper
+	log *log.Logger
+
+	mu sync.Mutex
+
+	// blobNames maps shortened and disambiguated file names to blob names.
+	blobNames map[string]string
+
+	// mapFile is where new mappings are appended to, nil if not persisted.
+	mapFile *os.File
+}
+
+// nameMapEntry is a line in the name map file.
+type nameMapEntry struct {
+	FileName string `json:"file"`
+	BlobName string `json:"blob"`
+}
+
+// newPathEscaperShortening wraps escaper to shorten long file names. The
+// mapping is kept in mapFileName if given, loading what is there already.
+func newPathEscaperShortening(escaper pathEscaper, mapFileName string, log *log.Logger) *pathEscaperShortening {
+	x := &pathEscaperShortening{
+		pathEscaper: escaper,
+		log:         log,
+		blobNames:   make(map[string]string),
+	}
+
+	if mapFileName == "" {
+		return x
+	}
+
+	if err := x.load(mapFileName); err != nil {
+		x.log.Printf("[ERROR] Could not load name map '%s', long names will be remembered in memory only. %s\n", mapFileName, err)
+		return x
+	}
+
+	mapFile, err := os.OpenFile(mapFileName, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		x.log.Printf("[ERROR] Could not open name map '%s', long names will be remembered in memory only. %s\n", mapFileName, err)
+		return x
+	}
+	x.mapFile = mapFile
+
+	return x
+}
+
+func (x *pathEscaperShortening) BlobNameToFileName(blobName string) (fileName string, err error) {
+	fileName, err = x.pathEscaper.BlobNameToFileName(blobName)
+	if err != nil {
+		return "", err
+	}
+
+	if len(fileName) <= maxNameLen {
+		// Not shortened, but FileNameToBlobName can't tell.
+		if isShortFileName(fileName) {
+			x.remember(fileName, blobName)
+		}
+		return fileName, nil
+	}
+
+	fileName = shortFileName(fileName, blobName)
+	x.remember(fileName, blobName)
+	return fileName, nil
+}
+
+// Disambiguate returns another file name for blobName, which escapes to the
+// same fileName as some other blob. The name is the same every time.
+func (x *pathEscaperShortening) Disambiguate(fileName string, blobName string) string {
+	sum := sha256.Sum256([]byte(blobName))
+	suffix := shortNameSeparator + hex.EncodeToString(sum[:])[:collisionHashLen]
+
+	if len(fileName)+len(suffix) > maxNameLen {
+		fileName = shortFileName(fileName, blobName)
+	} else {
+		fileName += suffix
+	}
+
+	x.remember(fileName, blobName)
+	return fileName
+}
+
+func (x *pathEscaperShortening) FileNameToBlobName(fileName string) (blobName string, err error) {
+	x.mu.Lock()
+	blobName, ok := x.blobNames[fileName]
+	x.mu.Unlock()
+
+	if ok {
+		return blobName, nil
+	}
+
+	if isShortFileName(fileName) {
+		return "", errShortNameNotMapped
+	}
+
+	return x.pathEscaper.FileNameToBlobName(fileName)
+}
+
+// Close closes the name map file. Mappings are remembered in memory only
+// from then on.
+func (x *pathEscaperShortening) Close() error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if x.mapFile == nil {
+		return nil
+	}
+
+	err := x.mapFile.Close()
+	x.mapFile = nil
+	return err
+}
+
+// remember records the shortened or disambiguated fileName of blobName.
+func (x *pathEscaperShortening) remember(fileName string, blobName string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if _, ok := x.blobNames[fileName]; ok {
+		return
+	}
+	x.blobNames[fileName] = blobName
+
+	if x.mapFile == nil {
+		return
+	}
+
+	line, err := json.Marshal(nameMapEntry{FileName: fileName, BlobName: blobName})
+	if err == nil {
+		_, err = x.mapFile.Write(append(line, '\n'))
+	}
+	if err != nil {
+		x.log.Printf("[ERROR] Could not save name map entry for blob '%s'. %s\n", blobName, err)
+	}
+}
+
+// load reads the name map file, it's OK if there is none yet.
+func (x *pathEscaperShortening) load(mapFileName string) error {
+	f, err := os.Open(mapFileName)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*maxBlobNameLen)
+	for scanner.Scan() {
+		var entry nameMapEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// Most likely a line cut short by a crash, the entry
+			// will be added again when the blob is listed.
+			continue
+		}
+		x.blobNames[entry.FileName] = entry.BlobName
+	}
+
+	return scanner.Err()
+}
+
+// isShortFileName tells if fileName looks like what shortFileName returns:
+// the longest possible name, give or take a cut multibyte character, with
+// a hash at the end.
+func isShortFileName(fileName string) bool {
+	hashStart := len(fileName) - shortNameHashLen
+	if len(fileName) <= maxNameLen-utf8.UTFMax || !strings.HasSuffix(fileName[:hashStart], shortNameSeparator) {
+		return false
+	}
+
+	_, err := hex.DecodeString(fileName[hashStart:])
+	return err == nil && strings.ToLower(fileName[hashStart:]) == fileName[hashStart:]
+}
+
+// shortFileName returns fileName cut short to fit in maxNameLen with a hash
+// of blobName at the end, so that the same blob always gets the same name.
+func shortFileName(fileName string, blobName string) string {
+	sum := sha256.Sum256([]byte(blobName))
+	suffix := shortNameSeparator + hex.EncodeToString(sum[:])[:shortNameHashLen]
+
+	// Don't cut multibyte characters in half.
+	prefix := fileName[:maxNameLen-len(suffix)]
+	if r, size := utf8.DecodeLastRuneInString(prefix); r == utf8.RuneError && size <= 1 {
+		i := len(prefix) - 1
+		for i > 0 && !utf8.RuneStart(prefix[i]) {
+			i--
+		}
+		prefix = prefix[:i]
+	}
+
+	return prefix + suffix
+}
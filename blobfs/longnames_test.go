@@ -0,0 +1,112 @@
+package blobfs
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func TestShortFileNames(t *testing.T) {
+	logger := log.New(ioutil.Discard, "", 0)
+
+	for _, escaping := range PathEscapings {
+		x := newPathEscaperShortening(newPathEscaper(escaping), "", logger)
+
+		for _, blobName := range []string{
+			strings.Repeat("x", maxBlobNameLen),
+			strings.Repeat("x", maxBlobNameLen-1) + "y",
+			strings.Repeat("/", maxBlobNameLen),
+			strings.Repeat("日本語", 100),
+			strings.Repeat("a b+c%", 50),
+		} {
+			fileName, err := x.BlobNameToFileName(blobName)
+			if err != nil {
+				t.Fatalf("%s: BlobNameToFileName: %s", escaping, err)
+			}
+
+			if len(fileName) > maxNameLen || !utf8.ValidString(fileName) || strings.Contains(fileName, "/") {
+				t.Errorf("%s: invalid short name %q", escaping, fileName)
+			}
+
+			again, _ := x.BlobNameToFileName(blobName)
+			if again != fileName {
+				t.Errorf("%s: short names differ: %q and %q", escaping, fileName, again)
+			}
+
+			if got, err := x.FileNameToBlobName(fileName); err != nil || got != blobName {
+				t.Errorf("%s: %q did not map back: got %q %v", escaping, fileName, got, err)
+			}
+		}
+	}
+
+	// Names which fit are left alone.
+	x := newPathEscaperShortening(pathEscaperMinimal{}, "", logger)
+	name := strings.Repeat("x", maxNameLen)
+	if fileName, _ := x.BlobNameToFileName(name); fileName != name {
+		t.Errorf("Name of %d bytes was shortened to %q", maxNameLen, fileName)
+	}
+}
+
+func TestShortFileNamesPersisted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "longnames")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	logger := log.New(ioutil.Discard, "", 0)
+	mapFileName := filepath.Join(dir, "names.json")
+	blobName := strings.Repeat("long name ", 100)
+
+	x := newPathEscaperShortening(pathEscaperURLQuery{}, mapFileName, logger)
+	fileName, _ := x.BlobNameToFileName(blobName)
+	if err := x.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A new mount knows the name without listing the blob first.
+	y := newPathEscaperShortening(pathEscaperURLQuery{}, mapFileName, logger)
+	defer y.Close()
+	if got, err := y.FileNameToBlobName(fileName); err != nil || got != blobName {
+		t.Errorf("%q not loaded from the name map: got %q %v", fileName, got, err)
+	}
+
+	fi, err := os.Stat(mapFileName)
+	if err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("Name map file: unexpected %v %v", fi, err)
+	}
+}
+
+func TestShortFileNamesNotMapped(t *testing.T) {
+	logger := log.New(ioutil.Discard, "", 0)
+	blobName := strings.Repeat("long name ", 100)
+	fileName, _ := newPathEscaperShortening(pathEscaperURLQuery{}, "", logger).BlobNameToFileName(blobName)
+
+	// Another mount without the name map doesn't know the name.
+	backend := newTestBackend(t)
+	fs := NewFlatBlobFs(conformanceContainer, backend, Options{}).(*flatblobFs)
+	fs.log = logger
+	if _, err := fs.pathEscaper.FileNameToBlobName(fileName); err != errShortNameNotMapped {
+		t.Errorf("FileNameToBlobName %q: expected errShortNameNotMapped got %v", fileName, err)
+	}
+	expectStatus(t, "GetAttr", statusOf(fs.GetAttr(fileName, nil)), fuse.ENOENT)
+	expectStatus(t, "Mknod", fs.Mknod(fileName, fuse.S_IFREG|0644, 0, nil), fuse.ENOENT)
+	expectStatus(t, "Unlink", fs.Unlink(fileName, nil), fuse.ENOENT)
+	if blobs, _ := backend.backend.ListBlobs(conformanceContainer, ListBlobsParameters{}); len(blobs) != 0 {
+		t.Errorf("Mknod created %d blobs", len(blobs))
+	}
+
+	// A blob whose name only looks shortened is found once listed.
+	lookalike := strings.Repeat("x", maxNameLen-len(shortNameSeparator)-shortNameHashLen) + shortNameSeparator + strings.Repeat("0", shortNameHashLen)
+	putBlob(t, backend.backend, conformanceContainer, lookalike, "content")
+	if _, status := fs.OpenDir("", nil); status != fuse.OK {
+		t.Fatalf("OpenDir: %s", status)
+	}
+	expectStatus(t, "GetAttr lookalike", statusOf(fs.GetAttr(lookalike, nil)), fuse.OK)
+}
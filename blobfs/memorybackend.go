@@ -0,0 +1,962 @@
+package blobfs
+
+// In-memory Backend which mimics Azure blob storage closely enough to
+// test the file systems without a storage account: ETags, leases,
+// block lists and error codes behave like the real thing.
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NewMemoryBackend creates an empty in-memory Backend.
+func NewMemoryBackend() Backend {
+	return newMemoryBackend()
+}
+
+func newMemoryBackend() *memoryBackend {
+	return &memoryBackend{
+		containers: make(map[string]*memoryContainer),
+		now:        time.Now,
+	}
+}
+
+type memoryBackend struct {
+	mu         sync.Mutex
+	containers map[string]*memoryContainer
+	etagSeq    uint64
+	leaseSeq   uint64
+
+	// now is the clock used for timestamps and lease expiry.
+	now func() time.Time
+
+	// versioning keeps a version of every write, like blob versioning.
+	// It's off by default, as it is in Azure.
+	versioning bool
+}
+
+type memoryContainer struct {
+	props ContainerProperties
+	blobs map[string]*memoryBlob
+	lease memoryLease
+
+	// deleted blobs by name, kept for softDeleteRetention.
+	deleted map[string]*memoryBlob
+
+	// versions of the blobs by name, oldest first, with versioning. They
+	// outlive the blobs.
+	versions map[string][]memoryVersion
+}
+
+type memoryBlob struct {
+	name         string
+	lastModified time.Time
+	data         []byte
+
+	// etag is empty until the blob is first committed.
+	etag string
+
+	// committed blocks make up data, uncommitted are waiting for PutBlockList.
+	committed   []memoryBlock
+	uncommitted map[string][]byte
+
+	lease memoryLease
+
+	// snapshots of the blob, oldest first.
+	snapshots []memorySnapshot
+
+	// deletedTime is when the blob was deleted, zero unless it was.
+	deletedTime time.Time
+
+	// copyStatus and copyProgress are set by CopyBlob until the blob is
+	// written otherwise.
+	copyStatus   string
+	copyProgress string
+
+	// versionID is the current version, with versioning.
+	versionID string
+}
+
+type memorySnapshot struct {
+	snapshot     string
+	lastModified time.Time
+	etag         string
+	data         []byte
+}
+
+type memoryVersion struct {
+	versionID    string
+	lastModified time.Time
+	etag         string
+	data         []byte
+}
+
+type memoryBlock struct {
+	id   string
+	data []byte
+}
+
+type memoryLease struct {
+	id string
+
+	// duration and expires are zero for infinite leases.
+	duration time.Duration
+	expires  time.Time
+}
+
+func (l memoryLease) isActive(now time.Time) bool {
+	return l.id != "" && (l.expires.IsZero() || now.Before(l.expires))
+}
+
+func (l memoryLease) state(now time.Time) string {
+	switch {
+	case l.id == "":
+		return leaseStateAvailable
+	case l.isActive(now):
+		return leaseStateLeased
+	}
+	return leaseStateExpired
+}
+
+// checkWrite fails unless a write with leaseID is allowed, which is the
+// case if it's the ID of the active lease or if there is no lease and
+// no leaseID.
+func (l memoryLease) checkWrite(leaseID string, now time.Time) error {
+	active := l.isActive(now)
+	switch {
+	case active && leaseID == "":
+		return errLeaseIDMissing()
+	case active && leaseID != l.id:
+		return &StorageError{http.StatusPreconditionFailed, errorCodeLeaseIDMismatchWrite, "The lease ID specified did not match the lease ID for the blob."}
+	case !active && leaseID != "":
+		return &StorageError{http.StatusPreconditionFailed, errorCodeLeaseNotPresentWrite, "There is currently no lease on the blob."}
+	}
+	return nil
+}
+
+// nextETag must be called with mu held.
+func (b *memoryBackend) nextETag() string {
+	b.etagSeq++
+	return fmt.Sprintf("\"0x8D%013X\"", b.etagSeq)
+}
+
+func (b *memoryBackend) ListContainers(prefix string) ([]ContainerProperties, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var result []ContainerProperties
+	for name, container := range b.containers {
+		if strings.HasPrefix(name, prefix) {
+			props := container.props
+			props.LeaseState = container.lease.state(b.now())
+			result = append(result, props)
+		}
+	}
+
+	sort.Sort(containersByName(result))
+	return result, nil
+}
+
+func (b *memoryBackend) ContainerExists(container string) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	_, ok := b.containers[container]
+	return ok, nil
+}
+
+func (b *memoryBackend) CreateContainer(container string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.containers[container]; ok {
+		return &StorageError{http.StatusConflict, errorCodeContainerAlreadyExists, "The specified container already exists."}
+	}
+
+	b.containers[container] = &memoryContainer{
+		props: ContainerProperties{
+			Name:         container,
+			LastModified: b.now(),
+			ETag:         b.nextETag(),
+		},
+		blobs:    make(map[string]*memoryBlob),
+		deleted:  make(map[string]*memoryBlob),
+		versions: make(map[string][]memoryVersion),
+	}
+	return nil
+}
+
+func (b *memoryBackend) DeleteContainer(container string, leaseID string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c, ok := b.containers[container]
+	if !ok {
+		return errContainerNotFound()
+	}
+
+	if err := c.lease.checkWrite(leaseID, b.now()); err != nil {
+		return err
+	}
+
+	delete(b.containers, container)
+	return nil
+}
+
+func (b *memoryBackend) AcquireContainerLease(container string, duration int, proposedLeaseID string) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c, ok := b.containers[container]
+	if !ok {
+		return "", errContainerNotFound()
+	}
+
+	return b.acquireLease(&c.lease, duration, proposedLeaseID)
+}
+
+func (b *memoryBackend) ReleaseContainerLease(container, leaseID string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c, ok := b.containers[container]
+	if !ok {
+		return errContainerNotFound()
+	}
+
+	if err := checkLeaseID(c.lease, leaseID); err != nil {
+		return err
+	}
+
+	c.lease = memoryLease{}
+	return nil
+}
+
+func (b *memoryBackend) BreakContainerLease(container string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c, ok := b.containers[container]
+	if !ok {
+		return errContainerNotFound()
+	}
+
+	return b.breakLease(&c.lease)
+}
+
+func (b *memoryBackend) ListBlobs(container string, params ListBlobsParameters) ([]BlobProperties, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c, ok := b.containers[container]
+	if !ok {
+		return nil, errContainerNotFound()
+	}
+
+	var result []BlobProperties
+	for name, blob := range c.blobs {
+		// Blobs with only uncommitted blocks don't show up in listings.
+		if blob.etag == "" || !strings.HasPrefix(name, params.Prefix) {
+			continue
+		}
+		if params.Snapshots {
+			for _, s := range blob.snapshots {
+				result = append(result, BlobProperties{
+					Name:          name,
+					ContentLength: int64(len(s.data)),
+					LastModified:  s.lastModified,
+					ETag:          s.etag,
+					Snapshot:      s.snapshot,
+				})
+			}
+		}
+		props := blob.properties(b.now())
+		if params.Versions && b.versioning {
+			props.VersionID, props.IsCurrentVersion = blob.versionID, true
+		}
+		result = append(result, props)
+	}
+
+	if params.Versions {
+		for name, versions := range c.versions {
+			if !strings.HasPrefix(name, params.Prefix) {
+				continue
+			}
+			current := ""
+			if blob, ok := c.blobs[name]; ok && blob.etag != "" {
+				current = blob.versionID
+			}
+			for _, v := range versions {
+				if v.versionID == current {
+					continue
+				}
+				result = append(result, BlobProperties{
+					Name:          name,
+					ContentLength: int64(len(v.data)),
+					LastModified:  v.lastModified,
+					ETag:          v.etag,
+					VersionID:     v.versionID,
+				})
+			}
+		}
+	}
+
+	if params.Deleted {
+		for name := range c.deleted {
+			blob := b.deletedBlob(c, name)
+			if blob == nil || !strings.HasPrefix(name, params.Prefix) {
+				continue
+			}
+			// Snapshots deleted with the blob are listed as deleted too.
+			if params.Snapshots {
+				for _, s := range blob.snapshots {
+					result = append(result, BlobProperties{
+						Name:          name,
+						ContentLength: int64(len(s.data)),
+						LastModified:  s.lastModified,
+						ETag:          s.etag,
+						Snapshot:      s.snapshot,
+						Deleted:       true,
+						DeletedTime:   blob.deletedTime,
+					})
+				}
+			}
+			result = append(result, blob.properties(b.now()))
+		}
+	}
+
+	sort.Sort(blobsByName(result))
+	if params.MaxResults > 0 && uint(len(result)) > params.MaxResults {
+		result = result[:params.MaxResults]
+	}
+	return result, nil
+}
+
+func (b *memoryBackend) GetBlobProperties(container, blob string) (BlobProperties, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	mb, err := b.getBlob(container, blob)
+	if err != nil {
+		return BlobProperties{}, err
+	}
+
+	return mb.properties(b.now()), nil
+}
+
+func (b *memoryBackend) GetBlobRange(container, blob, snapshot string, offset, count int64) (io.ReadCloser, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	mb, err := b.getBlob(container, blob)
+	if err != nil {
+		return nil, err
+	}
+
+	if snapshot == "" {
+		return readMemoryRange(mb.data, offset, count)
+	}
+
+	s := mb.snapshot(snapshot)
+	if s == nil {
+		return nil, errBlobNotFound()
+	}
+	return readMemoryRange(s.data, offset, count)
+}
+
+func (b *memoryBackend) GetBlobVersionRange(container, blob, versionID string, offset, count int64) (io.ReadCloser, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c, ok := b.containers[container]
+	if !ok {
+		return nil, errContainerNotFound()
+	}
+
+	for _, v := range c.versions[blob] {
+		if v.versionID == versionID {
+			return readMemoryRange(v.data, offset, count)
+		}
+	}
+	return nil, errBlobNotFound()
+}
+
+func (b *memoryBackend) GetDeletedBlobRange(container, blob string, offset, count int64) (io.ReadCloser, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c, ok := b.containers[container]
+	if !ok {
+		return nil, errContainerNotFound()
+	}
+
+	mb := b.deletedBlob(c, blob)
+	if mb == nil {
+		return nil, errBlobNotFound()
+	}
+	return readMemoryRange(mb.data, offset, count)
+}
+
+func (b *memoryBackend) UndeleteBlob(container, blob string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c, ok := b.containers[container]
+	if !ok {
+		return errContainerNotFound()
+	}
+
+	mb := b.deletedBlob(c, blob)
+	if mb == nil {
+		return errBlobNotFound()
+	}
+	if existing, ok := c.blobs[blob]; ok && existing.etag != "" {
+		// Like Azure, bring back only the snapshots, the blob stays deleted.
+		for _, s := range mb.snapshots {
+			if existing.snapshot(s.snapshot) == nil {
+				existing.addSnapshot(s)
+			}
+		}
+		mb.snapshots = nil
+		return nil
+	}
+
+	delete(c.deleted, blob)
+	mb.deletedTime = time.Time{}
+	c.blobs[blob] = mb
+	return nil
+}
+
+func (b *memoryBackend) SnapshotBlob(container, blob string) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	mb, err := b.getBlob(container, blob)
+	if err != nil {
+		return "", err
+	}
+
+	// Timestamps have a resolution of 100ns and must be unique per blob.
+	t := b.now().UTC()
+	snapshot := t.Format(snapshotTimeFormat)
+	for mb.snapshot(snapshot) != nil {
+		t = t.Add(100 * time.Nanosecond)
+		snapshot = t.Format(snapshotTimeFormat)
+	}
+
+	// Blob data is never changed in place, so the snapshot can share it.
+	mb.snapshots = append(mb.snapshots, memorySnapshot{
+		snapshot:     snapshot,
+		lastModified: mb.lastModified,
+		etag:         mb.etag,
+		data:         mb.data,
+	})
+	return snapshot, nil
+}
+
+func (b *memoryBackend) CreateBlockBlob(container, blob string, ifMatch, leaseID string) (BlobProperties, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	mb, err := b.writableBlob(container, blob, leaseID)
+	if err != nil {
+		return BlobProperties{}, err
+	}
+
+	if ifMatch != "" && mb.etag != ifMatch {
+		return BlobProperties{}, errConditionNotMet()
+	}
+
+	mb.data = nil
+	mb.committed = nil
+	mb.uncommitted = nil
+	mb.copyStatus, mb.copyProgress = "", ""
+	b.touch(container, mb)
+	return mb.properties(b.now()), nil
+}
+
+func (b *memoryBackend) DeleteBlob(container, blob string, ifMatch, leaseID string, deleteSnapshots bool) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	mb, err := b.getBlob(container, blob)
+	if err != nil {
+		return err
+	}
+
+	if ifMatch != "" && mb.etag != ifMatch {
+		return errConditionNotMet()
+	}
+
+	if err := mb.lease.checkWrite(leaseID, b.now()); err != nil {
+		return err
+	}
+
+	if len(mb.snapshots) != 0 && !deleteSnapshots {
+		return errSnapshotsPresent()
+	}
+
+	// Soft delete, with the snapshots. A blob deleted earlier by the same
+	// name is gone for good.
+	c := b.containers[container]
+	delete(c.blobs, blob)
+	mb.lease = memoryLease{}
+	mb.uncommitted = nil
+	mb.deletedTime = b.now()
+	c.deleted[blob] = mb
+	return nil
+}
+
+// CopyBlob copies right away, so copies are never pending.
+func (b *memoryBackend) CopyBlob(container, blob, sourceContainer, sourceBlob string, ifMatch string) (BlobProperties, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	src, err := b.getBlob(sourceContainer, sourceBlob)
+	if err != nil {
+		return BlobProperties{}, err
+	}
+
+	mb, err := b.writableBlob(container, blob, "")
+	if err != nil {
+		return BlobProperties{}, err
+	}
+
+	if ifMatch != "" && mb.etag != ifMatch {
+		return BlobProperties{}, errConditionNotMet()
+	}
+
+	// Blob data is never changed in place, so the copy can share it.
+	mb.data = src.data
+	mb.committed = append([]memoryBlock(nil), src.committed...)
+	mb.uncommitted = nil
+	mb.copyStatus = copyStatusSuccess
+	mb.copyProgress = fmt.Sprintf("%d/%d", len(src.data), len(src.data))
+	b.touch(container, mb)
+	return mb.properties(b.now()), nil
+}
+
+func (b *memoryBackend) PutBlock(container, blob, blockID string, data []byte, leaseID string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.putBlock(container, blob, blockID, append([]byte(nil), data...), leaseID)
+}
+
+func (b *memoryBackend) PutBlockFromURL(container, blob, blockID, sourceContainer, sourceBlob string, offset, count int64, leaseID string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	src, err := b.getBlob(sourceContainer, sourceBlob)
+	if err != nil {
+		return err
+	}
+	if offset < 0 || count <= 0 || count > copyBlockSize || offset+count > int64(len(src.data)) {
+		return errInvalidRange()
+	}
+
+	// Blob data is never changed in place, so the block can share it.
+	return b.putBlock(container, blob, blockID, src.data[offset:offset+count], leaseID)
+}
+
+// putBlock stages data, which it keeps, as the block. Must be called with
+// mu held.
+func (b *memoryBackend) putBlock(container, blob, blockID string, data []byte, leaseID string) error {
+	mb, err := b.writableBlob(container, blob, leaseID)
+	if err != nil {
+		return err
+	}
+
+	if err := checkBlockID(mb, blockID); err != nil {
+		return err
+	}
+
+	if mb.uncommitted == nil {
+		mb.uncommitted = make(map[string][]byte)
+	}
+	mb.uncommitted[blockID] = data
+	return nil
+}
+
+func (b *memoryBackend) PutBlockList(container, blob string, blockIDs []string, ifMatch, leaseID string) (BlobProperties, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	mb, err := b.writableBlob(container, blob, leaseID)
+	if err != nil {
+		return BlobProperties{}, err
+	}
+
+	if ifMatch != "" && mb.etag != ifMatch {
+		return BlobProperties{}, errConditionNotMet()
+	}
+
+	// Same as BlockStatusLatest: prefer uncommitted blocks, then committed.
+	committed := make(map[string][]byte, len(mb.committed))
+	for _, block := range mb.committed {
+		committed[block.id] = block.data
+	}
+
+	blocks := make([]memoryBlock, 0, len(blockIDs))
+	var data []byte
+	for _, id := range blockIDs {
+		blockData, ok := mb.uncommitted[id]
+		if !ok {
+			blockData, ok = committed[id]
+		}
+		if !ok {
+			return BlobProperties{}, &StorageError{http.StatusBadRequest, errorCodeInvalidBlockList, "The specified block list is invalid."}
+		}
+		blocks = append(blocks, memoryBlock{id: id, data: blockData})
+		data = append(data, blockData...)
+	}
+
+	mb.committed = blocks
+	mb.uncommitted = nil
+	mb.data = data
+	mb.copyStatus, mb.copyProgress = "", ""
+	b.touch(container, mb)
+	return mb.properties(b.now()), nil
+}
+
+func (b *memoryBackend) GetBlockList(container, blob string) ([]BlockProperties, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	mb, err := b.getBlob(container, blob)
+	if err != nil {
+		return nil, err
+	}
+
+	blocks := make([]BlockProperties, len(mb.committed))
+	for i, block := range mb.committed {
+		blocks[i] = BlockProperties{ID: block.id, Size: int64(len(block.data))}
+	}
+	return blocks, nil
+}
+
+func (b *memoryBackend) AcquireLease(container, blob string, duration int, proposedLeaseID string) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	mb, err := b.getBlob(container, blob)
+	if err != nil {
+		return "", err
+	}
+
+	return b.acquireLease(&mb.lease, duration, proposedLeaseID)
+}
+
+func (b *memoryBackend) RenewLease(container, blob, leaseID string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	mb, err := b.leasedBlob(container, blob, leaseID)
+	if err != nil {
+		return err
+	}
+
+	// Renewing works even if the lease has expired, as long as nobody
+	// else has acquired it in the meantime, and restarts the duration
+	// it was acquired with.
+	if mb.lease.duration != 0 {
+		mb.lease.expires = b.now().Add(mb.lease.duration)
+	}
+	return nil
+}
+
+func (b *memoryBackend) ReleaseLease(container, blob, leaseID string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	mb, err := b.leasedBlob(container, blob, leaseID)
+	if err != nil {
+		return err
+	}
+
+	mb.lease = memoryLease{}
+	return nil
+}
+
+func (b *memoryBackend) BreakLease(container, blob string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	mb, err := b.getBlob(container, blob)
+	if err != nil {
+		return err
+	}
+
+	return b.breakLease(&mb.lease)
+}
+
+// acquireLease acquires or changes the lease of a blob or container.
+// Must be called with mu held.
+func (b *memoryBackend) acquireLease(lease *memoryLease, duration int, proposedLeaseID string) (string, error) {
+	if duration != -1 && (duration < 15 || duration > 60) {
+		return "", &StorageError{http.StatusBadRequest, errorCodeInvalidHeaderValue, "The value for one of the HTTP headers is not in the correct format."}
+	}
+
+	now := b.now()
+	if lease.isActive(now) && lease.id != proposedLeaseID {
+		return "", &StorageError{http.StatusConflict, errorCodeLeaseAlreadyPresent, "There is already a lease present."}
+	}
+
+	leaseID := proposedLeaseID
+	if leaseID == "" {
+		b.leaseSeq++
+		leaseID = fmt.Sprintf("00000000-0000-0000-0000-%012x", b.leaseSeq)
+	}
+
+	*lease = memoryLease{id: leaseID}
+	if duration != -1 {
+		lease.duration = time.Duration(duration) * time.Second
+		lease.expires = now.Add(lease.duration)
+	}
+	return leaseID, nil
+}
+
+// breakLease ends the lease of a blob or container. Must be called with
+// mu held.
+func (b *memoryBackend) breakLease(lease *memoryLease) error {
+	if !lease.isActive(b.now()) {
+		return &StorageError{http.StatusConflict, errorCodeLeaseNotPresent, "There is currently no lease on the blob."}
+	}
+
+	// Break period of 0, the lease ends immediately.
+	*lease = memoryLease{}
+	return nil
+}
+
+// getBlob returns the blob if it exists. Must be called with mu held.
+func (b *memoryBackend) getBlob(container, blob string) (*memoryBlob, error) {
+	c, ok := b.containers[container]
+	if !ok {
+		return nil, errContainerNotFound()
+	}
+
+	mb, ok := c.blobs[blob]
+	if !ok || mb.etag == "" {
+		return nil, errBlobNotFound()
+	}
+
+	return mb, nil
+}
+
+// deletedBlob returns the deleted blob by the name, or nil if there is
+// none or it has been deleted for longer than softDeleteRetention. Must be
+// called with mu held.
+func (b *memoryBackend) deletedBlob(c *memoryContainer, blob string) *memoryBlob {
+	mb, ok := c.deleted[blob]
+	if !ok {
+		return nil
+	}
+
+	if b.now().Sub(mb.deletedTime) > softDeleteRetention {
+		delete(c.deleted, blob)
+		return nil
+	}
+	return mb
+}
+
+// addSnapshot adds s to the snapshots, keeping them oldest first.
+func (mb *memoryBlob) addSnapshot(s memorySnapshot) {
+	i := len(mb.snapshots)
+	for i > 0 && mb.snapshots[i-1].snapshot > s.snapshot {
+		i--
+	}
+	mb.snapshots = append(mb.snapshots, memorySnapshot{})
+	copy(mb.snapshots[i+1:], mb.snapshots[i:])
+	mb.snapshots[i] = s
+}
+
+// snapshot returns the snapshot with the timestamp, or nil if there is
+// no such snapshot.
+func (mb *memoryBlob) snapshot(snapshot string) *memorySnapshot {
+	for i := range mb.snapshots {
+		if mb.snapshots[i].snapshot == snapshot {
+			return &mb.snapshots[i]
+		}
+	}
+	return nil
+}
+
+// writableBlob returns the blob to write to with leaseID, creating it if
+// needed without making it visible yet. Must be called with mu held.
+func (b *memoryBackend) writableBlob(container, blob, leaseID string) (*memoryBlob, error) {
+	c, ok := b.containers[container]
+	if !ok {
+		return nil, errContainerNotFound()
+	}
+
+	mb, ok := c.blobs[blob]
+	if !ok {
+		mb = &memoryBlob{name: blob}
+		c.blobs[blob] = mb
+	}
+
+	if err := mb.lease.checkWrite(leaseID, b.now()); err != nil {
+		return nil, err
+	}
+
+	return mb, nil
+}
+
+// leasedBlob returns the blob if leaseID matches its lease, whether the
+// lease expired or not. Must be called with mu held.
+func (b *memoryBackend) leasedBlob(container, blob, leaseID string) (*memoryBlob, error) {
+	mb, err := b.getBlob(container, blob)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkLeaseID(mb.lease, leaseID); err != nil {
+		return nil, err
+	}
+
+	return mb, nil
+}
+
+// checkLeaseID checks that leaseID is the ID of the lease, whether it
+// expired or not, as lease operations require.
+func checkLeaseID(lease memoryLease, leaseID string) error {
+	if lease.id == "" {
+		return &StorageError{http.StatusConflict, errorCodeLeaseNotPresent, "There is currently no lease on the blob."}
+	}
+
+	if lease.id != leaseID {
+		return &StorageError{http.StatusConflict, errorCodeLeaseIDMismatch, "The lease ID specified did not match the lease ID for the blob."}
+	}
+
+	return nil
+}
+
+// touch updates the ETag and time of the blob after a change, which also
+// makes the blob visible. Must be called with mu held.
+func (b *memoryBackend) touch(container string, mb *memoryBlob) {
+	mb.etag = b.nextETag()
+	mb.lastModified = b.now()
+	if !b.versioning {
+		return
+	}
+
+	// Version IDs are timestamps like those of snapshots, unique per blob.
+	c := b.containers[container]
+	versions := c.versions[mb.name]
+	t := mb.lastModified.UTC()
+	versionID := t.Format(snapshotTimeFormat)
+	for len(versions) > 0 && versions[len(versions)-1].versionID >= versionID {
+		t = t.Add(100 * time.Nanosecond)
+		versionID = t.Format(snapshotTimeFormat)
+	}
+
+	// Blob data is never changed in place, so the version can share it.
+	mb.versionID = versionID
+	c.versions[mb.name] = append(versions, memoryVersion{
+		versionID:    versionID,
+		lastModified: mb.lastModified,
+		etag:         mb.etag,
+		data:         mb.data,
+	})
+}
+
+func (mb *memoryBlob) properties(now time.Time) BlobProperties {
+	return BlobProperties{
+		Name:          mb.name,
+		ContentLength: int64(len(mb.data)),
+		LastModified:  mb.lastModified,
+		ETag:          mb.etag,
+		Deleted:       !mb.deletedTime.IsZero(),
+		DeletedTime:   mb.deletedTime,
+		CopyStatus:    mb.copyStatus,
+		CopyProgress:  mb.copyProgress,
+		LeaseState:    mb.lease.state(now),
+	}
+}
+
+// readMemoryRange returns count bytes at offset of data.
+func readMemoryRange(data []byte, offset, count int64) (io.ReadCloser, error) {
+	size := int64(len(data))
+	if offset < 0 || count <= 0 || offset >= size {
+		return nil, errInvalidRange()
+	}
+
+	end := offset + count
+	if end > size {
+		end = size
+	}
+
+	// Copy so that later writes don't change what the caller is reading.
+	return ioutil.NopCloser(bytes.NewReader(append([]byte(nil), data[offset:end]...))), nil
+}
+
+// checkBlockID checks that blockID is base64 and has the same length as
+// all other blocks of the blob, as Azure requires.
+func checkBlockID(mb *memoryBlob, blockID string) error {
+	invalid := &StorageError{http.StatusBadRequest, errorCodeInvalidBlockID, "The specified block ID is invalid."}
+
+	decoded, err := base64.StdEncoding.DecodeString(blockID)
+	if err != nil || len(decoded) == 0 || len(decoded) > 64 {
+		return invalid
+	}
+
+	for id := range mb.uncommitted {
+		if len(id) != len(blockID) {
+			return invalid
+		}
+	}
+
+	return nil
+}
+
+func errContainerNotFound() error {
+	return &StorageError{http.StatusNotFound, errorCodeContainerNotFound, "The specified container does not exist."}
+}
+
+func errBlobNotFound() error {
+	return &StorageError{http.StatusNotFound, errorCodeBlobNotFound, "The specified blob does not exist."}
+}
+
+func errLeaseIDMissing() error {
+	return &StorageError{http.StatusPreconditionFailed, errorCodeLeaseIDMissing, "There is currently a lease on the blob and no lease ID was specified in the request."}
+}
+
+type containersByName []ContainerProperties
+
+func (s containersByName) Len() int           { return len(s) }
+func (s containersByName) Less(i, j int) bool { return s[i].Name < s[j].Name }
+func (s containersByName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+type blobsByName []BlobProperties
+
+func (s blobsByName) Len() int { return len(s) }
+func (s blobsByName) Less(i, j int) bool {
+	if s[i].Name != s[j].Name {
+		return s[i].Name < s[j].Name
+	}
+	// Snapshots oldest first, then previous versions oldest first, then a
+	// deleted blob, then the blob itself.
+	if s[i].Snapshot != s[j].Snapshot {
+		if s[i].Snapshot == "" || s[j].Snapshot == "" {
+			return s[j].Snapshot == ""
+		}
+		return s[i].Snapshot < s[j].Snapshot
+	}
+	iPrevious, jPrevious := isPreviousVersion(s[i]), isPreviousVersion(s[j])
+	if iPrevious != jPrevious {
+		return iPrevious
+	}
+	if iPrevious {
+		return s[i].VersionID < s[j].VersionID
+	}
+	return s[i].Deleted && !s[j].Deleted
+}
+func (s blobsByName) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
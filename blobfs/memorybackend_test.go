@@ -0,0 +1,586 @@
+package blobfs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func newTestMemoryBackend(t *testing.T, containers ...string) *memoryBackend {
+	b := newMemoryBackend()
+	for _, container := range containers {
+		if err := b.CreateContainer(container); err != nil {
+			t.Fatalf("CreateContainer '%s': %s", container, err)
+		}
+	}
+	return b
+}
+
+func putBlob(t *testing.T, b Backend, container, blob, content string) {
+	blockID := blockIDFor(0)
+	if err := b.PutBlock(container, blob, blockID, []byte(content), ""); err != nil {
+		t.Fatalf("PutBlock '%s': %s", blob, err)
+	}
+	if _, err := b.PutBlockList(container, blob, []string{blockID}, "", ""); err != nil {
+		t.Fatalf("PutBlockList '%s': %s", blob, err)
+	}
+}
+
+func readBlob(t *testing.T, b Backend, container, blob string, offset, count int64) string {
+	return readSnapshot(t, b, container, blob, "", offset, count)
+}
+
+func readSnapshot(t *testing.T, b Backend, container, blob, snapshot string, offset, count int64) string {
+	body, err := b.GetBlobRange(container, blob, snapshot, offset, count)
+	if err != nil {
+		t.Fatalf("GetBlobRange '%s': %s", blob, err)
+	}
+	defer body.Close()
+
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		t.Fatalf("GetBlobRange '%s': %s", blob, err)
+	}
+	return string(data)
+}
+
+func expectStorageError(t *testing.T, what string, err error, statusCode int, code string) {
+	e, ok := err.(*StorageError)
+	if !ok {
+		t.Errorf("%s: expected *StorageError %d %s, got %v", what, statusCode, code, err)
+		return
+	}
+	if e.StatusCode != statusCode || e.Code != code {
+		t.Errorf("%s: expected %d %s, got %d %s", what, statusCode, code, e.StatusCode, e.Code)
+	}
+}
+
+func TestMemoryBackendContainers(t *testing.T) {
+	b := newTestMemoryBackend(t, "bbb", "aaa")
+
+	err := b.CreateContainer("aaa")
+	expectStorageError(t, "CreateContainer existing", err, http.StatusConflict, errorCodeContainerAlreadyExists)
+
+	containers, err := b.ListContainers("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(containers) != 2 || containers[0].Name != "aaa" || containers[1].Name != "bbb" {
+		t.Errorf("ListContainers: expected [aaa bbb] got %v", containers)
+	}
+
+	if err := b.DeleteContainer("aaa", ""); err != nil {
+		t.Fatal(err)
+	}
+	if exists, _ := b.ContainerExists("aaa"); exists {
+		t.Errorf("ContainerExists: deleted container still exists")
+	}
+
+	err = b.DeleteContainer("aaa", "")
+	expectStorageError(t, "DeleteContainer missing", err, http.StatusNotFound, errorCodeContainerNotFound)
+
+	_, err = b.ListBlobs("aaa", ListBlobsParameters{})
+	expectStorageError(t, "ListBlobs missing container", err, http.StatusNotFound, errorCodeContainerNotFound)
+}
+
+func TestMemoryBackendBlocks(t *testing.T) {
+	b := newTestMemoryBackend(t, "data")
+
+	// Uncommitted blocks don't make a blob.
+	if err := b.PutBlock("data", "foo", blockIDFor(0), []byte("hello "), ""); err != nil {
+		t.Fatal(err)
+	}
+	_, err := b.GetBlobProperties("data", "foo")
+	expectStorageError(t, "GetBlobProperties uncommitted", err, http.StatusNotFound, errorCodeBlobNotFound)
+	if blobs, _ := b.ListBlobs("data", ListBlobsParameters{}); len(blobs) != 0 {
+		t.Errorf("ListBlobs: uncommitted blob is listed: %v", blobs)
+	}
+
+	if err := b.PutBlock("data", "foo", blockIDFor(1), []byte("world"), ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.PutBlockList("data", "foo", []string{blockIDFor(0), blockIDFor(1)}, "", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	props, err := b.GetBlobProperties("data", "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if props.ContentLength != 11 || props.ETag == "" {
+		t.Errorf("GetBlobProperties: unexpected %+v", props)
+	}
+
+	if got := readBlob(t, b, "data", "foo", 6, 100); got != "world" {
+		t.Errorf("GetBlobRange: expected 'world' got '%s'", got)
+	}
+
+	_, err = b.GetBlobRange("data", "foo", "", 11, 1)
+	expectStorageError(t, "GetBlobRange past the end", err, http.StatusRequestedRangeNotSatisfiable, errorCodeInvalidRange)
+
+	// Committed blocks can be reused in the next block list.
+	if err := b.PutBlock("data", "foo", blockIDFor(2), []byte("!"), ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.PutBlockList("data", "foo", []string{blockIDFor(1), blockIDFor(2)}, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	if got := readBlob(t, b, "data", "foo", 0, 100); got != "world!" {
+		t.Errorf("GetBlobRange: expected 'world!' got '%s'", got)
+	}
+
+	blocks, err := b.GetBlockList("data", "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blocks) != 2 || blocks[0].ID != blockIDFor(1) || blocks[1].Size != 1 {
+		t.Errorf("GetBlockList: unexpected %v", blocks)
+	}
+
+	_, err = b.PutBlockList("data", "foo", []string{blockIDFor(0)}, "", "")
+	expectStorageError(t, "PutBlockList unknown block", err, http.StatusBadRequest, errorCodeInvalidBlockList)
+
+	err = b.PutBlock("data", "foo", "not base64!", nil, "")
+	expectStorageError(t, "PutBlock invalid ID", err, http.StatusBadRequest, errorCodeInvalidBlockID)
+}
+
+func TestMemoryBackendETags(t *testing.T) {
+	b := newTestMemoryBackend(t, "data")
+
+	putBlob(t, b, "data", "foo", "one")
+	first, _ := b.GetBlobProperties("data", "foo")
+
+	putBlob(t, b, "data", "foo", "two")
+	second, _ := b.GetBlobProperties("data", "foo")
+
+	if first.ETag == second.ETag {
+		t.Errorf("ETag did not change after a write: %s", first.ETag)
+	}
+
+	if _, err := b.CreateBlockBlob("data", "foo", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	third, _ := b.GetBlobProperties("data", "foo")
+	if third.ETag == second.ETag || third.ContentLength != 0 {
+		t.Errorf("CreateBlockBlob did not replace the blob: %+v", third)
+	}
+}
+
+func TestMemoryBackendIfMatch(t *testing.T) {
+	b := newTestMemoryBackend(t, "data")
+
+	putBlob(t, b, "data", "foo", "one")
+	seen, _ := b.GetBlobProperties("data", "foo")
+	putBlob(t, b, "data", "foo", "two")
+
+	_, err := b.PutBlockList("data", "foo", nil, seen.ETag, "")
+	expectStorageError(t, "PutBlockList stale ETag", err, http.StatusPreconditionFailed, errorCodeConditionNotMet)
+	_, err = b.CreateBlockBlob("data", "foo", seen.ETag, "")
+	expectStorageError(t, "CreateBlockBlob stale ETag", err, http.StatusPreconditionFailed, errorCodeConditionNotMet)
+	err = b.DeleteBlob("data", "foo", seen.ETag, "", false)
+	expectStorageError(t, "DeleteBlob stale ETag", err, http.StatusPreconditionFailed, errorCodeConditionNotMet)
+
+	current, _ := b.GetBlobProperties("data", "foo")
+	if err := b.DeleteBlob("data", "foo", current.ETag, "", false); err != nil {
+		t.Errorf("DeleteBlob current ETag: %s", err)
+	}
+}
+
+func TestMemoryBackendLeases(t *testing.T) {
+	b := newTestMemoryBackend(t, "data")
+	now := time.Date(2016, 4, 1, 9, 50, 39, 0, time.UTC)
+	b.now = func() time.Time { return now }
+
+	putBlob(t, b, "data", "foo", "content")
+
+	_, err := b.AcquireLease("data", "foo", 5, "")
+	expectStorageError(t, "AcquireLease invalid duration", err, http.StatusBadRequest, errorCodeInvalidHeaderValue)
+
+	leaseID, err := b.AcquireLease("data", "foo", 15, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = b.AcquireLease("data", "foo", 15, "")
+	expectStorageError(t, "AcquireLease leased", err, http.StatusConflict, errorCodeLeaseAlreadyPresent)
+
+	err = b.DeleteBlob("data", "foo", "", "", false)
+	expectStorageError(t, "DeleteBlob leased", err, http.StatusPreconditionFailed, errorCodeLeaseIDMissing)
+
+	err = b.PutBlock("data", "foo", blockIDFor(0), nil, "")
+	expectStorageError(t, "PutBlock leased", err, http.StatusPreconditionFailed, errorCodeLeaseIDMissing)
+
+	err = b.PutBlock("data", "foo", blockIDFor(0), nil, "wrong")
+	expectStorageError(t, "PutBlock wrong ID", err, http.StatusPreconditionFailed, errorCodeLeaseIDMismatchWrite)
+
+	// The holder of the lease can write.
+	if err := b.PutBlock("data", "foo", blockIDFor(0), []byte("new"), leaseID); err != nil {
+		t.Errorf("PutBlock with lease: %s", err)
+	}
+	if _, err := b.PutBlockList("data", "foo", []string{blockIDFor(0)}, "", leaseID); err != nil {
+		t.Errorf("PutBlockList with lease: %s", err)
+	}
+
+	err = b.RenewLease("data", "foo", "wrong")
+	expectStorageError(t, "RenewLease wrong ID", err, http.StatusConflict, errorCodeLeaseIDMismatch)
+
+	if err := b.RenewLease("data", "foo", leaseID); err != nil {
+		t.Fatal(err)
+	}
+
+	// Expired leases don't block anything.
+	now = now.Add(time.Minute)
+	if _, err := b.CreateBlockBlob("data", "foo", "", ""); err != nil {
+		t.Errorf("CreateBlockBlob after lease expired: %s", err)
+	}
+
+	if _, err := b.AcquireLease("data", "foo", -1, leaseID); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.ReleaseLease("data", "foo", leaseID); err != nil {
+		t.Fatal(err)
+	}
+	err = b.ReleaseLease("data", "foo", leaseID)
+	expectStorageError(t, "ReleaseLease released", err, http.StatusConflict, errorCodeLeaseNotPresent)
+
+	_, err = b.CreateBlockBlob("data", "foo", "", leaseID)
+	expectStorageError(t, "CreateBlockBlob released", err, http.StatusPreconditionFailed, errorCodeLeaseNotPresentWrite)
+
+	if _, err := b.AcquireLease("data", "foo", -1, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.BreakLease("data", "foo"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.DeleteBlob("data", "foo", "", "", false); err != nil {
+		t.Errorf("DeleteBlob after lease broken: %s", err)
+	}
+}
+
+func TestMemoryBackendRenewLease(t *testing.T) {
+	b := newTestMemoryBackend(t, "data")
+	now := time.Date(2016, 4, 1, 9, 50, 39, 0, time.UTC)
+	b.now = func() time.Time { return now }
+
+	putBlob(t, b, "data", "foo", "content")
+	leaseID, err := b.AcquireLease("data", "foo", 20, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Renewed well before it expires, the lease lasts for good.
+	for i := 0; i < 4; i++ {
+		now = now.Add(15 * time.Second)
+		_, err := b.AcquireLease("data", "foo", 15, "")
+		expectStorageError(t, fmt.Sprintf("AcquireLease after %d renewals", i), err, http.StatusConflict, errorCodeLeaseAlreadyPresent)
+		if err := b.RenewLease("data", "foo", leaseID); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	now = now.Add(20 * time.Second)
+	if _, err := b.AcquireLease("data", "foo", 15, ""); err != nil {
+		t.Errorf("AcquireLease after lease expired: %s", err)
+	}
+}
+
+func TestMemoryBackendContainerLeases(t *testing.T) {
+	testContainerLeases(t, newTestMemoryBackend(t, "data"))
+}
+
+// testContainerLeases checks container leases of b, which must have an
+// unleased container "data".
+func testContainerLeases(t *testing.T, b Backend) {
+	leaseState := func() string {
+		containers, err := b.ListContainers("data")
+		if err != nil || len(containers) != 1 {
+			t.Fatalf("ListContainers: %v %v", containers, err)
+		}
+		return containers[0].LeaseState
+	}
+
+	if state := leaseState(); state != leaseStateAvailable {
+		t.Errorf("Expected lease state %q got %q", leaseStateAvailable, state)
+	}
+
+	leaseID, err := b.AcquireContainerLease("data", 15, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state := leaseState(); state != leaseStateLeased {
+		t.Errorf("Expected lease state %q got %q", leaseStateLeased, state)
+	}
+
+	_, err = b.AcquireContainerLease("data", 15, "")
+	expectStorageError(t, "AcquireContainerLease leased", err, http.StatusConflict, errorCodeLeaseAlreadyPresent)
+
+	err = b.DeleteContainer("data", "")
+	expectStorageError(t, "DeleteContainer leased", err, http.StatusPreconditionFailed, errorCodeLeaseIDMissing)
+
+	// Blobs in a leased container can still be written.
+	putBlob(t, b, "data", "foo", "content")
+
+	if err := b.ReleaseContainerLease("data", leaseID); err != nil {
+		t.Fatal(err)
+	}
+	err = b.ReleaseContainerLease("data", leaseID)
+	expectStorageError(t, "ReleaseContainerLease released", err, http.StatusConflict, errorCodeLeaseNotPresent)
+
+	if _, err := b.AcquireContainerLease("data", -1, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.BreakContainerLease("data"); err != nil {
+		t.Fatal(err)
+	}
+
+	leaseID, err = b.AcquireContainerLease("data", 60, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.DeleteContainer("data", leaseID); err != nil {
+		t.Errorf("DeleteContainer with lease: %s", err)
+	}
+
+	// A new container by the same name starts without a lease.
+	if err := b.CreateContainer("data"); err != nil {
+		t.Fatal(err)
+	}
+	if state := leaseState(); state != leaseStateAvailable {
+		t.Errorf("Expected lease state %q got %q", leaseStateAvailable, state)
+	}
+}
+
+func TestMemoryBackendSnapshots(t *testing.T) {
+	b := newTestMemoryBackend(t, "data")
+
+	// Snapshots taken at the same time still get timestamps of their own.
+	now := time.Date(2016, 4, 1, 9, 50, 39, 0, time.UTC)
+	b.now = func() time.Time { return now }
+
+	testSnapshots(t, b)
+}
+
+// testSnapshots checks blob snapshots of b, which must have an empty
+// container "data".
+func testSnapshots(t *testing.T, b Backend) {
+	putBlob(t, b, "data", "foo", "first")
+	first, err := b.SnapshotBlob("data", "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	putBlob(t, b, "data", "foo", "second")
+	second, err := b.SnapshotBlob("data", "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	putBlob(t, b, "data", "foo", "third")
+
+	if first == second || first > second {
+		t.Errorf("SnapshotBlob: expected increasing timestamps got '%s' then '%s'", first, second)
+	}
+	if _, err := time.Parse(snapshotTimeFormat, first); err != nil {
+		t.Errorf("SnapshotBlob: %s", err)
+	}
+
+	if got := readSnapshot(t, b, "data", "foo", first, 0, 100); got != "first" {
+		t.Errorf("GetBlobRange first snapshot: expected 'first' got '%s'", got)
+	}
+	if got := readSnapshot(t, b, "data", "foo", second, 1, 3); got != "eco" {
+		t.Errorf("GetBlobRange second snapshot: expected 'eco' got '%s'", got)
+	}
+	if got := readBlob(t, b, "data", "foo", 0, 100); got != "third" {
+		t.Errorf("GetBlobRange: expected 'third' got '%s'", got)
+	}
+
+	_, err = b.GetBlobRange("data", "foo", "2000-01-01T00:00:00.0000000Z", 0, 1)
+	expectStorageError(t, "GetBlobRange unknown snapshot", err, http.StatusNotFound, errorCodeBlobNotFound)
+
+	// Snapshots are only listed when asked for, right before their blob.
+	putBlob(t, b, "data", "goo", "other")
+	blobs, err := b.ListBlobs("data", ListBlobsParameters{})
+	if err != nil || len(blobs) != 2 {
+		t.Errorf("ListBlobs: expected 2 blobs got %v %v", blobs, err)
+	}
+	blobs, err = b.ListBlobs("data", ListBlobsParameters{Snapshots: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blobs) != 4 || blobs[0].Snapshot != first || blobs[1].Snapshot != second ||
+		blobs[2].Snapshot != "" || blobs[2].Name != "foo" || blobs[3].Name != "goo" {
+		t.Errorf("ListBlobs with snapshots: unexpected %v", blobs)
+	}
+	if blobs[0].ContentLength != 5 || blobs[1].ContentLength != 6 {
+		t.Errorf("ListBlobs with snapshots: unexpected sizes %v", blobs)
+	}
+
+	// Snapshots only go with their blob when asked to.
+	err = b.DeleteBlob("data", "foo", "", "", false)
+	expectStorageError(t, "DeleteBlob with snapshots", err, http.StatusConflict, errorCodeSnapshotsPresent)
+	if err := b.DeleteBlob("data", "foo", "", "", true); err != nil {
+		t.Fatal(err)
+	}
+	putBlob(t, b, "data", "foo", "new")
+	blobs, err = b.ListBlobs("data", ListBlobsParameters{Prefix: "foo", Snapshots: true})
+	if err != nil || len(blobs) != 1 || blobs[0].Snapshot != "" {
+		t.Errorf("ListBlobs after DeleteBlob: expected only the blob got %v %v", blobs, err)
+	}
+
+	_, err = b.SnapshotBlob("data", "nope")
+	expectStorageError(t, "SnapshotBlob missing blob", err, http.StatusNotFound, errorCodeBlobNotFound)
+}
+
+func TestMemoryBackendSoftDelete(t *testing.T) {
+	b := newTestMemoryBackend(t, "data")
+	testSoftDelete(t, b)
+
+	// Deleted blobs are gone for good after the retention period.
+	putBlob(t, b, "data", "old", "old")
+	if err := b.DeleteBlob("data", "old", "", "", false); err != nil {
+		t.Fatal(err)
+	}
+	b.now = func() time.Time { return time.Now().Add(softDeleteRetention + time.Hour) }
+	err := b.UndeleteBlob("data", "old")
+	expectStorageError(t, "UndeleteBlob expired", err, http.StatusNotFound, errorCodeBlobNotFound)
+}
+
+// testSoftDelete checks soft delete of b, which must have an empty
+// container "data".
+func testSoftDelete(t *testing.T, b Backend) {
+	putBlob(t, b, "data", "foo", "deleted")
+	if _, err := b.SnapshotBlob("data", "foo"); err != nil {
+		t.Fatal(err)
+	}
+	before := time.Now().Add(-time.Second)
+	if err := b.DeleteBlob("data", "foo", "", "", true); err != nil {
+		t.Fatal(err)
+	}
+
+	// Deleted blobs are only listed when asked for.
+	blobs, err := b.ListBlobs("data", ListBlobsParameters{})
+	if err != nil || len(blobs) != 0 {
+		t.Errorf("ListBlobs: expected nothing got %v %v", blobs, err)
+	}
+	blobs, err = b.ListBlobs("data", ListBlobsParameters{Deleted: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blobs) != 1 || !blobs[0].Deleted || blobs[0].DeletedTime.Before(before) || blobs[0].ContentLength != 7 {
+		t.Errorf("ListBlobs deleted: unexpected %v", blobs)
+	}
+
+	body, err := b.GetDeletedBlobRange("data", "foo", 2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(body)
+	body.Close()
+	if string(data) != "let" {
+		t.Errorf("GetDeletedBlobRange: expected 'let' got '%s'", data)
+	}
+	_, err = b.GetBlobRange("data", "foo", "", 0, 1)
+	expectStorageError(t, "GetBlobRange deleted", err, http.StatusNotFound, errorCodeBlobNotFound)
+
+	// A blob by the same name is listed after the deleted one. Undeleting
+	// then brings back only the snapshots.
+	putBlob(t, b, "data", "foo", "new")
+	blobs, err = b.ListBlobs("data", ListBlobsParameters{Deleted: true})
+	if err != nil || len(blobs) != 2 || !blobs[0].Deleted || blobs[1].Deleted {
+		t.Errorf("ListBlobs deleted and new: unexpected %v %v", blobs, err)
+	}
+	if err := b.UndeleteBlob("data", "foo"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readBlob(t, b, "data", "foo", 0, 100); got != "new" {
+		t.Errorf("GetBlobRange after UndeleteBlob over a blob: expected 'new' got '%s'", got)
+	}
+	blobs, err = b.ListBlobs("data", ListBlobsParameters{Prefix: "foo", Snapshots: true})
+	if err != nil || len(blobs) != 2 || blobs[0].Snapshot == "" || blobs[0].ContentLength != 7 || blobs[1].Snapshot != "" {
+		t.Errorf("ListBlobs after UndeleteBlob over a blob: expected the snapshot and the blob got %v %v", blobs, err)
+	}
+
+	if err := b.DeleteBlob("data", "foo", "", "", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.UndeleteBlob("data", "foo"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readBlob(t, b, "data", "foo", 0, 100); got != "new" {
+		t.Errorf("GetBlobRange after UndeleteBlob: expected 'new' got '%s'", got)
+	}
+	blobs, err = b.ListBlobs("data", ListBlobsParameters{Deleted: true})
+	if err != nil || len(blobs) != 1 || blobs[0].Deleted {
+		t.Errorf("ListBlobs after UndeleteBlob: unexpected %v %v", blobs, err)
+	}
+
+	err = b.UndeleteBlob("data", "nope")
+	expectStorageError(t, "UndeleteBlob never deleted", err, http.StatusNotFound, errorCodeBlobNotFound)
+}
+
+func TestMemoryBackendCopyBlob(t *testing.T) {
+	b := newTestMemoryBackend(t, "data")
+	testCopyBlob(t, b)
+
+	// Copies are done at once, and say so until the blob is written.
+	props, err := b.GetBlobProperties("data", "copy")
+	if err != nil || props.CopyStatus != copyStatusSuccess || props.CopyProgress != "8/8" {
+		t.Errorf("GetBlobProperties copy: unexpected %+v %v", props, err)
+	}
+	putBlob(t, b, "data", "copy", "written")
+	props, err = b.GetBlobProperties("data", "copy")
+	if err != nil || props.CopyStatus != "" || props.CopyProgress != "" {
+		t.Errorf("GetBlobProperties after write: unexpected %+v %v", props, err)
+	}
+}
+
+// testCopyBlob checks CopyBlob of b, which must have an empty container
+// "data".
+func testCopyBlob(t *testing.T, b Backend) {
+	if err := b.CreateContainer("other"); err != nil {
+		t.Fatal(err)
+	}
+	putBlob(t, b, "data", "foo", "original")
+
+	if _, err := b.CopyBlob("data", "copy", "data", "foo", ""); err != nil {
+		t.Fatal(err)
+	}
+	if got := readBlob(t, b, "data", "copy", 0, 100); got != "original" {
+		t.Errorf("GetBlobRange copy: expected 'original' got '%s'", got)
+	}
+
+	// Across containers and over existing blobs, only if unchanged.
+	putBlob(t, b, "other", "bar", "old bar")
+	props, err := b.GetBlobProperties("other", "bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = b.CopyBlob("other", "bar", "data", "foo", "\"0x8D0\"")
+	expectStorageError(t, "CopyBlob changed blob", err, http.StatusPreconditionFailed, errorCodeConditionNotMet)
+	if _, err := b.CopyBlob("other", "bar", "data", "foo", props.ETag); err != nil {
+		t.Fatal(err)
+	}
+	if got := readBlob(t, b, "other", "bar", 0, 100); got != "original" {
+		t.Errorf("GetBlobRange copy to other: expected 'original' got '%s'", got)
+	}
+
+	// The copy is a blob of its own.
+	putBlob(t, b, "data", "foo", "changed")
+	if got := readBlob(t, b, "data", "copy", 0, 100); got != "original" {
+		t.Errorf("GetBlobRange copy after source changed: expected 'original' got '%s'", got)
+	}
+
+	// Leased blobs can't be copied over.
+	leaseID, err := b.AcquireLease("data", "copy", 15, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = b.CopyBlob("data", "copy", "data", "foo", "")
+	expectStorageError(t, "CopyBlob leased blob", err, http.StatusPreconditionFailed, errorCodeLeaseIDMissing)
+	if err := b.ReleaseLease("data", "copy", leaseID); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = b.CopyBlob("data", "new", "data", "nope", "")
+	expectStorageError(t, "CopyBlob missing source", err, http.StatusNotFound, errorCodeBlobNotFound)
+}
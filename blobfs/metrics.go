@@ -0,0 +1,732 @@
+package blobfs
+
+// Metrics of the file system and storage calls in the Prometheus text
+// format, so that mounts on shared machines can be watched.
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+)
+
+// metricsBuckets are the upper bounds of the latency histograms in seconds.
+var metricsBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// statusNames are the label values of the statuses the file systems return.
+var statusNames = map[syscall.Errno]string{
+	syscall.EACCES:    "EACCES",
+	syscall.EBUSY:     "EBUSY",
+	syscall.EEXIST:    "EEXIST",
+	syscall.EINVAL:    "EINVAL",
+	syscall.EIO:       "EIO",
+	syscall.EISDIR:    "EISDIR",
+	syscall.ENODATA:   "ENODATA",
+	syscall.ENOENT:    "ENOENT",
+	syscall.ENOSYS:    "ENOSYS",
+	syscall.ENOTDIR:   "ENOTDIR",
+	syscall.ENOTEMPTY: "ENOTEMPTY",
+	syscall.EPERM:     "EPERM",
+	syscall.EROFS:     "EROFS",
+	syscall.ESTALE:    "ESTALE",
+}
+
+// Metrics counts the operations of the file system and the calls to the
+// backend it wraps. It's an http.Handler serving them to Prometheus.
+//
+// TODO(ppanyukov): there is no caching or retrying of storage calls yet,
+// count hits and retries when there is.
+type Metrics struct {
+	mu sync.Mutex
+
+	ops            map[metricsKey]uint64
+	opLatency      map[string]*histogram
+	opsInFlight    int64
+	calls          map[metricsKey]uint64
+	callLatency    map[string]*histogram
+	callsInFlight  int64
+	bytesRead      uint64
+	bytesWritten   uint64
+	bytesUploaded  uint64
+	blobRangeReads uint64
+}
+
+// metricsKey is an operation or call and how it ended.
+type metricsKey struct {
+	name   string
+	result string
+}
+
+type metricsKeys []metricsKey
+
+func (k metricsKeys) Len() int      { return len(k) }
+func (k metricsKeys) Swap(i, j int) { k[i], k[j] = k[j], k[i] }
+func (k metricsKeys) Less(i, j int) bool {
+	if k[i].name != k[j].name {
+		return k[i].name < k[j].name
+	}
+	return k[i].result < k[j].result
+}
+
+type histogram struct {
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+func (h *histogram) observe(seconds float64) {
+	for i, bound := range metricsBuckets {
+		if seconds <= bound {
+			h.buckets[i]++
+		}
+	}
+	h.count++
+	h.sum += seconds
+}
+
+// NewMetrics creates Metrics with all counters at zero.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		ops:         make(map[metricsKey]uint64),
+		opLatency:   make(map[string]*histogram),
+		calls:       make(map[metricsKey]uint64),
+		callLatency: make(map[string]*histogram),
+	}
+}
+
+// beginOp counts an operation in flight and returns when it started.
+func (m *Metrics) beginOp() time.Time {
+	m.mu.Lock()
+	m.opsInFlight++
+	m.mu.Unlock()
+	return time.Now()
+}
+
+// endOp counts the operation op started at start which returned status.
+func (m *Metrics) endOp(op string, start time.Time, status fuse.Status) {
+	seconds := time.Since(start).Seconds()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.opsInFlight--
+	m.ops[metricsKey{op, statusName(status)}]++
+	observe(m.opLatency, op, seconds)
+}
+
+// beginCall counts a storage call in flight and returns when it started.
+func (m *Metrics) beginCall() time.Time {
+	m.mu.Lock()
+	m.callsInFlight++
+	m.mu.Unlock()
+	return time.Now()
+}
+
+// endCall counts the storage call started at start which returned err.
+func (m *Metrics) endCall(call string, start time.Time, err error) {
+	seconds := time.Since(start).Seconds()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.callsInFlight--
+	m.calls[metricsKey{call, errorName(err)}]++
+	observe(m.callLatency, call, seconds)
+}
+
+func (m *Metrics) add(counter *uint64, n int) {
+	m.mu.Lock()
+	*counter += uint64(n)
+	m.mu.Unlock()
+}
+
+func observe(histograms map[string]*histogram, name string, seconds float64) {
+	h, ok := histograms[name]
+	if !ok {
+		h = &histogram{buckets: make([]uint64, len(metricsBuckets))}
+		histograms[name] = h
+	}
+	h.observe(seconds)
+}
+
+// statusName is the label value for status.
+func statusName(status fuse.Status) string {
+	if status == fuse.OK {
+		return "OK"
+	}
+	if name, ok := statusNames[syscall.Errno(status)]; ok {
+		return name
+	}
+	return strconv.Itoa(int(status))
+}
+
+// errorName is the label value for err returned by the backend.
+func errorName(err error) string {
+	if err == nil {
+		return "OK"
+	}
+	if e, ok := err.(*StorageError); ok {
+		if e.Code != "" {
+			return e.Code
+		}
+		return strconv.Itoa(e.StatusCode)
+	}
+	return "error"
+}
+
+// ServeHTTP writes the metrics in the Prometheus text format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	// Format into memory and write out after unlocking, a slow scraper
+	// mustn't hold up the operations counted.
+	var buf bytes.Buffer
+	m.mu.Lock()
+	m.writeTo(&buf)
+	m.mu.Unlock()
+
+	w.Write(buf.Bytes())
+}
+
+// writeTo must be called with mu held.
+func (m *Metrics) writeTo(w io.Writer) {
+	writeCounters(w, "azurefs_fuse_ops_total", "File system operations by operation and status.", "op", "status", m.ops)
+	writeHistograms(w, "azurefs_fuse_op_duration_seconds", "Duration of file system operations.", "op", m.opLatency)
+	writeGauge(w, "azurefs_fuse_ops_in_flight", "File system operations in progress.", m.opsInFlight)
+	writeCounters(w, "azurefs_storage_calls_total", "Storage calls by call and result, the error code if failed.", "call", "result", m.calls)
+	writeHistograms(w, "azurefs_storage_call_duration_seconds", "Duration of storage calls.", "call", m.callLatency)
+	writeGauge(w, "azurefs_storage_calls_in_flight", "Storage calls in progress.", m.callsInFlight)
+	writeCounter(w, "azurefs_read_bytes_total", "Bytes read from open files.", m.bytesRead)
+	writeCounter(w, "azurefs_written_bytes_total", "Bytes written to open files.", m.bytesWritten)
+	writeCounter(w, "azurefs_storage_uploaded_bytes_total", "Bytes uploaded to storage in blocks.", m.bytesUploaded)
+	writeCounter(w, "azurefs_storage_blob_range_reads_total", "Ranges of blobs downloaded from storage.", m.blobRangeReads)
+}
+
+func writeHeader(w io.Writer, name string, help string, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func writeCounter(w io.Writer, name string, help string, value uint64) {
+	writeHeader(w, name, help, "counter")
+	fmt.Fprintf(w, "%s %d\n", name, value)
+}
+
+func writeGauge(w io.Writer, name string, help string, value int64) {
+	writeHeader(w, name, help, "gauge")
+	fmt.Fprintf(w, "%s %d\n", name, value)
+}
+
+func writeCounters(w io.Writer, name string, help string, nameLabel string, resultLabel string, counters map[metricsKey]uint64) {
+	writeHeader(w, name, help, "counter")
+
+	keys := make([]metricsKey, 0, len(counters))
+	for key := range counters {
+		keys = append(keys, key)
+	}
+	sort.Sort(metricsKeys(keys))
+
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s{%s=\"%s\",%s=\"%s\"} %d\n", name, nameLabel, escapeLabel(key.name), resultLabel, escapeLabel(key.result), counters[key])
+	}
+}
+
+func writeHistograms(w io.Writer, name string, help string, label string, histograms map[string]*histogram) {
+	writeHeader(w, name, help, "histogram")
+
+	names := make([]string, 0, len(histograms))
+	for n := range histograms {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	for _, n := range names {
+		h := histograms[n]
+		for i, bound := range metricsBuckets {
+			fmt.Fprintf(w, "%s_bucket{%s=\"%s\",le=\"%s\"} %d\n", name, label, escapeLabel(n), strconv.FormatFloat(bound, 'g', -1, 64), h.buckets[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{%s=\"%s\",le=\"+Inf\"} %d\n", name, label, escapeLabel(n), h.count)
+		fmt.Fprintf(w, "%s_sum{%s=\"%s\"} %s\n", name, label, escapeLabel(n), strconv.FormatFloat(h.sum, 'g', -1, 64))
+		fmt.Fprintf(w, "%s_count{%s=\"%s\"} %d\n", name, label, escapeLabel(n), h.count)
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}
+
+// FileSystem creates a file system which counts calls and delegates to fs.
+func (m *Metrics) FileSystem(fs pathfs.FileSystem) pathfs.FileSystem {
+	return &metricsFs{
+		fs:      fs,
+		metrics: m,
+	}
+}
+
+type metricsFs struct {
+	fs      pathfs.FileSystem
+	metrics *Metrics
+}
+
+func (fs *metricsFs) SetDebug(debug bool) {
+	fs.fs.SetDebug(debug)
+}
+
+func (fs *metricsFs) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
+	start := fs.metrics.beginOp()
+	attr, status := fs.fs.GetAttr(name, context)
+	fs.metrics.endOp("GetAttr", start, status)
+	return attr, status
+}
+
+func (fs *metricsFs) GetXAttr(name string, attr string, context *fuse.Context) ([]byte, fuse.Status) {
+	start := fs.metrics.beginOp()
+	data, status := fs.fs.GetXAttr(name, attr, context)
+	fs.metrics.endOp("GetXAttr", start, status)
+	return data, status
+}
+
+func (fs *metricsFs) SetXAttr(name string, attr string, data []byte, flags int, context *fuse.Context) fuse.Status {
+	start := fs.metrics.beginOp()
+	status := fs.fs.SetXAttr(name, attr, data, flags, context)
+	fs.metrics.endOp("SetXAttr", start, status)
+	return status
+}
+
+func (fs *metricsFs) ListXAttr(name string, context *fuse.Context) ([]string, fuse.Status) {
+	start := fs.metrics.beginOp()
+	attrs, status := fs.fs.ListXAttr(name, context)
+	fs.metrics.endOp("ListXAttr", start, status)
+	return attrs, status
+}
+
+func (fs *metricsFs) RemoveXAttr(name string, attr string, context *fuse.Context) fuse.Status {
+	start := fs.metrics.beginOp()
+	status := fs.fs.RemoveXAttr(name, attr, context)
+	fs.metrics.endOp("RemoveXAttr", start, status)
+	return status
+}
+
+func (fs *metricsFs) Readlink(name string, context *fuse.Context) (string, fuse.Status) {
+	start := fs.metrics.beginOp()
+	value, status := fs.fs.Readlink(name, context)
+	fs.metrics.endOp("Readlink", start, status)
+	return value, status
+}
+
+func (fs *metricsFs) Mknod(name string, mode uint32, dev uint32, context *fuse.Context) fuse.Status {
+	start := fs.metrics.beginOp()
+	status := fs.fs.Mknod(name, mode, dev, context)
+	fs.metrics.endOp("Mknod", start, status)
+	return status
+}
+
+func (fs *metricsFs) Mkdir(name string, mode uint32, context *fuse.Context) fuse.Status {
+	start := fs.metrics.beginOp()
+	status := fs.fs.Mkdir(name, mode, context)
+	fs.metrics.endOp("Mkdir", start, status)
+	return status
+}
+
+func (fs *metricsFs) Unlink(name string, context *fuse.Context) (code fuse.Status) {
+	start := fs.metrics.beginOp()
+	status := fs.fs.Unlink(name, context)
+	fs.metrics.endOp("Unlink", start, status)
+	return status
+}
+
+func (fs *metricsFs) Rmdir(name string, context *fuse.Context) (code fuse.Status) {
+	start := fs.metrics.beginOp()
+	status := fs.fs.Rmdir(name, context)
+	fs.metrics.endOp("Rmdir", start, status)
+	return status
+}
+
+func (fs *metricsFs) Symlink(value string, linkName string, context *fuse.Context) (code fuse.Status) {
+	start := fs.metrics.beginOp()
+	status := fs.fs.Symlink(value, linkName, context)
+	fs.metrics.endOp("Symlink", start, status)
+	return status
+}
+
+func (fs *metricsFs) Rename(oldName string, newName string, context *fuse.Context) (code fuse.Status) {
+	start := fs.metrics.beginOp()
+	status := fs.fs.Rename(oldName, newName, context)
+	fs.metrics.endOp("Rename", start, status)
+	return status
+}
+
+func (fs *metricsFs) Link(oldName string, newName string, context *fuse.Context) (code fuse.Status) {
+	start := fs.metrics.beginOp()
+	status := fs.fs.Link(oldName, newName, context)
+	fs.metrics.endOp("Link", start, status)
+	return status
+}
+
+func (fs *metricsFs) Chmod(name string, mode uint32, context *fuse.Context) (code fuse.Status) {
+	start := fs.metrics.beginOp()
+	status := fs.fs.Chmod(name, mode, context)
+	fs.metrics.endOp("Chmod", start, status)
+	return status
+}
+
+func (fs *metricsFs) Chown(name string, uid uint32, gid uint32, context *fuse.Context) (code fuse.Status) {
+	start := fs.metrics.beginOp()
+	status := fs.fs.Chown(name, uid, gid, context)
+	fs.metrics.endOp("Chown", start, status)
+	return status
+}
+
+func (fs *metricsFs) Truncate(name string, offset uint64, context *fuse.Context) (code fuse.Status) {
+	start := fs.metrics.beginOp()
+	status := fs.fs.Truncate(name, offset, context)
+	fs.metrics.endOp("Truncate", start, status)
+	return status
+}
+
+func (fs *metricsFs) Open(name string, flags uint32, context *fuse.Context) (file nodefs.File, code fuse.Status) {
+	start := fs.metrics.beginOp()
+	file, status := fs.fs.Open(name, flags, context)
+	fs.metrics.endOp("Open", start, status)
+	return fs.metricsFile(file), status
+}
+
+func (fs *metricsFs) OpenDir(name string, context *fuse.Context) (stream []fuse.DirEntry, status fuse.Status) {
+	start := fs.metrics.beginOp()
+	stream, status = fs.fs.OpenDir(name, context)
+	fs.metrics.endOp("OpenDir", start, status)
+	return stream, status
+}
+
+func (fs *metricsFs) OnMount(nodeFs *pathfs.PathNodeFs) {
+	fs.fs.OnMount(nodeFs)
+}
+
+func (fs *metricsFs) OnUnmount() {
+	fs.fs.OnUnmount()
+}
+
+func (fs *metricsFs) Access(name string, mode uint32, context *fuse.Context) (code fuse.Status) {
+	start := fs.metrics.beginOp()
+	status := fs.fs.Access(name, mode, context)
+	fs.metrics.endOp("Access", start, status)
+	return status
+}
+
+func (fs *metricsFs) Create(name string, flags uint32, mode uint32, context *fuse.Context) (file nodefs.File, code fuse.Status) {
+	start := fs.metrics.beginOp()
+	file, status := fs.fs.Create(name, flags, mode, context)
+	fs.metrics.endOp("Create", start, status)
+	return fs.metricsFile(file), status
+}
+
+func (fs *metricsFs) Utimens(name string, Atime *time.Time, Mtime *time.Time, context *fuse.Context) (code fuse.Status) {
+	start := fs.metrics.beginOp()
+	status := fs.fs.Utimens(name, Atime, Mtime, context)
+	fs.metrics.endOp("Utimens", start, status)
+	return status
+}
+
+func (fs *metricsFs) String() string {
+	return fs.fs.String()
+}
+
+func (fs *metricsFs) StatFs(name string) *fuse.StatfsOut {
+	start := fs.metrics.beginOp()
+	out := fs.fs.StatFs(name)
+	status := fuse.OK
+	if out == nil {
+		status = fuse.ENOSYS
+	}
+	fs.metrics.endOp("StatFs", start, status)
+	return out
+}
+
+func (fs *metricsFs) metricsFile(file nodefs.File) nodefs.File {
+	if file == nil {
+		return nil
+	}
+
+	return &metricsFile{
+		File:    file,
+		metrics: fs.metrics,
+	}
+}
+
+// metricsFile counts operations on an open file. Operations
+// which are not counted go straight to the embedded File.
+type metricsFile struct {
+	nodefs.File
+	metrics *Metrics
+}
+
+func (f *metricsFile) InnerFile() nodefs.File {
+	return f.File
+}
+
+func (f *metricsFile) String() string {
+	return fmt.Sprintf("metricsFile(%s)", f.File)
+}
+
+func (f *metricsFile) Read(buf []byte, off int64) (fuse.ReadResult, fuse.Status) {
+	start := f.metrics.beginOp()
+	res, status := f.File.Read(buf, off)
+	f.metrics.endOp("Read", start, status)
+	if status == fuse.OK && res != nil {
+		f.metrics.add(&f.metrics.bytesRead, res.Size())
+	}
+	return res, status
+}
+
+func (f *metricsFile) Write(data []byte, off int64) (uint32, fuse.Status) {
+	start := f.metrics.beginOp()
+	n, status := f.File.Write(data, off)
+	f.metrics.endOp("Write", start, status)
+	f.metrics.add(&f.metrics.bytesWritten, int(n))
+	return n, status
+}
+
+func (f *metricsFile) Flush() fuse.Status {
+	start := f.metrics.beginOp()
+	status := f.File.Flush()
+	f.metrics.endOp("Flush", start, status)
+	return status
+}
+
+func (f *metricsFile) Release() {
+	start := f.metrics.beginOp()
+	f.File.Release()
+	f.metrics.endOp("Release", start, fuse.OK)
+}
+
+func (f *metricsFile) Fsync(flags int) (code fuse.Status) {
+	start := f.metrics.beginOp()
+	status := f.File.Fsync(flags)
+	f.metrics.endOp("Fsync", start, status)
+	return status
+}
+
+func (f *metricsFile) Truncate(size uint64) fuse.Status {
+	start := f.metrics.beginOp()
+	status := f.File.Truncate(size)
+	f.metrics.endOp("FTruncate", start, status)
+	return status
+}
+
+func (f *metricsFile) GetAttr(out *fuse.Attr) fuse.Status {
+	start := f.metrics.beginOp()
+	status := f.File.GetAttr(out)
+	f.metrics.endOp("FGetAttr", start, status)
+	return status
+}
+
+// Backend creates a Backend which counts the calls made to backend.
+func (m *Metrics) Backend(backend Backend) Backend {
+	return &metricsBackend{
+		backend: backend,
+		metrics: m,
+	}
+}
+
+type metricsBackend struct {
+	backend Backend
+	metrics *Metrics
+}
+
+func (b *metricsBackend) ListContainers(prefix string) ([]ContainerProperties, error) {
+	start := b.metrics.beginCall()
+	containers, err := b.backend.ListContainers(prefix)
+	b.metrics.endCall("ListContainers", start, err)
+	return containers, err
+}
+
+func (b *metricsBackend) ContainerExists(container string) (bool, error) {
+	start := b.metrics.beginCall()
+	exists, err := b.backend.ContainerExists(container)
+	b.metrics.endCall("ContainerExists", start, err)
+	return exists, err
+}
+
+func (b *metricsBackend) CreateContainer(container string) error {
+	start := b.metrics.beginCall()
+	err := b.backend.CreateContainer(container)
+	b.metrics.endCall("CreateContainer", start, err)
+	return err
+}
+
+func (b *metricsBackend) DeleteContainer(container string, leaseID string) error {
+	start := b.metrics.beginCall()
+	err := b.backend.DeleteContainer(container, leaseID)
+	b.metrics.endCall("DeleteContainer", start, err)
+	return err
+}
+
+func (b *metricsBackend) AcquireContainerLease(container string, duration int, proposedLeaseID string) (string, error) {
+	start := b.metrics.beginCall()
+	leaseID, err := b.backend.AcquireContainerLease(container, duration, proposedLeaseID)
+	b.metrics.endCall("AcquireContainerLease", start, err)
+	return leaseID, err
+}
+
+func (b *metricsBackend) ReleaseContainerLease(container, leaseID string) error {
+	start := b.metrics.beginCall()
+	err := b.backend.ReleaseContainerLease(container, leaseID)
+	b.metrics.endCall("ReleaseContainerLease", start, err)
+	return err
+}
+
+func (b *metricsBackend) BreakContainerLease(container string) error {
+	start := b.metrics.beginCall()
+	err := b.backend.BreakContainerLease(container)
+	b.metrics.endCall("BreakContainerLease", start, err)
+	return err
+}
+
+func (b *metricsBackend) ListBlobs(container string, params ListBlobsParameters) ([]BlobProperties, error) {
+	start := b.metrics.beginCall()
+	blobs, err := b.backend.ListBlobs(container, params)
+	b.metrics.endCall("ListBlobs", start, err)
+	return blobs, err
+}
+
+func (b *metricsBackend) GetBlobProperties(container, blob string) (BlobProperties, error) {
+	start := b.metrics.beginCall()
+	props, err := b.backend.GetBlobProperties(container, blob)
+	b.metrics.endCall("GetBlobProperties", start, err)
+	return props, err
+}
+
+func (b *metricsBackend) GetBlobRange(container, blob, snapshot string, offset, count int64) (io.ReadCloser, error) {
+	start := b.metrics.beginCall()
+	body, err := b.backend.GetBlobRange(container, blob, snapshot, offset, count)
+	b.metrics.endCall("GetBlobRange", start, err)
+	if err == nil {
+		b.metrics.add(&b.metrics.blobRangeReads, 1)
+	}
+	return body, err
+}
+
+func (b *metricsBackend) GetBlobVersionRange(container, blob, versionID string, offset, count int64) (io.ReadCloser, error) {
+	start := b.metrics.beginCall()
+	body, err := b.backend.GetBlobVersionRange(container, blob, versionID, offset, count)
+	b.metrics.endCall("GetBlobVersionRange", start, err)
+	if err == nil {
+		b.metrics.add(&b.metrics.blobRangeReads, 1)
+	}
+	return body, err
+}
+
+func (b *metricsBackend) SnapshotBlob(container, blob string) (string, error) {
+	start := b.metrics.beginCall()
+	snapshot, err := b.backend.SnapshotBlob(container, blob)
+	b.metrics.endCall("SnapshotBlob", start, err)
+	return snapshot, err
+}
+
+func (b *metricsBackend) GetDeletedBlobRange(container, blob string, offset, count int64) (io.ReadCloser, error) {
+	start := b.metrics.beginCall()
+	body, err := b.backend.GetDeletedBlobRange(container, blob, offset, count)
+	b.metrics.endCall("GetDeletedBlobRange", start, err)
+	if err == nil {
+		b.metrics.add(&b.metrics.blobRangeReads, 1)
+	}
+	return body, err
+}
+
+func (b *metricsBackend) UndeleteBlob(container, blob string) error {
+	start := b.metrics.beginCall()
+	err := b.backend.UndeleteBlob(container, blob)
+	b.metrics.endCall("UndeleteBlob", start, err)
+	return err
+}
+
+func (b *metricsBackend) CreateBlockBlob(container, blob string, ifMatch, leaseID string) (BlobProperties, error) {
+	start := b.metrics.beginCall()
+	props, err := b.backend.CreateBlockBlob(container, blob, ifMatch, leaseID)
+	b.metrics.endCall("CreateBlockBlob", start, err)
+	return props, err
+}
+
+func (b *metricsBackend) DeleteBlob(container, blob string, ifMatch, leaseID string, deleteSnapshots bool) error {
+	start := b.metrics.beginCall()
+	err := b.backend.DeleteBlob(container, blob, ifMatch, leaseID, deleteSnapshots)
+	b.metrics.endCall("DeleteBlob", start, err)
+	return err
+}
+
+func (b *metricsBackend) CopyBlob(container, blob, sourceContainer, sourceBlob string, ifMatch string) (BlobProperties, error) {
+	start := b.metrics.beginCall()
+	props, err := b.backend.CopyBlob(container, blob, sourceContainer, sourceBlob, ifMatch)
+	b.metrics.endCall("CopyBlob", start, err)
+	return props, err
+}
+
+func (b *metricsBackend) PutBlock(container, blob, blockID string, data []byte, leaseID string) error {
+	start := b.metrics.beginCall()
+	err := b.backend.PutBlock(container, blob, blockID, data, leaseID)
+	b.metrics.endCall("PutBlock", start, err)
+	if err == nil {
+		b.metrics.add(&b.metrics.bytesUploaded, len(data))
+	}
+	return err
+}
+
+func (b *metricsBackend) PutBlockFromURL(container, blob, blockID, sourceContainer, sourceBlob string, offset, count int64, leaseID string) error {
+	start := b.metrics.beginCall()
+	err := b.backend.PutBlockFromURL(container, blob, blockID, sourceContainer, sourceBlob, offset, count, leaseID)
+	b.metrics.endCall("PutBlockFromURL", start, err)
+	return err
+}
+
+func (b *metricsBackend) PutBlockList(container, blob string, blockIDs []string, ifMatch, leaseID string) (BlobProperties, error) {
+	start := b.metrics.beginCall()
+	props, err := b.backend.PutBlockList(container, blob, blockIDs, ifMatch, leaseID)
+	b.metrics.endCall("PutBlockList", start, err)
+	return props, err
+}
+
+func (b *metricsBackend) GetBlockList(container, blob string) ([]BlockProperties, error) {
+	start := b.metrics.beginCall()
+	blocks, err := b.backend.GetBlockList(container, blob)
+	b.metrics.endCall("GetBlockList", start, err)
+	return blocks, err
+}
+
+func (b *metricsBackend) AcquireLease(container, blob string, duration int, proposedLeaseID string) (string, error) {
+	start := b.metrics.beginCall()
+	leaseID, err := b.backend.AcquireLease(container, blob, duration, proposedLeaseID)
+	b.metrics.endCall("AcquireLease", start, err)
+	return leaseID, err
+}
+
+func (b *metricsBackend) RenewLease(container, blob, leaseID string) error {
+	start := b.metrics.beginCall()
+	err := b.backend.RenewLease(container, blob, leaseID)
+	b.metrics.endCall("RenewLease", start, err)
+	return err
+}
+
+func (b *metricsBackend) ReleaseLease(container, blob, leaseID string) error {
+	start := b.metrics.beginCall()
+	err := b.backend.ReleaseLease(container, blob, leaseID)
+	b.metrics.endCall("ReleaseLease", start, err)
+	return err
+}
+
+func (b *metricsBackend) BreakLease(container, blob string) error {
+	start := b.metrics.beginCall()
+	err := b.backend.BreakLease(container, blob)
+	b.metrics.endCall("BreakLease", start, err)
+	return err
+}
@@ -0,0 +1,79 @@
+package blobfs
+
+import (
+	"net/http/httptest"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func TestMetrics(t *testing.T) {
+	metrics := NewMetrics()
+	backend := metrics.Backend(newTestBackend(t))
+	fs := metrics.FileSystem(NewFlatBlobFs(conformanceContainer, backend, Options{}))
+
+	expectStatus(t, "Mknod", fs.Mknod("foo", syscall.S_IFREG|0644, 0, nil), fuse.OK)
+	writeFile(t, fs, "foo", "hello")
+	if content := readFile(t, fs, "foo"); content != "hello" {
+		t.Fatalf("readFile: got %q", content)
+	}
+	expectStatus(t, "GetAttr", statusOf(fs.GetAttr("bar", nil)), fuse.ENOENT)
+
+	recorder := httptest.NewRecorder()
+	metrics.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body := recorder.Body.String()
+
+	for _, line := range []string{
+		`# TYPE azurefs_fuse_ops_total counter`,
+		`azurefs_fuse_ops_total{op="Mknod",status="OK"} 1`,
+		`azurefs_fuse_ops_total{op="GetAttr",status="ENOENT"} 1`,
+		`azurefs_fuse_ops_total{op="Write",status="OK"} 1`,
+		`azurefs_fuse_op_duration_seconds_count{op="Mknod"} 1`,
+		`azurefs_fuse_op_duration_seconds_bucket{op="Mknod",le="+Inf"} 1`,
+		`azurefs_fuse_ops_in_flight 0`,
+		`azurefs_storage_calls_total{call="GetBlobProperties",result="BlobNotFound"} 1`,
+		`azurefs_storage_calls_total{call="PutBlockList",result="OK"} 1`,
+		`azurefs_storage_calls_in_flight 0`,
+		`azurefs_read_bytes_total 5`,
+		`azurefs_written_bytes_total 5`,
+		`azurefs_storage_uploaded_bytes_total 5`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("Metrics do not have %q:\n%s", line, body)
+		}
+	}
+}
+
+// blockedResponse doesn't return from Write until unblocked.
+type blockedResponse struct {
+	*httptest.ResponseRecorder
+	writing chan struct{}
+	unblock chan struct{}
+}
+
+func (r *blockedResponse) Write(p []byte) (int, error) {
+	close(r.writing)
+	<-r.unblock
+	return r.ResponseRecorder.Write(p)
+}
+
+func TestMetricsSlowScrape(t *testing.T) {
+	metrics := NewMetrics()
+	fs := metrics.FileSystem(NewFlatBlobFs(conformanceContainer, newTestBackend(t), Options{}))
+
+	response := &blockedResponse{httptest.NewRecorder(), make(chan struct{}), make(chan struct{})}
+	served := make(chan struct{})
+	go func() {
+		metrics.ServeHTTP(response, httptest.NewRequest("GET", "/metrics", nil))
+		close(served)
+	}()
+	<-response.writing
+
+	// Operations go on while the scraper doesn't read.
+	expectStatus(t, "GetAttr", statusOf(fs.GetAttr("bar", nil)), fuse.ENOENT)
+
+	close(response.unblock)
+	<-served
+}
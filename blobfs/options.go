@@ -0,0 +1,103 @@
+package blobfs
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Options controls behaviour shared by the file systems in this package.
+type Options struct {
+	// ReadOnly makes mutating operations fail with EROFS before
+	// any call to storage is made.
+	ReadOnly bool
+
+	// PathEscaping is how blob names are turned into file names,
+	// PathEscapingURLQuery if not given.
+	PathEscaping PathEscaping
+
+	// NameMapFile is where to remember the blob names behind shortened
+	// file names, see longnames.go. In memory only if not given.
+	NameMapFile string
+
+	// LastWriterWins makes writes and deletes overwrite changes made by
+	// others since the blob was opened or looked at. By default they
+	// fail with ESTALE instead.
+	LastWriterWins bool
+
+	// AsOf, if set, shows blobs as they were at that time, see asof.go.
+	// Implies ReadOnly.
+	AsOf time.Time
+
+	// DeleteSnapshots makes deleting a blob delete its snapshots too. By
+	// default blobs with snapshots can't be deleted, rm fails with EBUSY.
+	DeleteSnapshots bool
+}
+
+// ParseMountOptions parses a comma separated list of mount options as
+// given with `-o`. The options understood by this package are applied
+// to o, the rest is returned to be passed on to the kernel as is. rw is
+// the default, it doesn't undo ro given here or with -ro.
+func (o *Options) ParseMountOptions(mountOptions string) []string {
+	var rest []string
+	for _, option := range strings.Split(mountOptions, ",") {
+		switch option {
+		case "":
+		case "ro":
+			o.ReadOnly = true
+		case "rw":
+		case "lastwriterwins":
+			o.LastWriterWins = true
+		case "deletesnapshots":
+			o.DeleteSnapshots = true
+		default:
+			rest = append(rest, option)
+		}
+	}
+
+	return rest
+}
+
+// KernelMountOptions returns the options to mount with so that the
+// kernel knows about the behaviour in o. For example, with ro the
+// kernel rejects writes early and reports ST_RDONLY from statfs.
+func (o *Options) KernelMountOptions() []string {
+	if o.ReadOnly || !o.AsOf.IsZero() {
+		return []string{"ro"}
+	}
+
+	return nil
+}
+
+// accessWrite is W_OK from unistd.h, as found in the mode given to Access.
+const accessWrite = 2
+
+// xattrBlobName is the extended attribute with the blob name behind a file.
+const xattrBlobName = "user.azurefs.blobname"
+
+// xattrCopy is the extended attribute with the status and progress of the
+// last server-side copy to the blob behind a file, e.g. "pending 1024/4096".
+const xattrCopy = "user.azurefs.copy"
+
+// xattrLease is the extended attribute with the lease state of a container.
+const xattrLease = "user.azurefs.lease"
+
+// maxNameLen is the longest file name the kernel accepts.
+const maxNameLen = 255
+
+// isWriteOpen tells if flags given to Open ask for anything but reading.
+func isWriteOpen(flags uint32) bool {
+	return flags&(syscall.O_WRONLY|syscall.O_RDWR|syscall.O_APPEND|syscall.O_TRUNC|syscall.O_CREAT) != 0
+}
+
+// ParseAsOf parses the time given for Options.AsOf, either RFC 3339 such
+// as 2016-04-01T09:50:39Z or a date such as 2016-04-01 for its midnight UTC.
+func ParseAsOf(s string) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time '%s', expected e.g. 2016-04-01T09:50:39Z or 2016-04-01", s)
+}
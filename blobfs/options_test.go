@@ -0,0 +1,25 @@
+package blobfs
+
+import "testing"
+
+func TestParseMountOptionsReadOnlyWins(t *testing.T) {
+	for _, c := range []struct {
+		readOnly bool
+		options  string
+	}{
+		{true, "rw"},
+		{false, "ro,rw"},
+		{false, "rw,ro"},
+	} {
+		options := Options{ReadOnly: c.readOnly}
+		rest := options.ParseMountOptions(c.options)
+		if !options.ReadOnly || len(rest) != 0 {
+			t.Errorf("ParseMountOptions '%s' with ReadOnly %v: got %+v %q", c.options, c.readOnly, options, rest)
+		}
+	}
+
+	var options Options
+	if options.ParseMountOptions("rw"); options.ReadOnly {
+		t.Errorf("ParseMountOptions 'rw': got %+v", options)
+	}
+}
@@ -1,7 +1,12 @@
 package blobfs
 
 import (
+	"encoding/base32"
+	"fmt"
 	"net/url"
+	"strings"
+
+	"github.com/hanwen/go-fuse/fuse"
 )
 
 // pathEscaper provides escape/unescape methods to take care of characters
@@ -13,6 +18,71 @@ type pathEscaper interface {
 	FileNameToBlobName(fileName string) (blobName string, err error)
 }
 
+// fileNameStatus is the status for a file name FileNameToBlobName failed on.
+// A shortened name which isn't known has no blob behind it, anything else
+// is not a valid name.
+func fileNameStatus(err error) fuse.Status {
+	if err == errShortNameNotMapped {
+		return fuse.ENOENT
+	}
+	return fuse.EINVAL
+}
+
+// PathEscaping names the way blob names are turned into file names.
+type PathEscaping string
+
+const (
+	// PathEscapingURLQuery uses URL query encoding, e.g. 'a b/c' is 'a+b%2Fc'.
+	// This is the default.
+	PathEscapingURLQuery PathEscaping = "urlquery"
+
+	// PathEscapingMinimal only escapes what can't be in file names,
+	// e.g. 'a b/c' is 'a b%2Fc'.
+	PathEscapingMinimal PathEscaping = "minimal"
+
+	// PathEscapingPercent uses RFC 3986 percent-encoding of everything
+	// but unreserved characters, e.g. 'a b/c' is 'a%20b%2Fc'.
+	PathEscapingPercent PathEscaping = "percent"
+
+	// PathEscapingBase32 encodes the whole name as base32, e.g. 'a b/c'
+	// is 'MEQGEL3D'. Unreadable but safe for names nothing else copes with.
+	PathEscapingBase32 PathEscaping = "base32"
+)
+
+// PathEscapings lists all supported ways of escaping.
+var PathEscapings = []PathEscaping{
+	PathEscapingURLQuery,
+	PathEscapingMinimal,
+	PathEscapingPercent,
+	PathEscapingBase32,
+}
+
+// ParsePathEscaping returns the PathEscaping with the given name.
+func ParsePathEscaping(name string) (PathEscaping, error) {
+	for _, escaping := range PathEscapings {
+		if string(escaping) == name {
+			return escaping, nil
+		}
+	}
+
+	return "", fmt.Errorf("unknown path escaping '%s'", name)
+}
+
+// newPathEscaper returns the pathEscaper for escaping, pathEscaperURLQuery
+// if it's not given.
+func newPathEscaper(escaping PathEscaping) pathEscaper {
+	switch escaping {
+	case PathEscapingMinimal:
+		return pathEscaperMinimal{}
+	case PathEscapingPercent:
+		return pathEscaperPercent{}
+	case PathEscapingBase32:
+		return pathEscaperBase32{}
+	default:
+		return pathEscaperURLQuery{}
+	}
+}
+
 // pathEscaperURLQuery is an implementation of pathEscaper which
 // uses encodes blob names using URL query encoder. This *should*
 // always produce valid file names (hopefully). At least it takes care
@@ -21,9 +91,169 @@ type pathEscaperURLQuery struct {
 }
 
 func (x pathEscaperURLQuery) BlobNameToFileName(blobName string) (fileName string, err error) {
-	return url.QueryEscape(blobName), nil
+	return escapeDotNames(url.QueryEscape(blobName)), nil
 }
 
 func (x pathEscaperURLQuery) FileNameToBlobName(fileName string) (blobName string, err error) {
-	return url.QueryUnescape(fileName)
+	blobName, err = url.QueryUnescape(fileName)
+	return canonicalBlobName(x, fileName, blobName, err)
+}
+
+// pathEscaperMinimal is an implementation of pathEscaper which only
+// escapes the forward slash and NUL, plus '%' itself, so that names look
+// the same as in other tools as much as possible.
+type pathEscaperMinimal struct {
+}
+
+func (x pathEscaperMinimal) BlobNameToFileName(blobName string) (fileName string, err error) {
+	return escapeDotNames(percentEscape(blobName, func(c byte) bool {
+		return c != '/' && c != 0 && c != '%'
+	})), nil
+}
+
+func (x pathEscaperMinimal) FileNameToBlobName(fileName string) (blobName string, err error) {
+	blobName, err = percentUnescape(fileName)
+	return canonicalBlobName(x, fileName, blobName, err)
+}
+
+// pathEscaperPercent is an implementation of pathEscaper which
+// percent-encodes everything but the unreserved characters of RFC 3986.
+// Unlike url.PathEscape, sub-delims such as '+' and '&' are escaped too.
+type pathEscaperPercent struct {
+}
+
+func (x pathEscaperPercent) BlobNameToFileName(blobName string) (fileName string, err error) {
+	return escapeDotNames(percentEscape(blobName, isUnreserved)), nil
+}
+
+func (x pathEscaperPercent) FileNameToBlobName(fileName string) (blobName string, err error) {
+	blobName, err = percentUnescape(fileName)
+	return canonicalBlobName(x, fileName, blobName, err)
+}
+
+// pathEscaperBase32 is an implementation of pathEscaper which encodes the
+// whole name using base32 without padding. Any blob name is a valid file
+// name this way as long as it's not too long.
+type pathEscaperBase32 struct {
+}
+
+func (x pathEscaperBase32) BlobNameToFileName(blobName string) (fileName string, err error) {
+	return strings.TrimRight(base32.StdEncoding.EncodeToString([]byte(blobName)), "="), nil
+}
+
+func (x pathEscaperBase32) FileNameToBlobName(fileName string) (blobName string, err error) {
+	padded := fileName
+	if n := len(padded) % 8; n != 0 {
+		padded += strings.Repeat("=", 8-n)
+	}
+
+	data, err := base32.StdEncoding.DecodeString(padded)
+	return canonicalBlobName(x, fileName, string(data), err)
+}
+
+// canonicalBlobName returns blobName decoded from fileName if fileName is
+// exactly what escaping blobName gives, or if it is blobName as is, e.g.
+// `touch "a b"` for what is listed as 'a+b' with URL query encoding. Other
+// spellings such as 'a%20b' are rejected, so that `rm` on a name which was
+// never listed doesn't delete a blob in a roundabout way.
+func canonicalBlobName(x pathEscaper, fileName string, blobName string, err error) (string, error) {
+	if err != nil {
+		return "", err
+	}
+
+	if blobName == fileName && escapeDotNames(fileName) == fileName {
+		return blobName, nil
+	}
+
+	if canonical, err := x.BlobNameToFileName(blobName); err != nil || canonical != fileName {
+		return "", fmt.Errorf("'%s' is not how blob '%s' is escaped", fileName, blobName)
+	}
+
+	return blobName, nil
+}
+
+// isUnreserved tells if c is an unreserved character as per RFC 3986.
+func isUnreserved(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+		c == '-' || c == '.' || c == '_' || c == '~'
+}
+
+// percentEscape escapes the bytes of s for which keep returns false as %XX.
+func percentEscape(s string, keep func(c byte) bool) string {
+	const hex = "0123456789ABCDEF"
+
+	var buf []byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if keep(c) {
+			if buf != nil {
+				buf = append(buf, c)
+			}
+			continue
+		}
+
+		if buf == nil {
+			buf = append(make([]byte, 0, len(s)+8), s[:i]...)
+		}
+		buf = append(buf, '%', hex[c>>4], hex[c&15])
+	}
+
+	if buf == nil {
+		return s
+	}
+	return string(buf)
+}
+
+// percentUnescape reverses percentEscape. Unlike url.QueryUnescape
+// it leaves '+' alone.
+func percentUnescape(s string) (string, error) {
+	if !strings.Contains(s, "%") {
+		return s, nil
+	}
+
+	buf := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' {
+			buf = append(buf, s[i])
+			continue
+		}
+
+		if i+2 >= len(s) || !isHex(s[i+1]) || !isHex(s[i+2]) {
+			return "", fmt.Errorf("invalid escape sequence in '%s'", s)
+		}
+		buf = append(buf, unhex(s[i+1])<<4|unhex(s[i+2]))
+		i += 2
+	}
+
+	return string(buf), nil
+}
+
+// escapeDotNames escapes '.' and '..' which can't be file names, and the
+// virtual directories of flat mode, which would hide blobs named like
+// them. All other names are returned as is.
+func escapeDotNames(fileName string) string {
+	switch fileName {
+	case ".":
+		return "%2E"
+	case "..":
+		return "%2E%2E"
+	case snapshotsDir, trashDir:
+		return "%2E" + fileName[1:]
+	}
+	return fileName
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+func unhex(c byte) byte {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0'
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10
+	default:
+		return c - 'A' + 10
+	}
 }
@@ -0,0 +1,156 @@
+package blobfs
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// checkRoundTrip checks that blobName turns into a valid file name
+// which turns back into the same blob name.
+func checkRoundTrip(t *testing.T, escaping PathEscaping, escaper pathEscaper, blobName string) bool {
+	fileName, err := escaper.BlobNameToFileName(blobName)
+	if err != nil {
+		t.Errorf("%s: BlobNameToFileName %q: %s", escaping, blobName, err)
+		return false
+	}
+
+	if fileName == "" || fileName == "." || fileName == ".." || strings.ContainsAny(fileName, "/\x00") {
+		t.Errorf("%s: BlobNameToFileName %q: invalid file name %q", escaping, blobName, fileName)
+		return false
+	}
+
+	got, err := escaper.FileNameToBlobName(fileName)
+	if err != nil {
+		t.Errorf("%s: FileNameToBlobName %q: %s", escaping, fileName, err)
+		return false
+	}
+
+	if got != blobName {
+		t.Errorf("%s: %q turned into %q and back into %q", escaping, blobName, fileName, got)
+		return false
+	}
+
+	return true
+}
+
+func TestPathEscapersRoundTripAllCharacters(t *testing.T) {
+	for _, escaping := range PathEscapings {
+		escaper := newPathEscaper(escaping)
+
+		for r := rune(0); r <= utf8.MaxRune; r++ {
+			if !utf8.ValidRune(r) {
+				continue
+			}
+
+			c := string(r)
+			if !checkRoundTrip(t, escaping, escaper, c) || !checkRoundTrip(t, escaping, escaper, "a"+c+c+"z") {
+				// One failure per escaper is enough to see what's wrong.
+				break
+			}
+		}
+	}
+}
+
+func TestPathEscapersRoundTripNames(t *testing.T) {
+	names := append([]string{
+		".",
+		"..",
+		"%",
+		"%2F",
+		"%%25",
+		"+",
+		" ",
+		"/",
+		"//",
+		strings.Repeat("/", 100),
+		strings.Repeat("x", 1024),
+	}, conformanceBlobNames...)
+
+	for _, escaping := range PathEscapings {
+		escaper := newPathEscaper(escaping)
+		for _, name := range names {
+			checkRoundTrip(t, escaping, escaper, name)
+		}
+	}
+}
+
+func TestPathEscapersExamples(t *testing.T) {
+	cases := []struct {
+		escaping PathEscaping
+		blobName string
+		fileName string
+	}{
+		{PathEscapingURLQuery, "a b/c", "a+b%2Fc"},
+		{PathEscapingMinimal, "a b/c", "a b%2Fc"},
+		{PathEscapingMinimal, "100% done", "100%25 done"},
+		{PathEscapingMinimal, "日本", "日本"},
+		{PathEscapingPercent, "a b/c", "a%20b%2Fc"},
+		{PathEscapingPercent, "a+b~c", "a%2Bb~c"},
+		{PathEscapingPercent, "é", "%C3%A9"},
+		{PathEscapingBase32, "a b/c", "MEQGEL3D"},
+		{PathEscapingPercent, "..", "%2E%2E"},
+		{PathEscapingMinimal, ".snapshots", "%2Esnapshots"},
+		{PathEscapingURLQuery, ".trash", "%2Etrash"},
+	}
+
+	for _, tc := range cases {
+		fileName, err := newPathEscaper(tc.escaping).BlobNameToFileName(tc.blobName)
+		if err != nil || fileName != tc.fileName {
+			t.Errorf("%s: %q: expected %q got %q %v", tc.escaping, tc.blobName, tc.fileName, fileName, err)
+		}
+	}
+}
+
+func TestPathEscapersInvalidFileNames(t *testing.T) {
+	cases := []struct {
+		escaping PathEscaping
+		fileName string
+	}{
+		{PathEscapingMinimal, "100%"},
+		{PathEscapingMinimal, "%zz"},
+		{PathEscapingPercent, "abc%2"},
+		{PathEscapingBase32, "not base32!"},
+		{PathEscapingBase32, "a"},
+
+		// Other ways to escape the same blob names.
+		{PathEscapingURLQuery, "a%20b"},
+		{PathEscapingURLQuery, "%41"},
+		{PathEscapingURLQuery, "a%2fb"},
+		{PathEscapingURLQuery, "."},
+		{PathEscapingMinimal, "%41"},
+		{PathEscapingMinimal, "a%2fb"},
+		{PathEscapingPercent, "%7E"},
+		{PathEscapingPercent, "%c3%a9"},
+		{PathEscapingBase32, "MEQGEL3D===="},
+		{PathEscapingBase32, "MF"},
+	}
+
+	for _, tc := range cases {
+		if blobName, err := newPathEscaper(tc.escaping).FileNameToBlobName(tc.fileName); err == nil {
+			t.Errorf("%s: %q: expected error got %q", tc.escaping, tc.fileName, blobName)
+		}
+	}
+}
+
+func TestPathEscapersAcceptBlobNamesAsIs(t *testing.T) {
+	for _, escaping := range []PathEscaping{PathEscapingURLQuery, PathEscapingMinimal, PathEscapingPercent} {
+		for _, name := range []string{"a b", "naïve", "日本語"} {
+			if blobName, err := newPathEscaper(escaping).FileNameToBlobName(name); err != nil || blobName != name {
+				t.Errorf("%s: %q: got %q %v", escaping, name, blobName, err)
+			}
+		}
+	}
+}
+
+func TestParsePathEscaping(t *testing.T) {
+	for _, escaping := range PathEscapings {
+		if got, err := ParsePathEscaping(string(escaping)); err != nil || got != escaping {
+			t.Errorf("ParsePathEscaping %q: got %q %v", escaping, got, err)
+		}
+	}
+
+	if _, err := ParsePathEscaping("rot13"); err == nil {
+		t.Errorf("ParsePathEscaping: expected error for unknown escaping")
+	}
+}
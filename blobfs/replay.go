@@ -0,0 +1,257 @@
+package blobfs
+
+// Replay of a JSON trace against a file system, to reproduce what
+// a user saw without their mount.
+//
+// The trace has no data, only sizes, so writes replay zeros of the
+// same size. The blobs the operations worked on must be there before
+// replaying, e.g. in a -localDir.
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+)
+
+// ReplayDivergence is an operation which did not return the status it
+// returned when it was traced.
+type ReplayDivergence struct {
+	// Record is the number of the record in the trace, from 1.
+	Record int
+	Op     string
+	Path   string
+
+	Expected fuse.Status
+	Got      fuse.Status
+
+	// Message tells why the operation could not be replayed, if so.
+	Message string
+}
+
+func (d ReplayDivergence) String() string {
+	if d.Message != "" {
+		return fmt.Sprintf("#%d %s '%s': %s", d.Record, d.Op, d.Path, d.Message)
+	}
+	return fmt.Sprintf("#%d %s '%s': expected %s got %s", d.Record, d.Op, d.Path, statusName(d.Expected), statusName(d.Got))
+}
+
+// ReadTrace reads all records of a JSON trace.
+func ReadTrace(r io.Reader) ([]TraceRecord, error) {
+	var records []TraceRecord
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var record TraceRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, fmt.Errorf("trace record #%d: %s", len(records)+1, err)
+		}
+		records = append(records, record)
+	}
+
+	return records, scanner.Err()
+}
+
+// Replay runs the operations in records against fs in the order they
+// started and returns those which came out differently. Storage calls
+// are not replayed, they are whatever fs makes.
+func Replay(fs pathfs.FileSystem, records []TraceRecord) []ReplayDivergence {
+	r := &replayer{
+		fs:    fs,
+		files: make(map[uint64]nodefs.File),
+	}
+
+	order := make([]int, len(records))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Stable(recordsByTime{records, order})
+
+	for _, i := range order {
+		record := records[i]
+		if strings.HasPrefix(record.Op, "storage.") {
+			continue
+		}
+
+		got, message := r.replay(record)
+		if message != "" || got != fuse.Status(record.Status) {
+			r.divergences = append(r.divergences, ReplayDivergence{
+				Record:   i + 1,
+				Op:       record.Op,
+				Path:     record.Path,
+				Expected: fuse.Status(record.Status),
+				Got:      got,
+				Message:  message,
+			})
+		}
+	}
+
+	// The trace may end with files still open.
+	for _, file := range r.files {
+		file.Release()
+	}
+
+	return r.divergences
+}
+
+// recordsByTime sorts the order of records by the time they started.
+type recordsByTime struct {
+	records []TraceRecord
+	order   []int
+}
+
+func (s recordsByTime) Len() int      { return len(s.order) }
+func (s recordsByTime) Swap(i, j int) { s.order[i], s.order[j] = s.order[j], s.order[i] }
+func (s recordsByTime) Less(i, j int) bool {
+	return s.records[s.order[i]].Time.Before(s.records[s.order[j]].Time)
+}
+
+type replayer struct {
+	fs pathfs.FileSystem
+
+	// files are the files open in the replay by their handle in the trace.
+	files map[uint64]nodefs.File
+
+	divergences []ReplayDivergence
+}
+
+// replay runs a single operation, the message tells why it could not be.
+func (r *replayer) replay(record TraceRecord) (status fuse.Status, message string) {
+	args := replayArgs(record.Args)
+	name := record.Path
+
+	switch record.Op {
+	case "GetAttr":
+		_, status = r.fs.GetAttr(name, nil)
+	case "GetXAttr":
+		_, status = r.fs.GetXAttr(name, args.string("attr"), nil)
+	case "SetXAttr":
+		status = r.fs.SetXAttr(name, args.string("attr"), make([]byte, args.int64("size")), int(args.int64("flags")), nil)
+	case "ListXAttr":
+		_, status = r.fs.ListXAttr(name, nil)
+	case "RemoveXAttr":
+		status = r.fs.RemoveXAttr(name, args.string("attr"), nil)
+	case "Readlink":
+		_, status = r.fs.Readlink(name, nil)
+	case "Mknod":
+		status = r.fs.Mknod(name, args.uint32("mode"), args.uint32("dev"), nil)
+	case "Mkdir":
+		status = r.fs.Mkdir(name, args.uint32("mode"), nil)
+	case "Unlink":
+		status = r.fs.Unlink(name, nil)
+	case "Rmdir":
+		status = r.fs.Rmdir(name, nil)
+	case "Symlink":
+		status = r.fs.Symlink(args.string("value"), name, nil)
+	case "Rename":
+		status = r.fs.Rename(name, args.string("newName"), nil)
+	case "Link":
+		status = r.fs.Link(name, args.string("newName"), nil)
+	case "Chmod":
+		status = r.fs.Chmod(name, args.uint32("mode"), nil)
+	case "Chown":
+		status = r.fs.Chown(name, args.uint32("uid"), args.uint32("gid"), nil)
+	case "Truncate":
+		status = r.fs.Truncate(name, uint64(args.int64("offset")), nil)
+	case "Open":
+		var file nodefs.File
+		file, status = r.fs.Open(name, args.uint32("flags"), nil)
+		r.opened(record, file)
+	case "Create":
+		var file nodefs.File
+		file, status = r.fs.Create(name, args.uint32("flags"), args.uint32("mode"), nil)
+		r.opened(record, file)
+	case "OpenDir":
+		_, status = r.fs.OpenDir(name, nil)
+	case "Access":
+		status = r.fs.Access(name, args.uint32("mode"), nil)
+	case "Utimens":
+		status = r.fs.Utimens(name, args.time("atime"), args.time("mtime"), nil)
+	case "StatFs":
+		status = fuse.OK
+		if r.fs.StatFs(name) == nil {
+			status = fuse.ENOSYS
+		}
+	case "Read", "Write", "Flush", "Release", "Fsync", "FTruncate", "FGetAttr":
+		return r.replayFile(record, args)
+	default:
+		return fuse.ENOSYS, fmt.Sprintf("don't know how to replay '%s'", record.Op)
+	}
+
+	return status, ""
+}
+
+// replayFile runs an operation on an open file.
+func (r *replayer) replayFile(record TraceRecord, args replayArgs) (status fuse.Status, message string) {
+	file, ok := r.files[record.FH]
+	if !ok {
+		return fuse.EBADF, fmt.Sprintf("file handle %d is not open, its Open failed or is not in the trace", record.FH)
+	}
+
+	switch record.Op {
+	case "Read":
+		_, status = file.Read(make([]byte, args.int64("size")), args.int64("offset"))
+	case "Write":
+		_, status = file.Write(make([]byte, args.int64("size")), args.int64("offset"))
+	case "Flush":
+		status = file.Flush()
+	case "Release":
+		file.Release()
+		delete(r.files, record.FH)
+		status = fuse.OK
+	case "Fsync":
+		status = file.Fsync(int(args.int64("flags")))
+	case "FTruncate":
+		status = file.Truncate(uint64(args.int64("size")))
+	case "FGetAttr":
+		status = file.GetAttr(&fuse.Attr{})
+	}
+
+	return status, ""
+}
+
+// opened remembers file opened by record under the handle in the trace.
+func (r *replayer) opened(record TraceRecord, file nodefs.File) {
+	if file != nil && record.FH != 0 {
+		r.files[record.FH] = file
+	}
+}
+
+// replayArgs are the arguments of a trace record. Numbers come out of
+// JSON as float64, which holds all the flags, modes and offsets exactly.
+type replayArgs map[string]interface{}
+
+func (args replayArgs) string(key string) string {
+	s, _ := args[key].(string)
+	return s
+}
+
+func (args replayArgs) int64(key string) int64 {
+	f, _ := args[key].(float64)
+	return int64(f)
+}
+
+func (args replayArgs) uint32(key string) uint32 {
+	f, _ := args[key].(float64)
+	return uint32(f)
+}
+
+func (args replayArgs) time(key string) *time.Time {
+	s, ok := args[key].(string)
+	if !ok {
+		return nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return nil
+	}
+	return &t
+}
@@ -0,0 +1,58 @@
+package blobfs
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func TestReplay(t *testing.T) {
+	var buf bytes.Buffer
+	tracer := NewTracer(&buf, nil)
+	tracer.log = log.New(ioutil.Discard, "", 0)
+
+	// Record what `touch foo`, `echo hello > foo`, `cat bar` do.
+	backend := newTestBackend(t)
+	putBlob(t, backend.backend, conformanceContainer, "bar", "bar")
+	fs := tracer.FileSystem(NewFlatBlobFs(conformanceContainer, tracer.Backend(backend), Options{}))
+
+	fs.GetAttr("foo", nil)
+	fs.Mknod("foo", syscall.S_IFREG|0644, 0, nil)
+	writeFile(t, fs, "foo", "hello")
+	readFile(t, fs, "bar")
+	tracer.Flush()
+
+	records, err := ReadTrace(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The same blobs give the same results.
+	replayBackend := newTestBackend(t)
+	putBlob(t, replayBackend.backend, conformanceContainer, "bar", "bar")
+	if divergences := Replay(NewFlatBlobFs(conformanceContainer, replayBackend, Options{}), records); len(divergences) != 0 {
+		t.Errorf("Expected no divergences got %v", divergences)
+	}
+	if content := readBlob(t, replayBackend.backend, conformanceContainer, "foo", 0, 5); content != "\x00\x00\x00\x00\x00" {
+		t.Errorf("Replayed write: expected 5 zeros got %q", content)
+	}
+
+	// Without 'bar' cat fails, and so does everything it does to the file.
+	divergences := Replay(NewFlatBlobFs(conformanceContainer, newTestBackend(t), Options{}), records)
+	if len(divergences) == 0 || divergences[0].Op != "Open" || divergences[0].Got != fuse.ENOENT {
+		t.Fatalf("Expected Open to diverge got %v", divergences)
+	}
+	if s := divergences[0].String(); !strings.Contains(s, "Open 'bar': expected OK got ENOENT") {
+		t.Errorf("Unexpected divergence text %q", s)
+	}
+	for _, d := range divergences[1:] {
+		if d.Path != "bar" || d.Message == "" {
+			t.Errorf("Operation on a file which did not open: expected message got %v", d)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package blobfs
+
+// Files open for writing keep their changes in memory until Flush, so a
+// mount going away with files still open loses them. Shutdown keeps track
+// of open files so that their changes can be saved first, and turns away
+// new opens and writes while that goes on.
+
+import (
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+)
+
+// Shutdown saves the changes to the files open through FileSystem before
+// the mount goes away, see Flush.
+type Shutdown struct {
+	mu       sync.Mutex
+	flushing bool
+	files    map[*shutdownFile]bool
+
+	// writing counts the writes started before flushing and not done yet.
+	writing sync.WaitGroup
+}
+
+// NewShutdown returns a Shutdown with no files open yet.
+func NewShutdown() *Shutdown {
+	return &Shutdown{
+		files: make(map[*shutdownFile]bool),
+	}
+}
+
+// FileSystem wraps fs to keep track of the files opened for writing.
+func (s *Shutdown) FileSystem(fs pathfs.FileSystem) pathfs.FileSystem {
+	return &shutdownFs{
+		FileSystem: fs,
+		shutdown:   s,
+	}
+}
+
+// Flush makes new opens and writes fail with ESHUTDOWN and flushes all
+// files open for writing once the writes under way are done, giving up on
+// those not done after timeout. It returns the names of the files whose
+// changes may be lost.
+func (s *Shutdown) Flush(timeout time.Duration) []string {
+	s.mu.Lock()
+	s.flushing = true
+	var files []*shutdownFile
+	for f := range s.files {
+		files = append(files, f)
+	}
+	s.mu.Unlock()
+
+	// Flush waits on storage, so all at once and not for longer than
+	// timeout in total.
+	type flushed struct {
+		index  int
+		status fuse.Status
+	}
+	results := make(chan flushed, len(files))
+	for i, f := range files {
+		go func(i int, f *shutdownFile) {
+			s.writing.Wait()
+			results <- flushed{i, f.File.Flush()}
+		}(i, f)
+	}
+
+	saved := make([]bool, len(files))
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+wait:
+	for range files {
+		select {
+		case result := <-results:
+			saved[result.index] = result.status == fuse.OK
+		case <-timer.C:
+			break wait
+		}
+	}
+
+	var lost []string
+	for i, f := range files {
+		if !saved[i] {
+			lost = append(lost, f.name)
+		}
+	}
+	sort.Strings(lost)
+	return lost
+}
+
+// open is false once flushing, new files are not to be opened then.
+func (s *Shutdown) open() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return !s.flushing
+}
+
+// write starts a write unless flushing, done is to be called once it's
+// over.
+func (s *Shutdown) write() (done func(), status fuse.Status) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.flushing {
+		return nil, fuse.Status(syscall.ESHUTDOWN)
+	}
+	s.writing.Add(1)
+	return s.writing.Done, fuse.OK
+}
+
+// opened starts following file if it is open for writing.
+func (s *Shutdown) opened(name string, file nodefs.File, flags uint32) nodefs.File {
+	if file == nil || flags&syscall.O_ACCMODE == syscall.O_RDONLY {
+		return file
+	}
+
+	f := &shutdownFile{
+		File:     file,
+		shutdown: s,
+		name:     name,
+	}
+	s.mu.Lock()
+	s.files[f] = true
+	s.mu.Unlock()
+	return f
+}
+
+func (s *Shutdown) released(f *shutdownFile) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.files, f)
+}
+
+// shutdownFs turns away opens once flushing. Everything else goes straight
+// to the embedded file system.
+type shutdownFs struct {
+	pathfs.FileSystem
+	shutdown *Shutdown
+}
+
+func (fs *shutdownFs) Open(name string, flags uint32, context *fuse.Context) (file nodefs.File, code fuse.Status) {
+	if !fs.shutdown.open() {
+		return nil, fuse.Status(syscall.ESHUTDOWN)
+	}
+	file, status := fs.FileSystem.Open(name, flags, context)
+	return fs.shutdown.opened(name, file, flags), status
+}
+
+func (fs *shutdownFs) Create(name string, flags uint32, mode uint32, context *fuse.Context) (file nodefs.File, code fuse.Status) {
+	if !fs.shutdown.open() {
+		return nil, fuse.Status(syscall.ESHUTDOWN)
+	}
+	file, status := fs.FileSystem.Create(name, flags, mode, context)
+	return fs.shutdown.opened(name, file, flags), status
+}
+
+// shutdownFile is a file open for writing, followed until released.
+type shutdownFile struct {
+	nodefs.File
+	shutdown *Shutdown
+	name     string
+}
+
+func (f *shutdownFile) InnerFile() nodefs.File {
+	return f.File
+}
+
+func (f *shutdownFile) Write(data []byte, off int64) (uint32, fuse.Status) {
+	done, status := f.startWrite()
+	if status != fuse.OK {
+		return 0, status
+	}
+	defer done()
+	return f.File.Write(data, off)
+}
+
+func (f *shutdownFile) Truncate(size uint64) fuse.Status {
+	done, status := f.startWrite()
+	if status != fuse.OK {
+		return status
+	}
+	defer done()
+	return f.File.Truncate(size)
+}
+
+// startWrite makes shutdownFile a writeGuard, for copy_file_range.
+func (f *shutdownFile) startWrite() (done func(), status fuse.Status) {
+	return f.shutdown.write()
+}
+
+func (f *shutdownFile) Release() {
+	f.shutdown.released(f)
+	f.File.Release()
+}
@@ -0,0 +1,92 @@
+package blobfs
+
+import (
+	"io/ioutil"
+	"log"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func TestShutdownFlush(t *testing.T) {
+	backend := newTestBackend(t)
+	putBlob(t, backend.backend, conformanceContainer, "saved", "old")
+	putBlob(t, backend.backend, conformanceContainer, "lost", "old")
+	putBlob(t, backend.backend, conformanceContainer, "read", "old")
+
+	flat := NewFlatBlobFs(conformanceContainer, backend, Options{}).(*flatblobFs)
+	flat.log = log.New(ioutil.Discard, "", 0)
+	shutdown := NewShutdown()
+	fs := shutdown.FileSystem(flat)
+
+	saved, status := fs.Open("saved", uint32(syscall.O_WRONLY|syscall.O_TRUNC), nil)
+	expectStatus(t, "Open saved", status, fuse.OK)
+	saved.Write([]byte("new"), 0)
+	lost, status := fs.Open("lost", uint32(syscall.O_WRONLY|syscall.O_TRUNC), nil)
+	expectStatus(t, "Open lost", status, fuse.OK)
+	lost.Write([]byte("new"), 0)
+	read, status := fs.Open("read", uint32(syscall.O_RDONLY), nil)
+	expectStatus(t, "Open read", status, fuse.OK)
+	defer read.Release()
+
+	// Released files are not flushed again.
+	released, status := fs.Open("saved", uint32(syscall.O_WRONLY), nil)
+	expectStatus(t, "Open released", status, fuse.OK)
+	released.Release()
+
+	// One of the blobs gets changed by someone else.
+	putBlob(t, backend.backend, conformanceContainer, "lost", "changed")
+
+	names := shutdown.Flush(time.Minute)
+	if len(names) != 1 || names[0] != "lost" {
+		t.Errorf("Flush: expected [lost] got %q", names)
+	}
+	if got := readFile(t, flat, "saved"); got != "new" {
+		t.Errorf("Read saved: expected 'new' got '%s'", got)
+	}
+	if got := readFile(t, flat, "lost"); got != "changed" {
+		t.Errorf("Read lost: expected 'changed' got '%s'", got)
+	}
+	expectStatus(t, "Open after Flush", statusOf(fs.Open("saved", uint32(syscall.O_RDONLY), nil)), fuse.Status(syscall.ESHUTDOWN))
+	expectStatus(t, "Create after Flush", statusOf(fs.Create("new", uint32(syscall.O_WRONLY), 0644, nil)), fuse.Status(syscall.ESHUTDOWN))
+
+	// Files already open can't be changed any more either.
+	if n, status := saved.Write([]byte("lost"), 0); n != 0 || status != fuse.Status(syscall.ESHUTDOWN) {
+		t.Errorf("Write after Flush: expected ESHUTDOWN got %d %v", n, status)
+	}
+	expectStatus(t, "Truncate after Flush", saved.Truncate(0), fuse.Status(syscall.ESHUTDOWN))
+	if got := readFile(t, flat, "saved"); got != "new" {
+		t.Errorf("Read saved after Write: expected 'new' got '%s'", got)
+	}
+
+	saved.Release()
+	lost.Release()
+}
+
+func TestShutdownFlushTimeout(t *testing.T) {
+	backend := newTestBackend(t)
+	putBlob(t, backend.backend, conformanceContainer, "slow", "old")
+
+	flat := NewFlatBlobFs(conformanceContainer, backend, Options{}).(*flatblobFs)
+	flat.log = log.New(ioutil.Discard, "", 0)
+	shutdown := NewShutdown()
+	fs := shutdown.FileSystem(flat)
+
+	f, status := fs.Open("slow", uint32(syscall.O_WRONLY|syscall.O_TRUNC), nil)
+	expectStatus(t, "Open", status, fuse.OK)
+	f.Write([]byte("new"), 0)
+
+	// Hold the file so that Flush can't get at it in time.
+	inner := f.InnerFile().(*blobFile)
+	inner.mu.Lock()
+	names := shutdown.Flush(10 * time.Millisecond)
+	inner.dirty = false
+	inner.mu.Unlock()
+	if len(names) != 1 || names[0] != "slow" {
+		t.Errorf("Flush: expected [slow] got %q", names)
+	}
+
+	f.Release()
+}
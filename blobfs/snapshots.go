@@ -0,0 +1,295 @@
+package blobfs
+
+// Snapshots of blobs show up read-only under a hidden .snapshots directory
+// in the root, one directory per second in which snapshots were taken:
+//
+//     .snapshots/2016-04-01T09:50:39Z/foo
+//
+// Snapshots are taken with `mkdir .snapshots/now` for all blobs, or with
+// `setfattr -n user.azurefs.snapshot -v 1 foo` for one. Azure gives each
+// snapshot its own timestamp, so snapshots of many blobs taken at once can
+// end up in more than one directory.
+
+import (
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+const (
+	// snapshotsDir is the directory in the root with the snapshots. It's
+	// not listed, same as .zfs, and hides a blob of the same name.
+	snapshotsDir = ".snapshots"
+
+	// snapshotsNow is what to mkdir in snapshotsDir to snapshot all blobs.
+	snapshotsNow = "now"
+
+	// snapshotDirFormat is the format of directory names in snapshotsDir.
+	snapshotDirFormat = "2006-01-02T15:04:05Z"
+)
+
+// xattrSnapshot is the extended attribute to take a snapshot of a blob by
+// setting it, and with the timestamp of a snapshot in snapshotsDir.
+const xattrSnapshot = "user.azurefs.snapshot"
+
+// isSnapshotPath tells if the file name is snapshotsDir or in it.
+func isSnapshotPath(name string) bool {
+	return name == snapshotsDir || strings.HasPrefix(name, snapshotsDir+"/")
+}
+
+// splitSnapshotPath splits a name in snapshotsDir into the snapshot
+// directory and the file name in it, either of which can be empty.
+func splitSnapshotPath(name string) (dir string, fileName string) {
+	parts := strings.SplitN(strings.TrimPrefix(name, snapshotsDir), "/", 3)
+	if len(parts) > 1 {
+		dir = parts[1]
+	}
+	if len(parts) > 2 {
+		fileName = parts[2]
+	}
+	return dir, fileName
+}
+
+// snapshotDirName returns the directory in snapshotsDir which the snapshot
+// shows up in, "" if the snapshot timestamp can't be parsed.
+func snapshotDirName(snapshot string) string {
+	t, err := time.Parse(snapshotTimeFormat, snapshot)
+	if err != nil {
+		return ""
+	}
+	return t.Format(snapshotDirFormat)
+}
+
+func (fs *flatblobFs) snapshotGetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
+	dir, fileName := splitSnapshotPath(name)
+	if dir == "" {
+		attr := fs.defaultDirFuseAttr
+		attr.Mode = fuse.S_IFDIR | 0555
+		return &attr, fuse.OK
+	}
+
+	// The kernel looks at what mkdir made right after, let it see it once.
+	if dir == snapshotsNow && fileName == "" {
+		fs.snapshotsMu.Lock()
+		made := fs.snapshotsNowMade
+		fs.snapshotsNowMade = false
+		fs.snapshotsMu.Unlock()
+
+		if made {
+			attr := fs.defaultDirFuseAttr
+			attr.Mode = fuse.S_IFDIR | 0555
+			return &attr, fuse.OK
+		}
+		return nil, fuse.ENOENT
+	}
+
+	if fileName == "" {
+		snapshots, status := fs.listSnapshots("GetAttr", name, "", context)
+		if status != fuse.OK {
+			return nil, status
+		}
+		for _, props := range snapshots {
+			if snapshotDirName(props.Snapshot) == dir {
+				attr := fs.defaultDirFuseAttr
+				attr.Mode = fuse.S_IFDIR | 0555
+				attr.SetTimes(nil, &props.LastModified, &props.LastModified)
+				return &attr, fuse.OK
+			}
+		}
+		return nil, fuse.ENOENT
+	}
+
+	props, status := fs.findSnapshot("GetAttr", name, dir, fileName, context)
+	if status != fuse.OK {
+		return nil, status
+	}
+
+	attr := fs.defaultFileFuseAttr
+	attr.Mode = fuse.S_IFREG | 0444
+	attr.Size = uint64(props.ContentLength)
+	attr.SetTimes(nil, &props.LastModified, &props.LastModified)
+	return &attr, fuse.OK
+}
+
+func (fs *flatblobFs) snapshotGetXAttr(name string, attr string, context *fuse.Context) ([]byte, fuse.Status) {
+	dir, fileName := splitSnapshotPath(name)
+	if fileName == "" || (attr != xattrBlobName && attr != xattrSnapshot) {
+		return nil, fuse.Status(syscall.ENODATA)
+	}
+
+	props, status := fs.findSnapshot("GetXAttr", name, dir, fileName, context)
+	if status != fuse.OK {
+		return nil, status
+	}
+
+	if attr == xattrSnapshot {
+		return []byte(props.Snapshot), fuse.OK
+	}
+	return []byte(props.Name), fuse.OK
+}
+
+func (fs *flatblobFs) snapshotOpen(name string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	if isWriteOpen(flags) {
+		return nil, fuse.EROFS
+	}
+
+	dir, fileName := splitSnapshotPath(name)
+	if fileName == "" {
+		return nil, fuse.EISDIR
+	}
+
+	props, status := fs.findSnapshot("Open", name, dir, fileName, context)
+	if status != fuse.OK {
+		return nil, status
+	}
+
+	f, status := newBlobFile(fs.backend, fs.accountContainer, props, false, false, true, fs.log, context)
+	if status != fuse.OK {
+		return nil, status
+	}
+	return f, fuse.OK
+}
+
+func (fs *flatblobFs) snapshotOpenDir(name string, context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	dir, fileName := splitSnapshotPath(name)
+	if fileName != "" {
+		return nil, fuse.ENOTDIR
+	}
+
+	snapshots, status := fs.listSnapshots("OpenDir", name, "", context)
+	if status != fuse.OK {
+		return nil, status
+	}
+
+	if dir == "" {
+		var dirs []string
+		seen := make(map[string]bool)
+		for _, props := range snapshots {
+			dirName := snapshotDirName(props.Snapshot)
+			if dirName != "" && !seen[dirName] {
+				seen[dirName] = true
+				dirs = append(dirs, dirName)
+			}
+		}
+		sort.Strings(dirs)
+
+		stream := make([]fuse.DirEntry, len(dirs))
+		for i, dirName := range dirs {
+			stream[i] = fuse.DirEntry{Mode: fuse.S_IFDIR | 0555, Name: dirName}
+		}
+		return stream, fuse.OK
+	}
+
+	// Latest snapshot of each blob in the directory, they come oldest first.
+	var blobs []BlobProperties
+	for _, props := range snapshots {
+		if snapshotDirName(props.Snapshot) != dir {
+			continue
+		}
+		if len(blobs) > 0 && blobs[len(blobs)-1].Name == props.Name {
+			blobs[len(blobs)-1] = props
+		} else {
+			blobs = append(blobs, props)
+		}
+	}
+	if len(blobs) == 0 {
+		return nil, fuse.ENOENT
+	}
+
+	return fs.dirEntries(blobs, fuse.S_IFREG|0444), fuse.OK
+}
+
+// snapshotMkdir snapshots all blobs for `mkdir .snapshots/now`, nothing
+// else can be made in snapshotsDir.
+func (fs *flatblobFs) snapshotMkdir(name string, context *fuse.Context) fuse.Status {
+	if name == snapshotsDir {
+		return fuse.Status(syscall.EEXIST)
+	}
+	if name != snapshotsDir+"/"+snapshotsNow {
+		return fuse.EROFS
+	}
+
+	blobs, err := fs.storage(context).ListBlobs(fs.accountContainer, fs.defaultListBlobParams)
+	if err != nil {
+		fs.log.Printf("[ERROR] Mkdir '%s': %s\n", name, err)
+		return statusFromError(err)
+	}
+
+	// Keep going on errors, a snapshot of most blobs beats none.
+	status := fuse.OK
+	for _, blob := range blobs {
+		if _, err := fs.storage(context).SnapshotBlob(fs.accountContainer, blob.Name); err != nil && !isNotFound(err) {
+			fs.log.Printf("[ERROR] Mkdir '%s': Could not snapshot blob '%s'. %s\n", name, blob.Name, err)
+			status = statusFromError(err)
+		}
+	}
+
+	fs.snapshotsMu.Lock()
+	fs.snapshotsNowMade = status == fuse.OK
+	fs.snapshotsMu.Unlock()
+
+	return status
+}
+
+// snapshotBlob snapshots the blob behind the file name for SetXAttr.
+func (fs *flatblobFs) snapshotBlob(name string, context *fuse.Context) fuse.Status {
+	blobName, err := fs.pathEscaper.FileNameToBlobName(name)
+	if err != nil {
+		return fuse.ENOENT
+	}
+
+	if _, err := fs.storage(context).SnapshotBlob(fs.accountContainer, blobName); err != nil {
+		if !isNotFound(err) {
+			fs.log.Printf("[ERROR] SetXAttr '%s': Could not snapshot blob. %s\n", name, err)
+		}
+		return statusFromError(err)
+	}
+	return fuse.OK
+}
+
+// listSnapshots lists the snapshots of the blobs starting with prefix,
+// op and name are for logging.
+func (fs *flatblobFs) listSnapshots(op string, name string, prefix string, context *fuse.Context) ([]BlobProperties, fuse.Status) {
+	blobs, err := fs.storage(context).ListBlobs(fs.accountContainer, ListBlobsParameters{Prefix: prefix, Snapshots: true})
+	if err != nil {
+		fs.log.Printf("[ERROR] %s '%s': %s\n", op, name, err)
+		return nil, statusFromError(err)
+	}
+
+	snapshots := make([]BlobProperties, 0, len(blobs))
+	for _, props := range blobs {
+		if props.Snapshot != "" {
+			snapshots = append(snapshots, props)
+		}
+	}
+	return snapshots, fuse.OK
+}
+
+// findSnapshot returns the latest snapshot in the directory of the blob
+// behind the file name.
+func (fs *flatblobFs) findSnapshot(op string, name string, dir string, fileName string, context *fuse.Context) (BlobProperties, fuse.Status) {
+	blobName, err := fs.pathEscaper.FileNameToBlobName(fileName)
+	if err != nil {
+		return BlobProperties{}, fuse.ENOENT
+	}
+
+	snapshots, status := fs.listSnapshots(op, name, blobName, context)
+	if status != fuse.OK {
+		return BlobProperties{}, status
+	}
+
+	var found *BlobProperties
+	for i, props := range snapshots {
+		if props.Name == blobName && snapshotDirName(props.Snapshot) == dir {
+			found = &snapshots[i]
+		}
+	}
+	if found == nil {
+		return BlobProperties{}, fuse.ENOENT
+	}
+	return *found, fuse.OK
+}
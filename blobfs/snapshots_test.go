@@ -0,0 +1,101 @@
+package blobfs
+
+import (
+	"io/ioutil"
+	"log"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func TestFlatBlobFsSnapshots(t *testing.T) {
+	backend := newTestBackend(t)
+	memory := backend.backend.(*memoryBackend)
+	now := time.Date(2016, 4, 1, 9, 50, 39, 0, time.UTC)
+	memory.now = func() time.Time { return now }
+
+	putBlob(t, memory, conformanceContainer, "foo", "old foo")
+	putBlob(t, memory, conformanceContainer, "bar", "old bar")
+
+	fs := NewFlatBlobFs(conformanceContainer, backend, Options{}).(*flatblobFs)
+	fs.log = log.New(ioutil.Discard, "", 0)
+
+	// Hidden from the root, but there.
+	if names := listNames(t, fs, ""); strings.Join(names, ",") != "bar,foo" {
+		t.Errorf("OpenDir root: expected [bar foo] got %q", names)
+	}
+	expectStatus(t, "GetAttr .snapshots", statusOf(fs.GetAttr(".snapshots", nil)), fuse.OK)
+	if names := listNames(t, fs, ".snapshots"); len(names) != 0 {
+		t.Errorf("OpenDir .snapshots: expected nothing got %q", names)
+	}
+
+	// mkdir now snapshots all blobs, and is there just long enough for
+	// the kernel to see it was made.
+	expectStatus(t, "Mkdir now", fs.Mkdir(".snapshots/now", 0755, nil), fuse.OK)
+	expectStatus(t, "GetAttr now", statusOf(fs.GetAttr(".snapshots/now", nil)), fuse.OK)
+	expectStatus(t, "GetAttr now again", statusOf(fs.GetAttr(".snapshots/now", nil)), fuse.ENOENT)
+
+	writeFile(t, fs, "foo", "new foo")
+
+	names := listNames(t, fs, ".snapshots")
+	if len(names) != 1 || names[0] != "2016-04-01T09:50:39Z" {
+		t.Fatalf("OpenDir .snapshots: expected [2016-04-01T09:50:39Z] got %q", names)
+	}
+	dir := ".snapshots/" + names[0]
+	if names := listNames(t, fs, dir); strings.Join(names, ",") != "bar,foo" {
+		t.Errorf("OpenDir %s: expected [bar foo] got %q", dir, names)
+	}
+
+	if got := readFile(t, fs, dir+"/foo"); got != "old foo" {
+		t.Errorf("Read snapshot: expected 'old foo' got '%s'", got)
+	}
+	if got := readFile(t, fs, "foo"); got != "new foo" {
+		t.Errorf("Read: expected 'new foo' got '%s'", got)
+	}
+
+	attr, status := fs.GetAttr(dir+"/foo", nil)
+	expectStatus(t, "GetAttr snapshot", status, fuse.OK)
+	if attr != nil && (attr.Mode != fuse.S_IFREG|0444 || attr.Size != 7) {
+		t.Errorf("GetAttr snapshot: unexpected %+v", attr)
+	}
+	expectStatus(t, "GetAttr missing snapshot", statusOf(fs.GetAttr(".snapshots/2000-01-01T00:00:00Z/foo", nil)), fuse.ENOENT)
+
+	snapshot, status := fs.GetXAttr(dir+"/foo", xattrSnapshot, nil)
+	expectStatus(t, "GetXAttr snapshot", status, fuse.OK)
+	if !strings.HasPrefix(string(snapshot), "2016-04-01T09:50:39.") {
+		t.Errorf("GetXAttr snapshot: unexpected '%s'", snapshot)
+	}
+
+	// Snapshots are read-only.
+	expectStatus(t, "Open for writing", statusOf(fs.Open(dir+"/foo", uint32(syscall.O_WRONLY), nil)), fuse.EROFS)
+	expectStatus(t, "Unlink", fs.Unlink(dir+"/foo", nil), fuse.EROFS)
+	expectStatus(t, "Mknod", fs.Mknod(dir+"/baz", fuse.S_IFREG|0644, 0, nil), fuse.EROFS)
+	expectStatus(t, "Mkdir", fs.Mkdir(".snapshots/other", 0755, nil), fuse.EROFS)
+	expectStatus(t, "Rename", fs.Rename("foo", dir+"/foo", nil), fuse.EROFS)
+	expectStatus(t, "Access write", fs.Access(dir+"/foo", accessWrite, nil), fuse.EROFS)
+
+	// Snapshots of single blobs are taken through an xattr.
+	now = now.Add(time.Minute)
+	expectStatus(t, "SetXAttr", fs.SetXAttr("foo", xattrSnapshot, []byte("1"), 0, nil), fuse.OK)
+	expectStatus(t, "SetXAttr missing", fs.SetXAttr("nope", xattrSnapshot, []byte("1"), 0, nil), fuse.ENOENT)
+	if names := listNames(t, fs, ".snapshots/2016-04-01T09:51:39Z"); strings.Join(names, ",") != "foo" {
+		t.Errorf("OpenDir after SetXAttr: expected [foo] got %q", names)
+	}
+	if got := readFile(t, fs, ".snapshots/2016-04-01T09:51:39Z/foo"); got != "new foo" {
+		t.Errorf("Read snapshot after SetXAttr: expected 'new foo' got '%s'", got)
+	}
+
+	// Read-only mounts can't take snapshots.
+	ro := NewFlatBlobFs(conformanceContainer, backend, Options{ReadOnly: true}).(*flatblobFs)
+	expectStatus(t, "Mkdir read-only", ro.Mkdir(".snapshots/now", 0755, nil), fuse.EROFS)
+	expectStatus(t, "SetXAttr read-only", ro.SetXAttr("foo", xattrSnapshot, []byte("1"), 0, nil), fuse.EROFS)
+
+	// Blobs with snapshots are only deleted along with them when asked to.
+	expectStatus(t, "Unlink with snapshots", fs.Unlink("foo", nil), fuse.EBUSY)
+	del := NewFlatBlobFs(conformanceContainer, backend, Options{DeleteSnapshots: true}).(*flatblobFs)
+	expectStatus(t, "Unlink deletesnapshots", del.Unlink("foo", nil), fuse.OK)
+	expectStatus(t, "GetAttr snapshot after Unlink", statusOf(fs.GetAttr(".snapshots/2016-04-01T09:51:39Z/foo", nil)), fuse.ENOENT)
+}
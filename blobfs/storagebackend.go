@@ -0,0 +1,380 @@
+package blobfs
+
+// Backend implementation on top of the Azure SDK.
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/ppanyukov/azure-sdk-for-go/storage"
+)
+
+// NewStorageBackend creates a Backend which talks to Azure storage using
+// the given client. Requests the SDK can't make are sent to the REST API
+// of account directly, through the client's HTTPClient.
+func NewStorageBackend(storageClient storage.Client, account StorageAccount) Backend {
+	httpClient := storageClient.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	return &storageBackend{
+		client:     storageClient.GetBlobService(),
+		account:    account,
+		httpClient: httpClient,
+	}
+}
+
+type storageBackend struct {
+	client     storage.BlobStorageClient
+	account    StorageAccount
+	httpClient *http.Client
+}
+
+func (b *storageBackend) ListContainers(prefix string) ([]ContainerProperties, error) {
+	var result []ContainerProperties
+	params := storage.ListContainersParameters{Prefix: prefix}
+	for {
+		res, err := b.client.ListContainers(params)
+		if err != nil {
+			return nil, storageError(err)
+		}
+
+		for _, container := range res.Containers {
+			result = append(result, ContainerProperties{
+				Name:         container.Name,
+				LastModified: parseTime(container.Properties.LastModified),
+				ETag:         container.Properties.Etag,
+				LeaseState:   container.Properties.LeaseState,
+			})
+		}
+
+		if res.NextMarker == "" {
+			return result, nil
+		}
+		params.Marker = res.NextMarker
+	}
+}
+
+func (b *storageBackend) ContainerExists(container string) (bool, error) {
+	exists, err := b.client.ContainerExists(container)
+	return exists, storageError(err)
+}
+
+func (b *storageBackend) CreateContainer(container string) error {
+	return storageError(b.client.CreateContainer(container, storage.ContainerAccessTypePrivate))
+}
+
+func (b *storageBackend) DeleteContainer(container string, leaseID string) error {
+	if leaseID == "" {
+		return storageError(b.client.DeleteContainer(container))
+	}
+
+	req := restRequest{method: "DELETE", container: container, query: url.Values{"restype": {"container"}}}
+	req.set("x-ms-lease-id", leaseID)
+	_, err := b.doAndClose(req)
+	return err
+}
+
+// The SDK has no container leases, so they are requested with Lease
+// Container directly.
+func (b *storageBackend) AcquireContainerLease(container string, duration int, proposedLeaseID string) (string, error) {
+	req := containerLeaseRequest(container, "acquire")
+	req.set("x-ms-lease-duration", strconv.Itoa(duration))
+	req.set("x-ms-proposed-lease-id", proposedLeaseID)
+	header, err := b.doAndClose(req)
+	if err != nil {
+		return "", err
+	}
+	return header.Get("x-ms-lease-id"), nil
+}
+
+func (b *storageBackend) ReleaseContainerLease(container, leaseID string) error {
+	req := containerLeaseRequest(container, "release")
+	req.set("x-ms-lease-id", leaseID)
+	_, err := b.doAndClose(req)
+	return err
+}
+
+// BreakContainerLease breaks the lease right away rather than when its
+// duration is up.
+func (b *storageBackend) BreakContainerLease(container string) error {
+	req := containerLeaseRequest(container, "break")
+	req.set("x-ms-lease-break-period", "0")
+	_, err := b.doAndClose(req)
+	return err
+}
+
+func containerLeaseRequest(container, action string) restRequest {
+	req := restRequest{method: "PUT", container: container, query: url.Values{"comp": {"lease"}, "restype": {"container"}}}
+	req.set("x-ms-lease-action", action)
+	return req
+}
+
+// ListBlobs lists through the SDK unless snapshots, deleted blobs or
+// versions are to be included, which it can't do.
+func (b *storageBackend) ListBlobs(container string, params ListBlobsParameters) ([]BlobProperties, error) {
+	if params.Snapshots || params.Deleted || params.Versions {
+		return b.listBlobs(container, params)
+	}
+
+	var result []BlobProperties
+	listParams := storage.ListBlobsParameters{
+		Prefix:     params.Prefix,
+		MaxResults: params.MaxResults,
+	}
+	for {
+		res, err := b.client.ListBlobs(container, listParams)
+		if err != nil {
+			return nil, storageError(err)
+		}
+
+		for _, blob := range res.Blobs {
+			result = append(result, blobProperties(blob.Name, blob.Properties))
+		}
+
+		if res.NextMarker == "" || params.MaxResults > 0 {
+			return result, nil
+		}
+		listParams.Marker = res.NextMarker
+	}
+}
+
+func (b *storageBackend) GetBlobProperties(container, blob string) (BlobProperties, error) {
+	props, err := b.client.GetBlobProperties(container, blob)
+	if err != nil {
+		// Responses to HEAD have no body, so the SDK can't always tell
+		// why it failed. Find out whether it's because there is no blob.
+		if exists, existsErr := b.client.BlobExists(container, blob); existsErr == nil && !exists {
+			return BlobProperties{}, &StorageError{
+				StatusCode: http.StatusNotFound,
+				Code:       errorCodeBlobNotFound,
+				Message:    "The specified blob does not exist.",
+			}
+		}
+		return BlobProperties{}, storageError(err)
+	}
+
+	return blobProperties(blob, *props), nil
+}
+
+func (b *storageBackend) GetBlobRange(container, blob, snapshot string, offset, count int64) (io.ReadCloser, error) {
+	if snapshot != "" {
+		return b.getBlobRange(container, blob, url.Values{"snapshot": {snapshot}}, offset, count)
+	}
+
+	bytesRange := fmt.Sprintf("%d-%d", offset, offset+count-1)
+	body, err := b.client.GetBlobRange(container, blob, bytesRange, nil)
+	return body, storageError(err)
+}
+
+func (b *storageBackend) GetBlobVersionRange(container, blob, versionID string, offset, count int64) (io.ReadCloser, error) {
+	return b.getBlobRange(container, blob, url.Values{"versionid": {versionID}}, offset, count)
+}
+
+func (b *storageBackend) SnapshotBlob(container, blob string) (string, error) {
+	header, err := b.doAndClose(restRequest{method: "PUT", container: container, blob: blob, query: url.Values{"comp": {"snapshot"}}})
+	if err != nil {
+		return "", err
+	}
+	return header.Get("x-ms-snapshot"), nil
+}
+
+// GetDeletedBlobRange reads the version the delete left behind. Soft-deleted
+// blobs themselves can't be read until they are undeleted, so this needs
+// blob versioning on.
+func (b *storageBackend) GetDeletedBlobRange(container, blob string, offset, count int64) (io.ReadCloser, error) {
+	versionID, err := b.deletedVersion(container, blob)
+	if err != nil {
+		return nil, err
+	}
+	if versionID == "" {
+		return nil, errNotImplemented("Reading a deleted blob without blob versioning")
+	}
+	return b.GetBlobVersionRange(container, blob, versionID, offset, count)
+}
+
+func (b *storageBackend) UndeleteBlob(container, blob string) error {
+	_, err := b.doAndClose(restRequest{method: "PUT", container: container, blob: blob, query: url.Values{"comp": {"undelete"}}})
+	return err
+}
+
+// CreateBlockBlob is Put Blob with no content.
+func (b *storageBackend) CreateBlockBlob(container, blob string, ifMatch, leaseID string) (BlobProperties, error) {
+	req := restRequest{method: "PUT", container: container, blob: blob}
+	req.set("x-ms-blob-type", "BlockBlob")
+	req.set("If-Match", ifMatch)
+	req.set("x-ms-lease-id", leaseID)
+	header, err := b.doAndClose(req)
+	if err != nil {
+		return BlobProperties{}, err
+	}
+	return writtenProperties(blob, header), nil
+}
+
+func (b *storageBackend) DeleteBlob(container, blob string, ifMatch, leaseID string, deleteSnapshots bool) error {
+	extraHeaders := make(map[string]string)
+	if deleteSnapshots {
+		extraHeaders["x-ms-delete-snapshots"] = "include"
+	}
+	if ifMatch != "" {
+		extraHeaders["If-Match"] = ifMatch
+	}
+	if leaseID != "" {
+		extraHeaders["x-ms-lease-id"] = leaseID
+	}
+	return storageError(b.client.DeleteBlob(container, blob, extraHeaders))
+}
+
+// CopyBlob has the service copy from the URL of the source blob. With the
+// account key that works as it is, the source is in the same account.
+// Otherwise the source is read with the SAS of the mount, see sourceURL.
+func (b *storageBackend) CopyBlob(container, blob, sourceContainer, sourceBlob string, ifMatch string) (BlobProperties, error) {
+	u, err := b.resourceURL(sourceContainer, sourceBlob)
+	if err != nil {
+		return BlobProperties{}, err
+	}
+	source := u.String()
+	if b.account.Key == "" {
+		if source, err = b.sourceURL(sourceContainer, sourceBlob); err != nil {
+			return BlobProperties{}, err
+		}
+	}
+
+	req := restRequest{method: "PUT", container: container, blob: blob}
+	req.set("x-ms-copy-source", source)
+	req.set("If-Match", ifMatch)
+	header, err := b.doAndClose(req)
+	if err != nil {
+		return BlobProperties{}, err
+	}
+	return writtenProperties(blob, header), nil
+}
+
+func (b *storageBackend) PutBlock(container, blob, blockID string, data []byte, leaseID string) error {
+	req := restRequest{method: "PUT", container: container, blob: blob, query: url.Values{"comp": {"block"}, "blockid": {blockID}}, body: data}
+	req.set("x-ms-lease-id", leaseID)
+	_, err := b.doAndClose(req)
+	return err
+}
+
+// PutBlockFromURL has the source read with a SAS, Shared Key doesn't
+// authorize reading it for Put Block From URL, even in the same account.
+func (b *storageBackend) PutBlockFromURL(container, blob, blockID, sourceContainer, sourceBlob string, offset, count int64, leaseID string) error {
+	source, err := b.sourceURL(sourceContainer, sourceBlob)
+	if err != nil {
+		return err
+	}
+
+	req := restRequest{method: "PUT", container: container, blob: blob, query: url.Values{"comp": {"block"}, "blockid": {blockID}}}
+	req.set("x-ms-copy-source", source)
+	req.set("x-ms-source-range", fmt.Sprintf("bytes=%d-%d", offset, offset+count-1))
+	req.set("x-ms-lease-id", leaseID)
+	_, err = b.doAndClose(req)
+	return err
+}
+
+func (b *storageBackend) PutBlockList(container, blob string, blockIDs []string, ifMatch, leaseID string) (BlobProperties, error) {
+	blockList := struct {
+		XMLName xml.Name `xml:"BlockList"`
+		Latest  []string
+	}{Latest: blockIDs}
+	body, err := xml.Marshal(blockList)
+	if err != nil {
+		return BlobProperties{}, err
+	}
+
+	req := restRequest{method: "PUT", container: container, blob: blob, query: url.Values{"comp": {"blocklist"}}, body: body}
+	req.set("If-Match", ifMatch)
+	req.set("x-ms-lease-id", leaseID)
+	header, err := b.doAndClose(req)
+	if err != nil {
+		return BlobProperties{}, err
+	}
+	return writtenProperties(blob, header), nil
+}
+
+func (b *storageBackend) GetBlockList(container, blob string) ([]BlockProperties, error) {
+	res, err := b.client.GetBlockList(container, blob, storage.BlockListTypeCommitted)
+	if err != nil {
+		return nil, storageError(err)
+	}
+
+	blocks := make([]BlockProperties, len(res.CommittedBlocks))
+	for i, block := range res.CommittedBlocks {
+		blocks[i] = BlockProperties{ID: block.Name, Size: block.Size}
+	}
+	return blocks, nil
+}
+
+func (b *storageBackend) AcquireLease(container, blob string, duration int, proposedLeaseID string) (string, error) {
+	leaseID, err := b.client.AcquireLease(container, blob, duration, proposedLeaseID)
+	return leaseID, storageError(err)
+}
+
+func (b *storageBackend) RenewLease(container, blob, leaseID string) error {
+	return storageError(b.client.RenewLease(container, blob, leaseID))
+}
+
+func (b *storageBackend) ReleaseLease(container, blob, leaseID string) error {
+	return storageError(b.client.ReleaseLease(container, blob, leaseID))
+}
+
+func (b *storageBackend) BreakLease(container, blob string) error {
+	_, err := b.client.BreakLease(container, blob)
+	return storageError(err)
+}
+
+func blobProperties(name string, props storage.BlobProperties) BlobProperties {
+	return BlobProperties{
+		Name:          name,
+		ContentLength: props.ContentLength,
+		LastModified:  parseTime(props.LastModified),
+		ETag:          props.Etag,
+		CopyStatus:    props.CopyStatus,
+		CopyProgress:  props.CopyProgress,
+		LeaseState:    props.LeaseState,
+	}
+}
+
+// parseTime parses times as returned by the storage service,
+// e.g. "Fri, 01 Apr 2016 09:50:39 GMT". Zero time if it can't.
+func parseTime(value string) time.Time {
+	t, err := time.Parse(http.TimeFormat, value)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// statusInMessage finds the HTTP status in errors the SDK returns for
+// responses without a body, e.g. "... without a response body (403 Server failed ...)".
+var statusInMessage = regexp.MustCompile(`\((\d{3}) `)
+
+// storageError translates errors returned by the SDK into *StorageError
+// where possible, other errors are returned as is.
+func storageError(err error) error {
+	switch e := err.(type) {
+	case nil:
+		return nil
+	case storage.AzureStorageServiceError:
+		return &StorageError{StatusCode: e.StatusCode, Code: e.Code, Message: e.Message}
+	case *storage.AzureStorageServiceError:
+		return &StorageError{StatusCode: e.StatusCode, Code: e.Code, Message: e.Message}
+	case storage.UnexpectedStatusCodeError:
+		return &StorageError{StatusCode: e.Got(), Message: e.Error()}
+	}
+
+	if m := statusInMessage.FindStringSubmatch(err.Error()); m != nil {
+		statusCode, _ := strconv.Atoi(m[1])
+		return &StorageError{StatusCode: statusCode, Message: err.Error()}
+	}
+
+	return err
+}
@@ -0,0 +1,392 @@
+package blobfs
+
+// Requests the SDK can't make, sent to the REST API of the blob service
+// directly. See https://docs.microsoft.com/rest/api/storageservices/blob-service-rest-api
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StorageAccount is what storageBackend needs to know about the account
+// to make the requests the SDK can't.
+type StorageAccount struct {
+	Name string
+
+	// Key signs the requests with Shared Key. It's empty with a SAS or
+	// anonymous access, the storage client's HTTPClient takes care of those.
+	Key string
+
+	// SAS is the SAS the account is mounted with, if any. The storage
+	// service reads the source of copies with it.
+	SAS string
+
+	// URL is the blob service as the storage client addresses it, e.g.
+	// https://NAME.blob.core.windows.net. Its HTTPClient takes care of
+	// custom endpoints.
+	URL string
+}
+
+// restAPIVersion is the version of the REST API the requests are made
+// for. It's newer than the one the SDK uses, which lacks what's needed.
+const restAPIVersion = "2019-12-12"
+
+// restRequest is a request to a container, or to a blob if blob is set.
+type restRequest struct {
+	method    string
+	container string
+	blob      string
+	query     url.Values
+	header    http.Header
+	body      []byte
+}
+
+// set sets the header name to value unless value is empty.
+func (r *restRequest) set(name, value string) {
+	if value == "" {
+		return
+	}
+	if r.header == nil {
+		r.header = make(http.Header)
+	}
+	r.header.Set(name, value)
+}
+
+// do sends req and returns the response if it succeeded, otherwise a
+// *StorageError. The caller must close the response body.
+func (b *storageBackend) do(req restRequest) (*http.Response, error) {
+	u, err := b.resourceURL(req.container, req.blob)
+	if err != nil {
+		return nil, err
+	}
+	u.RawQuery = req.query.Encode()
+
+	r, err := http.NewRequest(req.method, u.String(), bytes.NewReader(req.body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range req.header {
+		r.Header[name] = values
+	}
+	r.Header.Set("x-ms-version", restAPIVersion)
+	r.Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+	if err := b.sign(r); err != nil {
+		return nil, err
+	}
+
+	resp, err := b.httpClient.Do(r)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		return nil, restError(resp)
+	}
+	return resp, nil
+}
+
+// doAndClose is do for requests whose response body is of no interest.
+func (b *storageBackend) doAndClose(req restRequest) (http.Header, error) {
+	resp, err := b.do(req)
+	if err != nil {
+		return nil, err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	return resp.Header, nil
+}
+
+// sign adds the Shared Key signature to r, if there is a key.
+// See https://docs.microsoft.com/rest/api/storageservices/authorize-with-shared-key
+func (b *storageBackend) sign(r *http.Request) error {
+	if b.account.Key == "" {
+		return nil
+	}
+	key, err := base64.StdEncoding.DecodeString(b.account.Key)
+	if err != nil {
+		return fmt.Errorf("invalid account key: %s", err)
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(stringToSign(b.account.Name, r)))
+	r.Header.Set("Authorization", "SharedKey "+b.account.Name+":"+base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+	return nil
+}
+
+// stringToSign is what the Shared Key signature of r is computed from.
+func stringToSign(account string, r *http.Request) string {
+	contentLength := ""
+	if r.ContentLength > 0 {
+		contentLength = strconv.FormatInt(r.ContentLength, 10)
+	}
+
+	// Date is left empty, x-ms-date is sent instead.
+	lines := []string{
+		r.Method,
+		r.Header.Get("Content-Encoding"),
+		r.Header.Get("Content-Language"),
+		contentLength,
+		r.Header.Get("Content-MD5"),
+		r.Header.Get("Content-Type"),
+		"",
+		r.Header.Get("If-Modified-Since"),
+		r.Header.Get("If-Match"),
+		r.Header.Get("If-None-Match"),
+		r.Header.Get("If-Unmodified-Since"),
+		r.Header.Get("Range"),
+	}
+
+	var headers []string
+	for name, values := range r.Header {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, "x-ms-") {
+			headers = append(headers, name+":"+strings.Join(values, ","))
+		}
+	}
+	sort.Strings(headers)
+	lines = append(lines, headers...)
+
+	resource := "/" + account + r.URL.EscapedPath()
+	query := r.URL.Query()
+	var names []string
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		values := query[name]
+		sort.Strings(values)
+		resource += "\n" + strings.ToLower(name) + ":" + strings.Join(values, ",")
+	}
+	lines = append(lines, resource)
+
+	return strings.Join(lines, "\n")
+}
+
+// restError reads the error from a failed response. The code is in the
+// x-ms-error-code header, and in the body if there is one.
+func restError(resp *http.Response) error {
+	var body struct {
+		Code    string
+		Message string
+	}
+	data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	xml.Unmarshal(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf")), &body)
+
+	code := body.Code
+	if code == "" {
+		code = resp.Header.Get("x-ms-error-code")
+	}
+	// The message goes on with the request ID and time, on lines of their own.
+	message := strings.SplitN(body.Message, "\n", 2)[0]
+	if message == "" {
+		message = resp.Status
+	}
+	return &StorageError{StatusCode: resp.StatusCode, Code: code, Message: message}
+}
+
+// writtenProperties are the properties of the blob written by a request,
+// as far as the response tells.
+func writtenProperties(blob string, header http.Header) BlobProperties {
+	return BlobProperties{
+		Name:         blob,
+		LastModified: parseTime(header.Get("Last-Modified")),
+		ETag:         header.Get("ETag"),
+		CopyStatus:   header.Get("x-ms-copy-status"),
+	}
+}
+
+// sourceSASDuration is how long the SAS of sourceURL is valid, enough for
+// a block of copyBlockSize to be copied.
+const sourceSASDuration = time.Hour
+
+// sourceURL is the URL of the blob for requests which read it as their
+// source, with the SAS of the mount or a read-only service SAS signed with
+// the account key. Anonymous mounts have neither.
+// See https://docs.microsoft.com/rest/api/storageservices/create-service-sas
+func (b *storageBackend) sourceURL(container, blob string) (string, error) {
+	u, err := b.resourceURL(container, blob)
+	if err != nil {
+		return "", err
+	}
+	if b.account.SAS != "" {
+		u.RawQuery = strings.TrimPrefix(b.account.SAS, "?")
+		return u.String(), nil
+	}
+	if b.account.Key == "" {
+		return "", errNotImplemented("Copying blobs with anonymous access")
+	}
+	key, err := base64.StdEncoding.DecodeString(b.account.Key)
+	if err != nil {
+		return "", fmt.Errorf("invalid account key: %s", err)
+	}
+
+	expiry := time.Now().UTC().Add(sourceSASDuration).Format("2006-01-02T15:04:05Z")
+	resource := "/blob/" + b.account.Name + "/" + container + "/" + blob
+	// Permissions, start, expiry, resource, identifier, IP, protocol,
+	// version, resource type, snapshot time and the 5 response headers.
+	fields := []string{"r", "", expiry, resource, "", "", "", restAPIVersion, "b", "", "", "", "", "", ""}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(strings.Join(fields, "\n")))
+
+	u.RawQuery = url.Values{
+		"sv":  {restAPIVersion},
+		"sr":  {"b"},
+		"sp":  {"r"},
+		"se":  {expiry},
+		"sig": {base64.StdEncoding.EncodeToString(mac.Sum(nil))},
+	}.Encode()
+	return u.String(), nil
+}
+
+// resourceURL is the URL of the container, or of the blob if blob is set.
+func (b *storageBackend) resourceURL(container, blob string) (*url.URL, error) {
+	u, err := url.Parse(b.account.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid blob service URL '%s': %s", b.account.URL, err)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + container
+	if blob != "" {
+		u.Path += "/" + blob
+	}
+	return u, nil
+}
+
+// getBlobRange reads count bytes at offset of the blob, or of the snapshot
+// or version of it given in query.
+func (b *storageBackend) getBlobRange(container, blob string, query url.Values, offset, count int64) (io.ReadCloser, error) {
+	req := restRequest{method: "GET", container: container, blob: blob, query: query}
+	req.set("x-ms-range", fmt.Sprintf("bytes=%d-%d", offset, offset+count-1))
+	resp, err := b.do(req)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// blobList is the response to List Blobs, as far as we need it.
+type blobList struct {
+	Blobs      []listedBlob `xml:"Blobs>Blob"`
+	NextMarker string
+}
+
+type listedBlob struct {
+	Name             string
+	Snapshot         string
+	VersionId        string
+	IsCurrentVersion bool
+	Deleted          bool
+	Properties       struct {
+		LastModified  string `xml:"Last-Modified"`
+		Etag          string
+		ContentLength int64 `xml:"Content-Length"`
+		CopyStatus    string
+		CopyProgress  string
+		LeaseState    string
+		DeletedTime   string
+	}
+}
+
+// listBlobs is ListBlobs with what the SDK can't include in listings.
+func (b *storageBackend) listBlobs(container string, params ListBlobsParameters) ([]BlobProperties, error) {
+	var include []string
+	if params.Snapshots {
+		include = append(include, "snapshots")
+	}
+	if params.Deleted {
+		include = append(include, "deleted")
+	}
+	if params.Versions {
+		include = append(include, "versions")
+	}
+
+	blobs, err := b.listBlobItems(container, params.Prefix, params.MaxResults, include)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]BlobProperties, 0, len(blobs))
+	for _, blob := range blobs {
+		result = append(result, BlobProperties{
+			Name:             blob.Name,
+			ContentLength:    blob.Properties.ContentLength,
+			LastModified:     parseTime(blob.Properties.LastModified),
+			ETag:             blob.Properties.Etag,
+			Snapshot:         blob.Snapshot,
+			Deleted:          blob.Deleted,
+			DeletedTime:      parseTime(blob.Properties.DeletedTime),
+			VersionID:        blob.VersionId,
+			IsCurrentVersion: blob.IsCurrentVersion,
+			CopyStatus:       blob.Properties.CopyStatus,
+			CopyProgress:     blob.Properties.CopyProgress,
+			LeaseState:       blob.Properties.LeaseState,
+		})
+	}
+	return result, nil
+}
+
+// listBlobItems lists the blobs starting with prefix, all of them unless
+// maxResults is set, with the datasets in include.
+func (b *storageBackend) listBlobItems(container, prefix string, maxResults uint, include []string) ([]listedBlob, error) {
+	query := url.Values{"restype": {"container"}, "comp": {"list"}}
+	if prefix != "" {
+		query.Set("prefix", prefix)
+	}
+	if maxResults > 0 {
+		query.Set("maxresults", strconv.FormatUint(uint64(maxResults), 10))
+	}
+	if len(include) > 0 {
+		query.Set("include", strings.Join(include, ","))
+	}
+
+	var result []listedBlob
+	for {
+		resp, err := b.do(restRequest{method: "GET", container: container, query: query})
+		if err != nil {
+			return nil, err
+		}
+		var list blobList
+		err = xml.NewDecoder(resp.Body).Decode(&list)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("invalid List Blobs response: %s", err)
+		}
+		result = append(result, list.Blobs...)
+
+		if list.NextMarker == "" || maxResults > 0 {
+			return result, nil
+		}
+		query.Set("marker", list.NextMarker)
+	}
+}
+
+// deletedVersion returns the ID of the version a delete left behind of the
+// blob, which is the latest previous version, or "" if there is none. There
+// are versions only with blob versioning on.
+func (b *storageBackend) deletedVersion(container, blob string) (string, error) {
+	blobs, err := b.listBlobItems(container, blob, 0, []string{"versions", "deleted"})
+	if err != nil {
+		return "", err
+	}
+
+	// Version IDs are timestamps that sort as strings.
+	var versionID string
+	for _, item := range blobs {
+		if item.Name == blob && item.Snapshot == "" && !item.IsCurrentVersion && item.VersionId > versionID {
+			versionID = item.VersionId
+		}
+	}
+	return versionID, nil
+}
@@ -0,0 +1,394 @@
+package blobfs
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStringToSign(t *testing.T) {
+	r, err := http.NewRequest("PUT", "https://foo.blob.core.windows.net/data/dir/a%20b?comp=blocklist", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("If-Match", `"0x1"`)
+	r.Header.Set("x-ms-version", restAPIVersion)
+	r.Header.Set("x-ms-date", "Fri, 01 Apr 2016 09:50:39 GMT")
+	r.Header.Set("X-Ms-Lease-Id", "lease")
+
+	expected := "PUT\n\n\n5\n\n\n\n\n\"0x1\"\n\n\n\n" +
+		"x-ms-date:Fri, 01 Apr 2016 09:50:39 GMT\nx-ms-lease-id:lease\nx-ms-version:" + restAPIVersion + "\n" +
+		"/foo/data/dir/a%20b\ncomp:blocklist"
+	if got := stringToSign("foo", r); got != expected {
+		t.Errorf("expected\n%q\ngot\n%q", expected, got)
+	}
+}
+
+// restServer answers requests with status and header, and keeps the last
+// request and its body.
+type restServer struct {
+	*httptest.Server
+	status int
+	header http.Header
+	body   string
+
+	request     *http.Request
+	requestBody string
+}
+
+func newRestServer() *restServer {
+	s := &restServer{status: http.StatusCreated, header: make(http.Header)}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		s.request, s.requestBody = r, string(data)
+		for name, values := range s.header {
+			w.Header()[name] = values
+		}
+		w.WriteHeader(s.status)
+		w.Write([]byte(s.body))
+	}))
+	return s
+}
+
+func newRestBackend(s *restServer) *storageBackend {
+	return &storageBackend{
+		account: StorageAccount{
+			Name: "foo",
+			Key:  base64.StdEncoding.EncodeToString([]byte("key")),
+			URL:  s.URL,
+		},
+		httpClient: s.Client(),
+	}
+}
+
+func TestStorageBackendWritesIfMatch(t *testing.T) {
+	s := newRestServer()
+	defer s.Close()
+	b := newRestBackend(s)
+
+	lastModified := time.Date(2016, 4, 1, 9, 50, 39, 0, time.UTC)
+	s.header.Set("ETag", `"0x2"`)
+	s.header.Set("Last-Modified", lastModified.Format(http.TimeFormat))
+
+	props, err := b.PutBlockList("data", "dir/foo", []string{blockIDFor(0)}, `"0x1"`, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if props.ETag != `"0x2"` || !props.LastModified.Equal(lastModified) {
+		t.Errorf("PutBlockList: expected the properties from the response got %+v", props)
+	}
+	r := s.request
+	if r.Method != "PUT" || r.URL.Path != "/data/dir/foo" || r.URL.Query().Get("comp") != "blocklist" {
+		t.Errorf("PutBlockList: unexpected request %s %s", r.Method, r.URL)
+	}
+	if r.Header.Get("If-Match") != `"0x1"` || !strings.HasPrefix(r.Header.Get("Authorization"), "SharedKey foo:") {
+		t.Errorf("PutBlockList: unexpected headers %v", r.Header)
+	}
+	if !strings.Contains(s.requestBody, "<Latest>"+blockIDFor(0)+"</Latest>") {
+		t.Errorf("PutBlockList: unexpected body %q", s.requestBody)
+	}
+
+	if _, err := b.CreateBlockBlob("data", "foo", `"0x2"`, ""); err != nil {
+		t.Fatal(err)
+	}
+	if r := s.request; r.Header.Get("x-ms-blob-type") != "BlockBlob" || r.Header.Get("If-Match") != `"0x2"` || r.ContentLength != 0 {
+		t.Errorf("CreateBlockBlob: unexpected request %v", r.Header)
+	}
+
+	s.header.Set("x-ms-copy-status", "pending")
+	props, err = b.CopyBlob("data", "copy", "other", "src", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if props.CopyStatus != "pending" {
+		t.Errorf("CopyBlob: expected a pending copy got %+v", props)
+	}
+	if r := s.request; r.Header.Get("x-ms-copy-source") != s.URL+"/other/src" || r.Header.Get("If-Match") != "" {
+		t.Errorf("CopyBlob: unexpected request %v", r.Header)
+	}
+}
+
+func TestStorageBackendWritesLeaseID(t *testing.T) {
+	s := newRestServer()
+	defer s.Close()
+	b := newRestBackend(s)
+
+	if err := b.PutBlock("data", "foo", blockIDFor(0), []byte("hello"), "lease"); err != nil {
+		t.Fatal(err)
+	}
+	r := s.request
+	if r.URL.Query().Get("comp") != "block" || r.URL.Query().Get("blockid") != blockIDFor(0) || s.requestBody != "hello" {
+		t.Errorf("PutBlock: unexpected request %s %q", r.URL, s.requestBody)
+	}
+	if r.Header.Get("x-ms-lease-id") != "lease" {
+		t.Errorf("PutBlock: expected the lease ID got %v", r.Header)
+	}
+
+	if _, err := b.PutBlockList("data", "foo", []string{blockIDFor(0)}, "", "lease"); err != nil {
+		t.Fatal(err)
+	}
+	if r := s.request; r.Header.Get("x-ms-lease-id") != "lease" {
+		t.Errorf("PutBlockList: expected the lease ID got %v", r.Header)
+	}
+
+	if _, err := b.CreateBlockBlob("data", "foo", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	if r := s.request; r.Header.Get("x-ms-lease-id") != "" {
+		t.Errorf("CreateBlockBlob: expected no lease ID got %v", r.Header)
+	}
+}
+
+func TestStorageBackendContainerLeases(t *testing.T) {
+	s := newRestServer()
+	defer s.Close()
+	b := newRestBackend(s)
+
+	s.header.Set("x-ms-lease-id", "lease")
+	leaseID, err := b.AcquireContainerLease("data", 15, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leaseID != "lease" {
+		t.Errorf("AcquireContainerLease: expected 'lease' got %q", leaseID)
+	}
+	r := s.request
+	if r.URL.Path != "/data" || r.URL.RawQuery != "comp=lease&restype=container" {
+		t.Errorf("AcquireContainerLease: unexpected request %s", r.URL)
+	}
+	if r.Header.Get("x-ms-lease-action") != "acquire" || r.Header.Get("x-ms-lease-duration") != "15" || r.Header.Get("x-ms-proposed-lease-id") != "" {
+		t.Errorf("AcquireContainerLease: unexpected headers %v", r.Header)
+	}
+
+	if err := b.ReleaseContainerLease("data", "lease"); err != nil {
+		t.Fatal(err)
+	}
+	if r := s.request; r.Header.Get("x-ms-lease-action") != "release" || r.Header.Get("x-ms-lease-id") != "lease" {
+		t.Errorf("ReleaseContainerLease: unexpected headers %v", r.Header)
+	}
+
+	if err := b.BreakContainerLease("data"); err != nil {
+		t.Fatal(err)
+	}
+	if r := s.request; r.Header.Get("x-ms-lease-action") != "break" || r.Header.Get("x-ms-lease-break-period") != "0" {
+		t.Errorf("BreakContainerLease: unexpected headers %v", r.Header)
+	}
+
+	s.status = http.StatusAccepted
+	if err := b.DeleteContainer("data", "lease"); err != nil {
+		t.Fatal(err)
+	}
+	if r := s.request; r.Method != "DELETE" || r.URL.RawQuery != "restype=container" || r.Header.Get("x-ms-lease-id") != "lease" {
+		t.Errorf("DeleteContainer: unexpected request %s %s %v", r.Method, r.URL, r.Header)
+	}
+}
+
+func TestStorageBackendSnapshots(t *testing.T) {
+	s := newRestServer()
+	defer s.Close()
+	b := newRestBackend(s)
+
+	const snapshot = "2016-04-01T09:50:39.1234567Z"
+	s.header.Set("x-ms-snapshot", snapshot)
+	got, err := b.SnapshotBlob("data", "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != snapshot || s.request.URL.RawQuery != "comp=snapshot" {
+		t.Errorf("SnapshotBlob: unexpected %q for %s", got, s.request.URL)
+	}
+
+	s.status = http.StatusPartialContent
+	s.body = "old"
+	body, err := b.GetBlobRange("data", "foo", snapshot, 2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body.Close()
+	if r := s.request; r.URL.Query().Get("snapshot") != snapshot || r.Header.Get("x-ms-range") != "bytes=2-4" {
+		t.Errorf("GetBlobRange snapshot: unexpected request %s %v", r.URL, r.Header)
+	}
+
+	s.status = http.StatusOK
+	s.body = `<?xml version="1.0" encoding="utf-8"?><EnumerationResults ContainerName="data"><Blobs>` +
+		`<Blob><Name>foo</Name><Snapshot>` + snapshot + `</Snapshot><Properties><Last-Modified>Fri, 01 Apr 2016 09:50:39 GMT</Last-Modified><Etag>0x1</Etag><Content-Length>3</Content-Length></Properties></Blob>` +
+		`<Blob><Name>foo</Name><Properties><Etag>0x2</Etag><Content-Length>5</Content-Length><LeaseState>leased</LeaseState></Properties></Blob>` +
+		`</Blobs><NextMarker /></EnumerationResults>`
+	blobs, err := b.ListBlobs("data", ListBlobsParameters{Prefix: "f", Snapshots: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q := s.request.URL.Query(); q.Get("include") != "snapshots" || q.Get("prefix") != "f" || q.Get("comp") != "list" {
+		t.Errorf("ListBlobs: unexpected request %s", s.request.URL)
+	}
+	if len(blobs) != 2 || blobs[0].Snapshot != snapshot || blobs[0].ContentLength != 3 || blobs[0].LastModified.IsZero() ||
+		blobs[1].Snapshot != "" || blobs[1].ETag != "0x2" || blobs[1].LeaseState != leaseStateLeased {
+		t.Errorf("ListBlobs: unexpected %+v", blobs)
+	}
+}
+
+func TestStorageBackendSoftDelete(t *testing.T) {
+	s := newRestServer()
+	defer s.Close()
+	b := newRestBackend(s)
+
+	s.status = http.StatusOK
+	s.body = `<?xml version="1.0" encoding="utf-8"?><EnumerationResults ContainerName="data"><Blobs>` +
+		`<Blob><Name>foo</Name><Deleted>true</Deleted><Properties><Content-Length>3</Content-Length><DeletedTime>Fri, 01 Apr 2016 09:50:39 GMT</DeletedTime></Properties></Blob>` +
+		`</Blobs><NextMarker /></EnumerationResults>`
+	blobs, err := b.ListBlobs("data", ListBlobsParameters{Deleted: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q := s.request.URL.Query(); q.Get("include") != "deleted" {
+		t.Errorf("ListBlobs: unexpected request %s", s.request.URL)
+	}
+	if len(blobs) != 1 || !blobs[0].Deleted || blobs[0].DeletedTime.IsZero() || blobs[0].ContentLength != 3 {
+		t.Errorf("ListBlobs: unexpected %+v", blobs)
+	}
+
+	// Without versions, deleted blobs can't be read.
+	_, err = b.GetDeletedBlobRange("data", "foo", 0, 3)
+	expectStorageError(t, "GetDeletedBlobRange without versions", err, http.StatusNotImplemented, errorCodeNotImplemented)
+	if q := s.request.URL.Query(); q.Get("include") != "versions,deleted" || q.Get("prefix") != "foo" {
+		t.Errorf("GetDeletedBlobRange: unexpected list request %s", s.request.URL)
+	}
+
+	// Otherwise the latest previous version of the blob is read.
+	s.body = `<?xml version="1.0" encoding="utf-8"?><EnumerationResults ContainerName="data"><Blobs>` +
+		`<Blob><Name>foo</Name><VersionId>2016-04-01T09:50:39.0000000Z</VersionId></Blob>` +
+		`<Blob><Name>foo</Name><VersionId>2016-04-02T09:50:39.0000000Z</VersionId></Blob>` +
+		`<Blob><Name>foo2</Name><VersionId>2016-04-03T09:50:39.0000000Z</VersionId></Blob>` +
+		`</Blobs><NextMarker /></EnumerationResults>`
+	body, err := b.GetDeletedBlobRange("data", "foo", 0, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body.Close()
+	if r := s.request; r.URL.Query().Get("versionid") != "2016-04-02T09:50:39.0000000Z" || r.Header.Get("x-ms-range") != "bytes=0-2" {
+		t.Errorf("GetDeletedBlobRange: unexpected request %s %v", r.URL, r.Header)
+	}
+
+	if err := b.UndeleteBlob("data", "foo"); err != nil {
+		t.Fatal(err)
+	}
+	if r := s.request; r.Method != "PUT" || r.URL.Path != "/data/foo" || r.URL.RawQuery != "comp=undelete" {
+		t.Errorf("UndeleteBlob: unexpected request %s %s", r.Method, r.URL)
+	}
+}
+
+func TestStorageBackendVersions(t *testing.T) {
+	s := newRestServer()
+	defer s.Close()
+	b := newRestBackend(s)
+
+	s.status = http.StatusOK
+	s.body = `<?xml version="1.0" encoding="utf-8"?><EnumerationResults ContainerName="data"><Blobs>` +
+		`<Blob><Name>foo</Name><VersionId>2016-04-01T09:50:39.0000000Z</VersionId><Properties><Content-Length>3</Content-Length></Properties></Blob>` +
+		`<Blob><Name>foo</Name><VersionId>2016-04-02T09:50:39.0000000Z</VersionId><IsCurrentVersion>true</IsCurrentVersion><Properties><Content-Length>5</Content-Length></Properties></Blob>` +
+		`</Blobs><NextMarker /></EnumerationResults>`
+	blobs, err := b.ListBlobs("data", asOfListParameters("", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q := s.request.URL.Query(); q.Get("include") != "snapshots,deleted,versions" {
+		t.Errorf("ListBlobs: unexpected request %s", s.request.URL)
+	}
+	if len(blobs) != 2 || !isPreviousVersion(blobs[0]) || blobs[0].VersionID != "2016-04-01T09:50:39.0000000Z" ||
+		isPreviousVersion(blobs[1]) || !blobs[1].IsCurrentVersion {
+		t.Errorf("ListBlobs: unexpected %+v", blobs)
+	}
+
+	s.status = http.StatusPartialContent
+	s.body = "old"
+	body, err := b.GetBlobVersionRange("data", "foo", blobs[0].VersionID, 0, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body.Close()
+	if r := s.request; r.URL.Query().Get("versionid") != blobs[0].VersionID || r.Header.Get("x-ms-range") != "bytes=0-2" {
+		t.Errorf("GetBlobVersionRange: unexpected request %s %v", r.URL, r.Header)
+	}
+}
+
+func TestStorageBackendPutBlockFromURL(t *testing.T) {
+	s := newRestServer()
+	defer s.Close()
+	b := newRestBackend(s)
+
+	if err := b.PutBlockFromURL("data", "copy", blockIDFor(1), "other", "src", 100, 50, "lease"); err != nil {
+		t.Fatal(err)
+	}
+	r := s.request
+	if r.Method != "PUT" || r.URL.Path != "/data/copy" || r.URL.Query().Get("comp") != "block" || r.URL.Query().Get("blockid") != blockIDFor(1) {
+		t.Errorf("PutBlockFromURL: unexpected request %s %s", r.Method, r.URL)
+	}
+	if r.Header.Get("x-ms-source-range") != "bytes=100-149" || r.Header.Get("x-ms-lease-id") != "lease" {
+		t.Errorf("PutBlockFromURL: unexpected headers %v", r.Header)
+	}
+	source, err := url.Parse(r.Header.Get("x-ms-copy-source"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := source.Query()
+	if source.Path != "/other/src" || q.Get("sp") != "r" || q.Get("sr") != "b" || q.Get("sv") != restAPIVersion || q.Get("sig") == "" {
+		t.Errorf("PutBlockFromURL: unexpected source %s", source)
+	}
+	if expiry, err := time.Parse(time.RFC3339, q.Get("se")); err != nil || expiry.Before(time.Now()) {
+		t.Errorf("PutBlockFromURL: unexpected source expiry %q", q.Get("se"))
+	}
+
+	// Mounts with a SAS have the source read with it, as does Copy Blob.
+	b.account.Key, b.account.SAS = "", "?sv=2019-12-12&sr=c&sp=rw&sig=abc"
+	if err := b.PutBlockFromURL("data", "copy", blockIDFor(1), "other", "src", 0, 50, ""); err != nil {
+		t.Fatal(err)
+	}
+	if source := s.request.Header.Get("x-ms-copy-source"); source != s.URL+"/other/src?sv=2019-12-12&sr=c&sp=rw&sig=abc" {
+		t.Errorf("PutBlockFromURL with a SAS: unexpected source %s", source)
+	}
+	if s.request.Header.Get("Authorization") != "" {
+		t.Errorf("PutBlockFromURL with a SAS: expected no Shared Key signature got %v", s.request.Header)
+	}
+	s.status = http.StatusAccepted
+	if _, err := b.CopyBlob("data", "copy", "other", "src", ""); err != nil {
+		t.Fatal(err)
+	}
+	if source := s.request.Header.Get("x-ms-copy-source"); source != s.URL+"/other/src?sv=2019-12-12&sr=c&sp=rw&sig=abc" {
+		t.Errorf("CopyBlob with a SAS: unexpected source %s", source)
+	}
+
+	// Anonymous mounts have nothing to read the source with, so copies
+	// go through the machine right away.
+	b.account.SAS = ""
+	err = b.PutBlockFromURL("data", "copy", blockIDFor(1), "other", "src", 0, 50, "")
+	expectStorageError(t, "PutBlockFromURL anonymous", err, http.StatusNotImplemented, errorCodeNotImplemented)
+	_, err = b.CopyBlob("data", "copy", "other", "src", "")
+	expectStorageError(t, "CopyBlob anonymous", err, http.StatusNotImplemented, errorCodeNotImplemented)
+}
+
+func TestStorageBackendRESTErrors(t *testing.T) {
+	s := newRestServer()
+	defer s.Close()
+	b := newRestBackend(s)
+
+	s.status = http.StatusPreconditionFailed
+	s.body = "\xef\xbb\xbf<?xml version=\"1.0\" encoding=\"utf-8\"?><Error><Code>ConditionNotMet</Code>" +
+		"<Message>The condition specified using HTTP conditional header(s) is not met.\nRequestId:1\nTime:2016-04-01T09:50:39Z</Message></Error>"
+	_, err := b.CreateBlockBlob("data", "foo", `"0x1"`, "")
+	expectStorageError(t, "CreateBlockBlob", err, http.StatusPreconditionFailed, errorCodeConditionNotMet)
+	if e, ok := err.(*StorageError); ok && strings.Contains(e.Message, "RequestId") {
+		t.Errorf("CreateBlockBlob: expected the message only got %q", e.Message)
+	}
+
+	// Responses to HEAD have the code in a header only.
+	s.status = http.StatusNotFound
+	s.body = ""
+	s.header.Set("x-ms-error-code", errorCodeBlobNotFound)
+	_, err = b.CopyBlob("data", "foo", "data", "nope", "")
+	expectStorageError(t, "CopyBlob", err, http.StatusNotFound, errorCodeBlobNotFound)
+}
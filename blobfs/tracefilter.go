@@ -0,0 +1,246 @@
+package blobfs
+
+// Filtering and sampling of traced operations, so that tracing can stay
+// on without GetAttr calls drowning everything else.
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// TraceFilter decides which operations are traced. It's set from a spec of
+// space separated terms, all of which must match:
+//
+//	op=Open,Read        only these operations
+//	op=-GetAttr         all but these operations
+//	path=*.log,tmp/*    only paths matching one of these globs
+//	status=-OK          only failed operations, or e.g. status=ENOENT,EIO
+//	sample=0.01         only one in a hundred of the operations left
+//
+// An empty spec traces everything. The spec can be changed at any time,
+// also over HTTP as TraceFilter is an http.Handler.
+type TraceFilter struct {
+	mu   sync.RWMutex
+	spec string
+
+	ops      traceFilterSet
+	paths    []string
+	statuses traceFilterSet
+	sample   float64
+
+	// random returns a number in [0, 1) for sampling.
+	random func() float64
+}
+
+// traceFilterSet matches names which are in include, or all names which
+// are not in exclude if include is empty.
+type traceFilterSet struct {
+	include map[string]bool
+	exclude map[string]bool
+}
+
+func (s traceFilterSet) match(name string) bool {
+	if s.exclude[name] {
+		return false
+	}
+	return len(s.include) == 0 || s.include[name]
+}
+
+func parseTraceFilterSet(values []string) traceFilterSet {
+	s := traceFilterSet{
+		include: make(map[string]bool),
+		exclude: make(map[string]bool),
+	}
+	for _, value := range values {
+		if strings.HasPrefix(value, "-") {
+			s.exclude[value[1:]] = true
+		} else {
+			s.include[value] = true
+		}
+	}
+	return s
+}
+
+// NewTraceFilter creates a TraceFilter from spec.
+func NewTraceFilter(spec string) (*TraceFilter, error) {
+	f := &TraceFilter{
+		random: rand.Float64,
+	}
+	if err := f.Set(spec); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Set changes what is traced to spec. On error nothing changes.
+func (f *TraceFilter) Set(spec string) error {
+	var (
+		ops      traceFilterSet
+		paths    []string
+		statuses traceFilterSet
+		sample   = 1.0
+	)
+
+	for _, term := range strings.Fields(spec) {
+		i := strings.Index(term, "=")
+		if i <= 0 || i == len(term)-1 {
+			return fmt.Errorf("invalid trace filter term '%s', expected key=value", term)
+		}
+		key, values := term[:i], strings.Split(term[i+1:], ",")
+
+		switch key {
+		case "op":
+			ops = parseTraceFilterSet(values)
+		case "path":
+			for _, glob := range values {
+				if _, err := path.Match(glob, ""); err != nil {
+					return fmt.Errorf("invalid trace filter path '%s': %s", glob, err)
+				}
+			}
+			paths = values
+		case "status":
+			statuses = parseTraceFilterSet(values)
+		case "sample":
+			rate, err := strconv.ParseFloat(values[0], 64)
+			if err != nil || len(values) != 1 || rate <= 0 || rate > 1 {
+				return fmt.Errorf("invalid trace filter sample '%s', expected a rate above 0 and up to 1", term[i+1:])
+			}
+			sample = rate
+		default:
+			return fmt.Errorf("unknown trace filter key '%s', expected op, path, status or sample", key)
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.spec = strings.Join(strings.Fields(spec), " ")
+	f.ops = ops
+	f.paths = paths
+	f.statuses = statuses
+	f.sample = sample
+	return nil
+}
+
+// String returns the spec of the filter.
+func (f *TraceFilter) String() string {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return f.spec
+}
+
+// match tells if the operation op on name which returned status is traced.
+// A nil filter traces everything.
+func (f *TraceFilter) match(op string, name string, status fuse.Status) bool {
+	return f.matchStatus(status) && f.matchCall(op, name)
+}
+
+// matchStatus tells if operations which returned status are traced.
+func (f *TraceFilter) matchStatus(status fuse.Status) bool {
+	if f == nil {
+		return true
+	}
+
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return f.statuses.match(statusName(status))
+}
+
+// anyStatus is true if operations are traced whatever they return, so
+// that they can be traced as soon as they are called.
+func (f *TraceFilter) anyStatus() bool {
+	if f == nil {
+		return true
+	}
+
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return len(f.statuses.include) == 0 && len(f.statuses.exclude) == 0
+}
+
+// matchCall tells if the operation op on name is traced, leaving aside the
+// status it returns, see matchStatus. Operations are sampled here, so it's
+// called once for each.
+func (f *TraceFilter) matchCall(op string, name string) bool {
+	if f == nil {
+		return true
+	}
+
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	if !f.ops.match(op) {
+		return false
+	}
+
+	if len(f.paths) > 0 {
+		matched := false
+		for _, glob := range f.paths {
+			if ok, _ := path.Match(glob, name); ok {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	return f.sample >= 1 || f.random() < f.sample
+}
+
+// ServeHTTP returns the spec on GET and changes it to the request body
+// on PUT or POST, e.g.
+//
+//	curl -X PUT -d 'op=-GetAttr status=-OK' http://127.0.0.1:9102/trace/filter
+//
+// There is no authentication, so only requests from this machine are
+// served. Tracing all paths could fill the disk or show file names to
+// anyone on the network otherwise.
+func (f *TraceFilter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !isLoopback(r.RemoteAddr) {
+		http.Error(w, "The trace filter can only be used from this machine.", http.StatusForbidden)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+	case "PUT", "POST":
+		spec, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 4096))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := f.Set(string(spec)); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "Use GET to see the trace filter, PUT to change it.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	fmt.Fprintln(w, f.String())
+}
+
+// isLoopback is true if addr, a host:port, is a loopback address.
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,160 @@
+package blobfs
+
+import (
+	"bytes"
+	"log"
+	"net/http/httptest"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func TestTraceFilter(t *testing.T) {
+	cases := []struct {
+		spec   string
+		op     string
+		name   string
+		status fuse.Status
+		match  bool
+	}{
+		{"", "GetAttr", "foo", fuse.OK, true},
+		{"op=-GetAttr", "GetAttr", "foo", fuse.OK, false},
+		{"op=-GetAttr", "Open", "foo", fuse.OK, true},
+		{"op=Open,Read", "Read", "foo", fuse.OK, true},
+		{"op=Open,Read", "Write", "foo", fuse.OK, false},
+		{"status=-OK", "GetAttr", "foo", fuse.OK, false},
+		{"status=-OK", "GetAttr", "foo", fuse.ENOENT, true},
+		{"status=EIO,EACCES", "GetAttr", "foo", fuse.ENOENT, false},
+		{"status=EIO,EACCES", "GetAttr", "foo", fuse.EIO, true},
+		{"path=*.log", "Open", "app.log", fuse.OK, true},
+		{"path=*.log", "Open", "app.txt", fuse.OK, false},
+		{"path=*.log,tmp/*", "Open", "tmp/x", fuse.OK, true},
+		{"op=-GetAttr  status=-OK", "Open", "foo", fuse.EIO, true},
+		{"op=-GetAttr status=-OK", "GetAttr", "foo", fuse.EIO, false},
+	}
+
+	for _, tc := range cases {
+		filter, err := NewTraceFilter(tc.spec)
+		if err != nil {
+			t.Fatalf("NewTraceFilter %q: %s", tc.spec, err)
+		}
+		if got := filter.match(tc.op, tc.name, tc.status); got != tc.match {
+			t.Errorf("%q: %s '%s' %v: expected %v got %v", tc.spec, tc.op, tc.name, tc.status, tc.match, got)
+		}
+	}
+
+	// A nil filter traces everything.
+	var filter *TraceFilter
+	if !filter.match("GetAttr", "foo", fuse.OK) {
+		t.Errorf("nil filter: expected everything to match")
+	}
+
+	for _, spec := range []string{"op", "op=", "colour=red", "sample=0", "sample=2", "sample=x", "path=[", "sample=0.1,0.2"} {
+		if _, err := NewTraceFilter(spec); err == nil {
+			t.Errorf("NewTraceFilter %q: expected error", spec)
+		}
+	}
+}
+
+func TestTraceFilterSample(t *testing.T) {
+	filter, _ := NewTraceFilter("sample=0.25")
+	n := 0
+	filter.random = func() float64 {
+		n++
+		return float64(n%4) / 4
+	}
+
+	matched := 0
+	for i := 0; i < 100; i++ {
+		if filter.match("GetAttr", "foo", fuse.OK) {
+			matched++
+		}
+	}
+	if matched != 25 {
+		t.Errorf("Expected 25 of 100 sampled got %d", matched)
+	}
+}
+
+func TestTraceFilterRuntimeChange(t *testing.T) {
+	filter, _ := NewTraceFilter("")
+
+	var out bytes.Buffer
+	fs := NewTraceFs(NewFlatBlobFs(conformanceContainer, newTestBackend(t), Options{}), filter).(*traceFs)
+	fs.log = log.New(&out, "", 0)
+
+	fs.GetAttr("foo", nil)
+	if !strings.Contains(out.String(), "[TRACE] GetAttr: name: foo status: 2=no such file or directory") {
+		t.Errorf("Expected GetAttr with status in the trace got %q", out.String())
+	}
+
+	// The filter can only be changed from this machine.
+	put := func(spec string, remoteAddr string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		r := httptest.NewRequest("PUT", "/trace/filter", strings.NewReader(spec))
+		r.RemoteAddr = remoteAddr
+		filter.ServeHTTP(recorder, r)
+		return recorder
+	}
+	recorder := put("op=-GetAttr", "192.0.2.1:1234")
+	if recorder.Code != 403 || filter.String() != "" {
+		t.Errorf("Remote PUT: got %d, filter %q", recorder.Code, filter.String())
+	}
+
+	recorder = put("op=-GetAttr", "127.0.0.1:1234")
+	if recorder.Code != 200 || filter.String() != "op=-GetAttr" {
+		t.Fatalf("PUT: got %d %q", recorder.Code, recorder.Body.String())
+	}
+
+	out.Reset()
+	fs.GetAttr("foo", nil)
+	fs.Mknod("foo", syscall.S_IFREG|0644, 0, nil)
+	if trace := out.String(); strings.Contains(trace, "GetAttr") || !strings.Contains(trace, "Mknod") {
+		t.Errorf("Expected only Mknod in the trace got %q", trace)
+	}
+
+	// Invalid specs leave the filter as it was.
+	recorder = put("op", "[::1]:1234")
+	if recorder.Code != 400 || filter.String() != "op=-GetAttr" {
+		t.Errorf("Invalid PUT: got %d, filter %q", recorder.Code, filter.String())
+	}
+}
+
+func TestTraceFsLogsCalls(t *testing.T) {
+	filter, _ := NewTraceFilter("op=GetAttr")
+
+	var out bytes.Buffer
+	fs := NewTraceFs(NewFlatBlobFs(conformanceContainer, newTestBackend(t), Options{}), filter).(*traceFs)
+	fs.log = log.New(&out, "", 0)
+
+	// Once when called, so that calls which hang show up, and once done.
+	fs.GetAttr("foo", nil)
+	expected := "[TRACE] GetAttr: name: foo\n[TRACE] GetAttr: name: foo status: 2=no such file or directory"
+	if !strings.HasPrefix(out.String(), expected) {
+		t.Errorf("Expected %q got %q", expected, out.String())
+	}
+
+	// The status isn't known when called, so only done is logged.
+	filter.Set("status=-OK")
+	out.Reset()
+	fs.GetAttr("foo", nil)
+	if lines := strings.Count(out.String(), "\n"); lines != 1 || !strings.Contains(out.String(), "status:") {
+		t.Errorf("Expected only GetAttr done got %q", out.String())
+	}
+
+	// Sampled operations are logged both times or not at all.
+	filter.Set("sample=0.5")
+	n := 0
+	filter.random = func() float64 {
+		n++
+		return float64(n%2) / 2
+	}
+	out.Reset()
+	for i := 0; i < 10; i++ {
+		fs.GetAttr("foo", nil)
+	}
+	if lines := strings.Count(out.String(), "\n"); lines != 10 {
+		t.Errorf("Expected 5 operations logged twice got %q", out.String())
+	}
+}
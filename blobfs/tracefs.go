@@ -16,112 +16,188 @@ import (
 )
 
 // NewTraceFs creates a file system which traces calls and delegates to the specified fs.
-func NewTraceFs(fs pathfs.FileSystem) pathfs.FileSystem {
+// Only the calls which filter lets through are traced, all of them if it's nil.
+func NewTraceFs(fs pathfs.FileSystem, filter *TraceFilter) pathfs.FileSystem {
 	logPrefix := fmt.Sprintf("[%s]: ", fs.String())
 	result := traceFs{
-		fs:  fs,
-		log: log.New(os.Stderr, logPrefix, log.LstdFlags),
+		fs:     fs,
+		filter: filter,
+		log:    log.New(os.Stderr, logPrefix, log.LstdFlags),
 	}
 
 	return &result
 }
 
 type traceFs struct {
-	fs  pathfs.FileSystem
-	log *log.Logger
+	fs     pathfs.FileSystem
+	filter *TraceFilter
+	log    *log.Logger
+}
+
+// traceCall is an operation in progress, see begin.
+type traceCall struct {
+	op     string
+	args   []interface{}
+	start  time.Time
+	traced bool
+}
+
+// begin starts tracing the operation op on name, unless the filter leaves
+// it out. It's logged when called, so that calls which hang show up, and
+// again by end with its status. With a status filter only end logs it,
+// the status isn't known before.
+func (fs *traceFs) begin(op string, name string, args ...interface{}) traceCall {
+	call := traceCall{
+		op:     op,
+		args:   args,
+		start:  time.Now(),
+		traced: fs.filter.matchCall(op, name),
+	}
+	if call.traced && fs.filter.anyStatus() {
+		fs.log.Println(append([]interface{}{"[TRACE] " + op + ":"}, args...)...)
+	}
+	return call
+}
+
+// end logs the operation begun with call which returned status, unless
+// the filter leaves it out.
+func (fs *traceFs) end(call traceCall, status fuse.Status) {
+	if !call.traced || !fs.filter.matchStatus(status) {
+		return
+	}
+
+	line := append([]interface{}{"[TRACE] " + call.op + ":"}, call.args...)
+	line = append(line, "status:", status, "duration:", time.Since(call.start))
+	fs.log.Println(line...)
 }
 
 func (fs *traceFs) SetDebug(debug bool) {}
 
 func (fs *traceFs) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
-	fs.log.Println("[TRACE] GetAttr:", "name:", name)
-	return fs.fs.GetAttr(name, context)
+	call := fs.begin("GetAttr", name, "name:", name)
+	attr, status := fs.fs.GetAttr(name, context)
+	fs.end(call, status)
+	return attr, status
 }
 
 func (fs *traceFs) GetXAttr(name string, attr string, context *fuse.Context) ([]byte, fuse.Status) {
-	fs.log.Println("[TRACE] GetXAttr:", "name:", name, "attr:", attr)
-	return fs.fs.GetXAttr(name, attr, context)
+	call := fs.begin("GetXAttr", name, "name:", name, "attr:", attr)
+	data, status := fs.fs.GetXAttr(name, attr, context)
+	fs.end(call, status)
+	return data, status
 }
 
 func (fs *traceFs) SetXAttr(name string, attr string, data []byte, flags int, context *fuse.Context) fuse.Status {
-	fs.log.Println("[TRACE] SetXAttr:", "name:", name, "attr:", attr)
-	return fs.fs.SetXAttr(name, attr, data, flags, context)
+	call := fs.begin("SetXAttr", name, "name:", name, "attr:", attr)
+	status := fs.fs.SetXAttr(name, attr, data, flags, context)
+	fs.end(call, status)
+	return status
 }
 
 func (fs *traceFs) ListXAttr(name string, context *fuse.Context) ([]string, fuse.Status) {
-	fs.log.Println("[TRACE] ListXAttr:", "name:", name)
-	return fs.fs.ListXAttr(name, context)
+	call := fs.begin("ListXAttr", name, "name:", name)
+	attrs, status := fs.fs.ListXAttr(name, context)
+	fs.end(call, status)
+	return attrs, status
 }
 
 func (fs *traceFs) RemoveXAttr(name string, attr string, context *fuse.Context) fuse.Status {
-	fs.log.Println("[TRACE] RemoveXAttr:", "name:", name, "attr:", attr)
-	return fs.fs.RemoveXAttr(name, attr, context)
+	call := fs.begin("RemoveXAttr", name, "name:", name, "attr:", attr)
+	status := fs.fs.RemoveXAttr(name, attr, context)
+	fs.end(call, status)
+	return status
 }
 
 func (fs *traceFs) Readlink(name string, context *fuse.Context) (string, fuse.Status) {
-	fs.log.Println("[TRACE] Readlink:", "name:", name)
-	return fs.fs.Readlink(name, context)
+	call := fs.begin("Readlink", name, "name:", name)
+	value, status := fs.fs.Readlink(name, context)
+	fs.end(call, status)
+	return value, status
 }
 
 func (fs *traceFs) Mknod(name string, mode uint32, dev uint32, context *fuse.Context) fuse.Status {
-	fs.log.Println("[TRACE] Mknod:", "name:", name, "mode:", mode, "dev:", dev)
-	return fs.fs.Mknod(name, mode, dev, context)
+	call := fs.begin("Mknod", name, "name:", name, "mode:", mode, "dev:", dev)
+	status := fs.fs.Mknod(name, mode, dev, context)
+	fs.end(call, status)
+	return status
 }
 
 func (fs *traceFs) Mkdir(name string, mode uint32, context *fuse.Context) fuse.Status {
-	fs.log.Println("[TRACE] Mkdir:", "name:", name, "mode:", mode)
-	return fs.fs.Mkdir(name, mode, context)
+	call := fs.begin("Mkdir", name, "name:", name, "mode:", mode)
+	status := fs.fs.Mkdir(name, mode, context)
+	fs.end(call, status)
+	return status
 }
 
 func (fs *traceFs) Unlink(name string, context *fuse.Context) (code fuse.Status) {
-	fs.log.Println("[TRACE] Unlink:", "name:", name)
-	return fs.fs.Unlink(name, context)
+	call := fs.begin("Unlink", name, "name:", name)
+	status := fs.fs.Unlink(name, context)
+	fs.end(call, status)
+	return status
 }
 
 func (fs *traceFs) Rmdir(name string, context *fuse.Context) (code fuse.Status) {
-	fs.log.Println("[TRACE] Rmdir:", "name:", name)
-	return fs.fs.Rmdir(name, context)
+	call := fs.begin("Rmdir", name, "name:", name)
+	status := fs.fs.Rmdir(name, context)
+	fs.end(call, status)
+	return status
 }
 
 func (fs *traceFs) Symlink(value string, linkName string, context *fuse.Context) (code fuse.Status) {
-	fs.log.Println("[TRACE] Symlink:", "value:", value, "linkName:", linkName)
-	return fs.fs.Symlink(value, linkName, context)
+	call := fs.begin("Symlink", linkName, "value:", value, "linkName:", linkName)
+	status := fs.fs.Symlink(value, linkName, context)
+	fs.end(call, status)
+	return status
 }
 
 func (fs *traceFs) Rename(oldName string, newName string, context *fuse.Context) (code fuse.Status) {
-	fs.log.Println("[TRACE] Rename:", "oldName:", oldName, "newName:", newName)
-	return fs.fs.Rename(oldName, newName, context)
+	call := fs.begin("Rename", oldName, "oldName:", oldName, "newName:", newName)
+	status := fs.fs.Rename(oldName, newName, context)
+	fs.end(call, status)
+	return status
 }
 
 func (fs *traceFs) Link(oldName string, newName string, context *fuse.Context) (code fuse.Status) {
-	fs.log.Println("[TRACE] Link:", "oldName:", oldName, "newName:", newName)
-	return fs.fs.Link(oldName, newName, context)
+	call := fs.begin("Link", oldName, "oldName:", oldName, "newName:", newName)
+	status := fs.fs.Link(oldName, newName, context)
+	fs.end(call, status)
+	return status
 }
 
 func (fs *traceFs) Chmod(name string, mode uint32, context *fuse.Context) (code fuse.Status) {
-	fs.log.Println("[TRACE] Chmod:", "name:", name, "mode:", mode)
-	return fs.fs.Chmod(name, mode, context)
+	call := fs.begin("Chmod", name, "name:", name, "mode:", mode)
+	status := fs.fs.Chmod(name, mode, context)
+	fs.end(call, status)
+	return status
 }
 
 func (fs *traceFs) Chown(name string, uid uint32, gid uint32, context *fuse.Context) (code fuse.Status) {
-	fs.log.Println("[TRACE] Chown:", "name:", name, "uid:", uid, "gid:", gid)
-	return fs.fs.Chown(name, uid, gid, context)
+	call := fs.begin("Chown", name, "name:", name, "uid:", uid, "gid:", gid)
+	status := fs.fs.Chown(name, uid, gid, context)
+	fs.end(call, status)
+	return status
 }
 
 func (fs *traceFs) Truncate(name string, offset uint64, context *fuse.Context) (code fuse.Status) {
-	fs.log.Println("[TRACE] Truncate:", "name:", name, "uid:", "offset:", offset)
-	return fs.fs.Truncate(name, offset, context)
+	call := fs.begin("Truncate", name, "name:", name, "offset:", offset)
+	status := fs.fs.Truncate(name, offset, context)
+	fs.end(call, status)
+	return status
 }
 
 func (fs *traceFs) Open(name string, flags uint32, context *fuse.Context) (file nodefs.File, code fuse.Status) {
 	flagsAsStr := flagsToText(flags)
-	fs.log.Println("[TRACE] Open:", "name:", name, "flags:", flags, "("+flagsAsStr+")")
-	return fs.fs.Open(name, flags, context)
+	call := fs.begin("Open", name, "name:", name, "flags:", flags, "("+flagsAsStr+")")
+	file, status := fs.fs.Open(name, flags, context)
+	fs.end(call, status)
+	return file, status
 }
 
 func (fs *traceFs) OpenDir(name string, context *fuse.Context) (stream []fuse.DirEntry, status fuse.Status) {
-	fs.log.Println("[TRACE] OpenDir:", "name:", name)
-	return fs.fs.OpenDir(name, context)
+	call := fs.begin("OpenDir", name, "name:", name)
+	stream, status = fs.fs.OpenDir(name, context)
+	fs.end(call, status)
+	return stream, status
 }
 
 func (fs *traceFs) OnMount(nodeFs *pathfs.PathNodeFs) {
@@ -135,19 +211,25 @@ func (fs *traceFs) OnUnmount() {
 }
 
 func (fs *traceFs) Access(name string, mode uint32, context *fuse.Context) (code fuse.Status) {
-	fs.log.Println("[TRACE] Access:", "name:", name, "mode:", mode)
-	return fs.fs.Access(name, mode, context)
+	call := fs.begin("Access", name, "name:", name, "mode:", mode)
+	status := fs.fs.Access(name, mode, context)
+	fs.end(call, status)
+	return status
 }
 
 func (fs *traceFs) Create(name string, flags uint32, mode uint32, context *fuse.Context) (file nodefs.File, code fuse.Status) {
 	flagsAsStr := flagsToText(flags)
-	fs.log.Println("[TRACE] Create:", "name:", name, "flags:", flags, "("+flagsAsStr+")", "mode:", mode)
-	return fs.fs.Create(name, flags, mode, context)
+	call := fs.begin("Create", name, "name:", name, "flags:", flags, "("+flagsAsStr+")", "mode:", mode)
+	file, status := fs.fs.Create(name, flags, mode, context)
+	fs.end(call, status)
+	return file, status
 }
 
 func (fs *traceFs) Utimens(name string, Atime *time.Time, Mtime *time.Time, context *fuse.Context) (code fuse.Status) {
-	fs.log.Println("[TRACE] Utimens:", "name:", name, "Atime:", Atime, "Mtime:", Mtime)
-	return fs.fs.Utimens(name, Atime, Mtime, context)
+	call := fs.begin("Utimens", name, "name:", name, "Atime:", Atime, "Mtime:", Mtime)
+	status := fs.fs.Utimens(name, Atime, Mtime, context)
+	fs.end(call, status)
+	return status
 }
 
 func (fs *traceFs) String() string {
@@ -155,8 +237,14 @@ func (fs *traceFs) String() string {
 }
 
 func (fs *traceFs) StatFs(name string) *fuse.StatfsOut {
-	fs.log.Println("[TRACE] StatFs:", "name:", name)
-	return fs.fs.StatFs(name)
+	call := fs.begin("StatFs", name, "name:", name)
+	out := fs.fs.StatFs(name)
+	status := fuse.OK
+	if out == nil {
+		status = fuse.ENOSYS
+	}
+	fs.end(call, status)
+	return out
 }
 
 // flagsToText converts flags given to Create and Open into human-readable strings.
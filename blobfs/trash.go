@@ -0,0 +1,169 @@
+package blobfs
+
+// With soft delete, blobs deleted with rm show up read-only under a hidden
+// .trash directory in the root until the retention period is over. Moving
+// a file out of it under its own name restores the blob:
+//
+//     ls -lc .trash/        # ctime is when the blob was deleted
+//     mv .trash/foo foo
+
+import (
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+// trashDir is the directory in the root with the deleted blobs. It's not
+// listed and hides a blob of the same name.
+const trashDir = ".trash"
+
+// xattrDeletedTime is the extended attribute with when a blob in trashDir
+// was deleted.
+const xattrDeletedTime = "user.azurefs.deleted"
+
+// isTrashPath tells if the file name is trashDir or in it.
+func isTrashPath(name string) bool {
+	return name == trashDir || strings.HasPrefix(name, trashDir+"/")
+}
+
+func (fs *flatblobFs) trashGetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
+	if name == trashDir {
+		// Writable so that files can be moved out with default_permissions.
+		return &fs.defaultDirFuseAttr, fuse.OK
+	}
+
+	props, status := fs.findDeleted("GetAttr", name, context)
+	if status != fuse.OK {
+		return nil, status
+	}
+
+	attr := fs.defaultFileFuseAttr
+	attr.Mode = fuse.S_IFREG | 0444
+	attr.Size = uint64(props.ContentLength)
+	attr.SetTimes(nil, &props.LastModified, &props.DeletedTime)
+	return &attr, fuse.OK
+}
+
+func (fs *flatblobFs) trashGetXAttr(name string, attr string, context *fuse.Context) ([]byte, fuse.Status) {
+	if name == trashDir || (attr != xattrBlobName && attr != xattrDeletedTime) {
+		return nil, fuse.Status(syscall.ENODATA)
+	}
+
+	props, status := fs.findDeleted("GetXAttr", name, context)
+	if status != fuse.OK {
+		return nil, status
+	}
+
+	if attr == xattrDeletedTime {
+		return []byte(props.DeletedTime.UTC().Format(time.RFC3339)), fuse.OK
+	}
+	return []byte(props.Name), fuse.OK
+}
+
+func (fs *flatblobFs) trashOpen(name string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	if isWriteOpen(flags) {
+		return nil, fuse.EROFS
+	}
+	if name == trashDir {
+		return nil, fuse.EISDIR
+	}
+
+	props, status := fs.findDeleted("Open", name, context)
+	if status != fuse.OK {
+		return nil, status
+	}
+
+	f, status := newBlobFile(fs.backend, fs.accountContainer, props, false, false, true, fs.log, context)
+	if status != fuse.OK {
+		return nil, status
+	}
+	return f, fuse.OK
+}
+
+func (fs *flatblobFs) trashOpenDir(name string, context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	if name != trashDir {
+		return nil, fuse.ENOTDIR
+	}
+
+	deleted, status := fs.listDeleted("OpenDir", name, "", context)
+	if status != fuse.OK {
+		return nil, status
+	}
+
+	return fs.dirEntries(deleted, fuse.S_IFREG|0444), fuse.OK
+}
+
+// trashRestore undeletes the blob behind the file in trashDir for
+// `mv .trash/foo foo`. Blobs can only be restored under their own name,
+// and not over a blob by that name, which would only get the snapshots.
+func (fs *flatblobFs) trashRestore(oldName string, newName string, context *fuse.Context) fuse.Status {
+	if strings.TrimPrefix(oldName, trashDir+"/") != newName {
+		fs.log.Printf("[ERROR] Rename '%s': Deleted blobs can only be restored under their own name, not as '%s'.\n", oldName, newName)
+		return fuse.EINVAL
+	}
+
+	props, status := fs.findDeleted("Rename", oldName, context)
+	if status != fuse.OK {
+		return status
+	}
+
+	_, err := fs.storage(context).GetBlobProperties(fs.accountContainer, props.Name)
+	if err == nil {
+		fs.log.Printf("[ERROR] Rename '%s': There is a blob '%s' again, not restoring it.\n", oldName, props.Name)
+		return fuse.Status(syscall.EEXIST)
+	}
+	if !isNotFound(err) {
+		fs.log.Printf("[ERROR] Rename '%s': %s\n", oldName, err)
+		return statusFromError(err)
+	}
+
+	err = fs.storage(context).UndeleteBlob(fs.accountContainer, props.Name)
+	if err != nil {
+		fs.log.Printf("[ERROR] Rename '%s': Could not undelete blob. %s\n", oldName, err)
+		return statusFromError(err)
+	}
+	fs.forgetBlob(props.Name)
+
+	return fuse.OK
+}
+
+// listDeleted lists the deleted blobs starting with prefix, op and name
+// are for logging.
+func (fs *flatblobFs) listDeleted(op string, name string, prefix string, context *fuse.Context) ([]BlobProperties, fuse.Status) {
+	blobs, err := fs.storage(context).ListBlobs(fs.accountContainer, ListBlobsParameters{Prefix: prefix, Deleted: true})
+	if err != nil {
+		fs.log.Printf("[ERROR] %s '%s': %s\n", op, name, err)
+		return nil, statusFromError(err)
+	}
+
+	deleted := make([]BlobProperties, 0, len(blobs))
+	for _, props := range blobs {
+		if props.Deleted {
+			deleted = append(deleted, props)
+		}
+	}
+	return deleted, fuse.OK
+}
+
+// findDeleted returns the deleted blob behind the file in trashDir.
+func (fs *flatblobFs) findDeleted(op string, name string, context *fuse.Context) (BlobProperties, fuse.Status) {
+	blobName, err := fs.pathEscaper.FileNameToBlobName(strings.TrimPrefix(name, trashDir+"/"))
+	if err != nil {
+		return BlobProperties{}, fuse.ENOENT
+	}
+
+	deleted, status := fs.listDeleted(op, name, blobName, context)
+	if status != fuse.OK {
+		return BlobProperties{}, status
+	}
+
+	for _, props := range deleted {
+		if props.Name == blobName {
+			return props, fuse.OK
+		}
+	}
+	return BlobProperties{}, fuse.ENOENT
+}
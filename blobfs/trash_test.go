@@ -0,0 +1,67 @@
+package blobfs
+
+import (
+	"io/ioutil"
+	"log"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func TestFlatBlobFsTrash(t *testing.T) {
+	backend := newTestBackend(t)
+	putBlob(t, backend.backend, conformanceContainer, "foo", "precious")
+	putBlob(t, backend.backend, conformanceContainer, "bar", "junk")
+
+	fs := NewFlatBlobFs(conformanceContainer, backend, Options{}).(*flatblobFs)
+	fs.log = log.New(ioutil.Discard, "", 0)
+
+	expectStatus(t, "GetAttr .trash", statusOf(fs.GetAttr(".trash", nil)), fuse.OK)
+	if names := listNames(t, fs, ".trash"); len(names) != 0 {
+		t.Errorf("OpenDir .trash: expected nothing got %q", names)
+	}
+
+	expectStatus(t, "Unlink foo", fs.Unlink("foo", nil), fuse.OK)
+	expectStatus(t, "Unlink bar", fs.Unlink("bar", nil), fuse.OK)
+
+	// Deleted blobs are in the trash and nowhere else.
+	if names := listNames(t, fs, ""); len(names) != 0 {
+		t.Errorf("OpenDir root: expected nothing got %q", names)
+	}
+	if names := listNames(t, fs, ".trash"); strings.Join(names, ",") != "bar,foo" {
+		t.Errorf("OpenDir .trash: expected [bar foo] got %q", names)
+	}
+
+	attr, status := fs.GetAttr(".trash/foo", nil)
+	expectStatus(t, "GetAttr .trash/foo", status, fuse.OK)
+	if attr != nil && (attr.Mode != fuse.S_IFREG|0444 || attr.Size != 8 || attr.Ctime == 0) {
+		t.Errorf("GetAttr .trash/foo: unexpected %+v", attr)
+	}
+	if _, status := fs.GetXAttr(".trash/foo", xattrDeletedTime, nil); status != fuse.OK {
+		t.Errorf("GetXAttr deleted time: %v", status)
+	}
+	if got := readFile(t, fs, ".trash/foo"); got != "precious" {
+		t.Errorf("Read .trash/foo: expected 'precious' got '%s'", got)
+	}
+
+	// The trash is read-only, files can only be moved out.
+	expectStatus(t, "Open for writing", statusOf(fs.Open(".trash/foo", uint32(syscall.O_WRONLY), nil)), fuse.EROFS)
+	expectStatus(t, "Unlink in trash", fs.Unlink(".trash/foo", nil), fuse.EROFS)
+	expectStatus(t, "Rename into trash", fs.Rename("baz", ".trash/baz", nil), fuse.EROFS)
+	expectStatus(t, "Rename to another name", fs.Rename(".trash/foo", "other", nil), fuse.EINVAL)
+
+	// Moving out restores the blob, unless there is one by that name.
+	expectStatus(t, "Rename restore", fs.Rename(".trash/foo", "foo", nil), fuse.OK)
+	if got := readFile(t, fs, "foo"); got != "precious" {
+		t.Errorf("Read restored foo: expected 'precious' got '%s'", got)
+	}
+	expectStatus(t, "GetAttr restored in trash", statusOf(fs.GetAttr(".trash/foo", nil)), fuse.ENOENT)
+
+	putBlob(t, backend.backend, conformanceContainer, "bar", "new bar")
+	expectStatus(t, "Rename restore over a file", fs.Rename(".trash/bar", "bar", nil), fuse.Status(syscall.EEXIST))
+
+	ro := NewFlatBlobFs(conformanceContainer, backend, Options{ReadOnly: true}).(*flatblobFs)
+	expectStatus(t, "Rename restore read-only", ro.Rename(".trash/bar", "bar", nil), fuse.EROFS)
+}
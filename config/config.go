@@ -0,0 +1,201 @@
+// Package config reads azurefs config files.
+//
+// They are TOML, see https://toml.io, with settings of mount at the top
+// and [accounts.NAME] tables for settings of one account each.
+//
+//	mode = "flat"
+//	accountContainer = "logs"
+//	account = "prod"
+//
+//	[accounts.prod]
+//	credentials-file = "/etc/azurefs/prod.key"
+//
+// What the keys mean is up to the caller, this package only parses them.
+package config
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Setting is a key and its value from a config file. Values of all types
+// are kept as strings, the way they'd be given on the command line.
+type Setting struct {
+	Name  string
+	Value string
+}
+
+// Config is a parsed config file.
+type Config struct {
+	// Path is where the file was loaded from, for errors.
+	Path string
+
+	// Settings are those outside of any table, in file order.
+	Settings []Setting
+
+	// Accounts are the settings of each [accounts.NAME] table.
+	Accounts map[string][]Setting
+}
+
+// Load reads and parses the config file at path.
+func Load(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := Parse(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid config file '%s': %s", path, err)
+	}
+	config.Path = path
+	return config, nil
+}
+
+// Apply sets the flags in flags not given on the command line from the
+// settings of c, and then from those of its [accounts.NAME] table for
+// account, which win. If account is "" and c has just one account, that
+// one is used. It returns the account used, "" for none.
+//
+// The flags in secret can't be set in config files at all, and of the
+// others only those in accountFlags can be set in [accounts.NAME] tables.
+func (c *Config) Apply(flags *flag.FlagSet, account string, secret map[string]bool, accountFlags map[string]bool) (string, error) {
+	given := make(map[string]bool)
+	flags.Visit(func(set *flag.Flag) { given[set.Name] = true })
+
+	apply := func(table string, settings []Setting) error {
+		where := fmt.Sprintf("config file '%s'", c.Path)
+		if table != "" {
+			where += fmt.Sprintf(" [%s]", table)
+		}
+		for _, s := range settings {
+			switch {
+			case flags.Lookup(s.Name) == nil:
+				return fmt.Errorf("%s: unknown setting '%s'", where, s.Name)
+			case secret[s.Name]:
+				return fmt.Errorf("%s: '%s' can't be set in config files, use credentials-file", where, s.Name)
+			case table != "" && !accountFlags[s.Name]:
+				return fmt.Errorf("%s: '%s' can't be set in [accounts.NAME] tables", where, s.Name)
+			case given[s.Name]:
+				continue
+			}
+			if err := flags.Set(s.Name, s.Value); err != nil {
+				return fmt.Errorf("%s: invalid value '%s' for '%s': %s", where, s.Value, s.Name, err)
+			}
+		}
+		return nil
+	}
+
+	if err := apply("", c.Settings); err != nil {
+		return "", err
+	}
+	if account == "" && len(c.Accounts) == 1 {
+		for name := range c.Accounts {
+			account = name
+		}
+	}
+	if account == "" {
+		return "", nil
+	}
+	settings, ok := c.Accounts[account]
+	if !ok {
+		return "", fmt.Errorf("config file '%s' has no [accounts.%s]", c.Path, account)
+	}
+	return account, apply("accounts."+account, settings)
+}
+
+// Parse parses a config file from data.
+func Parse(data string) (*Config, error) {
+	var values map[string]interface{}
+	md, err := toml.Decode(data, &values)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &Config{Accounts: make(map[string][]Setting)}
+	// The keys come in file order, tables before their keys.
+	for _, key := range md.Keys() {
+		value := lookup(values, key)
+		if _, ok := value.([]map[string]interface{}); ok {
+			return nil, fmt.Errorf("unknown table '%s', only [accounts.NAME] is supported", key)
+		}
+		if _, ok := value.(map[string]interface{}); ok {
+			switch {
+			case len(key) == 1 && key[0] == "accounts":
+			case len(key) == 2 && key[0] == "accounts":
+				config.Accounts[key[1]] = nil
+			default:
+				return nil, fmt.Errorf("unknown table '%s', only [accounts.NAME] is supported", key)
+			}
+			continue
+		}
+
+		var account string
+		switch {
+		case len(key) == 1:
+		case len(key) == 3 && key[0] == "accounts":
+			account = key[1]
+		default:
+			return nil, fmt.Errorf("unknown setting '%s', only [accounts.NAME] tables are supported", key)
+		}
+		s, err := format(value)
+		if err != nil {
+			return nil, fmt.Errorf("'%s': %s", key, err)
+		}
+		setting := Setting{Name: key[len(key)-1], Value: s}
+		if account == "" {
+			config.Settings = append(config.Settings, setting)
+		} else {
+			config.Accounts[account] = append(config.Accounts[account], setting)
+		}
+	}
+
+	return config, nil
+}
+
+// lookup returns the value of key in the decoded tables.
+func lookup(values map[string]interface{}, key toml.Key) interface{} {
+	var value interface{} = values
+	for _, name := range key {
+		table, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = table[name]
+	}
+	return value
+}
+
+// format turns a value into what would be given on the command line.
+// Arrays become comma separated lists, as -o takes them.
+func format(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64), nil
+	case time.Time:
+		return v.Format(time.RFC3339Nano), nil
+	case []interface{}:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			s, err := format(item)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, s)
+		}
+		return strings.Join(items, ","), nil
+	}
+	return "", fmt.Errorf("unsupported value of type %T", value)
+}
@@ -0,0 +1,196 @@
+package config
+
+import (
+	"flag"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	config, err := Parse(`
+# Mounted by /etc/fstab.
+mode = "flat"      # or container
+accountContainer = 'logs # not a comment'
+ro = true
+maxReadAhead = 131_072
+traceFilter = "op=-GetAttr \"quoted\""
+o = ["allow_other", "default_permissions"]
+as-of = 2016-04-01T09:50:39Z
+
+[accounts.prod]
+accountName = "foo"
+credentials-file = "/etc/azurefs/prod"
+
+[accounts.dev] # Azurite
+blobEndpoint = "http://127.0.0.1:10000/devstoreaccount1"
+
+[accounts.empty]
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Setting{
+		{"mode", "flat"},
+		{"accountContainer", "logs # not a comment"},
+		{"ro", "true"},
+		{"maxReadAhead", "131072"},
+		{"traceFilter", `op=-GetAttr "quoted"`},
+		{"o", "allow_other,default_permissions"},
+		{"as-of", "2016-04-01T09:50:39Z"},
+	}
+	if len(config.Settings) != len(expected) {
+		t.Fatalf("Settings: expected %v got %v", expected, config.Settings)
+	}
+	for i, s := range expected {
+		if config.Settings[i] != s {
+			t.Errorf("Settings[%d]: expected %v got %v", i, s, config.Settings[i])
+		}
+	}
+
+	if prod := config.Accounts["prod"]; len(prod) != 2 || prod[1] != (Setting{"credentials-file", "/etc/azurefs/prod"}) {
+		t.Errorf("Accounts prod: got %v", prod)
+	}
+	if dev := config.Accounts["dev"]; len(dev) != 1 || dev[0].Name != "blobEndpoint" {
+		t.Errorf("Accounts dev: got %v", dev)
+	}
+	if empty, ok := config.Accounts["empty"]; !ok || len(empty) != 0 {
+		t.Errorf("Accounts empty: got %v", empty)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, c := range []struct{ data, err string }{
+		{"mode flat", "line 1"},
+		{"\nmode = flat", "line 2"},
+		{"ro = true\nro = false", "line 2"},
+		{"[accounts.a]\n[accounts.a]", "line 2"},
+		{"a.b = 1", "unknown setting 'a.b'"},
+		{"[mount]", "unknown table 'mount', only [accounts.NAME] is supported"},
+		{"[accounts.a.b]", "unknown table 'accounts.a.b'"},
+		{"[[accounts.a]]\nmode = \"flat\"", "unknown table 'accounts.a'"},
+	} {
+		_, err := Parse(c.data)
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("Parse %q: expected '%s' got %v", c.data, c.err, err)
+		}
+	}
+
+	// The same key can be in different tables.
+	if _, err := Parse("accountName = \"a\"\n[accounts.b]\naccountName = \"b\""); err != nil {
+		t.Errorf("Parse same key in tables: %v", err)
+	}
+}
+
+func TestApply(t *testing.T) {
+	secret := map[string]bool{"accountKey": true, "sas": true}
+	accountFlags := map[string]bool{"accountName": true}
+
+	for _, c := range []struct {
+		name     string
+		data     string
+		args     []string
+		account  string
+		expected map[string]string
+		used     string
+		err      string
+	}{
+		{
+			name:     "flags win over the file",
+			data:     "mode = \"flat\"\naccountName = \"file\"",
+			args:     []string{"-mode=container"},
+			expected: map[string]string{"mode": "container", "accountName": "file"},
+		},
+		{
+			name:     "account table wins over the top",
+			data:     "accountName = \"top\"\n[accounts.a]\naccountName = \"a\"\n[accounts.b]\naccountName = \"b\"",
+			account:  "b",
+			expected: map[string]string{"accountName": "b"},
+			used:     "b",
+		},
+		{
+			name:     "flags win over the account table",
+			data:     "[accounts.a]\naccountName = \"a\"",
+			args:     []string{"-accountName=flag"},
+			account:  "a",
+			expected: map[string]string{"accountName": "flag"},
+			used:     "a",
+		},
+		{
+			name:     "only account is used",
+			data:     "accountName = \"top\"\n[accounts.a]\naccountName = \"a\"",
+			expected: map[string]string{"accountName": "a"},
+			used:     "a",
+		},
+		{
+			name:     "no account of several is used",
+			data:     "accountName = \"top\"\n[accounts.a]\naccountName = \"a\"\n[accounts.b]\naccountName = \"b\"",
+			expected: map[string]string{"accountName": "top"},
+		},
+		{
+			name: "key in the file",
+			data: "accountKey = \"key\"",
+			err:  "'accountKey' can't be set in config files",
+		},
+		{
+			name: "key given as flag is still rejected in the file",
+			data: "accountKey = \"key\"",
+			args: []string{"-accountKey=flag"},
+			err:  "'accountKey' can't be set in config files",
+		},
+		{
+			name: "SAS in an account table",
+			data: "[accounts.a]\nsas = \"sig\"",
+			err:  "[accounts.a]: 'sas' can't be set in config files",
+		},
+		{
+			name: "mount setting in an account table",
+			data: "[accounts.a]\nmode = \"flat\"",
+			err:  "'mode' can't be set in [accounts.NAME] tables",
+		},
+		{
+			name:    "unknown account",
+			data:    "[accounts.a]",
+			account: "b",
+			err:     "has no [accounts.b]",
+		},
+		{
+			name: "unknown setting",
+			data: "color = \"blue\"",
+			err:  "unknown setting 'color'",
+		},
+	} {
+		config, err := Parse(c.data)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		flags := flag.NewFlagSet("test", flag.ContinueOnError)
+		values := map[string]*string{}
+		for _, name := range []string{"mode", "accountName", "accountKey", "sas"} {
+			values[name] = flags.String(name, "", "")
+		}
+		if err := flags.Parse(c.args); err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+
+		used, err := config.Apply(flags, c.account, secret, accountFlags)
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("%s: expected '%s' got %v", c.name, c.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if used != c.used {
+			t.Errorf("%s: expected account '%s' got '%s'", c.name, c.used, used)
+		}
+		for name, value := range c.expected {
+			if *values[name] != value {
+				t.Errorf("%s: %s: expected '%s' got '%s'", c.name, name, value, *values[name])
+			}
+		}
+	}
+}
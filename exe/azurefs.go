@@ -0,0 +1,906 @@
+// Implementation of FUSE's file system on top of Azure blob storage.
+//
+// One binary for all of it: azurefs mount -mode container|flat|tree, and
+// as mount.azurefs a mount helper so that /etc/fstab can mount it.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+	"github.com/ppanyukov/azure-sdk-for-go/storage"
+	"github.com/ppanyukov/azurefs-fuse/account"
+	"github.com/ppanyukov/azurefs-fuse/blobfs"
+	"github.com/ppanyukov/azurefs-fuse/config"
+)
+
+// mountHelperName is what mount(8) runs to mount file systems of type
+// azurefs, install it as a link to azurefs in /sbin.
+const mountHelperName = "mount.azurefs"
+
+// statusFdEnv tells a mount started by mount.azurefs which file descriptor
+// to report on once the file system is mounted, or why it isn't.
+const statusFdEnv = "AZUREFS_STATUS_FD"
+
+// mountedStatus is what gets reported on the status file descriptor once
+// mounted, anything else is an error.
+const mountedStatus = "OK"
+
+// environment has the settings taken from the environment variables, which
+// are cleared as early as possible.
+type environment struct {
+	accountName      string
+	accountKey       string
+	accountContainer string
+	sas              string
+}
+
+// environ returns the environment variables to give a child azurefs. The
+// account key and SAS are left out, they go on pipes.
+func (env environment) environ() []string {
+	var vars []string
+	for _, v := range []struct{ name, value string }{
+		{"AZURE_STORAGE_ACCOUNT_NAME", env.accountName},
+		{"AZURE_STORAGE_ACCOUNT_CONTAINER", env.accountContainer},
+	} {
+		if v.value != "" {
+			vars = append(vars, v.name+"="+v.value)
+		}
+	}
+	return vars
+}
+
+// statusFile is where to report the mount to mount.azurefs, nil if it's not
+// waiting for it.
+var statusFile *os.File
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s COMMAND [flags] ...\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "The commands are:\n")
+	fmt.Fprintf(os.Stderr, "  mount [flags] MOUNTPOINT   mount blob storage, see '%s mount -h' for the flags\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  config validate [flags]    check the config file given with -config, and the flags, without mounting\n")
+	fmt.Fprintf(os.Stderr, "  help                       show this\n")
+	fmt.Fprintf(os.Stderr, "As %s, from mount(8) or /etc/fstab:\n", mountHelperName)
+	fmt.Fprintf(os.Stderr, "  %s SOURCE MOUNTPOINT [-o OPTIONS]\n", mountHelperName)
+}
+
+func main() {
+	// The most secure way to pass the key is -credentials-file or -accountKeyFd,
+	// args and env vars are still supported for convenience.
+	//
+	// zap sensitive vars early so nobody can grab them via /proc/pid/environ
+	// This may actually not work, because according to docs:
+	//      setenv_c and unsetenv_c are provided by the runtime but are no-ops
+	//      if cgo isn't loaded.
+	// At least it makes them inaccessible in go.
+	env := environment{
+		accountName:      os.Getenv("AZURE_STORAGE_ACCOUNT_NAME"),
+		accountKey:       os.Getenv("AZURE_STORAGE_ACCOUNT_KEY"),
+		accountContainer: os.Getenv("AZURE_STORAGE_ACCOUNT_CONTAINER"),
+		sas:              os.Getenv("AZURE_STORAGE_SAS_TOKEN"),
+	}
+	statusFd := os.Getenv(statusFdEnv)
+	os.Clearenv()
+
+	if statusFd != "" {
+		var fd uintptr
+		if _, err := fmt.Sscan(statusFd, &fd); err == nil {
+			statusFile = os.NewFile(fd, "status")
+		}
+	}
+
+	if filepath.Base(os.Args[0]) == mountHelperName {
+		mountHelper(os.Args[1:], env)
+		return
+	}
+
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(1)
+	}
+	switch os.Args[1] {
+	case "mount":
+		mount(os.Args[2:], env)
+	case "config":
+		if len(os.Args) < 3 || os.Args[2] != "validate" {
+			usage()
+			os.Exit(1)
+		}
+		validateConfig(os.Args[3:], env)
+	case "help", "-h", "-help", "--help":
+		usage()
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command '%s'.\n", os.Args[1])
+		usage()
+		os.Exit(1)
+	}
+}
+
+// mountFlags are the flags of the mount command.
+type mountFlags struct {
+	mode             string
+	isTrace          bool
+	traceJSON        string
+	traceFilterSpec  string
+	metricsAddr      string
+	isReadOnly       bool
+	mountOptions     string
+	accountName      string
+	accountKey       string
+	accountKeyFd     int
+	accountContainer string
+	sas              string
+	sasFd            int
+	anonymous        bool
+	credentialsFile  string
+	blobEndpoint     string
+	baseURL          string
+	apiVersion       string
+	useHTTPS         bool
+	pathStyle        bool
+	localDir         string
+	pathEscaping     string
+	nameMapFile      string
+	asOf             string
+	logFile          string
+	configFile       string
+	account          string
+	entryTTL         time.Duration
+	attrTTL          time.Duration
+	negativeTTL      time.Duration
+	maxReadAhead     int
+	shutdownTimeout  time.Duration
+}
+
+// newMountFlagSet returns the flags of the mount command, set into f.
+func newMountFlagSet(f *mountFlags, errorHandling flag.ErrorHandling) *flag.FlagSet {
+	flags := flag.NewFlagSet("mount", errorHandling)
+	flags.StringVar(&f.configFile, "config", "", "OPTIONAL. Config file with defaults for these flags, see the readme. Flags given win over it.")
+	flags.StringVar(&f.account, "account", "", "OPTIONAL. Which [accounts.NAME] of the config file to use. Not needed if it has just one.")
+	flags.StringVar(&f.mode, "mode", "flat", "OPTIONAL. What to mount: container for all containers as directories, flat for the blobs of accountContainer as files, tree for them with directories (not there yet).")
+	flags.StringVar(&f.accountName, "accountName", "", "REQUIRED. Azure storage account name. Or use AZURE_STORAGE_ACCOUNT_NAME env var.")
+	flags.StringVar(&f.accountKey, "accountKey", "", "REQUIRED unless sas or anonymous is given. Azure storage account key. Or use AZURE_STORAGE_ACCOUNT_KEY env var.")
+	flags.StringVar(&f.accountContainer, "accountContainer", "", "REQUIRED for flat and tree modes. Azure storage account container name. Or use AZURE_STORAGE_ACCOUNT_CONTAINER env var.")
+	flags.IntVar(&f.accountKeyFd, "accountKeyFd", -1, "OPTIONAL. Read the account key from this file descriptor, e.g. 0 for stdin.")
+	flags.StringVar(&f.credentialsFile, "credentials-file", "", "OPTIONAL. File with a connection string, or INI or JSON with connection string settings. Must not be accessible by group or others. Settings in the file win over flags.")
+	flags.StringVar(&f.sas, "sas", "", "OPTIONAL. Shared access signature to use instead of the account key, either account SAS or, except in container mode, container SAS. Read-only SAS gives a read-only mount. Or use AZURE_STORAGE_SAS_TOKEN env var.")
+	flags.IntVar(&f.sasFd, "sasFd", -1, "OPTIONAL. Read the shared access signature from this file descriptor, e.g. 0 for stdin.")
+	flags.BoolVar(&f.anonymous, "anonymous", false, "OPTIONAL. Specify true to mount a public container read-only without any credentials.")
+	flags.StringVar(&f.blobEndpoint, "blobEndpoint", "", "OPTIONAL. Full URL of the blob service, e.g. http://127.0.0.1:10000/devstoreaccount1 for Azurite. Overrides baseURL, useHTTPS and pathStyle.")
+	flags.StringVar(&f.baseURL, "baseURL", storage.DefaultBaseURL, "OPTIONAL. Storage service base URL, e.g. core.chinacloudapi.cn for Azure China.")
+	flags.StringVar(&f.apiVersion, "apiVersion", storage.DefaultAPIVersion, "OPTIONAL. Storage service API version.")
+	flags.BoolVar(&f.useHTTPS, "useHTTPS", true, "OPTIONAL. Specify false to talk to the storage service over plain HTTP.")
+	flags.BoolVar(&f.pathStyle, "pathStyle", false, "OPTIONAL. Specify true to address the account as baseURL/accountName instead of accountName.blob.baseURL.")
+	flags.StringVar(&f.localDir, "localDir", "", "OPTIONAL. Use this local directory instead of Azure storage: subdirectories are containers, files are blobs. No account is needed.")
+	flags.StringVar(&f.pathEscaping, "pathEscaping", string(blobfs.PathEscapingURLQuery), "OPTIONAL. How to turn blob names into file names: urlquery, minimal, percent or base32.")
+	flags.StringVar(&f.nameMapFile, "nameMapFile", "", "OPTIONAL. File to remember the blob names behind shortened file names in, so that they work across remounts.")
+	flags.BoolVar(&f.isTrace, "trace", false, "OPTIONAL. Specify true to trace calls.")
+	flags.StringVar(&f.traceJSON, "traceJSON", "", "OPTIONAL. Write one JSON line per operation with its status, duration and storage calls to this file, or to a socket given as unix:<path> or tcp:<host:port>.")
+	flags.StringVar(&f.traceFilterSpec, "traceFilter", "", "OPTIONAL. Which operations -trace and -traceJSON record, e.g. 'op=-GetAttr status=-OK sample=0.1'. Can be changed at http://<metricsAddr>/trace/filter from this machine while mounted.")
+	flags.StringVar(&f.metricsAddr, "metricsAddr", "", "OPTIONAL. Serve Prometheus metrics of operations and storage calls at http://<address>/metrics, e.g. 127.0.0.1:9102.")
+	flags.BoolVar(&f.isReadOnly, "ro", false, "OPTIONAL. Specify true to mount read-only.")
+	flags.StringVar(&f.asOf, "as-of", "", "OPTIONAL. Flat mode only. Show blobs as they were at this time, e.g. 2016-04-01T09:50:39Z or 2016-04-01, from snapshots and deleted blobs. Always read-only.")
+	flags.DurationVar(&f.entryTTL, "entryTTL", time.Second, "OPTIONAL. How long the kernel caches file names.")
+	flags.DurationVar(&f.attrTTL, "attrTTL", time.Second, "OPTIONAL. How long the kernel caches sizes, times and modes of files.")
+	flags.DurationVar(&f.negativeTTL, "negativeTTL", 0, "OPTIONAL. How long the kernel caches that a file name does not exist.")
+	flags.IntVar(&f.maxReadAhead, "maxReadAhead", 0, "OPTIONAL. Most bytes the kernel reads ahead of reads, 0 for its default.")
+	flags.DurationVar(&f.shutdownTimeout, "shutdownTimeout", 30*time.Second, "OPTIONAL. How long to wait on SIGINT or SIGTERM for changes to open files to be saved before unmounting.")
+	flags.StringVar(&f.logFile, "logFile", "", "OPTIONAL. Append the log to this file instead of writing it to stderr.")
+	flags.StringVar(&f.mountOptions, "o", "", "OPTIONAL. Comma separated mount options, e.g. ro. Options not known here are passed to fusermount.")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s mount [flags] MOUNTPOINT\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "The flags are:\n")
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+// mountSetup is what the flags of the mount command come to.
+type mountSetup struct {
+	accountConfig      account.Config
+	fsOptions          blobfs.Options
+	kernelMountOptions []string
+	traceFilter        *blobfs.TraceFilter
+	nodeOptions        *nodefs.Options
+}
+
+// setup checks the flags in f and works out what to mount, with the
+// settings from env where the flags don't have them.
+func (f *mountFlags) setup(env environment) (*mountSetup, error) {
+	if f.accountName == "" {
+		f.accountName = env.accountName
+	}
+	if f.accountKey == "" {
+		f.accountKey = env.accountKey
+	}
+	if f.sas == "" {
+		f.sas = env.sas
+	}
+	if f.accountContainer == "" {
+		f.accountContainer = env.accountContainer
+	}
+
+	switch f.mode {
+	case "container":
+		if f.asOf != "" {
+			return nil, errors.New("-as-of only works in flat mode")
+		}
+	case "flat":
+	case "tree":
+		return nil, errors.New("tree mode is not there yet, use flat")
+	default:
+		return nil, fmt.Errorf("unknown mode '%s', use container, flat or tree", f.mode)
+	}
+
+	var (
+		setup mountSetup
+		err   error
+	)
+	if f.accountKeyFd >= 0 {
+		f.accountKey, err = account.ReadSecretFromFd(f.accountKeyFd)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if f.sasFd >= 0 {
+		f.sas, err = account.ReadSecretFromFd(f.sasFd)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	setup.accountConfig = account.Config{
+		Name:         f.accountName,
+		Key:          f.accountKey,
+		SAS:          f.sas,
+		Anonymous:    f.anonymous,
+		BlobEndpoint: f.blobEndpoint,
+		BaseURL:      f.baseURL,
+		APIVersion:   f.apiVersion,
+		UseHTTPS:     f.useHTTPS,
+		PathStyle:    f.pathStyle,
+	}
+
+	if f.credentialsFile != "" {
+		setup.accountConfig, err = account.LoadCredentialsFile(f.credentialsFile, setup.accountConfig)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	accountConfig := setup.accountConfig
+	if f.localDir == "" && accountConfig.Name == "" {
+		return nil, errors.New("missing account name, give -accountName or -localDir")
+	}
+	if f.localDir == "" && accountConfig.Key == "" && accountConfig.SAS == "" && !accountConfig.Anonymous {
+		return nil, errors.New("missing credentials, give -accountKey, -accountKeyFd, -credentials-file, -sas, -sasFd or -anonymous")
+	}
+	if f.mode == "container" && accountConfig.Anonymous {
+		return nil, errors.New("anonymous access cannot list containers, use flat mode")
+	}
+	if f.mode != "container" && f.accountContainer == "" {
+		return nil, fmt.Errorf("missing container, %s mode needs -accountContainer", f.mode)
+	}
+
+	setup.fsOptions = blobfs.Options{
+		ReadOnly:    f.isReadOnly,
+		NameMapFile: f.nameMapFile,
+	}
+	setup.fsOptions.PathEscaping, err = blobfs.ParsePathEscaping(f.pathEscaping)
+	if err != nil {
+		return nil, err
+	}
+	setup.kernelMountOptions = setup.fsOptions.ParseMountOptions(f.mountOptions)
+	if f.asOf != "" {
+		setup.fsOptions.AsOf, err = blobfs.ParseAsOf(f.asOf)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	setup.traceFilter, err = blobfs.NewTraceFilter(f.traceFilterSpec)
+	if err != nil {
+		return nil, err
+	}
+
+	if f.entryTTL < 0 || f.attrTTL < 0 || f.negativeTTL < 0 || f.maxReadAhead < 0 || f.shutdownTimeout < 0 {
+		return nil, errors.New("-entryTTL, -attrTTL, -negativeTTL, -maxReadAhead and -shutdownTimeout can't be negative")
+	}
+	setup.nodeOptions = nodefs.NewOptions()
+	setup.nodeOptions.EntryTimeout = f.entryTTL
+	setup.nodeOptions.AttrTimeout = f.attrTTL
+	setup.nodeOptions.NegativeTimeout = f.negativeTTL
+
+	return &setup, nil
+}
+
+// accountFlags are the flags [accounts.NAME] tables of config files can
+// set. Keys and SAS go in a credentials-file rather than in there.
+var accountFlags = map[string]bool{
+	"accountName":      true,
+	"credentials-file": true,
+	"anonymous":        true,
+	"blobEndpoint":     true,
+	"baseURL":          true,
+	"apiVersion":       true,
+	"useHTTPS":         true,
+	"pathStyle":        true,
+	"localDir":         true,
+	"accountContainer": true,
+}
+
+// noConfigFlags are the flags config files can't set.
+var noConfigFlags = map[string]bool{
+	"config":       true,
+	"accountKey":   true,
+	"accountKeyFd": true,
+	"sas":          true,
+	"sasFd":        true,
+}
+
+// applyConfig sets the flags not given on the command line from the config
+// file given with -config, if any. Settings of the account win over those
+// outside of [accounts.NAME] tables.
+func applyConfig(flags *flag.FlagSet, f *mountFlags) error {
+	if f.configFile == "" {
+		return nil
+	}
+	cfg, err := config.Load(f.configFile)
+	if err != nil {
+		return err
+	}
+	f.account, err = cfg.Apply(flags, f.account, noConfigFlags, accountFlags)
+	return err
+}
+
+// validateConfig checks the config file given with -config the way mount
+// would, for each of its accounts unless -account is given, and reports
+// what's wrong without mounting anything.
+func validateConfig(args []string, env environment) {
+	var f mountFlags
+	flags := newMountFlagSet(&f, flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s config validate -config FILE [flags]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "The flags are those of mount.\n")
+	}
+	flags.Parse(args)
+	if f.configFile == "" {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	cfg, err := config.Load(f.configFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		os.Exit(1)
+	}
+	accounts := []string{f.account}
+	if f.account == "" && len(cfg.Accounts) > 1 {
+		accounts = accounts[:0]
+		for name := range cfg.Accounts {
+			accounts = append(accounts, name)
+		}
+		sort.Strings(accounts)
+	}
+
+	// Reading a file descriptor closes it, so the key and SAS are read
+	// once for all accounts.
+	for _, secret := range []struct {
+		fd    *int
+		value *string
+	}{
+		{&f.accountKeyFd, &f.accountKey},
+		{&f.sasFd, &f.sas},
+	} {
+		if *secret.fd < 0 {
+			continue
+		}
+		*secret.value, err = account.ReadSecretFromFd(*secret.fd)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+			os.Exit(1)
+		}
+		*secret.fd = -1
+	}
+
+	failed := false
+	for _, name := range accounts {
+		var checked mountFlags
+		flags := newMountFlagSet(&checked, flag.ExitOnError)
+		flags.Parse(args)
+		if name != "" {
+			flags.Set("account", name)
+		}
+		checked.accountKey, checked.accountKeyFd = f.accountKey, f.accountKeyFd
+		checked.sas, checked.sasFd = f.sas, f.sasFd
+
+		err := applyConfig(flags, &checked)
+		if err == nil {
+			_, err = checked.setup(env)
+		}
+		if err != nil {
+			failed = true
+			if name != "" {
+				fmt.Fprintf(os.Stderr, "ERROR: account '%s': %v\n", name, err)
+			} else {
+				fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+			}
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+	fmt.Printf("OK. Config file '%s' is valid.\n", f.configFile)
+}
+
+// reportMount tells mount.azurefs, if it's waiting, that the file system is
+// mounted when err is nil, or why it isn't.
+func reportMount(err error) {
+	if statusFile == nil {
+		return
+	}
+	if err == nil {
+		statusFile.WriteString(mountedStatus)
+	} else {
+		statusFile.WriteString(err.Error())
+	}
+	statusFile.Close()
+	statusFile = nil
+}
+
+// fatalf logs and exits like log.Fatalf, telling mount.azurefs first.
+func fatalf(format string, v ...interface{}) {
+	reportMount(errors.New(strings.TrimSpace(fmt.Sprintf(format, v...))))
+	log.Fatalf(format, v...)
+}
+
+func mount(args []string, env environment) {
+	// TODO(ppanyukov): too much args parsing, is there a better saner way?
+	var (
+		f          mountFlags
+		mountPoint string
+		err        error
+	)
+	flags := newMountFlagSet(&f, flag.ExitOnError)
+	flags.Parse(args)
+	if err = applyConfig(flags, &f); err != nil {
+		fatalf("ERROR: %v\n", err)
+	}
+
+	if f.logFile != "" {
+		logFile, err := os.OpenFile(f.logFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			fatalf("ERROR: %v\n", err)
+		}
+		// blobfs logs to os.Stderr as it is when the file system is made.
+		os.Stderr = logFile
+		log.SetOutput(logFile)
+	}
+
+	if len(flags.Args()) > 0 {
+		mountPoint = flags.Arg(0)
+	}
+	if mountPoint == "" {
+		reportMount(errors.New("missing mount point"))
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	setup, err := f.setup(env)
+	if err != nil {
+		fatalf("ERROR: %v\n", err)
+	}
+	accountConfig, fsOptions, traceFilter := setup.accountConfig, setup.fsOptions, setup.traceFilter
+	kernelMountOptions := setup.kernelMountOptions
+
+	// good to go
+	var backend blobfs.Backend
+	if f.localDir != "" {
+		fmt.Printf("OK. Will mount local directory '%s' at '%s'", f.localDir, mountPoint)
+
+		backend, err = blobfs.NewLocalBackend(f.localDir)
+		if err != nil {
+			fatalf("ERROR: %v\n", err)
+		}
+	} else {
+		fmt.Printf("OK. Will mount storage account '%s' at '%s'", accountConfig.Name, mountPoint)
+
+		storageClient, err := accountConfig.NewClient()
+		if err != nil {
+			fatalf("ERROR: %v\n", err)
+		}
+
+		if f.mode == "container" && accountConfig.IsContainerSAS() {
+			fatalf("ERROR: container SAS cannot list containers, use flat mode or an account SAS.\n")
+		}
+
+		if !fsOptions.ReadOnly && accountConfig.IsReadOnly() {
+			log.Println("The credentials do not allow writing, mounting read-only.")
+			fsOptions.ReadOnly = true
+		}
+		serviceURL, key := accountConfig.BlobService()
+		backend = blobfs.NewStorageBackend(storageClient, blobfs.StorageAccount{Name: accountConfig.Name, Key: key, SAS: accountConfig.SAS, URL: serviceURL})
+	}
+
+	var metrics *blobfs.Metrics
+	if f.metricsAddr != "" {
+		listener, err := net.Listen("tcp", f.metricsAddr)
+		if err != nil {
+			fatalf("ERROR: %v\n", err)
+		}
+		metrics = blobfs.NewMetrics()
+		backend = metrics.Backend(backend)
+
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics)
+		mux.Handle("/trace/filter", traceFilter)
+		go http.Serve(listener, mux)
+	}
+
+	var tracer *blobfs.Tracer
+	// The trace is written in the background, what's queued is lost
+	// unless flushed before exiting.
+	flushTrace := func() {}
+	if f.traceJSON != "" {
+		traceOutput, err := blobfs.OpenTraceOutput(f.traceJSON)
+		if err != nil {
+			fatalf("ERROR: %v\n", err)
+		}
+		tracer = blobfs.NewTracer(traceOutput, traceFilter)
+		backend = tracer.Backend(backend)
+		flushTrace = tracer.Flush
+	}
+	kernelMountOptions = append(kernelMountOptions, fsOptions.KernelMountOptions()...)
+
+	if !fsOptions.AsOf.IsZero() {
+		if err := blobfs.CheckAsOf(backend, f.accountContainer); err != nil {
+			fatalf("ERROR: -as-of needs to list snapshots, deleted blobs and versions. %v\n", err)
+		}
+	}
+
+	var fs pathfs.FileSystem
+	if f.mode == "container" {
+		fs = blobfs.NewContainerFs(backend, fsOptions)
+	} else {
+		fs = blobfs.NewFlatBlobFs(f.accountContainer, backend, fsOptions)
+	}
+	if f.isTrace {
+		fs = blobfs.NewTraceFs(fs, traceFilter)
+	}
+	if metrics != nil {
+		fs = metrics.FileSystem(fs)
+	}
+	if tracer != nil {
+		fs = tracer.FileSystem(fs)
+	}
+	shutdown := blobfs.NewShutdown()
+	fs = shutdown.FileSystem(fs)
+	var copies *blobfs.CopyFileRange
+	if f.mode == "flat" {
+		copies = blobfs.NewCopyFileRange()
+		fs = copies.FileSystem(fs)
+	}
+
+	nfs := pathfs.NewPathNodeFs(fs, nil)
+	conn := nodefs.NewFileSystemConnector(nfs.Root(), setup.nodeOptions)
+	rawFs := conn.RawFS()
+	mountOpts := &fuse.MountOptions{
+		Options:      kernelMountOptions,
+		MaxReadAhead: f.maxReadAhead,
+	}
+	if f.mode == "flat" {
+		// flock and fcntl locks become blob leases, see blobfs/bloblock.go.
+		// cp copies blobs server-side through copy_file_range, see
+		// blobfs/copyrange.go.
+		rawFs = copies.RawFileSystem(rawFs)
+		mountOpts.EnableLocks = true
+	}
+	server, err := fuse.NewServer(rawFs, mountPoint, mountOpts)
+	if err != nil {
+		fatalf("Mount fail: %v\n", err)
+	}
+	go shutdownOnSignal(server, shutdown, mountPoint, f.shutdownTimeout, flushTrace)
+	defer flushTrace()
+
+	if statusFile == nil {
+		server.Serve()
+		return
+	}
+
+	served := make(chan struct{})
+	go func() {
+		server.Serve()
+		close(served)
+	}()
+	reportMount(server.WaitMount())
+	<-served
+}
+
+// exitLostData is the exit status when changes to open files may have been
+// lost, 1 is for not getting to mount at all.
+const exitLostData = 2
+
+// shutdownOnSignal waits for SIGINT or SIGTERM, then saves the changes to
+// open files, unmounts, writes out the rest of the trace and exits. Another
+// signal exits at once.
+func shutdownOnSignal(server *fuse.Server, shutdown *blobfs.Shutdown, mountPoint string, timeout time.Duration, flushTrace func()) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	log.Printf("Got %s, saving open files and unmounting.\n", <-signals)
+	go func() {
+		log.Printf("Got %s again, exiting without saving open files.\n", <-signals)
+		os.Exit(exitLostData)
+	}()
+
+	status := 0
+	for _, name := range shutdown.Flush(timeout) {
+		log.Printf("ERROR: changes to '%s' may be lost.\n", name)
+		status = exitLostData
+	}
+	if err := unmount(server, mountPoint); err != nil {
+		log.Printf("ERROR: %v\n", err)
+	}
+	flushTrace()
+	os.Exit(status)
+}
+
+// unmount unmounts, lazily if files are still open so that the mount point
+// isn't left behind dead.
+func unmount(server *fuse.Server, mountPoint string) error {
+	err := server.Unmount()
+	if err == nil {
+		return nil
+	}
+	out, lazyErr := exec.Command("fusermount", "-u", "-z", mountPoint).CombinedOutput()
+	if lazyErr != nil {
+		return fmt.Errorf("cannot unmount '%s': %v, %s", mountPoint, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// mountHelper runs as mount.azurefs, the way mount(8) runs it:
+//
+//	mount.azurefs SOURCE MOUNTPOINT [-sfnv] [-o OPTIONS]
+//
+// so that an /etc/fstab line like this one mounts a container:
+//
+//	mycontainer /mnt/blobs azurefs credentials-file=/etc/azurefs/account,allow_other,_netdev 0 0
+//
+// SOURCE is the container, options named like flags of the mount command
+// set those and the rest are mount options. It returns once mounted, the
+// file system is served by azurefs in the background.
+func mountHelper(args []string, env environment) {
+	source, mountPoint, options, fake, err := parseMountHelperArgs(args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", mountHelperName, err)
+		usage()
+		os.Exit(1)
+	}
+
+	mountArgs, flags, err := mountHelperFlags(source, options)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", mountHelperName, err)
+		os.Exit(1)
+	}
+	// The key and SAS are passed on pipes of their own, not in the
+	// arguments, and the file descriptors given to mount are not passed on.
+	if flags.accountKey != "" {
+		env.accountKey = flags.accountKey
+	}
+	if flags.sas != "" {
+		env.sas = flags.sas
+	}
+	for _, secret := range []struct {
+		fd    int
+		value *string
+	}{
+		{flags.accountKeyFd, &env.accountKey},
+		{flags.sasFd, &env.sas},
+	} {
+		if secret.fd < 0 {
+			continue
+		}
+		*secret.value, err = account.ReadSecretFromFd(secret.fd)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", mountHelperName, err)
+			os.Exit(1)
+		}
+	}
+	if fake {
+		return
+	}
+
+	if err := mountInBackground(mountArgs, mountPoint, env); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", mountHelperName, err)
+		os.Exit(1)
+	}
+}
+
+// parseMountHelperArgs parses what mount(8) gives mount helpers. Of the
+// single letter flags only -f, which means not to mount, matters here.
+func parseMountHelperArgs(args []string) (source string, mountPoint string, options string, fake bool, err error) {
+	var positional, optionList []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "-o" || arg == "-t" || arg == "-N":
+			if i+1 == len(args) {
+				return "", "", "", false, fmt.Errorf("%s needs a value", arg)
+			}
+			i++
+			if arg == "-o" {
+				optionList = append(optionList, args[i])
+			}
+		case strings.HasPrefix(arg, "-o"):
+			optionList = append(optionList, arg[2:])
+		case strings.HasPrefix(arg, "-") && len(arg) > 1:
+			fake = fake || strings.Contains(arg, "f")
+		default:
+			positional = append(positional, arg)
+		}
+	}
+
+	if len(positional) != 2 {
+		return "", "", "", false, errors.New("expected SOURCE and MOUNTPOINT")
+	}
+	return positional[0], positional[1], strings.Join(optionList, ","), fake, nil
+}
+
+// ignoredMountOption is true for options which are for mount(8) or other
+// tools reading /etc/fstab, not for the file system.
+func ignoredMountOption(name string) bool {
+	switch name {
+	case "defaults", "auto", "noauto", "nofail", "user", "users", "nouser", "owner", "_netdev", "comment":
+		return true
+	}
+	return strings.HasPrefix(name, "x-")
+}
+
+// secretFlags are the flags mount.azurefs doesn't pass on as arguments,
+// where ps and /proc/PID/cmdline would show them.
+var secretFlags = map[string]bool{
+	"accountKey":   true,
+	"accountKeyFd": true,
+	"sas":          true,
+	"sasFd":        true,
+}
+
+// mountHelperFlags turns the source and options given to mount.azurefs into
+// arguments of the mount command, and what they set. Options of
+// secretFlags are only in what they set. Values can't have commas in them.
+func mountHelperFlags(source string, options string) ([]string, mountFlags, error) {
+	var f mountFlags
+	flags := newMountFlagSet(&f, flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+
+	args := []string{"-accountContainer=" + source}
+	var secretArgs, mountOptions []string
+	for _, option := range strings.Split(options, ",") {
+		name, value := option, ""
+		hasValue := false
+		if i := strings.Index(option, "="); i >= 0 {
+			name, value, hasValue = option[:i], option[i+1:], true
+		}
+		if name == "" || ignoredMountOption(name) {
+			continue
+		}
+
+		known := flags.Lookup(name)
+		if known == nil || name == "o" {
+			mountOptions = append(mountOptions, option)
+			continue
+		}
+		if b, ok := known.Value.(interface {
+			IsBoolFlag() bool
+		}); ok && b.IsBoolFlag() && !hasValue {
+			args = append(args, "-"+name)
+			continue
+		}
+		if !hasValue {
+			return nil, f, fmt.Errorf("option '%s' needs a value", name)
+		}
+		if secretFlags[name] {
+			secretArgs = append(secretArgs, "-"+name+"="+value)
+			continue
+		}
+		args = append(args, "-"+name+"="+value)
+	}
+	if len(mountOptions) > 0 {
+		args = append(args, "-o", strings.Join(mountOptions, ","))
+	}
+
+	// Bad values are better reported here than from the background.
+	if err := flags.Parse(append(append([]string{}, args...), secretArgs...)); err != nil {
+		return nil, f, err
+	}
+	return args, f, nil
+}
+
+// mountInBackground runs azurefs mount with args on mountPoint in a new
+// session and waits until it reports the file system mounted or fails.
+// The account key and SAS go on pipes, anyone can read the environment of
+// a process of the same user from /proc/PID/environ.
+func mountInBackground(args []string, mountPoint string, env environment) error {
+	status, statusWriter, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer status.Close()
+	// The status pipe is the first of ExtraFiles, fd 3.
+	files := []*os.File{statusWriter}
+
+	for _, secret := range []struct{ flag, value string }{
+		{"accountKeyFd", env.accountKey},
+		{"sasFd", env.sas},
+	} {
+		if secret.value == "" {
+			continue
+		}
+		pipe, err := keyPipe(secret.value)
+		if err != nil {
+			statusWriter.Close()
+			return err
+		}
+		defer pipe.Close()
+		args = append(args, fmt.Sprintf("-%s=%d", secret.flag, 3+len(files)))
+		files = append(files, pipe)
+	}
+
+	// os.Args[0] is mount.azurefs, or whatever mount(8) made of it.
+	cmd := exec.Command("/proc/self/exe", append(append([]string{"mount"}, args...), mountPoint)...)
+	cmd.Args[0] = "azurefs"
+	cmd.Env = append(env.environ(), statusFdEnv+"=3")
+	cmd.ExtraFiles = files
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	err = cmd.Start()
+	statusWriter.Close()
+	if err != nil {
+		return err
+	}
+	cmd.Process.Release()
+
+	reported, err := ioutil.ReadAll(status)
+	if err != nil {
+		return err
+	}
+	switch string(reported) {
+	case mountedStatus:
+		return nil
+	case "":
+		return errors.New("mount failed, use -o logFile=<path> to see why")
+	}
+	return errors.New(string(reported))
+}
+
+// keyPipe returns the reading end of a pipe with key written to it. Keys
+// and SAS fit in the pipe buffer, so there is no need to wait for the reader.
+func keyPipe(key string) (*os.File, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.WriteString(w, key)
+	w.Close()
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	return r, nil
+}
@@ -0,0 +1,126 @@
+// Replays a JSON trace recorded with -traceJSON against a file system
+// and reports operations which return a different status.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+	"github.com/ppanyukov/azurefs-fuse/account"
+	"github.com/ppanyukov/azurefs-fuse/blobfs"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [flags] TRACE_FILE\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "Replays the trace against blobs in memory, a local directory or a storage account.\n")
+	fmt.Fprintf(os.Stderr, "The flags are:\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	var (
+		fsName           string
+		accountName      string
+		accountKey       string
+		accountContainer string
+		sas              string
+		blobEndpoint     string
+		localDir         string
+		pathEscaping     string
+		isReadOnly       bool
+		traceFile        string
+		err              error
+	)
+
+	flag.Usage = usage
+	flag.StringVar(&fsName, "fs", "flatblobfs", "OPTIONAL. File system the trace was recorded with: flatblobfs or containerfs.")
+	flag.StringVar(&accountName, "accountName", "", "OPTIONAL. Azure storage account name to replay against. Blobs are in memory if neither this nor localDir is given.")
+	flag.StringVar(&accountKey, "accountKey", "", "OPTIONAL. Azure storage account key.")
+	flag.StringVar(&sas, "sas", "", "OPTIONAL. Shared access signature to use instead of the account key.")
+	flag.StringVar(&blobEndpoint, "blobEndpoint", "", "OPTIONAL. Full URL of the blob service, e.g. http://127.0.0.1:10000/devstoreaccount1 for Azurite.")
+	flag.StringVar(&accountContainer, "accountContainer", "", "REQUIRED for flatblobfs. Container the trace was recorded in.")
+	flag.StringVar(&localDir, "localDir", "", "OPTIONAL. Replay against this local directory: subdirectories are containers, files are blobs.")
+	flag.StringVar(&pathEscaping, "pathEscaping", string(blobfs.PathEscapingURLQuery), "OPTIONAL. How blob names were turned into file names: urlquery, minimal, percent or base32.")
+	flag.BoolVar(&isReadOnly, "ro", false, "OPTIONAL. Specify true to replay read-only.")
+	flag.Parse()
+
+	if len(flag.Args()) > 0 {
+		traceFile = flag.Arg(0)
+	}
+
+	if traceFile == "" || (fsName == "flatblobfs" && accountContainer == "") {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	f, err := os.Open(traceFile)
+	if err != nil {
+		log.Fatalf("ERROR: %v\n", err)
+	}
+	records, err := blobfs.ReadTrace(f)
+	f.Close()
+	if err != nil {
+		log.Fatalf("ERROR: %v\n", err)
+	}
+
+	fsOptions := blobfs.Options{
+		ReadOnly: isReadOnly,
+	}
+	fsOptions.PathEscaping, err = blobfs.ParsePathEscaping(pathEscaping)
+	if err != nil {
+		log.Fatalf("ERROR: %v\n", err)
+	}
+
+	var backend blobfs.Backend
+	switch {
+	case localDir != "":
+		backend, err = blobfs.NewLocalBackend(localDir)
+		if err != nil {
+			log.Fatalf("ERROR: %v\n", err)
+		}
+	case accountName != "":
+		accountConfig := account.Config{
+			Name:         accountName,
+			Key:          accountKey,
+			SAS:          sas,
+			BlobEndpoint: blobEndpoint,
+			UseHTTPS:     true,
+		}
+		storageClient, err := accountConfig.NewClient()
+		if err != nil {
+			log.Fatalf("ERROR: %v\n", err)
+		}
+		serviceURL, key := accountConfig.BlobService()
+		backend = blobfs.NewStorageBackend(storageClient, blobfs.StorageAccount{Name: accountName, Key: key, SAS: accountConfig.SAS, URL: serviceURL})
+	default:
+		backend = blobfs.NewMemoryBackend()
+		if accountContainer != "" {
+			if err := backend.CreateContainer(accountContainer); err != nil {
+				log.Fatalf("ERROR: %v\n", err)
+			}
+		}
+	}
+
+	var fs pathfs.FileSystem
+	switch fsName {
+	case "flatblobfs":
+		fs = blobfs.NewFlatBlobFs(accountContainer, backend, fsOptions)
+	case "containerfs":
+		fs = blobfs.NewContainerFs(backend, fsOptions)
+	default:
+		log.Fatalf("ERROR: unknown file system '%s'\n", fsName)
+	}
+
+	divergences := blobfs.Replay(fs, records)
+	for _, d := range divergences {
+		fmt.Println(d)
+	}
+
+	fmt.Printf("Replayed %d trace records, %d diverged.\n", len(records), len(divergences))
+	if len(divergences) > 0 {
+		os.Exit(1)
+	}
+}